@@ -0,0 +1,337 @@
+// Package bam reads aligned reads from BAM and SAM files and genotypes cells from the reads
+// at a set of sites, splitting reads into cells by their cell barcode tag.
+//
+// BAM files are decompressed with compress/gzip, which reads the concatenated gzip members of
+// a BGZF file in order, so files are streamed from start to end without an index. SAM files
+// are read with the gonomics sam package.
+package bam
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"github.com/vertgenlab/gonomics/dna"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/sam"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Flags used to skip reads (see DefaultParam).
+const (
+	FlagUnmapped      uint16 = 0x4
+	FlagSecondary     uint16 = 0x100
+	FlagQcFail        uint16 = 0x200
+	FlagDuplicate     uint16 = 0x400
+	FlagSupplementary uint16 = 0x800
+)
+
+// Header stores the reference sequences of an alignment file.
+type Header struct {
+	Text    string
+	Names   []string
+	Lengths []int
+}
+
+// CigarOp is a single operation in a CIGAR string.
+type CigarOp struct {
+	Op  byte // one of MIDNSHP=X
+	Len int
+}
+
+// Record is an aligned read.
+type Record struct {
+	Name    string
+	Flag    uint16
+	MapQ    uint8
+	Chr     string // "*" if unmapped
+	Pos     int    // 0-based leftmost aligned position
+	Cigar   []CigarOp
+	MateChr string // "*" if unavailable
+	MatePos int    // 0-based leftmost aligned position of the mate
+	Seq     []dna.Base
+	Qual    []byte // phred-scaled base qualities. 0xff if missing
+	tags    []tag
+}
+
+// tag is an optional field of a record stored as a string.
+type tag struct {
+	name  string
+	value string
+}
+
+// Tag returns the value of the optional field name (e.g. CB) as a string, and false if the
+// field is not present. Numeric values are formatted in decimal.
+func (r Record) Tag(name string) (string, bool) {
+	for i := range r.tags {
+		if r.tags[i].name == name {
+			return r.tags[i].value, true
+		}
+	}
+	return "", false
+}
+
+// End returns the position after the last reference base covered by the alignment.
+func (r Record) End() int {
+	end := r.Pos
+	for _, c := range r.Cigar {
+		if consumesRef(c.Op) {
+			end += c.Len
+		}
+	}
+	return end
+}
+
+// consumesRef returns true if the cigar operation consumes reference bases.
+func consumesRef(op byte) bool {
+	return op == 'M' || op == 'D' || op == 'N' || op == '=' || op == 'X'
+}
+
+// consumesQuery returns true if the cigar operation consumes read bases.
+func consumesQuery(op byte) bool {
+	return op == 'M' || op == 'I' || op == 'S' || op == '=' || op == 'X'
+}
+
+// GoReadToChan streams the records of a BAM file, or a SAM file if the file name ends in .sam
+// or .sam.gz. The header is read before returning and the channel is closed at the end of the file.
+func GoReadToChan(file string) (<-chan Record, Header) {
+	if strings.HasSuffix(file, ".sam") || strings.HasSuffix(file, ".sam.gz") {
+		return goReadSam(file)
+	}
+	f, err := os.Open(file)
+	exception.PanicOnErr(err)
+	gz, err := gzip.NewReader(f)
+	exception.PanicOnErr(err)
+	r := bufio.NewReaderSize(gz, 1<<16)
+	header := readHeader(r, file)
+	answer := make(chan Record, 1000)
+	go func() {
+		var rec Record
+		var ok bool
+		for rec, ok = readRecord(r, header); ok; rec, ok = readRecord(r, header) {
+			answer <- rec
+		}
+		exception.PanicOnErr(gz.Close())
+		exception.PanicOnErr(f.Close())
+		close(answer)
+	}()
+	return answer, header
+}
+
+// readHeader reads the magic string, header text, and reference sequences of a BAM file.
+func readHeader(r io.Reader, file string) Header {
+	var answer Header
+	magic := make([]byte, 4)
+	_, err := io.ReadFull(r, magic)
+	exception.PanicOnErr(err)
+	if string(magic) != "BAM\x01" {
+		log.Panicf("'%s' is not a BAM file", file)
+	}
+	text := make([]byte, readInt32(r))
+	_, err = io.ReadFull(r, text)
+	exception.PanicOnErr(err)
+	answer.Text = strings.TrimRight(string(text), "\x00")
+	numRefs := int(readInt32(r))
+	answer.Names = make([]string, numRefs)
+	answer.Lengths = make([]int, numRefs)
+	for i := 0; i < numRefs; i++ {
+		name := make([]byte, readInt32(r))
+		_, err = io.ReadFull(r, name)
+		exception.PanicOnErr(err)
+		answer.Names[i] = strings.TrimRight(string(name), "\x00")
+		answer.Lengths[i] = int(readInt32(r))
+	}
+	return answer
+}
+
+func readInt32(r io.Reader) int32 {
+	var answer int32
+	exception.PanicOnErr(binary.Read(r, binary.LittleEndian, &answer))
+	return answer
+}
+
+// seqCodes maps the 4-bit encoded bases of a BAM record to characters.
+const seqCodes = "=ACMGRSVTWYHKDBN"
+
+// cigarOps maps the 4-bit encoded cigar operations of a BAM record to characters.
+const cigarOps = "MIDNSHP=X"
+
+// readRecord reads the next alignment from a BAM file. Returns false at the end of the file.
+func readRecord(r io.Reader, header Header) (Record, bool) {
+	var answer Record
+	var blockSize int32
+	err := binary.Read(r, binary.LittleEndian, &blockSize)
+	if err == io.EOF {
+		return answer, false
+	}
+	exception.PanicOnErr(err)
+	block := make([]byte, blockSize)
+	_, err = io.ReadFull(r, block)
+	exception.PanicOnErr(err)
+
+	le := binary.LittleEndian
+	refId := int32(le.Uint32(block[0:]))
+	answer.Pos = int(int32(le.Uint32(block[4:])))
+	nameLen := int(block[8])
+	answer.MapQ = block[9]
+	numCigar := int(le.Uint16(block[12:]))
+	answer.Flag = le.Uint16(block[14:])
+	seqLen := int(le.Uint32(block[16:]))
+	answer.Chr = refName(refId, header)
+	answer.MateChr = refName(int32(le.Uint32(block[20:])), header)
+	answer.MatePos = int(int32(le.Uint32(block[24:])))
+
+	offset := 32
+	answer.Name = strings.TrimRight(string(block[offset:offset+nameLen]), "\x00")
+	offset += nameLen
+	answer.Cigar = make([]CigarOp, numCigar)
+	var val uint32
+	for i := range answer.Cigar {
+		val = le.Uint32(block[offset:])
+		if int(val&0xf) >= len(cigarOps) {
+			log.Panicf("invalid cigar operation in read %s", answer.Name)
+		}
+		answer.Cigar[i] = CigarOp{Op: cigarOps[val&0xf], Len: int(val >> 4)}
+		offset += 4
+	}
+	answer.Seq = make([]dna.Base, seqLen)
+	var code byte
+	for i := range answer.Seq {
+		code = block[offset+i/2]
+		if i%2 == 0 {
+			code >>= 4
+		}
+		answer.Seq[i] = byteToBase(seqCodes[code&0xf])
+	}
+	offset += (seqLen + 1) / 2
+	answer.Qual = block[offset : offset+seqLen]
+	offset += seqLen
+	answer.tags = parseTags(block[offset:], answer.Name)
+	return answer, true
+}
+
+// refName returns the name of the reference sequence with index refId, or "*" if refId is -1.
+func refName(refId int32, header Header) string {
+	if refId < 0 || int(refId) >= len(header.Names) {
+		return "*"
+	}
+	return header.Names[refId]
+}
+
+// byteToBase converts a base to dna.Base with ambiguous bases converted to N.
+func byteToBase(b byte) dna.Base {
+	switch b {
+	case 'A', 'C', 'G', 'T', 'N', 'a', 'c', 'g', 't', 'n':
+		return dna.ByteToBase(b)
+	default:
+		return dna.N
+	}
+}
+
+// parseTags parses the binary optional fields of a BAM record.
+func parseTags(b []byte, readName string) []tag {
+	var answer []tag
+	le := binary.LittleEndian
+	var t tag
+	var end int
+	for len(b) >= 3 {
+		t.name = string(b[:2])
+		typ := b[2]
+		b = b[3:]
+		switch typ {
+		case 'A':
+			t.value, b = string(b[:1]), b[1:]
+		case 'c':
+			t.value, b = strconv.Itoa(int(int8(b[0]))), b[1:]
+		case 'C':
+			t.value, b = strconv.Itoa(int(b[0])), b[1:]
+		case 's':
+			t.value, b = strconv.Itoa(int(int16(le.Uint16(b)))), b[2:]
+		case 'S':
+			t.value, b = strconv.Itoa(int(le.Uint16(b))), b[2:]
+		case 'i':
+			t.value, b = strconv.Itoa(int(int32(le.Uint32(b)))), b[4:]
+		case 'I':
+			t.value, b = strconv.FormatUint(uint64(le.Uint32(b)), 10), b[4:]
+		case 'f':
+			t.value, b = strconv.FormatFloat(float64(math.Float32frombits(le.Uint32(b))), 'g', -1, 32), b[4:]
+		case 'Z', 'H':
+			end = 0
+			for end < len(b) && b[end] != 0 {
+				end++
+			}
+			t.value, b = string(b[:end]), b[minInt(end+1, len(b)):]
+		case 'B':
+			size := map[byte]int{'c': 1, 'C': 1, 's': 2, 'S': 2, 'i': 4, 'I': 4, 'f': 4}[b[0]]
+			if size == 0 {
+				log.Panicf("invalid array type in tag %s of read %s", t.name, readName)
+			}
+			count := int(le.Uint32(b[1:]))
+			t.value, b = "", b[5+size*count:] // array values are not used
+		default:
+			log.Panicf("invalid type '%c' in tag %s of read %s", typ, t.name, readName)
+		}
+		answer = append(answer, t)
+	}
+	return answer
+}
+
+// goReadSam streams the records of a SAM file using the gonomics sam package.
+func goReadSam(file string) (<-chan Record, Header) {
+	samChan, samHeader := sam.GoReadToChan(file)
+	header := Header{Text: strings.Join(samHeader.Text, "\n")}
+	for _, c := range samHeader.Chroms {
+		header.Names = append(header.Names, c.Name)
+		header.Lengths = append(header.Lengths, c.Size)
+	}
+	answer := make(chan Record, 1000)
+	go func() {
+		for s := range samChan {
+			answer <- fromSam(s)
+		}
+		close(answer)
+	}()
+	return answer, header
+}
+
+// fromSam converts a gonomics sam record to a Record.
+func fromSam(s sam.Sam) Record {
+	answer := Record{Name: s.QName, Flag: s.Flag, MapQ: s.MapQ, Chr: s.RName, Pos: int(s.Pos) - 1, Seq: s.Seq}
+	answer.MateChr, answer.MatePos = s.RNext, int(s.PNext)-1
+	if s.RNext == "=" {
+		answer.MateChr = s.RName
+	}
+	for _, c := range s.Cigar {
+		if c.Op == '*' {
+			break
+		}
+		answer.Cigar = append(answer.Cigar, CigarOp{Op: byte(c.Op), Len: c.RunLength})
+	}
+	answer.Qual = make([]byte, len(s.Seq))
+	for i := range answer.Qual {
+		if s.Qual == "*" || i >= len(s.Qual) {
+			answer.Qual[i] = 0xff
+		} else {
+			answer.Qual[i] = s.Qual[i] - 33
+		}
+	}
+	var fields []string
+	for _, field := range strings.Split(s.Extra, "\t") {
+		fields = strings.SplitN(field, ":", 3)
+		if len(fields) == 3 {
+			answer.tags = append(answer.tags, tag{name: fields[0], value: fields[2]})
+		}
+	}
+	return answer
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,378 @@
+package bam
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/reference"
+	"github.com/ddsnellings/weaver/variants"
+	"github.com/vertgenlab/gonomics/dna"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testRef = reference.Map{"chr1": dna.StringToBases(strings.Repeat("ACGTACGTAC", 4))}
+
+var testSites = []variants.Variant{
+	{Chr: "chr1", Pos: 10, Ref: dna.StringToBases("A"), Alt: dna.StringToBases("G")}, // substitution
+	{Chr: "chr1", Pos: 20, Ref: dna.StringToBases("A"), Alt: []dna.Base{}},           // deletion
+	{Chr: "chr1", Pos: 30, Ref: []dna.Base{}, Alt: dna.StringToBases("T")},           // insertion
+}
+
+// testRead returns a read of up to 30 bases starting at pos in cell barcode with the alt
+// allele of each site in testSites where alt is true.
+func testRead(name, barcode string, pos int, alt [3]bool) Record {
+	r := Record{Name: name, MapQ: 60, Chr: "chr1", Pos: pos, MateChr: "*", MatePos: -1}
+	r.tags = []tag{{name: "CB", value: barcode}, {name: "NM", value: "0"}}
+	addOp := func(op byte) {
+		if len(r.Cigar) > 0 && r.Cigar[len(r.Cigar)-1].Op == op {
+			r.Cigar[len(r.Cigar)-1].Len++
+		} else {
+			r.Cigar = append(r.Cigar, CigarOp{Op: op, Len: 1})
+		}
+	}
+	for refPos := pos; refPos < pos+30 && refPos < len(testRef["chr1"]); refPos++ {
+		switch {
+		case refPos == 20 && alt[1]:
+			addOp('D')
+			continue
+		case refPos == 30 && alt[2]:
+			r.Seq = append(r.Seq, dna.T)
+			addOp('I')
+		}
+		if refPos == 10 && alt[0] {
+			r.Seq = append(r.Seq, dna.G)
+		} else {
+			r.Seq = append(r.Seq, testRef["chr1"][refPos])
+		}
+		addOp('M')
+	}
+	r.Qual = bytes.Repeat([]byte{30}, len(r.Seq))
+	return r
+}
+
+// testReads returns 12 reads in each of 3 cells, and 2 read pairs in cell GGG where both
+// mates cover every site.
+func testReads() []Record {
+	genotypes := map[string][3]variants.Zygosity{
+		"AAA": {variants.Homozygous, variants.Heterozygous, variants.WildType},
+		"CCC": {variants.Heterozygous, variants.WildType, variants.Homozygous},
+		"GGG": {variants.WildType, variants.Homozygous, variants.Heterozygous},
+	}
+	var answer []Record
+	var alt [3]bool
+	for _, barcode := range []string{"GGG", "AAA", "CCC"} {
+		for i := 0; i < 12; i++ {
+			for s, g := range genotypes[barcode] {
+				alt[s] = g == variants.Homozygous || (g == variants.Heterozygous && i%2 == 0)
+			}
+			answer = append(answer, testRead(fmt.Sprintf("%s_%d", barcode, i), barcode, 5, alt))
+		}
+	}
+	for i := 0; i < 2; i++ {
+		alt = [3]bool{false, true, i == 0}
+		first := testRead(fmt.Sprintf("pair_%d", i), "GGG", 5, alt)
+		second := testRead(fmt.Sprintf("pair_%d", i), "GGG", 8, alt)
+		first.Flag, second.Flag = 0x1|0x40, 0x1|0x80
+		first.MateChr, first.MatePos = "chr1", second.Pos
+		second.MateChr, second.MatePos = "chr1", first.Pos
+		answer = append(answer, first, second)
+	}
+	answer = append(answer, testRead("duplicate", "AAA", 5, [3]bool{false, false, true}))
+	answer[len(answer)-1].Flag = FlagDuplicate
+	return answer
+}
+
+// writeBam encodes records in a BAM file with a single reference sequence chr1.
+func writeBam(t *testing.T, file string, records []Record) {
+	var b bytes.Buffer
+	le := binary.LittleEndian
+	write := func(data interface{}) {
+		if err := binary.Write(&b, le, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	text := "@HD\tVN:1.6\n@SQ\tSN:chr1\tLN:40\n"
+	b.WriteString("BAM\x01")
+	write(int32(len(text)))
+	b.WriteString(text)
+	write(int32(1))
+	write(int32(5))
+	b.WriteString("chr1\x00")
+	write(int32(40))
+
+	var block bytes.Buffer
+	for _, r := range records {
+		block.Reset()
+		refId := func(chr string) int32 {
+			if chr == "chr1" {
+				return 0
+			}
+			return -1
+		}
+		fields := []interface{}{refId(r.Chr), int32(r.Pos), uint8(len(r.Name) + 1), r.MapQ, uint16(0),
+			uint16(len(r.Cigar)), r.Flag, int32(len(r.Seq)), refId(r.MateChr), int32(r.MatePos), int32(0)}
+		for _, f := range fields {
+			if err := binary.Write(&block, le, f); err != nil {
+				t.Fatal(err)
+			}
+		}
+		block.WriteString(r.Name + "\x00")
+		for _, c := range r.Cigar {
+			if err := binary.Write(&block, le, uint32(c.Len)<<4|uint32(strings.IndexByte(cigarOps, c.Op))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		seq := make([]byte, (len(r.Seq)+1)/2)
+		for i := range r.Seq {
+			code := byte(strings.IndexRune(seqCodes, dna.BaseToRune(r.Seq[i])))
+			if i%2 == 0 {
+				code <<= 4
+			}
+			seq[i/2] |= code
+		}
+		block.Write(seq)
+		block.Write(r.Qual)
+		for _, tg := range r.tags {
+			if tg.name == "NM" {
+				block.WriteString("NMC")
+				block.WriteByte(0)
+			} else {
+				block.WriteString(tg.name + "Z" + tg.value + "\x00")
+			}
+		}
+		write(int32(block.Len()))
+		b.Write(block.Bytes())
+	}
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	if _, err := w.Write(b.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, gz.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeSam writes records in a SAM file with a single reference sequence chr1.
+func writeSam(t *testing.T, file string, records []Record) {
+	var b strings.Builder
+	b.WriteString("@HD\tVN:1.6\n@SQ\tSN:chr1\tLN:40\n")
+	for _, r := range records {
+		var cigar, qual strings.Builder
+		for _, c := range r.Cigar {
+			fmt.Fprintf(&cigar, "%d%c", c.Len, c.Op)
+		}
+		for _, q := range r.Qual {
+			qual.WriteByte(q + 33)
+		}
+		mateChr := "*"
+		if r.MateChr == r.Chr {
+			mateChr = "="
+		}
+		fmt.Fprintf(&b, "%s\t%d\t%s\t%d\t%d\t%s\t%s\t%d\t0\t%s\t%s\tCB:Z:%s\tNM:i:0\n", r.Name, r.Flag, r.Chr,
+			r.Pos+1, r.MapQ, cigar.String(), mateChr, r.MatePos+1, dna.BasesToString(r.Seq), qual.String(), r.tags[0].value)
+	}
+	if err := os.WriteFile(file, []byte(b.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGoReadToChan(t *testing.T) {
+	records := testReads()
+	dir := t.TempDir()
+	bamFile := filepath.Join(dir, "weaver.reads.bam")
+	samFile := filepath.Join(dir, "weaver.reads.sam")
+	writeBam(t, bamFile, records)
+	writeSam(t, samFile, records)
+
+	for _, file := range []string{bamFile, samFile} {
+		reads, header := GoReadToChan(file)
+		if len(header.Names) != 1 || header.Names[0] != "chr1" || header.Lengths[0] != 40 {
+			t.Errorf("unexpected reference sequences %v %v in %s", header.Names, header.Lengths, file)
+		}
+		var i int
+		for r := range reads {
+			expected := records[i]
+			if r.Name != expected.Name || r.Pos != expected.Pos || r.Flag != expected.Flag || r.End() != expected.End() ||
+				r.MateChr != expected.MateChr || r.MatePos != expected.MatePos {
+				t.Errorf("read %d in %s: expected %+v, found %+v", i, file, expected, r)
+			}
+			if dna.CompareSeqsIgnoreCase(r.Seq, expected.Seq) != 0 || !bytes.Equal(r.Qual, expected.Qual) ||
+				fmt.Sprint(r.Cigar) != fmt.Sprint(expected.Cigar) {
+				t.Errorf("read %d in %s: expected sequence %s %v, found %s %v", i, file,
+					dna.BasesToString(expected.Seq), expected.Cigar, dna.BasesToString(r.Seq), r.Cigar)
+			}
+			if barcode, _ := r.Tag("CB"); barcode != expected.tags[0].value {
+				t.Errorf("read %d in %s: expected barcode %s, found %s", i, file, expected.tags[0].value, barcode)
+			}
+			if nm, found := r.Tag("NM"); !found || nm != "0" {
+				t.Errorf("read %d in %s: expected NM tag 0, found %s", i, file, nm)
+			}
+			if _, found := r.Tag("XX"); found {
+				t.Errorf("read %d in %s: found missing tag XX", i, file)
+			}
+			i++
+		}
+		if i != len(records) {
+			t.Errorf("expected %d reads in %s, found %d", len(records), file, i)
+		}
+	}
+}
+
+func TestGenotype(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "weaver.genotype.bam")
+	writeBam(t, file, testReads())
+
+	p := DefaultParam
+	p.MinCellReads = 10
+	p.GlobalFilter = cells.GlobalFilterParam{}
+	d := Genotype(file, testSites, p)
+	expectedCells := []string{"AAA", "CCC", "GGG"}
+	if len(d.Cells) != len(expectedCells) || len(d.Variants) != len(testSites) {
+		t.Fatalf("expected %d cells and %d variants, found %d and %d", len(expectedCells), len(testSites), len(d.Cells), len(d.Variants))
+	}
+	expected := [][]variants.Zygosity{
+		{variants.Homozygous, variants.Heterozygous, variants.WildType},
+		{variants.Heterozygous, variants.WildType, variants.Homozygous},
+		{variants.WildType, variants.Homozygous, variants.Heterozygous},
+	}
+	expectedDepth := []int{12, 12, 14} // mates overlapping a site count once
+	for i := range d.Cells {
+		if d.Cells[i].Name != expectedCells[i] {
+			t.Errorf("expected cell %d to be %s, found %s", i, expectedCells[i], d.Cells[i].Name)
+		}
+		for vid := range d.Variants {
+			cv := d.CellVar(i, vid)
+			if cv.Genotype != expected[i][vid] {
+				t.Errorf("cell %s variant %s: expected %s, found %s (%d/%d reads)", d.Cells[i].Name, d.Variants[vid].Key(),
+					expected[i][vid], cv.Genotype, cv.AltReads, cv.ReadDepth)
+			}
+			if cv.ReadDepth != expectedDepth[i] {
+				t.Errorf("cell %s variant %s: expected depth %d, found %d", d.Cells[i].Name, d.Variants[vid].Key(), expectedDepth[i], cv.ReadDepth)
+			}
+		}
+	}
+	if idx, found := d.Contigs.Index("chr1"); !found || idx != 0 {
+		t.Errorf("expected contigs from the bam header")
+	}
+
+	p.Barcodes = []string{"GGG", "TTT"}
+	d = Genotype(file, testSites, p)
+	if len(d.Cells) != 2 || d.Cells[0].Name != "GGG" || d.Cells[1].Name != "TTT" {
+		t.Fatalf("expected cells GGG and TTT, found %v", d.Cells)
+	}
+	if cv := d.CellVar(1, 0); cv.ReadDepth != 0 || cv.Genotype != variants.NoGenotype {
+		t.Errorf("expected no genotype in cell without reads, found %+v", cv)
+	}
+}
+
+func TestPendingMates(t *testing.T) {
+	site := testSites[0]
+	first := Record{Name: "pair", Flag: 0x1 | 0x40, Chr: "chr1", Pos: 5, MateChr: "chr1", MatePos: 8}
+	mate := Record{Name: "pair", Flag: 0x1 | 0x80, Chr: "chr1", Pos: 8, MateChr: "chr1", MatePos: 5}
+	m := make(pendingMates)
+	m.add(first, 0, site)
+	m.add(first, 2, testSites[2])
+	if supplementary := (Record{Name: "pair", Flag: mate.Flag | FlagSupplementary}); m.take(supplementary) != nil {
+		t.Errorf("expected supplementary alignments to leave pending mates")
+	}
+	if counted := m.take(mate); len(counted) != 2 || counted[0] != 0 || counted[1] != 2 || len(m) != 0 {
+		t.Errorf("expected the mate to take sites [0 2], found %v with %d pending", counted, len(m))
+	}
+
+	// mates that are not usable are evicted
+	m.add(first, 0, site)
+	mate.MapQ = 0
+	m.take(mate)
+	if len(m) != 0 {
+		t.Errorf("expected the filtered mate to be evicted")
+	}
+	// mates after the site are not pending
+	first.MatePos = site.Pos + 10
+	if m.add(first, 0, site); len(m) != 0 {
+		t.Errorf("expected no pending mate for a mate after the site")
+	}
+}
+
+func TestFindSites(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "weaver.findSites.sam")
+	writeSam(t, file, testReads())
+
+	p := DefaultParam
+	found := FindSites(file, []variants.Region{{Chr: "chr1", Start: 0, End: 40}}, testRef, p)
+	if len(found) != 1 || found[0].Key() != testSites[0].Key() {
+		t.Errorf("expected site %s, found %v", testSites[0].Key(), found)
+	}
+}
+
+func TestPhase(t *testing.T) {
+	hap := [][3]bool{{true, false, true}, {false, true, false}}
+	var records []Record
+	for i := 0; i < 6; i++ {
+		records = append(records, testRead(fmt.Sprintf("AAA_%d", i), "AAA", 5, hap[i%2]))
+	}
+	for i := 0; i < 4; i++ {
+		records = append(records, testRead(fmt.Sprintf("CCC_%d", i), "CCC", 5, hap[i%2]))
+	}
+	first := testRead("pair", "AAA", 0, hap[0])   // covers the substitution and deletion
+	second := testRead("pair", "AAA", 22, hap[0]) // covers the insertion
+	first.Flag, second.Flag = 0x1|0x40, 0x1|0x80
+	first.MateChr, first.MatePos = "chr1", second.Pos
+	second.MateChr, second.MatePos = "chr1", first.Pos
+	records = append(records, first, second)
+	file := filepath.Join(t.TempDir(), "weaver.phase.bam")
+	writeBam(t, file, records)
+
+	pairs := Phase(file, testSites, DefaultParam)
+	expected := []PhasedPair{
+		{A: 0, B: 1, Support: [2][2]int{{0, 5}, {6, 0}}},
+		{A: 0, B: 2, Support: [2][2]int{{5, 0}, {0, 6}}},
+		{A: 1, B: 2, Support: [2][2]int{{0, 6}, {5, 0}}},
+	}
+	if len(pairs) != len(expected) {
+		t.Fatalf("expected %d pairs, found %d", len(expected), len(pairs))
+	}
+	for i := range pairs {
+		if pairs[i].A != expected[i].A || pairs[i].B != expected[i].B || pairs[i].Support != expected[i].Support {
+			t.Errorf("expected pair %v, found %v", expected[i], pairs[i])
+		}
+	}
+	if pairs[0].Cells["AAA"] != [2][2]int{{0, 3}, {4, 0}} || pairs[0].Cells["CCC"] != [2][2]int{{0, 2}, {2, 0}} {
+		t.Errorf("unexpected support in cells %v", pairs[0].Cells)
+	}
+	if pairs[0].Cis() != 0 || pairs[0].Trans() != 11 {
+		t.Errorf("expected 0 cis and 11 trans reads, found %d and %d", pairs[0].Cis(), pairs[0].Trans())
+	}
+
+	sites := make([]variants.Variant, len(testSites))
+	copy(sites, testSites)
+	SetPhase(sites, pairs, DefaultParam)
+	for i, expectedHap := range []int{0, 1, 0} {
+		if sites[i].PhaseSet != 11 || sites[i].PhaseHap != expectedHap {
+			t.Errorf("expected site %d in phase set 11 on haplotype %d, found %d and %d", i, expectedHap, sites[i].PhaseSet, sites[i].PhaseHap)
+		}
+	}
+	if blocks := variants.PhaseBlocks(sites); len(blocks) != 1 || len(blocks[0]) != 3 {
+		t.Errorf("expected a single block of 3 variants, found %v", blocks)
+	}
+
+	p := DefaultParam
+	p.MaxPhaseDist = 15
+	if pairs = Phase(file, testSites, p); len(pairs) != 2 {
+		t.Errorf("expected 2 pairs within 15 bases, found %d", len(pairs))
+	}
+	p.MinPhaseReads = 100
+	SetPhase(sites, pairs, p)
+	if sites[0].PhaseSet != 0 || len(variants.PhaseBlocks(sites)) != 0 {
+		t.Errorf("expected unphased sites with too few reads")
+	}
+}
@@ -0,0 +1,537 @@
+package bam
+
+import (
+	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/interval"
+	"github.com/ddsnellings/weaver/variants"
+	"github.com/vertgenlab/gonomics/dna"
+	"github.com/vertgenlab/gonomics/vcf"
+	"log"
+	"math"
+	"sort"
+)
+
+// Param defines the parameters for genotyping cells from aligned reads.
+type Param struct {
+	BarcodeTag    string                  // tag storing the cell barcode of each read // Default CB
+	Barcodes      []string                // cells to genotype in order. nil genotypes every barcode with at least MinCellReads reads // Default nil
+	MinCellReads  int                     // minimum reads overlapping the sites for a barcode to be called a cell. ignored if Barcodes is set // Default 100
+	MinMapQ       int                     // reads with mapping quality < MinMapQ are skipped // Default 20
+	MinBaseQual   int                     // bases with quality < MinBaseQual are skipped // Default 20
+	SkipFlags     uint16                  // reads with any of these flags are skipped // Default unmapped, secondary, qc fail, duplicate, and supplementary
+	MinAltReads   int                     // minimum alt reads pooled across cells to report a site in FindSites // Default 5
+	MaxPhaseDist  int                     // maximum distance between variants phased by Phase // Default 500
+	MinPhaseReads int                     // minimum reads covering both variants to phase a pair in SetPhase // Default 3
+	MinPhaseFrac  float64                 // minimum fraction of reads supporting the cis or trans phase of a pair in SetPhase // Default 0.9
+	CellFilter    cells.CellFilterParam   // filter for genotypes in each cell // Default cells.DefaultCellFilter with the Likelihood caller
+	GlobalFilter  cells.GlobalFilterParam // filter applied after genotyping // Default cells.DefaultGlobalFilter
+}
+
+var DefaultParam = Param{
+	BarcodeTag:    "CB",
+	MinCellReads:  100,
+	MinMapQ:       20,
+	MinBaseQual:   20,
+	SkipFlags:     FlagUnmapped | FlagSecondary | FlagQcFail | FlagDuplicate | FlagSupplementary,
+	MinAltReads:   5,
+	MaxPhaseDist:  500,
+	MinPhaseReads: 3,
+	MinPhaseFrac:  0.9,
+	CellFilter:    cells.CellFilterParam{MinGenotypeQuality: 30, MinGenotypeDepth: 10, MinReadAf: 0.2, Caller: cells.Likelihood},
+	GlobalFilter:  cells.DefaultGlobalFilter,
+}
+
+// Alleles observed in a read at a site.
+const (
+	noAllele = iota // read is not informative at the site
+	refAllele
+	altAllele
+	otherAllele
+)
+
+// siteCounts stores the reads observed in a cell at a site.
+type siteCounts struct {
+	ref, alt, other int
+	logLik          [3]float64 // log likelihood of the reads given 0, 1, or 2 alt copies
+}
+
+// ReadSitesVcf returns a site for each alt allele in a vcf file with matching bases trimmed
+// as in cells.ReadVcf. If ref is not nil indels are left-aligned (see variants.Normalize).
+func ReadSitesVcf(file string, ref variants.Reference) []variants.Variant {
+	vcfChan, _ := vcf.GoReadToChan(file)
+	var answer []variants.Variant
+	var v variants.Variant
+	var ok bool
+	for record := range vcfChan {
+		for alleleIdx := range record.Alt {
+			if record.Alt[alleleIdx] == "." {
+				continue
+			}
+			v = cells.NewVariant(record, alleleIdx)
+			if ref != nil {
+				if v, ok = cells.NormalizeVariant(v, ref); !ok {
+					continue
+				}
+			}
+			v.Id = len(answer)
+			answer = append(answer, v)
+		}
+	}
+	return answer
+}
+
+// FindSites piles up the reads of all cells at each position in regions and returns a
+// substitution for each position where the most common non-reference base is observed in at
+// least p.MinAltReads reads. Reference bases are taken from ref.
+func FindSites(file string, regions []variants.Region, ref variants.Reference, p Param) []variants.Variant {
+	regions = interval.Merge(regions)
+	tree := interval.NewTree(regions)
+	counts := make([][][4]int, len(regions))
+	for i := range regions {
+		counts[i] = make([][4]int, interval.Len(regions[i]))
+	}
+	whitelist := barcodeSet(p.Barcodes)
+	reads, _ := GoReadToChan(file)
+	var aln alignment
+	var readIdx int
+	var b dna.Base
+	for r := range reads {
+		if !p.usable(r, whitelist) {
+			continue
+		}
+		hits := tree.Query(variants.Region{Chr: r.Chr, Start: r.Pos, End: r.End()})
+		if len(hits) == 0 {
+			continue
+		}
+		aln = newAlignment(r)
+		for _, i := range hits {
+			for pos := maxInt(regions[i].Start, r.Pos); pos < minInt(regions[i].End, aln.end); pos++ {
+				readIdx = aln.readIdx(pos)
+				if readIdx == -1 || int(r.Qual[readIdx]) < p.MinBaseQual {
+					continue
+				}
+				b = dna.ToUpper(r.Seq[readIdx])
+				if b <= dna.T {
+					counts[i][pos-regions[i].Start][b]++
+				}
+			}
+		}
+	}
+
+	var answer []variants.Variant
+	var refBase, alt dna.Base
+	for i := range regions {
+		seq := ref.Seq(regions[i].Chr, regions[i].Start, regions[i].End)
+		for offset := range counts[i] {
+			if offset >= len(seq) {
+				break
+			}
+			refBase = dna.ToUpper(seq[offset])
+			if refBase > dna.T {
+				continue
+			}
+			alt = refBase
+			for base := dna.A; base <= dna.T; base++ {
+				if base != refBase && (alt == refBase || counts[i][offset][base] > counts[i][offset][alt]) {
+					alt = base
+				}
+			}
+			if counts[i][offset][alt] >= p.MinAltReads {
+				answer = append(answer, variants.Variant{
+					Id:  len(answer),
+					Chr: regions[i].Chr,
+					Pos: regions[i].Start + offset,
+					Ref: []dna.Base{refBase},
+					Alt: []dna.Base{alt},
+				})
+			}
+		}
+	}
+	return answer
+}
+
+// Genotype piles up the reads of each cell at each site and returns the genotype of each cell.
+// Reads are assigned to cells by the p.BarcodeTag tag. Substitutions and simple indels (see
+// variants.Normalize) are supported and other sites are not genotyped. Genotypes are called from
+// likelihoods using the base quality of each read, and the mates of a read pair that both cover a
+// site are counted once. The file must be sorted by coordinate. The cell filter is applied as in
+// cells.ReadVcf and the global filter is applied to the returned data.
+//
+// Counts are stored by site for each barcode until the barcode has p.MinCellReads reads, or from
+// the first read if p.Barcodes is set, so memory for all sites is only used by retained cells.
+func Genotype(file string, sites []variants.Variant, p Param) *cells.Data {
+	regions := make([]variants.Region, len(sites))
+	var numComplex int
+	for i := range sites {
+		regions[i] = queryRegion(sites[i])
+		if !simple(sites[i]) {
+			if numComplex == 0 {
+				log.Printf("WARNING: complex variants such as %s are not genotyped from reads", sites[i])
+			}
+			numComplex++
+		}
+	}
+	if numComplex > 1 {
+		log.Printf("WARNING: %d complex variants were not genotyped", numComplex)
+	}
+	tree := interval.NewTree(regions)
+	whitelist := barcodeSet(p.Barcodes)
+	cellIdx := make(map[string]int)
+	var barcodes []string
+	var counts [][]siteCounts        // counts[cell][site]. nil until the cell may be retained
+	var sparse []map[int]*siteCounts // counts of cells that are not yet in counts by site
+	var numReads []int
+	pending := make(pendingMates)
+
+	reads, header := GoReadToChan(file)
+	var aln alignment
+	var barcode, chr string
+	var found bool
+	var c, allele int
+	var errProb float64
+	var sc *siteCounts
+	var counted []int
+	for r := range reads {
+		if r.Chr != chr {
+			// mates on the same contig are adjacent in a sorted file
+			pending = make(pendingMates)
+			chr = r.Chr
+		}
+		counted = pending.take(r)
+		if !p.usable(r, whitelist) {
+			continue
+		}
+		hits := tree.Query(variants.Region{Chr: r.Chr, Start: r.Pos, End: r.End()})
+		if len(hits) == 0 {
+			continue
+		}
+		barcode, _ = r.Tag(p.BarcodeTag)
+		if c, found = cellIdx[barcode]; !found {
+			c = len(barcodes)
+			cellIdx[barcode] = c
+			barcodes = append(barcodes, barcode)
+			counts = append(counts, nil)
+			sparse = append(sparse, nil)
+			numReads = append(numReads, 0)
+		}
+		numReads[c]++
+		if counts[c] == nil && (whitelist != nil || numReads[c] >= p.MinCellReads) {
+			counts[c] = make([]siteCounts, len(sites))
+			for s, sc := range sparse[c] {
+				counts[c][s] = *sc
+			}
+			sparse[c] = nil
+		}
+		aln = newAlignment(r)
+		for _, s := range hits {
+			allele, errProb = aln.observe(sites[s], p.MinBaseQual)
+			if allele == noAllele || containsInt(counted, s) {
+				continue
+			}
+			pending.add(r, s, sites[s])
+			if counts[c] != nil {
+				sc = &counts[c][s]
+			} else {
+				if sparse[c] == nil {
+					sparse[c] = make(map[int]*siteCounts)
+				}
+				if sc, found = sparse[c][s]; !found {
+					sc = new(siteCounts)
+					sparse[c][s] = sc
+				}
+			}
+			sc.add(allele, errProb, len(sites[s].Ref) == 1 && len(sites[s].Alt) == 1)
+		}
+	}
+
+	d := new(cells.Data)
+	d.Contigs = variants.NewContigs(header.Names, header.Lengths)
+	for _, barcode = range selectCells(p, barcodes, numReads) {
+		d.Cells = append(d.Cells, cells.Cell{Id: len(d.Cells), Name: barcode})
+	}
+
+	var cellVars []variants.CellVar
+	var logLik [][3]float64
+	for s := range sites {
+		cellVars = make([]variants.CellVar, len(d.Cells))
+		logLik = make([][3]float64, len(d.Cells))
+		for i := range d.Cells {
+			if c, found = cellIdx[d.Cells[i].Name]; !found || counts[c] == nil {
+				continue
+			}
+			sc = &counts[c][s]
+			cellVars[i].ReadDepth = sc.ref + sc.alt + sc.other
+			cellVars[i].AltReads = sc.alt
+			if cellVars[i].ReadDepth > 0 {
+				cellVars[i].Af = float64(sc.alt) / float64(cellVars[i].ReadDepth)
+			}
+			logLik[i] = sc.logLik
+		}
+		cells.CallFromLogLikelihoods(cellVars, logLik)
+		d.AddVariant(sites[s], cellVars, p.CellFilter)
+	}
+	p.GlobalFilter.Apply(d)
+	return d
+}
+
+// usable returns true if the read passes the flag and mapping quality filters and has a
+// barcode in the whitelist, or any barcode if the whitelist is nil.
+func (p Param) usable(r Record, whitelist map[string]bool) bool {
+	if r.Flag&p.SkipFlags != 0 || int(r.MapQ) < p.MinMapQ || r.Chr == "*" {
+		return false
+	}
+	barcode, found := r.Tag(p.BarcodeTag)
+	if !found {
+		return false
+	}
+	return whitelist == nil || whitelist[barcode]
+}
+
+// barcodeSet returns the set of barcodes, or nil if barcodes is nil.
+func barcodeSet(barcodes []string) map[string]bool {
+	if barcodes == nil {
+		return nil
+	}
+	answer := make(map[string]bool, len(barcodes))
+	for _, b := range barcodes {
+		answer[b] = true
+	}
+	return answer
+}
+
+// selectCells returns the barcodes to genotype in output order. If p.Barcodes is set it is
+// returned as is, otherwise barcodes with at least p.MinCellReads reads are returned sorted.
+func selectCells(p Param, barcodes []string, numReads []int) []string {
+	if p.Barcodes != nil {
+		return p.Barcodes
+	}
+	var answer []string
+	for c := range barcodes {
+		if numReads[c] >= p.MinCellReads {
+			answer = append(answer, barcodes[c])
+		}
+	}
+	sort.Strings(answer)
+	return answer
+}
+
+// queryRegion returns the reference bases a read must overlap to be informative at site v.
+// Indels include the flanking reference bases.
+func queryRegion(v variants.Variant) variants.Region {
+	r := v.Region()
+	if len(v.Ref) != len(v.Alt) {
+		r.Start--
+		r.End = v.Pos + len(v.Ref) + 1
+	}
+	return r
+}
+
+// pendingMates stores the sites at which a read was counted while its mate may cover the same
+// sites later in the file, keyed by read name.
+type pendingMates map[string][]int
+
+// take returns the sites at which the mate of r was counted and removes them from m. Entries are
+// removed when the primary alignment of the mate is read, also if the mate is not usable.
+func (m pendingMates) take(r Record) []int {
+	if r.Flag&(FlagSecondary|FlagSupplementary) != 0 {
+		return nil
+	}
+	answer, found := m[r.Name]
+	if found {
+		delete(m, r.Name)
+	}
+	return answer
+}
+
+// add stores site s, at which r was counted, if the mate of r may cover the site later in the file.
+func (m pendingMates) add(r Record, s int, site variants.Variant) {
+	const paired = 0x1
+	if r.Flag&paired == 0 || r.MateChr != r.Chr {
+		return
+	}
+	if r.MatePos >= r.Pos && r.MatePos <= site.Pos+len(site.Ref) {
+		m[r.Name] = append(m[r.Name], s)
+	}
+}
+
+// containsInt returns true if s contains val.
+func containsInt(s []int, val int) bool {
+	for i := range s {
+		if s[i] == val {
+			return true
+		}
+	}
+	return false
+}
+
+// simple returns true if v is a substitution, insertion, or deletion that can be observed in reads.
+func simple(v variants.Variant) bool {
+	return len(v.Ref) == len(v.Alt) && len(v.Ref) > 0 || len(v.Ref) == 0 || len(v.Alt) == 0
+}
+
+// add an observation of allele with the input error probability. For substitutions
+// a sequencing error is equally likely to produce each of the three other bases.
+func (sc *siteCounts) add(allele int, errProb float64, substitution bool) {
+	errShare := errProb
+	if substitution {
+		errShare = errProb / 3
+	}
+	var p float64
+	switch allele {
+	case refAllele:
+		sc.ref++
+		for g := range sc.logLik {
+			p = float64(g) / 2
+			sc.logLik[g] += math.Log((1-p)*(1-errProb) + p*errShare)
+		}
+	case altAllele:
+		sc.alt++
+		for g := range sc.logLik {
+			p = float64(g) / 2
+			sc.logLik[g] += math.Log(p*(1-errProb) + (1-p)*errShare)
+		}
+	case otherAllele:
+		sc.other++
+	}
+}
+
+// alignment maps reference positions to read positions for a single read.
+type alignment struct {
+	r          Record
+	start, end int
+	refToRead  []int         // refToRead[pos-start] is the read index aligned to pos, or -1 if deleted
+	insertions map[int][]int // insertions[pos] is the read index range inserted before pos
+	deletions  map[int]int   // deletions[pos] is the length of the deletion starting at pos
+}
+
+func newAlignment(r Record) alignment {
+	answer := alignment{r: r, start: r.Pos, end: r.End()}
+	answer.refToRead = make([]int, answer.end-answer.start)
+	refPos, readPos := r.Pos, 0
+	for _, c := range r.Cigar {
+		switch {
+		case c.Op == 'I':
+			if answer.insertions == nil {
+				answer.insertions = make(map[int][]int)
+			}
+			answer.insertions[refPos] = []int{readPos, readPos + c.Len}
+		case c.Op == 'D' || c.Op == 'N':
+			if answer.deletions == nil {
+				answer.deletions = make(map[int]int)
+			}
+			answer.deletions[refPos] = c.Len
+			for i := 0; i < c.Len; i++ {
+				answer.refToRead[refPos-answer.start+i] = -1
+			}
+		case consumesRef(c.Op) && consumesQuery(c.Op):
+			for i := 0; i < c.Len; i++ {
+				answer.refToRead[refPos-answer.start+i] = readPos + i
+			}
+		}
+		if consumesRef(c.Op) {
+			refPos += c.Len
+		}
+		if consumesQuery(c.Op) {
+			readPos += c.Len
+		}
+	}
+	return answer
+}
+
+// readIdx returns the index of the read base aligned to pos, or -1 if pos is deleted or not covered.
+func (a alignment) readIdx(pos int) int {
+	if pos < a.start || pos >= a.end {
+		return -1
+	}
+	return a.refToRead[pos-a.start]
+}
+
+// qual returns the quality of the read base aligned to pos, or -1 if pos is deleted or not covered.
+// Missing qualities are treated as 30.
+func (a alignment) qual(pos int) int {
+	idx := a.readIdx(pos)
+	switch {
+	case idx == -1:
+		return -1
+	case a.r.Qual[idx] == 0xff:
+		return 30
+	default:
+		return int(a.r.Qual[idx])
+	}
+}
+
+// observe returns the allele of site v observed in the read and the probability that the
+// observation is a sequencing error. Returns noAllele if the read is not informative.
+func (a alignment) observe(v variants.Variant, minBaseQual int) (int, float64) {
+	var q int
+	switch {
+	case len(v.Ref) == len(v.Alt) && len(v.Ref) > 0: // substitution
+		q = math.MaxInt32
+		seq := make([]dna.Base, len(v.Ref))
+		for i := range v.Ref {
+			if a.qual(v.Pos+i) < minBaseQual {
+				return noAllele, 0
+			}
+			q = minInt(q, a.qual(v.Pos+i))
+			seq[i] = a.r.Seq[a.readIdx(v.Pos+i)]
+		}
+		switch {
+		case dna.CompareSeqsIgnoreCase(seq, v.Alt) == 0:
+			return altAllele, phredToProb(q)
+		case dna.CompareSeqsIgnoreCase(seq, v.Ref) == 0:
+			return refAllele, phredToProb(q)
+		case len(v.Ref) == 1:
+			return otherAllele, phredToProb(q)
+		default:
+			return noAllele, 0
+		}
+
+	case len(v.Alt) == 0: // deletion
+		q = a.qual(v.Pos - 1)
+		if q < minBaseQual || a.qual(v.Pos+len(v.Ref)) == -1 {
+			return noAllele, 0
+		}
+		if a.deletions[v.Pos] == len(v.Ref) {
+			return altAllele, phredToProb(q)
+		}
+		for pos := v.Pos; pos < v.Pos+len(v.Ref); pos++ {
+			if a.readIdx(pos) == -1 || a.insertions[pos] != nil {
+				return otherAllele, phredToProb(q)
+			}
+		}
+		if a.insertions[v.Pos+len(v.Ref)] != nil {
+			return otherAllele, phredToProb(q)
+		}
+		return refAllele, phredToProb(q)
+
+	case len(v.Ref) == 0: // insertion
+		q = a.qual(v.Pos - 1)
+		if q < minBaseQual || a.qual(v.Pos) == -1 {
+			return noAllele, 0
+		}
+		ins := a.insertions[v.Pos]
+		switch {
+		case ins == nil:
+			return refAllele, phredToProb(q)
+		case dna.CompareSeqsIgnoreCase(a.r.Seq[ins[0]:ins[1]], v.Alt) == 0:
+			return altAllele, phredToProb(q)
+		default:
+			return otherAllele, phredToProb(q)
+		}
+
+	default: // complex variants are not observed (see simple)
+		return noAllele, 0
+	}
+}
+
+// phredToProb converts a phred-scaled quality to an error probability.
+func phredToProb(q int) float64 {
+	return math.Pow(10, -float64(q)/10)
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,228 @@
+package bam
+
+import (
+	"github.com/ddsnellings/weaver/interval"
+	"github.com/ddsnellings/weaver/variants"
+	"sort"
+)
+
+// PhasedPair stores the reads covering both variants of a pair of sites.
+type PhasedPair struct {
+	A, B    int                  // index of the sites with A < B
+	Support [2][2]int            // Support[a][b] is the number of reads with allele a at A and allele b at B. 0 is ref and 1 is alt
+	Cells   map[string][2][2]int // Support in each cell by barcode
+}
+
+// Cis returns the number of reads consistent with the alt alleles of A and B being on the same haplotype.
+func (pp PhasedPair) Cis() int {
+	return pp.Support[0][0] + pp.Support[1][1]
+}
+
+// Trans returns the number of reads consistent with the alt alleles of A and B being on different haplotypes.
+func (pp PhasedPair) Trans() int {
+	return pp.Support[0][1] + pp.Support[1][0]
+}
+
+// siteObs is the allele of a site observed in a read.
+type siteObs struct {
+	site   int
+	allele int
+}
+
+// Phase finds the pairs of sites within p.MaxPhaseDist of each other that are covered by the same
+// read or read pair, and counts the alleles observed together at each pair in each cell and
+// pooled across cells. Only reads showing the ref or alt allele at both sites are counted. The
+// mates of a read pair are merged, so variants covered by different mates of the same fragment
+// are phased, and sites where the mates disagree are skipped. Returns pairs sorted by A then B.
+func Phase(file string, sites []variants.Variant, p Param) []PhasedPair {
+	regions := make([]variants.Region, len(sites))
+	for i := range sites {
+		regions[i] = queryRegion(sites[i])
+	}
+	tree := interval.NewTree(regions)
+	whitelist := barcodeSet(p.Barcodes)
+	pairIdx := make(map[[2]int]int)
+	var answer []PhasedPair
+	type mateKey struct {
+		barcode, name string
+	}
+	pending := make(map[mateKey][]siteObs) // observations of reads whose mate is expected later in the file
+
+	count := func(barcode string, obs []siteObs) {
+		sort.Slice(obs, func(i, j int) bool { return obs[i].site < obs[j].site })
+		var key [2]int
+		var idx int
+		var found bool
+		var support [2][2]int
+		for i := range obs {
+			for j := i + 1; j < len(obs); j++ {
+				if !withinDist(sites[obs[i].site], sites[obs[j].site], p.MaxPhaseDist) {
+					continue
+				}
+				key = [2]int{obs[i].site, obs[j].site}
+				if idx, found = pairIdx[key]; !found {
+					idx = len(answer)
+					pairIdx[key] = idx
+					answer = append(answer, PhasedPair{A: key[0], B: key[1], Cells: make(map[string][2][2]int)})
+				}
+				answer[idx].Support[obs[i].allele-refAllele][obs[j].allele-refAllele]++
+				support = answer[idx].Cells[barcode]
+				support[obs[i].allele-refAllele][obs[j].allele-refAllele]++
+				answer[idx].Cells[barcode] = support
+			}
+		}
+	}
+
+	reads, _ := GoReadToChan(file)
+	var aln alignment
+	var barcode string
+	var obs []siteObs
+	var allele int
+	var found bool
+	for r := range reads {
+		if !p.usable(r, whitelist) {
+			continue
+		}
+		barcode, _ = r.Tag(p.BarcodeTag)
+		obs = nil
+		if hits := tree.Query(variants.Region{Chr: r.Chr, Start: r.Pos, End: r.End()}); len(hits) > 0 {
+			aln = newAlignment(r)
+			for _, s := range hits {
+				if allele, _ = aln.observe(sites[s], p.MinBaseQual); allele == refAllele || allele == altAllele {
+					obs = append(obs, siteObs{site: s, allele: allele})
+				}
+			}
+		}
+		const paired = 0x1
+		if r.Flag&paired != 0 && r.MateChr == r.Chr {
+			key := mateKey{barcode: barcode, name: r.Name}
+			var mateObs []siteObs
+			if mateObs, found = pending[key]; found {
+				delete(pending, key)
+				count(barcode, mergeObs(obs, mateObs))
+				continue
+			}
+			if r.MatePos >= r.Pos {
+				pending[key] = obs
+				continue
+			}
+		}
+		count(barcode, obs)
+	}
+	for key, mateObs := range pending { // mates that were filtered or missing
+		count(key.barcode, mateObs)
+	}
+
+	sort.Slice(answer, func(i, j int) bool {
+		if answer[i].A != answer[j].A {
+			return answer[i].A < answer[j].A
+		}
+		return answer[i].B < answer[j].B
+	})
+	return answer
+}
+
+// mergeObs merges the observations of two mates. Sites where the mates disagree are removed.
+func mergeObs(a, b []siteObs) []siteObs {
+	alleles := make(map[int]int, len(a)+len(b))
+	for _, o := range append(a, b...) {
+		if prev, found := alleles[o.site]; found && prev != o.allele {
+			alleles[o.site] = noAllele
+		} else {
+			alleles[o.site] = o.allele
+		}
+	}
+	answer := make([]siteObs, 0, len(alleles))
+	for site, allele := range alleles {
+		if allele != noAllele {
+			answer = append(answer, siteObs{site: site, allele: allele})
+		}
+	}
+	return answer
+}
+
+// withinDist returns true if a and b are on the same contig and start within maxDist bases.
+func withinDist(a, b variants.Variant, maxDist int) bool {
+	if variants.CanonicalChr(a.Chr) != variants.CanonicalChr(b.Chr) {
+		return false
+	}
+	return b.Pos-a.Pos <= maxDist && a.Pos-b.Pos <= maxDist
+}
+
+// SetPhase joins sites into phased blocks using the pooled support of pairs and sets the
+// PhaseSet and PhaseHap of each site in a block. A pair is phased if at least p.MinPhaseReads
+// reads cover both sites and at least p.MinPhaseFrac of them support the cis or trans phase.
+// Pairs are added to blocks in order of decreasing support, and pairs that conflict with the
+// phase of a block are skipped. Sites not in a block are unphased.
+func SetPhase(sites []variants.Variant, pairs []PhasedPair, p Param) {
+	type edge struct {
+		a, b    int
+		trans   int // 0 if the alt alleles are in cis, 1 if in trans
+		support int
+	}
+	var edges []edge
+	var n int
+	for _, pp := range pairs {
+		n = pp.Cis() + pp.Trans()
+		switch {
+		case n < p.MinPhaseReads:
+		case float64(pp.Cis()) >= p.MinPhaseFrac*float64(n):
+			edges = append(edges, edge{a: pp.A, b: pp.B, trans: 0, support: pp.Cis()})
+		case float64(pp.Trans()) >= p.MinPhaseFrac*float64(n):
+			edges = append(edges, edge{a: pp.A, b: pp.B, trans: 1, support: pp.Trans()})
+		}
+	}
+	sort.SliceStable(edges, func(i, j int) bool { return edges[i].support > edges[j].support })
+
+	// union find where parity[i] is the haplotype of site i relative to its parent
+	parent := make([]int, len(sites))
+	parity := make([]int, len(sites))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) (int, int)
+	find = func(i int) (int, int) {
+		if parent[i] == i {
+			return i, 0
+		}
+		root, rootParity := find(parent[i])
+		parent[i] = root
+		parity[i] ^= rootParity
+		return root, parity[i]
+	}
+	var rootA, rootB, parityA, parityB int
+	for _, e := range edges {
+		rootA, parityA = find(e.a)
+		rootB, parityB = find(e.b)
+		if rootA == rootB {
+			continue // conflicting or already implied by stronger pairs
+		}
+		parent[rootB] = rootA
+		parity[rootB] = parityA ^ parityB ^ e.trans
+	}
+
+	blocks := make(map[int][]int)
+	for i := range sites {
+		sites[i].PhaseSet, sites[i].PhaseHap = 0, 0
+		rootA, _ = find(i)
+		blocks[rootA] = append(blocks[rootA], i)
+	}
+	var first, hap int
+	for _, members := range blocks {
+		if len(members) < 2 {
+			continue
+		}
+		first = members[0]
+		for _, i := range members[1:] {
+			if sites[i].Pos < sites[first].Pos {
+				first = i
+			}
+		}
+		_, hap = find(first)
+		for _, i := range members {
+			sites[i].PhaseSet = sites[first].Pos + 1
+			_, sites[i].PhaseHap = find(i)
+			sites[i].PhaseHap ^= hap
+		}
+	}
+}
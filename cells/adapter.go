@@ -0,0 +1,236 @@
+package cells
+
+import (
+	"github.com/ddsnellings/weaver/variants"
+	"github.com/vertgenlab/gonomics/vcf"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Adapter converts the per-sample FORMAT data written by a variant caller into a CellVar.
+// Adapters for GATK, bcftools, FreeBayes, and Strelka are built in, and other callers can be
+// supported by implementing Adapter and calling RegisterAdapter. CellVar may be called
+// concurrently when reading a vcf with more than one worker (see ReadParam).
+type Adapter interface {
+	Name() string                                                          // name used to select the adapter (see AdapterByName)
+	Detect(header []string) bool                                           // true if the vcf header was written by the caller
+	CellVar(v vcf.Vcf, g vcf.GenomeSample, alleleIdx int) variants.CellVar // CellVar of allele v.Alt[alleleIdx] in sample g
+}
+
+// Built in adapters.
+var (
+	// Gatk reads allele counts from AD as written by GATK HaplotypeCaller and GenotypeGVCFs.
+	// Used when no adapter is detected.
+	Gatk Adapter = adAdapter{name: "gatk", prefixes: []string{"##GATKCommandLine", "##source=HaplotypeCaller", "##source=GenotypeGVCFs", "##source=Mutect2"}}
+
+	// Bcftools reads allele counts from AD as written by bcftools call. Read depth is the sum of
+	// AD if the sample DP field is not present.
+	Bcftools Adapter = adAdapter{name: "bcftools", prefixes: []string{"##bcftools_callCommand", "##source=bcftools"}}
+
+	// FreeBayes reads allele counts from RO and AO.
+	FreeBayes Adapter = freeBayesAdapter{}
+
+	// Strelka reads allele counts from the tier 1 counts of the alleles (AU, CU, GU, and TU for
+	// substitutions, TAR and TIR for indels), or from AD if present as in Strelka2 germline calls.
+	Strelka Adapter = strelkaAdapter{}
+)
+
+// adapters is the list of adapters considered by DetectAdapter in order. Guarded by adaptersMu.
+var adapters = []Adapter{Strelka, FreeBayes, Bcftools, Gatk}
+
+var adaptersMu sync.RWMutex
+
+// RegisterAdapter adds a to the adapters selectable by AdapterByName and detected by DetectAdapter.
+// Registered adapters are detected before the built in adapters. RegisterAdapter is safe for
+// concurrent use, but vcfs read before an adapter is registered do not detect it, so adapters
+// are typically registered in an init function.
+func RegisterAdapter(a Adapter) {
+	adaptersMu.Lock()
+	defer adaptersMu.Unlock()
+	adapters = append([]Adapter{a}, adapters...)
+}
+
+// AdapterByName returns the adapter with the input name (case insensitive).
+func AdapterByName(name string) Adapter {
+	adaptersMu.RLock()
+	defer adaptersMu.RUnlock()
+	var names []string
+	for _, a := range adapters {
+		if strings.EqualFold(a.Name(), name) {
+			return a
+		}
+		names = append(names, a.Name())
+	}
+	log.Panicf("unknown variant caller '%s'. options are: %s", name, strings.Join(names, ", "))
+	return nil
+}
+
+// DetectAdapter returns the first adapter that detects the caller from the vcf header lines,
+// or Gatk if no adapter detects the caller.
+func DetectAdapter(header []string) Adapter {
+	adaptersMu.RLock()
+	defer adaptersMu.RUnlock()
+	for _, a := range adapters {
+		if a.Detect(header) {
+			return a
+		}
+	}
+	return Gatk
+}
+
+// hasHeaderPrefix returns true if any header line begins with one of prefixes, ignoring case.
+func hasHeaderPrefix(header []string, prefixes []string) bool {
+	for _, line := range header {
+		for _, prefix := range prefixes {
+			if len(line) >= len(prefix) && strings.EqualFold(line[:len(prefix)], prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// adAdapter reads allele counts from the AD field.
+type adAdapter struct {
+	name     string
+	prefixes []string // header line prefixes written by the caller
+}
+
+func (a adAdapter) Name() string {
+	return a.name
+}
+
+func (a adAdapter) Detect(header []string) bool {
+	return hasHeaderPrefix(header, a.prefixes)
+}
+
+func (a adAdapter) CellVar(v vcf.Vcf, g vcf.GenomeSample, alleleIdx int) variants.CellVar {
+	if g.AlleleOne == -1 && g.AlleleTwo == -1 {
+		return variants.CellVar{}
+	}
+	ad := intList(sampleField(v, g, "AD"))
+	depth, found := intField(v, g, "DP")
+	if !found {
+		depth = sum(ad)
+	}
+	return newCellVar(v, g, alleleIdx, listValue(ad, alleleIdx+1), depth)
+}
+
+// freeBayesAdapter reads allele counts from the RO and AO fields.
+type freeBayesAdapter struct{}
+
+func (freeBayesAdapter) Name() string {
+	return "freebayes"
+}
+
+func (freeBayesAdapter) Detect(header []string) bool {
+	return hasHeaderPrefix(header, []string{"##source=freeBayes"})
+}
+
+func (freeBayesAdapter) CellVar(v vcf.Vcf, g vcf.GenomeSample, alleleIdx int) variants.CellVar {
+	if g.AlleleOne == -1 && g.AlleleTwo == -1 {
+		return variants.CellVar{}
+	}
+	ref, _ := intField(v, g, "RO")
+	alt := intList(sampleField(v, g, "AO"))
+	depth, found := intField(v, g, "DP")
+	if !found {
+		depth = ref + sum(alt)
+	}
+	return newCellVar(v, g, alleleIdx, listValue(alt, alleleIdx), depth)
+}
+
+// strelkaAdapter reads allele counts from tier 1 allele counts, or the AD field if present.
+type strelkaAdapter struct{}
+
+func (strelkaAdapter) Name() string {
+	return "strelka"
+}
+
+func (strelkaAdapter) Detect(header []string) bool {
+	return hasHeaderPrefix(header, []string{"##source=strelka"})
+}
+
+func (strelkaAdapter) CellVar(v vcf.Vcf, g vcf.GenomeSample, alleleIdx int) variants.CellVar {
+	if g.AlleleOne == -1 && g.AlleleTwo == -1 {
+		return variants.CellVar{}
+	}
+	if formatIdx(v.Format, "AD") != -1 {
+		return adAdapter{}.CellVar(v, g, alleleIdx)
+	}
+	var ref, alt int
+	if len(v.Ref) == 1 && len(v.Alt[alleleIdx]) == 1 { // substitution
+		ref = listValue(intList(sampleField(v, g, strings.ToUpper(v.Ref)+"U")), 0)
+		alt = listValue(intList(sampleField(v, g, strings.ToUpper(v.Alt[alleleIdx])+"U")), 0)
+	} else {
+		ref = listValue(intList(sampleField(v, g, "TAR")), 0)
+		alt = listValue(intList(sampleField(v, g, "TIR")), 0)
+	}
+	depth, found := intField(v, g, "DP")
+	if !found || depth < ref+alt {
+		depth = ref + alt
+	}
+	return newCellVar(v, g, alleleIdx, alt, depth)
+}
+
+// newCellVar returns a CellVar with the genotype from GT and genotype quality from GQ of sample g.
+func newCellVar(v vcf.Vcf, g vcf.GenomeSample, alleleIdx int, altReads int, depth int) variants.CellVar {
+	var answer variants.CellVar
+	answer.Genotype = getZygosity(g, alleleIdx+1)
+	answer.GenotypeQuality, _ = intField(v, g, "GQ")
+	answer.ReadDepth = depth
+	answer.AltReads = altReads
+	answer.Af = float64(answer.AltReads) / float64(answer.ReadDepth)
+	return answer
+}
+
+// sampleField returns the value of the FORMAT field key in sample g, or "" if not present.
+func sampleField(v vcf.Vcf, g vcf.GenomeSample, key string) string {
+	idx := formatIdx(v.Format, key)
+	if idx == -1 || idx >= len(g.FormatData) {
+		return ""
+	}
+	return g.FormatData[idx]
+}
+
+// intField returns the integer value of the FORMAT field key in sample g rounded to the nearest
+// integer, and false if the field is not present or missing.
+func intField(v vcf.Vcf, g vcf.GenomeSample, key string) (int, bool) {
+	val, err := strconv.ParseFloat(sampleField(v, g, key), 64)
+	if err != nil {
+		return 0, false
+	}
+	return int(math.Round(val)), true
+}
+
+// intList parses a comma separated list of integers. Missing values are 0.
+func intList(s string) []int {
+	if s == "" {
+		return nil
+	}
+	words := strings.Split(s, ",")
+	answer := make([]int, len(words))
+	for i := range words {
+		answer[i], _ = strconv.Atoi(words[i])
+	}
+	return answer
+}
+
+// listValue returns l[idx], or 0 if idx is outside l.
+func listValue(l []int, idx int) int {
+	if idx < 0 || idx >= len(l) {
+		return 0
+	}
+	return l[idx]
+}
+
+func sum(l []int) int {
+	var answer int
+	for _, val := range l {
+		answer += val
+	}
+	return answer
+}
@@ -0,0 +1,144 @@
+package cells
+
+import (
+	"github.com/ddsnellings/weaver/variants"
+	"github.com/vertgenlab/gonomics/vcf"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type adapterTest struct {
+	name      string
+	ref, alt  string
+	format    string
+	sample    string
+	alleleIdx int
+	expected  variants.CellVar
+}
+
+func runAdapterTests(t *testing.T, a Adapter, tests []adapterTest) {
+	for _, test := range tests {
+		format := strings.Split(test.format, ":")
+		v := vcf.Vcf{Chr: "chr1", Pos: 10, Ref: test.ref, Alt: strings.Split(test.alt, ","), Format: format}
+		v.Samples = vcf.ParseNotes(test.sample, format)
+		found := a.CellVar(v, v.Samples[0], test.alleleIdx)
+		if found.Genotype != test.expected.Genotype || found.GenotypeQuality != test.expected.GenotypeQuality ||
+			found.ReadDepth != test.expected.ReadDepth || found.AltReads != test.expected.AltReads {
+			t.Errorf("%s %s: expected %+v, found %+v", a.Name(), test.name, test.expected, found)
+		}
+		if test.expected.ReadDepth > 0 && found.Af != float64(test.expected.AltReads)/float64(test.expected.ReadDepth) {
+			t.Errorf("%s %s: expected af %v, found %v", a.Name(), test.name, float64(test.expected.AltReads)/float64(test.expected.ReadDepth), found.Af)
+		}
+	}
+}
+
+func TestGatkAdapter(t *testing.T) {
+	runAdapterTests(t, Gatk, []adapterTest{
+		{"het", "A", "G", "GT:AD:DP:GQ:PL", "0/1:10,8:18:99:200,0,250", 0,
+			variants.CellVar{Genotype: variants.Heterozygous, GenotypeQuality: 99, ReadDepth: 18, AltReads: 8}},
+		{"second allele", "A", "G,T", "GT:AD:DP:GQ:PL", "2/2:1,0,20:21:60:.", 1,
+			variants.CellVar{Genotype: variants.Homozygous, GenotypeQuality: 60, ReadDepth: 21, AltReads: 20}},
+		{"first allele of hom second", "A", "G,T", "GT:AD:DP:GQ:PL", "2/2:1,0,20:21:60:.", 0,
+			variants.CellVar{Genotype: variants.WildType, GenotypeQuality: 60, ReadDepth: 21, AltReads: 0}},
+		{"phased fields", "A", "G", "GT:AD:DP:GQ:PGT:PID:PL", "0|1:5,5:10:40:0|1:10_A_G:100,0,100", 0,
+			variants.CellVar{Genotype: variants.Heterozygous, GenotypeQuality: 40, ReadDepth: 10, AltReads: 5}},
+		{"reordered fields", "C", "T", "GT:GQ:DP:AD", "1/1:30:12:0,12", 0,
+			variants.CellVar{Genotype: variants.Homozygous, GenotypeQuality: 30, ReadDepth: 12, AltReads: 12}},
+		{"no call", "A", "G", "GT:AD:DP:GQ:PL", "./.:0,0:0:0:0,0,0", 0,
+			variants.CellVar{}},
+	})
+}
+
+func TestBcftoolsAdapter(t *testing.T) {
+	runAdapterTests(t, Bcftools, []adapterTest{
+		{"with depth", "A", "G", "GT:PL:DP:AD", "0/1:100,0,120:15:9,6", 0,
+			variants.CellVar{Genotype: variants.Heterozygous, ReadDepth: 15, AltReads: 6}},
+		{"depth from AD", "A", "G", "GT:PL:AD", "1/1:200,30,0:1,11", 0,
+			variants.CellVar{Genotype: variants.Homozygous, ReadDepth: 12, AltReads: 11}},
+		{"missing AD", "A", "G", "GT:PL", "0/0:0,30,200", 0,
+			variants.CellVar{Genotype: variants.WildType}},
+	})
+}
+
+func TestFreeBayesAdapter(t *testing.T) {
+	runAdapterTests(t, FreeBayes, []adapterTest{
+		{"het", "A", "G", "GT:GQ:DP:AD:RO:QR:AO:QA:GL", "0/1:35.5:20:12,8:12:400:8:280:-20,0,-30", 0,
+			variants.CellVar{Genotype: variants.Heterozygous, GenotypeQuality: 36, ReadDepth: 20, AltReads: 8}},
+		{"second allele", "AT", "A,ATT", "GT:DP:RO:AO", "0/2:14:6:1,7", 1,
+			variants.CellVar{Genotype: variants.Heterozygous, ReadDepth: 14, AltReads: 7}},
+		{"depth from counts", "A", "C", "GT:RO:AO", "1/1:0:9", 0,
+			variants.CellVar{Genotype: variants.Homozygous, ReadDepth: 9, AltReads: 9}},
+	})
+}
+
+func TestStrelkaAdapter(t *testing.T) {
+	runAdapterTests(t, Strelka, []adapterTest{
+		{"germline", "A", "G", "GT:GQ:GQX:DP:DPF:AD:ADF:ADR:SB:FT:PL", "0/1:80:20:25:0:13,12:6,6:7,6:-5:PASS:100,0,120", 0,
+			variants.CellVar{Genotype: variants.Heterozygous, GenotypeQuality: 80, ReadDepth: 25, AltReads: 12}},
+		{"substitution tiers", "c", "T", "GT:DP:FDP:SDP:SUBDP:AU:CU:GU:TU", "0/1:30:0:0:0:0,0:18,19:0,0:11,12", 0,
+			variants.CellVar{Genotype: variants.Heterozygous, ReadDepth: 30, AltReads: 11}},
+		{"indel tiers", "AT", "A", "GT:DP:DP2:TAR:TIR:TOR:DP50:FDP50:SUBDP50", "1/1:20:20:1,1:19,20:0,0:20:0:0", 0,
+			variants.CellVar{Genotype: variants.Homozygous, ReadDepth: 20, AltReads: 19}},
+		{"depth from tiers", "G", "A", "GT:AU:CU:GU:TU", "0/1:4,4:0,0:6,6:0,0", 0,
+			variants.CellVar{Genotype: variants.Heterozygous, ReadDepth: 10, AltReads: 4}},
+	})
+}
+
+func TestDetectAdapter(t *testing.T) {
+	tests := []struct {
+		header   []string
+		expected Adapter
+	}{
+		{[]string{"##fileformat=VCFv4.2", "##source=freeBayes v1.3.2"}, FreeBayes},
+		{[]string{"##fileformat=VCFv4.2", "##source=freeBayes v1.3.2", "##bcftools_normCommand=norm -m-any"}, FreeBayes},
+		{[]string{"##fileformat=VCFv4.2", "##bcftools_callVersion=1.10", "##bcftools_callCommand=call -mv"}, Bcftools},
+		{[]string{"##fileformat=VCFv4.1", "##source=strelka"}, Strelka},
+		{[]string{"##fileformat=VCFv4.2", "##GATKCommandLine=<ID=HaplotypeCaller>", "##bcftools_viewCommand=view"}, Gatk},
+		{[]string{"##fileformat=VCFv4.2"}, Gatk},
+	}
+	for _, test := range tests {
+		if found := DetectAdapter(test.header); found.Name() != test.expected.Name() {
+			t.Errorf("expected %s for header %v, found %s", test.expected.Name(), test.header, found.Name())
+		}
+	}
+	for _, a := range []Adapter{Gatk, Bcftools, FreeBayes, Strelka} {
+		if AdapterByName(strings.ToUpper(a.Name())).Name() != a.Name() {
+			t.Errorf("could not select adapter %s by name", a.Name())
+		}
+	}
+}
+
+// TestRegisterAdapter registers adapters while others are detected. Run with -race to check
+// that the registry is guarded. The registry is restored when the test ends.
+func TestRegisterAdapter(t *testing.T) {
+	adaptersMu.RLock()
+	registered := append([]Adapter(nil), adapters...)
+	adaptersMu.RUnlock()
+	t.Cleanup(func() {
+		adaptersMu.Lock()
+		adapters = registered
+		adaptersMu.Unlock()
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			RegisterAdapter(adAdapter{name: "test" + strconv.Itoa(i), prefixes: []string{"##source=test" + strconv.Itoa(i)}})
+		}(i)
+		go func() {
+			defer wg.Done()
+			DetectAdapter([]string{"##source=bcftools"})
+		}()
+	}
+	wg.Wait()
+	if found := DetectAdapter([]string{"##source=test2"}); found.Name() != "test2" {
+		t.Errorf("expected registered adapter test2, found %s", found.Name())
+	}
+	if AdapterByName("TEST3").Name() != "test3" {
+		t.Errorf("could not select registered adapter by name")
+	}
+}
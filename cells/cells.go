@@ -1,11 +1,11 @@
 package cells
 
 import (
+	"github.com/ddsnellings/weaver/parallel"
 	"github.com/ddsnellings/weaver/variants"
 	"github.com/vertgenlab/gonomics/dna"
 	"github.com/vertgenlab/gonomics/vcf"
 	"log"
-	"strconv"
 	"strings"
 )
 
@@ -15,108 +15,221 @@ type BarcodeMap map[Barcode]Cell
 // Cell stores information on genotypes for a single cell
 type Cell struct {
 	Id               int
-	Genotypes        []variants.CellVar
+	Name             string // sample name in the vcf header. typically the cell barcode
 	GenotypesPresent float64
+	Batch            string // label of the run the cell was sequenced in. set by SetBatch or Merge
 }
 
 // Data organizes Cell and Variant information from a vcf file
 type Data struct {
-	Cells    []Cell
-	Variants []variants.Variant
+	Cells     []Cell
+	Variants  []variants.Variant
+	Contigs   *variants.Contigs // contig order from the vcf header. nil if the header has no ##contig lines
+	Genotypes *GenotypeStore    // CellVar of each cell at each variant. see CellVar and SetCellVar
 }
 
+// ReadParam defines the options for reading a vcf file.
+type ReadParam struct {
+	CellFilter   CellFilterParam
+	GlobalFilter GlobalFilterParam
+	MinVcfQual   float64            // records with QUAL <= MinVcfQual are ignored // Default 100
+	Reference    variants.Reference // left-align indels against the reference (see variants.Normalize). nil disables // Default nil
+	Adapter      Adapter            // converts the FORMAT data of the variant caller to CellVar. nil detects the caller from the header (see DetectAdapter) // Default nil
+	Workers      int                // number of goroutines decompressing and parsing records. 0 uses all available cores, 1 reads serially // Default 0
+	Sparse       bool               // store genotypes sparsely for variants where most cells have the same genotype (see GenotypeStore) // Default false
+}
+
+var DefaultReadParam = ReadParam{CellFilter: DefaultCellFilter, GlobalFilter: DefaultGlobalFilter, MinVcfQual: DefaultVcfQual}
+
 // ReadVcf into a Data struct that stores information about Cells and Variants that pass the input filters
 func ReadVcf(file string, cellFilter CellFilterParam, globalFilter GlobalFilterParam, minVcfQual float64) *Data {
+	return ReadVcfWithParam(file, ReadParam{CellFilter: cellFilter, GlobalFilter: globalFilter, MinVcfQual: minVcfQual})
+}
+
+// ReadVcfWithParam reads a vcf into a Data struct that stores information about Cells and
+// Variants that pass the input filters, with the options in p. Records are parsed by p.Workers
+// goroutines and the result is identical for any number of workers.
+func ReadVcfWithParam(file string, p ReadParam) *Data {
+	if parallel.NumWorkers(p.Workers) > 1 {
+		return readVcfParallel(file, p)
+	}
 	vcfChan, header := vcf.GoReadToChan(file)
+	answer, adapter := newData(header.Text, p)
+	var fromReads int
+	for record := range vcfChan {
+		if record.Qual > p.MinVcfQual {
+			fromReads += parseVcf(record, p.CellFilter, p.Reference, adapter, answer)
+		}
+	}
+	warnFromReadCounts(file, fromReads)
+
+	p.GlobalFilter.Apply(answer)
+	return answer
+}
+
+// newData returns Data with the cells and contigs in the vcf header, and the adapter for the
+// variant caller that wrote the vcf.
+func newData(header []string, p ReadParam) (*Data, Adapter) {
 	answer := new(Data)
+	answer.Contigs = variants.ContigsFromHeader(header)
+	adapter := p.Adapter
+	if adapter == nil {
+		adapter = DetectAdapter(header)
+	}
 
-	colNames := strings.Split(header.Text[len(header.Text)-1], "\t")
+	colNames := strings.Split(header[len(header)-1], "\t")
 	sampleNames := colNames[9:]
 	answer.Cells = make([]Cell, len(sampleNames))
+	answer.Genotypes = NewGenotypeStore(len(sampleNames), p.Sparse)
 
 	for i := range answer.Cells {
 		answer.Cells[i].Id = i
+		answer.Cells[i].Name = sampleNames[i]
 	}
+	return answer, adapter
+}
 
-	for record := range vcfChan {
-		if record.Qual > minVcfQual {
-			parseVcf(record, cellFilter, answer)
+// parseVcf to fill the appropriate fields in data. Returns the number of alleles called from read
+// counts (see processCells).
+func parseVcf(v vcf.Vcf, cellFilter CellFilterParam, ref variants.Reference, adapter Adapter, data *Data) int {
+	var fromReads int
+	var ok bool
+	for _, allele := range parseAlleles(v, cellFilter, adapter) {
+		if ref != nil {
+			if allele.variant, ok = NormalizeVariant(allele.variant, ref); !ok {
+				continue
+			}
+		}
+		if allele.fromReads {
+			fromReads++
 		}
+		data.AddVariant(allele.variant, allele.cellVars, cellFilter)
 	}
+	return fromReads
+}
 
-	globalFilter.Apply(answer)
-	return answer
+// parsedAllele is a variant and the CellVar of each cell parsed from a vcf record.
+type parsedAllele struct {
+	variant   variants.Variant
+	cellVars  []variants.CellVar
+	fromReads bool // genotypes were called from read counts (see processCells)
 }
 
-// parseVcf to fill the appropriate fields in data
-func parseVcf(v vcf.Vcf, cellFilter CellFilterParam, data *Data) {
-	var offset int
+// parseAlleles returns the variant and cells for each alt allele of v (see NewVariant and
+// processCells). Does not modify Data, so records can be parsed concurrently.
+func parseAlleles(v vcf.Vcf, cellFilter CellFilterParam, adapter Adapter) []parsedAllele {
+	answer := make([]parsedAllele, 0, len(v.Alt))
 	for alleleIdx := range v.Alt { // for each allele make a new variant
 		if v.Alt[alleleIdx] == "." { // no variant. can be ignored
 			continue
 		}
-		var variant variants.Variant
-		variant.Id = len(data.Variants)
-		variant.Chr = v.Chr
-		variant.Pos = v.Pos - 1
-		variant.Ref = dna.StringToBases(v.Ref)
-		variant.Alt = dna.StringToBases(v.Alt[alleleIdx])
-		variant.Ref, variant.Alt, offset = trimMatchingBases(variant.Ref, variant.Alt)
-		variant.Pos += offset
-		variant = processCells(v, variant, alleleIdx, cellFilter, data)
-		data.Variants = append(data.Variants, variant)
-	}
-}
-
-// processCells parses all cells from a given vcf record and stores them directly in data
-func processCells(v vcf.Vcf, variant variants.Variant, alleleIdx int, cellFilter CellFilterParam, data *Data) variants.Variant {
-	var currCv variants.CellVar
-	for idx := range v.Samples {
-		currCv = getCellVar(v, v.Samples[idx], alleleIdx, variant)
-		if currCv.GenotypeQuality > cellFilter.MinGenotypeQuality &&
-			currCv.ReadDepth > cellFilter.MinGenotypeDepth {
-
-			variant.CellsGenotyped = append(variant.CellsGenotyped, idx)
-			if currCv.Af > cellFilter.MinReadAf {
-				variant.CellsMutated = append(variant.CellsMutated, idx)
-			} else if currCv.Genotype != variants.WildType {
-				currCv.Genotype = variants.WildType
-			}
-		}
-		data.Cells[idx].Genotypes = append(data.Cells[idx].Genotypes, currCv)
+		allele := parsedAllele{variant: NewVariant(v, alleleIdx)}
+		allele.cellVars, allele.fromReads = processCells(v, alleleIdx, adapter, cellFilter)
+		answer = append(answer, allele)
 	}
+	return answer
+}
+
+// NewVariant returns the Variant for allele v.Alt[alleleIdx] with matching bases trimmed from
+// Ref and Alt, as stored in Data. The untrimmed alleles are kept in Record. Id and cell
+// information are not set.
+func NewVariant(v vcf.Vcf, alleleIdx int) variants.Variant {
+	var variant variants.Variant
+	var offset int
+	variant.Chr = v.Chr
+	variant.Pos = v.Pos - 1
+	variant.Record = variants.Record{Pos: v.Pos, Ref: v.Ref, Alt: v.Alt[alleleIdx]}
+	variant.Ref = dna.StringToBases(v.Ref)
+	variant.Alt = dna.StringToBases(v.Alt[alleleIdx])
+	variant.Ref, variant.Alt, offset = trimMatchingBases(variant.Ref, variant.Alt)
+	variant.Pos += offset
 	return variant
 }
 
-// getCellVar parses a GenomeSample into a CellVar
-func getCellVar(v vcf.Vcf, g vcf.GenomeSample, alleleIdx int, variant variants.Variant) variants.CellVar {
-	var answer variants.CellVar
-	var err error
+// NormalizeVariant left-aligns a variant returned by NewVariant against ref (see
+// variants.Normalize). Returns false and logs a warning if the REF of the vcf record does not
+// match ref, so the record can be skipped.
+func NormalizeVariant(v variants.Variant, ref variants.Reference) (variants.Variant, bool) {
+	if !variants.MatchesReference(v, ref) {
+		log.Printf("WARNING: skipping vcf record %s:%d %s>%s. REF does not match the reference", v.Chr, v.Record.Pos, v.Record.Ref, v.Record.Alt)
+		return v, false
+	}
+	return variants.Normalize(v, ref), true
+}
 
-	answer.Vid = variant.Id
-	if g.AlleleOne == -1 && g.AlleleTwo == -1 {
-		return answer
+// processCells parses all cells from a given vcf record for allele v.Alt[alleleIdx]. Returns true
+// if the Likelihood caller called the genotypes from read counts (see callFromLikelihoods).
+func processCells(v vcf.Vcf, alleleIdx int, adapter Adapter, cellFilter CellFilterParam) ([]variants.CellVar, bool) {
+	cellVars := make([]variants.CellVar, len(v.Samples))
+	for idx := range v.Samples {
+		cellVars[idx] = adapter.CellVar(v, v.Samples[idx], alleleIdx)
 	}
+	var fromReads bool
+	if cellFilter.Caller == Likelihood {
+		fromReads = callFromLikelihoods(v, cellVars, alleleIdx, cellFilter)
+	}
+	return cellVars, fromReads
+}
 
-	answer.Genotype = getZygosity(g, alleleIdx+1)
-	answer.GenotypeQuality, err = strconv.Atoi(g.FormatData[3])
-	if err != nil {
-		answer.GenotypeQuality = 0
+// AddVariant appends variant to d with cellVars[i] as the CellVar of d.Cells[i]. Each CellVar
+// should have the Genotype, GenotypeQuality, ReadDepth, AltReads, and Af fields set as when
+// reading a vcf, and the Posterior set if cellFilter.Caller is Likelihood (see CallFromLogLikelihoods).
+// Genotypes are called with the error model for the Binomial caller, and the cells passing
+// cellFilter are stored in CellsGenotyped and CellsMutated. The Id of variant and the Vid of
+// each CellVar are set. Summary statistics such as CellAf are computed by GlobalFilterParam.Apply,
+// which should be run after all variants are added.
+func (d *Data) AddVariant(variant variants.Variant, cellVars []variants.CellVar, cellFilter CellFilterParam) {
+	if len(cellVars) != len(d.Cells) {
+		log.Panicf("AddVariant requires a CellVar for each of %d cells, found %d", len(d.Cells), len(cellVars))
+	}
+	if d.Genotypes == nil {
+		d.Genotypes = NewGenotypeStore(len(d.Cells), false)
+	}
+	if d.Genotypes.NumVariants() != len(d.Variants) {
+		log.Panicf("AddVariant found genotypes for %d variants in data with %d variants", d.Genotypes.NumVariants(), len(d.Variants))
+	}
+	variant.Id = len(d.Variants)
+	variant.CellsGenotyped = nil
+	variant.CellsMutated = nil
+	if cellFilter.Caller == Binomial {
+		variant.ErrorRate = callFromErrorModel(cellVars, cellFilter)
 	}
 
-	answer.ReadDepth, err = strconv.Atoi(g.FormatData[2])
-	if err != nil {
-		answer.ReadDepth = 0
+	for idx := range cellVars {
+		if passesCellFilter(cellVars[idx], cellFilter) {
+			variant.CellsGenotyped = append(variant.CellsGenotyped, idx)
+			if isMutated(cellVars[idx], cellFilter) {
+				variant.CellsMutated = append(variant.CellsMutated, idx)
+			} else if cellVars[idx].Genotype != variants.WildType {
+				cellVars[idx].Genotype = variants.WildType
+			}
+		}
 	}
+	d.Genotypes.AppendVariant(cellVars)
+	d.Variants = append(d.Variants, variant)
+}
 
-	altReadsPerAllele := strings.Split(g.FormatData[1], ",")
-	answer.AltReads, err = strconv.Atoi(altReadsPerAllele[alleleIdx+1])
-	if err != nil {
-		answer.AltReads = 0
+// passesCellFilter returns true if the genotype in a cell is of sufficient quality to be considered genotyped.
+func passesCellFilter(cv variants.CellVar, cellFilter CellFilterParam) bool {
+	if cv.GenotypeQuality <= cellFilter.MinGenotypeQuality || cv.ReadDepth <= cellFilter.MinGenotypeDepth {
+		return false
+	}
+	if cellFilter.Caller == Likelihood {
+		return maxPosterior(cv) >= cellFilter.MinPosterior && cv.HasPosterior()
 	}
+	return true
+}
 
-	answer.Af = float64(answer.AltReads) / float64(answer.ReadDepth)
-	return answer
+// isMutated returns true if a genotyped cell should be called as carrying the variant.
+func isMutated(cv variants.CellVar, cellFilter CellFilterParam) bool {
+	switch cellFilter.Caller {
+	case Likelihood:
+		return cv.Genotype == variants.Heterozygous || cv.Genotype == variants.Homozygous
+	case Binomial:
+		return cv.PValue < cellFilter.MaxPValue
+	default:
+		return cv.Af > cellFilter.MinReadAf
+	}
 }
 
 // getZygosity parses a GenomeSample and returns the variant Zygosity
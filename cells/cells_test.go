@@ -1,6 +1,7 @@
 package cells
 
 import (
+	"github.com/ddsnellings/weaver/reference"
 	"github.com/ddsnellings/weaver/variants"
 	"github.com/vertgenlab/gonomics/dna"
 	"testing"
@@ -20,15 +21,13 @@ import (
 // Allele 4 (Var 3, Alt 1)      WT,Hom,WT       100,100,100     2,90,0      98,9,50     99,99,99
 // Allele 5 (Var 3, Alt 2)      WT,WT,Het       100,100,100     0,1,50      98,9,50     99,99,99
 
-var expectedData = Data{
-	Cells:    []Cell{expectedCell1, expectedCell2, expectedCell3},
-	Variants: []variants.Variant{expectedAllele2, expectedAllele3, expectedAllele4, expectedAllele5},
-}
+var expectedData = newTestData([]Cell{expectedCell1, expectedCell2, expectedCell3},
+	[]variants.Variant{expectedAllele2, expectedAllele3, expectedAllele4, expectedAllele5},
+	[][]variants.CellVar{cellVar1, cellVar2, cellVar3})
 
 // Expected Cells
 var expectedCell1 = Cell{
 	Id:               0,
-	Genotypes:        cellVar1,
 	GenotypesPresent: 1,
 }
 var cellVar1 = []variants.CellVar{{
@@ -63,7 +62,6 @@ var cellVar1 = []variants.CellVar{{
 
 var expectedCell2 = Cell{
 	Id:               1,
-	Genotypes:        cellVar2,
 	GenotypesPresent: 1,
 }
 var cellVar2 = []variants.CellVar{{
@@ -98,7 +96,6 @@ var cellVar2 = []variants.CellVar{{
 
 var expectedCell3 = Cell{
 	Id:               2,
-	Genotypes:        cellVar3,
 	GenotypesPresent: 1,
 }
 var cellVar3 = []variants.CellVar{{
@@ -190,8 +187,38 @@ func TestReadVcf(t *testing.T) {
 	}
 }
 
+func TestReadVcfReferenceMismatch(t *testing.T) {
+	p := ReadParam{CellFilter: DefaultCellFilter, Reference: reference.Map{"chr1": dna.StringToBases("GTTCA")}}
+	for _, workers := range []int{1, 2} {
+		p.Workers = workers
+		data := ReadVcfWithParam("testdata/small.vcf", p) // REF of the record at chr1:2 does not match
+		if len(data.Variants) != 3 || data.Variants[0].Pos != 0 || data.Variants[1].Pos != 2 || data.Variants[2].Pos != 2 {
+			t.Errorf("expected the record at chr1:2 to be skipped with %d workers, found %v", workers, data.Variants)
+		}
+	}
+}
+
+// newTestData returns Data with genotypes[cellId][vid] as the CellVar of each cell and variant.
+func newTestData(cells []Cell, vars []variants.Variant, genotypes [][]variants.CellVar) Data {
+	d := Data{Cells: cells, Variants: vars}
+	for cellId := range genotypes {
+		for vid, cv := range genotypes[cellId] {
+			d.SetCellVar(cellId, vid, cv)
+		}
+	}
+	return d
+}
+
 func equal(a *Data, b *Data) bool {
-	return equalCells(a.Cells, b.Cells) && equalVariants(a.Variants, b.Variants)
+	if !equalCells(a.Cells, b.Cells) || !equalVariants(a.Variants, b.Variants) {
+		return false
+	}
+	for i := range a.Cells {
+		if !equalCellVar(a.CellGenotypes(i), b.CellGenotypes(i)) {
+			return false
+		}
+	}
+	return true
 }
 
 func equalCells(a []Cell, b []Cell) bool {
@@ -205,8 +232,6 @@ func equalCells(a []Cell, b []Cell) bool {
 			return false
 		case a[i].GenotypesPresent != b[i].GenotypesPresent:
 			return false
-		case !equalCellVar(a[i].Genotypes, b[i].Genotypes):
-			return false
 		}
 	}
 	return true
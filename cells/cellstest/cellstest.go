@@ -0,0 +1,65 @@
+// Package cellstest builds cells.Data from genotype or read count matrices for tests.
+package cellstest
+
+import (
+	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/variants"
+)
+
+// TwoClones returns the genotypes of two clones of 3 cells each at 6 variants, with 3
+// missing genotypes. -1 denotes a missing genotype.
+func TwoClones() [][]int {
+	return [][]int{
+		{1, -1, 1, 0, 0, 0},
+		{1, 1, 1, 0, 0, 0},
+		{1, 1, 1, 0, 0, -1},
+		{0, 0, 0, 2, 2, 2},
+		{0, 0, -1, 2, 2, 2},
+		{0, 0, 0, 2, 2, 2},
+	}
+}
+
+// FromGenotypes builds a cells.Data from a matrix of genotypes[cell][variant] where 0 is
+// WildType, 1 is Heterozygous, 2 is Homozygous, and -1 is missing. Each genotyped cell has 2
+// reads with g alt reads, so Af is half the dosage.
+func FromGenotypes(genotypes [][]int) *cells.Data {
+	d := new(cells.Data)
+	d.Cells = make([]cells.Cell, len(genotypes))
+	d.Variants = make([]variants.Variant, len(genotypes[0]))
+	for j := range d.Variants {
+		d.Variants[j].Id = j
+	}
+	for i := range genotypes {
+		d.Cells[i].Id = i
+		for j, g := range genotypes[i] {
+			if g == -1 {
+				continue
+			}
+			d.SetCellVar(i, j, variants.CellVar{Genotype: variants.Zygosity(g + 1), ReadDepth: 2, AltReads: g})
+			d.Variants[j].CellsGenotyped = append(d.Variants[j].CellsGenotyped, i)
+		}
+	}
+	return d
+}
+
+// FromReadCounts builds a cells.Data from matrices of alt[cell][variant] and
+// depth[cell][variant] read counts. Genotypes are not called, so every CellVar is NoGenotype and
+// no cells are listed in CellsGenotyped.
+func FromReadCounts(alt [][]int, depth [][]int) *cells.Data {
+	d := new(cells.Data)
+	d.Cells = make([]cells.Cell, len(depth))
+	d.Variants = make([]variants.Variant, len(depth[0]))
+	for j := range d.Variants {
+		d.Variants[j].Id = j
+	}
+	for i := range depth {
+		d.Cells[i].Id = i
+		for j := range depth[i] {
+			if depth[i][j] == 0 {
+				continue
+			}
+			d.SetCellVar(i, j, variants.CellVar{ReadDepth: depth[i][j], AltReads: alt[i][j], Af: float64(alt[i][j]) / float64(depth[i][j])})
+		}
+	}
+	return d
+}
@@ -0,0 +1,108 @@
+package cells
+
+import (
+	"github.com/ddsnellings/weaver/variants"
+	"gonum.org/v1/gonum/mathext"
+	"math"
+)
+
+// Prior on the background error rate. The observed alt reads in wild-type cells
+// are combined with errorPriorReads pseudo-reads at errorPriorRate so that sites
+// with few confident wild-type cells still receive a sensible error rate.
+const (
+	errorPriorRate  = 0.005
+	errorPriorReads = 1000
+	minErrorRate    = 0.0001
+	maxErrorRate    = 0.2
+)
+
+// homozygousAf is the minimum read allele frequency for a mutated cell to be called homozygous
+// when the caller's genotype is wild-type. Matches the upper bound used by variants.FindHeterozygous.
+const homozygousAf = 0.8
+
+// callFromErrorModel estimates the background error rate of the variant from confidently
+// wild-type cells and then tests each cell for an excess of alt reads with a binomial
+// (or beta-binomial if cellFilter.Overdispersion > 0) test. The PValue of each CellVar is
+// set and cells with PValue < cellFilter.MaxPValue are given a mutant genotype.
+// Returns the estimated error rate.
+func callFromErrorModel(cellVars []variants.CellVar, cellFilter CellFilterParam) float64 {
+	errorRate := estimateErrorRate(cellVars, cellFilter)
+	for i := range cellVars {
+		if cellVars[i].Genotype == variants.NoGenotype {
+			continue
+		}
+		cellVars[i].PValue = altReadsPValue(cellVars[i].AltReads, cellVars[i].ReadDepth, errorRate, cellFilter.Overdispersion)
+		if cellVars[i].PValue < cellFilter.MaxPValue && cellVars[i].Genotype == variants.WildType {
+			if cellVars[i].Af >= homozygousAf {
+				cellVars[i].Genotype = variants.Homozygous
+			} else {
+				cellVars[i].Genotype = variants.Heterozygous
+			}
+		}
+	}
+	return errorRate
+}
+
+// estimateErrorRate pools the alt reads from all cells that pass quality filters,
+// are called wild-type, and have Af <= cellFilter.MinReadAf.
+func estimateErrorRate(cellVars []variants.CellVar, cellFilter CellFilterParam) float64 {
+	var alt, depth int
+	for i := range cellVars {
+		if cellVars[i].Genotype != variants.WildType ||
+			cellVars[i].Af > cellFilter.MinReadAf ||
+			cellVars[i].GenotypeQuality <= cellFilter.MinGenotypeQuality ||
+			cellVars[i].ReadDepth <= cellFilter.MinGenotypeDepth {
+			continue
+		}
+		alt += cellVars[i].AltReads
+		depth += cellVars[i].ReadDepth
+	}
+	rate := (float64(alt) + errorPriorRate*errorPriorReads) / (float64(depth) + errorPriorReads)
+	return math.Min(math.Max(rate, minErrorRate), maxErrorRate)
+}
+
+// altReadsPValue returns the probability of observing >= altReads of depth total reads
+// if each read is an error with probability errorRate. If overdispersion > 0 the
+// reads are modeled as beta-binomial with intra-cell correlation overdispersion.
+func altReadsPValue(altReads int, depth int, errorRate float64, overdispersion float64) float64 {
+	if altReads <= 0 || depth <= 0 {
+		return 1
+	}
+	if altReads > depth {
+		altReads = depth
+	}
+	if overdispersion <= 0 {
+		// upper tail of the binomial is the regularized incomplete beta function
+		return mathext.RegIncBeta(float64(altReads), float64(depth-altReads+1), errorRate)
+	}
+	return betaBinomialUpperTail(altReads, depth, errorRate, overdispersion)
+}
+
+// betaBinomialUpperTail returns P(X >= k) for a beta-binomial distribution with n trials,
+// mean p, and overdispersion rho.
+func betaBinomialUpperTail(k int, n int, p float64, rho float64) float64 {
+	alpha := p * (1 - rho) / rho
+	beta := (1 - p) * (1 - rho) / rho
+	lbetaAB := lbeta(alpha, beta)
+	var answer float64
+	for x := k; x <= n; x++ {
+		answer += math.Exp(lchoose(n, x) + lbeta(float64(x)+alpha, float64(n-x)+beta) - lbetaAB)
+	}
+	return math.Min(answer, 1)
+}
+
+// lbeta returns the log of the beta function.
+func lbeta(a, b float64) float64 {
+	la, _ := math.Lgamma(a)
+	lb, _ := math.Lgamma(b)
+	lab, _ := math.Lgamma(a + b)
+	return la + lb - lab
+}
+
+// lchoose returns the log of n choose k.
+func lchoose(n, k int) float64 {
+	ln, _ := math.Lgamma(float64(n + 1))
+	lk, _ := math.Lgamma(float64(k + 1))
+	lnk, _ := math.Lgamma(float64(n - k + 1))
+	return ln - lk - lnk
+}
@@ -1,6 +1,9 @@
 package cells
 
-import "github.com/ddsnellings/weaver/variants"
+import (
+	"github.com/ddsnellings/weaver/variants"
+	"log"
+)
 
 var DefaultVcfQual float64 = 100
 var DefaultCellFilter = CellFilterParam{MinGenotypeQuality: 30, MinGenotypeDepth: 10, MinReadAf: 0.2}
@@ -9,9 +12,13 @@ var DefaultGlobalFilter = GlobalFilterParam{MinGenotypedFrac: 0.5, MinGenotypesP
 // CellFilterParam defines the minimum values used for filtering cell.
 // These filters are applied on a per-cell basis
 type CellFilterParam struct {
-	MinGenotypeQuality int     // remove genotype in cell with quality < MinGenotypeQuality // Default 30
-	MinGenotypeDepth   int     // remove genotype in cell with read depth < MinGenotypeDepth // Default 10
-	MinReadAf          float64 // remove genotype in cell with alternate allele frequency < MinCellAf // Default 0.2
+	MinGenotypeQuality int            // remove genotype in cell with quality < MinGenotypeQuality // Default 30
+	MinGenotypeDepth   int            // remove genotype in cell with read depth < MinGenotypeDepth // Default 10
+	MinReadAf          float64        // remove genotype in cell with alternate allele frequency < MinCellAf // Default 0.2
+	Caller             GenotypeCaller // method used to call genotypes in each cell // Default AfThreshold
+	MinPosterior       float64        // remove genotype in cell with max posterior < MinPosterior. Likelihood caller only
+	MaxPValue          float64        // cell is mutated if p-value of alt reads under the site error rate < MaxPValue. Binomial caller only
+	Overdispersion     float64        // beta-binomial overdispersion of alt reads. 0 uses a binomial test. Binomial caller only
 }
 
 // GlobalFilterParam defines minimum values used for filtering cells and variants.
@@ -57,7 +64,7 @@ func applyMinGenotypesPresent(d *Data, f GlobalFilterParam, ignoreCells []bool,
 			continue
 		}
 
-		if countPassingCellVar(d.Cells[i].Genotypes, ignoreVariants)/passingVariants < f.MinGenotypesPresent {
+		if countPassingCellVar(d, ignoreVariants)/passingVariants < f.MinGenotypesPresent {
 			ignoreCells[i] = true
 		}
 	}
@@ -77,29 +84,50 @@ func applyMinCellAf(d *Data, f GlobalFilterParam, ignoreCells []bool, ignoreVari
 	}
 }
 
+// RemoveCells removes each cell where remove[cellId] is true and updates the Ids and
+// statistics of the remaining cells and variants.
+func (d *Data) RemoveCells(remove []bool) {
+	if len(remove) != len(d.Cells) {
+		log.Panicf("RemoveCells requires a value for each of %d cells, found %d", len(d.Cells), len(remove))
+	}
+	removeFailing(d, remove, make([]bool, len(d.Variants)))
+}
+
 // removeFailing removes all cells and variants which were determined should be ignored
 func removeFailing(d *Data, ignoreCells []bool, ignoreVariants []bool) {
-	passingCells, passingVariants, newCellIds, newVariantIds := fetchPassingCellsAndVariants(d, ignoreCells, ignoreVariants)
+	passingCells, passingVariants, newCellIds, _ := fetchPassingCellsAndVariants(d, ignoreCells, ignoreVariants)
+	if d.Genotypes != nil {
+		d.Genotypes = updateGenotypes(d.Genotypes, ignoreCells, ignoreVariants)
+	}
 	d.Cells = passingCells
 	d.Variants = passingVariants
 
-	totalCells := float64(len(d.Cells))
-	totalVariants := float64(len(d.Variants))
-
-	// update fields inside cells
-	for i := range d.Cells {
-		d.Cells[i].Genotypes = updateCellVar(d.Cells[i].Genotypes, ignoreVariants, newVariantIds)
-		d.Cells[i].GenotypesPresent = float64(len(d.Cells[i].Genotypes)) / totalVariants
-	}
-
 	// update fields inside variants
 	for i := range d.Variants {
 		d.Variants[i].CellsGenotyped = updateCellIds(d.Variants[i].CellsGenotyped, ignoreCells, newCellIds)
 		d.Variants[i].CellsMutated = updateCellIds(d.Variants[i].CellsMutated, ignoreCells, newCellIds)
+	}
+	updateStats(d)
+}
+
+// updateStats recomputes the fractions and allele frequencies stored in each cell and variant
+// from the Genotypes, CellsGenotyped, and CellsMutated fields. GenotypesPresent is the fraction
+// of variants with a CellVar stored for the cell.
+func updateStats(d *Data) {
+	totalCells := float64(len(d.Cells))
+	totalVariants := float64(len(d.Variants))
+	for i := range d.Variants {
 		d.Variants[i].GenotypedFrac = float64(len(d.Variants[i].CellsGenotyped)) / totalCells
 		d.Variants[i].CellsMutatedFrac = float64(len(d.Variants[i].CellsMutated)) / float64(len(d.Variants[i].CellsGenotyped))
 		d.Variants[i].CellAf = getCellAf(d, i)
 	}
+	var stored int // variants with a stored CellVar for each cell
+	if d.Genotypes != nil {
+		stored = d.Genotypes.NumVariants()
+	}
+	for i := range d.Cells {
+		d.Cells[i].GenotypesPresent = float64(stored) / totalVariants
+	}
 }
 
 // getCellAf determines the mutant alleles/WT alleles for a single variant
@@ -107,7 +135,7 @@ func getCellAf(d *Data, Vid int) float64 {
 	var total, mutant int
 	for _, cellId := range d.Variants[Vid].CellsGenotyped {
 		total += 2 // TODO HEMIZYGOSITY
-		mutant += zygosityToInt(d.Cells[cellId].Genotypes[Vid].Genotype)
+		mutant += zygosityToInt(d.Genotype(cellId, Vid))
 	}
 	return float64(mutant) / float64(total)
 }
@@ -124,20 +152,27 @@ func zygosityToInt(z variants.Zygosity) int {
 	case variants.Hemizygous:
 		return 1
 	default:
-		panic("zygosity not found in genotyped cell")
+		log.Panicf("zygosity not found in genotyped cell")
 		return 0
 	}
 }
 
-// updateCellVar updates the CellVar slice in each Variant after removing variants during filtering
-func updateCellVar(cellVars []variants.CellVar, ignoreVariants []bool, newVariantIds []int) []variants.CellVar {
-	answer := make([]variants.CellVar, 0, len(cellVars))
-	for _, currCv := range cellVars {
-		if ignoreVariants[currCv.Vid] {
-			continue
+// updateGenotypes returns the genotypes of the cells and variants remaining after filtering
+func updateGenotypes(s *GenotypeStore, ignoreCells []bool, ignoreVariants []bool) *GenotypeStore {
+	var vids, cellIds []int
+	for vid := 0; vid < s.NumVariants(); vid++ {
+		if !ignoreVariants[vid] {
+			vids = append(vids, vid)
 		}
-		currCv.Vid = newVariantIds[currCv.Vid]
-		answer = append(answer, currCv)
+	}
+	for i := range ignoreCells {
+		if !ignoreCells[i] {
+			cellIds = append(cellIds, i)
+		}
+	}
+	answer := s.SelectVariants(vids)
+	if len(cellIds) < len(ignoreCells) {
+		answer = answer.SelectCells(cellIds)
 	}
 	return answer
 }
@@ -196,11 +231,15 @@ func countFalse(b []bool) float64 {
 	return answer
 }
 
-// countPassingCellVar returns a float64 with the number of CellVar passing filters
-func countPassingCellVar(v []variants.CellVar, ignoreVariants []bool) float64 {
+// countPassingCellVar returns the number of variants not removed by ignoreVariants as a float64.
+// Every cell stores a CellVar for each variant, so the count is the same for all cells.
+func countPassingCellVar(d *Data, ignoreVariants []bool) float64 {
 	var answer float64
-	for i := range v {
-		if !ignoreVariants[v[i].Vid] {
+	if d.Genotypes == nil {
+		return answer
+	}
+	for vid := 0; vid < d.Genotypes.NumVariants(); vid++ {
+		if !ignoreVariants[vid] {
 			answer++
 		}
 	}
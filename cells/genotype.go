@@ -0,0 +1,257 @@
+package cells
+
+import (
+	"github.com/ddsnellings/weaver/variants"
+	"github.com/vertgenlab/gonomics/vcf"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// GenotypeCaller selects the method used to call genotypes in each cell.
+type GenotypeCaller byte
+
+const (
+	AfThreshold GenotypeCaller = iota // cell is mutated if Af > MinReadAf, otherwise WildType
+	Likelihood                        // genotype with max posterior from PL/GL, or read counts if missing, and a pseudobulk prior
+	Binomial                          // cell is mutated if alt reads are unlikely under a per-site error rate
+)
+
+// String returns the name of the caller.
+func (c GenotypeCaller) String() string {
+	switch c {
+	case AfThreshold:
+		return "AfThreshold"
+	case Likelihood:
+		return "Likelihood"
+	case Binomial:
+		return "Binomial"
+	default:
+		return "GenotypeCaller(" + strconv.Itoa(int(c)) + ")"
+	}
+}
+
+// GenotypeCallerByName returns the caller with the input name (case insensitive).
+func GenotypeCallerByName(name string) GenotypeCaller {
+	for _, c := range []GenotypeCaller{AfThreshold, Likelihood, Binomial} {
+		if strings.EqualFold(c.String(), name) {
+			return c
+		}
+	}
+	log.Panicf("unknown genotype caller '%s'. options are: AfThreshold, Likelihood, Binomial", name)
+	return AfThreshold
+}
+
+// minPriorAf bounds the pseudobulk allele frequency used to build genotype priors
+// so that no genotype is given a prior probability of zero.
+const minPriorAf = 0.001
+
+// callFromLikelihoods sets the Genotype and Posterior of each CellVar using the
+// genotype likelihoods (PL or GL) in the vcf record. The prior for each genotype is
+// determined from the pseudobulk allele frequency of the variant assuming Hardy-Weinberg
+// equilibrium. Samples without diploid likelihoods are left with an empty Posterior.
+//
+// Records without PL or GL fields are called from read counts (see CallFromReadCounts) with the
+// error rate estimated as for the Binomial caller, and true is returned.
+func callFromLikelihoods(v vcf.Vcf, cellVars []variants.CellVar, alleleIdx int, cellFilter CellFilterParam) bool {
+	plIdx := formatIdx(v.Format, "PL")
+	glIdx := formatIdx(v.Format, "GL")
+	if plIdx == -1 && glIdx == -1 {
+		CallFromReadCounts(cellVars, estimateErrorRate(cellVars, cellFilter))
+		return true
+	}
+
+	prior := genotypePrior(pseudobulkAf(cellVars))
+	numAlleles := len(v.Alt) + 1
+	var likelihoods [3]float64
+	var ok bool
+	for i := range v.Samples {
+		if v.Samples[i].AlleleOne == -1 && v.Samples[i].AlleleTwo == -1 {
+			continue
+		}
+		if plIdx != -1 {
+			likelihoods, ok = alleleLikelihoods(v.Samples[i].FormatData, plIdx, numAlleles, alleleIdx+1, plToLikelihood)
+		} else {
+			likelihoods, ok = alleleLikelihoods(v.Samples[i].FormatData, glIdx, numAlleles, alleleIdx+1, glToLikelihood)
+		}
+		if !ok {
+			continue
+		}
+		cellVars[i].Posterior = posterior(likelihoods, prior)
+		cellVars[i].Genotype = maxPosteriorGenotype(cellVars[i].Posterior)
+	}
+	return false
+}
+
+// warnFromReadCounts logs a warning if numAlleles alleles in file were called from read counts
+// by the Likelihood caller because their records have no PL or GL fields.
+func warnFromReadCounts(file string, numAlleles int) {
+	if numAlleles > 0 {
+		log.Printf("WARNING: %d alleles in '%s' have no PL or GL fields. the Likelihood caller called their genotypes from read counts", numAlleles, file)
+	}
+}
+
+// CallFromLogLikelihoods sets the Posterior, Genotype, and GenotypeQuality of each CellVar from
+// logLikelihoods[i], the natural log likelihood of the reads in cell i given 0, 1, or 2 copies of
+// the alt allele. The prior is determined from the pseudobulk allele frequency as for vcf likelihoods.
+// CellVars with no reads are skipped.
+func CallFromLogLikelihoods(cellVars []variants.CellVar, logLikelihoods [][3]float64) {
+	prior := genotypePrior(pseudobulkAf(cellVars))
+	var likelihoods [3]float64
+	var max float64
+	for i := range cellVars {
+		if cellVars[i].ReadDepth == 0 {
+			continue
+		}
+		max = math.Max(logLikelihoods[i][0], math.Max(logLikelihoods[i][1], logLikelihoods[i][2]))
+		for g := range likelihoods {
+			likelihoods[g] = math.Exp(logLikelihoods[i][g] - max)
+		}
+		cellVars[i].Posterior = posterior(likelihoods, prior)
+		cellVars[i].Genotype = maxPosteriorGenotype(cellVars[i].Posterior)
+		cellVars[i].GenotypeQuality = phredQuality(1 - maxPosterior(cellVars[i]))
+	}
+}
+
+// CallFromReadCounts sets the Posterior, Genotype, and GenotypeQuality of each CellVar from its
+// AltReads and ReadDepth as in CallFromLogLikelihoods, for inputs without genotype calls such as
+// allele count matrices. Each read is assumed to show the wrong allele with probability errorRate,
+// which must be > 0 and < 0.5.
+func CallFromReadCounts(cellVars []variants.CellVar, errorRate float64) {
+	if errorRate <= 0 || errorRate >= 0.5 {
+		log.Panicf("errorRate must be > 0 and < 0.5, found %v", errorRate)
+	}
+	logLikelihoods := make([][3]float64, len(cellVars))
+	var p float64
+	var ref int
+	for i := range cellVars {
+		ref = cellVars[i].ReadDepth - cellVars[i].AltReads
+		for g := range logLikelihoods[i] {
+			p = float64(g)/2*(1-errorRate) + (1-float64(g)/2)*errorRate // probability a read shows the alt allele
+			logLikelihoods[i][g] = float64(cellVars[i].AltReads)*math.Log(p) + float64(ref)*math.Log(1-p)
+		}
+	}
+	CallFromLogLikelihoods(cellVars, logLikelihoods)
+}
+
+// maxGenotypeQuality is the greatest GenotypeQuality set by CallFromLogLikelihoods, as in GATK.
+const maxGenotypeQuality = 99
+
+// phredQuality converts an error probability to a phred-scaled quality capped at maxGenotypeQuality.
+func phredQuality(errProb float64) int {
+	if errProb <= 0 {
+		return maxGenotypeQuality
+	}
+	return int(math.Min(math.Round(-10*math.Log10(errProb)), maxGenotypeQuality))
+}
+
+// formatIdx returns the index of key in the vcf format field, or -1 if key is not present.
+func formatIdx(format []string, key string) int {
+	for i := range format {
+		if format[i] == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// pseudobulkAf returns the fraction of alternate reads pooled across all cells.
+func pseudobulkAf(cellVars []variants.CellVar) float64 {
+	var alt, depth int
+	for i := range cellVars {
+		alt += cellVars[i].AltReads
+		depth += cellVars[i].ReadDepth
+	}
+	if depth == 0 {
+		return minPriorAf
+	}
+	return float64(alt) / float64(depth)
+}
+
+// genotypePrior returns the Hardy-Weinberg prior probability of WildType,
+// Heterozygous, and Homozygous genotypes for a variant with allele frequency af.
+func genotypePrior(af float64) [3]float64 {
+	af = math.Min(math.Max(af, minPriorAf), 1-minPriorAf)
+	return [3]float64{(1 - af) * (1 - af), 2 * af * (1 - af), af * af}
+}
+
+// plToLikelihood converts a phred-scaled likelihood to a likelihood.
+func plToLikelihood(pl float64) float64 {
+	return math.Pow(10, -pl/10)
+}
+
+// glToLikelihood converts a log10-scaled likelihood to a likelihood.
+func glToLikelihood(gl float64) float64 {
+	return math.Pow(10, gl)
+}
+
+// alleleLikelihoods collapses the likelihoods of all diploid genotypes in a multi-allelic
+// record into the likelihood of carrying 0, 1, or 2 copies of the allele at alleleIdx.
+// Genotypes are ordered as in the vcf specification such that genotype j/k is at index
+// k*(k+1)/2 + j. Returns false if the likelihood field is missing or not diploid.
+func alleleLikelihoods(formatData []string, fieldIdx int, numAlleles int, alleleIdx int, convert func(float64) float64) ([3]float64, bool) {
+	var answer [3]float64
+	if fieldIdx >= len(formatData) {
+		return answer, false
+	}
+	fields := strings.Split(formatData[fieldIdx], ",")
+	if len(fields) != numAlleles*(numAlleles+1)/2 {
+		return answer, false
+	}
+
+	var copies int
+	var val float64
+	var err error
+	for k := 0; k < numAlleles; k++ {
+		for j := 0; j <= k; j++ {
+			val, err = strconv.ParseFloat(fields[k*(k+1)/2+j], 64)
+			if err != nil {
+				return answer, false
+			}
+			copies = 0
+			if j == alleleIdx {
+				copies++
+			}
+			if k == alleleIdx {
+				copies++
+			}
+			answer[copies] += convert(val)
+		}
+	}
+	return answer, true
+}
+
+// posterior combines genotype likelihoods and priors into normalized posterior probabilities.
+func posterior(likelihoods [3]float64, prior [3]float64) [3]float64 {
+	var answer [3]float64
+	var total float64
+	for i := range answer {
+		answer[i] = likelihoods[i] * prior[i]
+		total += answer[i]
+	}
+	if total == 0 {
+		return [3]float64{}
+	}
+	for i := range answer {
+		answer[i] /= total
+	}
+	return answer
+}
+
+// maxPosteriorGenotype returns the genotype with the greatest posterior probability.
+func maxPosteriorGenotype(p [3]float64) variants.Zygosity {
+	switch {
+	case p[0] >= p[1] && p[0] >= p[2]:
+		return variants.WildType
+	case p[1] >= p[2]:
+		return variants.Heterozygous
+	default:
+		return variants.Homozygous
+	}
+}
+
+// maxPosterior returns the posterior probability of the called genotype.
+func maxPosterior(cv variants.CellVar) float64 {
+	return math.Max(cv.Posterior[0], math.Max(cv.Posterior[1], cv.Posterior[2]))
+}
@@ -0,0 +1,133 @@
+package cells
+
+import (
+	"github.com/ddsnellings/weaver/variants"
+	"github.com/vertgenlab/gonomics/vcf"
+	"math"
+	"testing"
+)
+
+func TestLikelihoodCaller(t *testing.T) {
+	format := []string{"GT", "AD", "DP", "GQ", "PL"}
+	record := vcf.Vcf{
+		Chr:    "chr1",
+		Pos:    10,
+		Ref:    "A",
+		Alt:    []string{"C"},
+		Qual:   1000,
+		Format: format,
+		Samples: vcf.ParseNotes("0/0:50,0:50:99:0,150,1500\t"+
+			"0/1:25,25:50:99:300,0,300\t"+
+			"1/1:0,50:50:99:1500,150,0\t"+
+			"0/1:45,5:50:99:3,0,200", format),
+	}
+
+	cellFilter := CellFilterParam{MinGenotypeQuality: 30, MinGenotypeDepth: 10, Caller: Likelihood, MinPosterior: 0.9}
+	data := &Data{Cells: make([]Cell, 4)}
+	parseVcf(record, cellFilter, nil, Gatk, data)
+
+	expectedGenotypes := []variants.Zygosity{variants.WildType, variants.Heterozygous, variants.Homozygous, variants.Heterozygous}
+	for i := range data.Cells {
+		cv := data.CellVar(i, 0)
+		if cv.Genotype != expectedGenotypes[i] {
+			t.Errorf("cell %d: expected genotype %s, found %s", i, expectedGenotypes[i], cv.Genotype)
+		}
+		if !cv.HasPosterior() {
+			t.Errorf("cell %d: missing posterior", i)
+		}
+	}
+
+	if !equalInt(data.Variants[0].CellsGenotyped, []int{0, 1, 2}) {
+		t.Errorf("expected cells genotyped %v, found %v", []int{0, 1, 2}, data.Variants[0].CellsGenotyped)
+	}
+	if !equalInt(data.Variants[0].CellsMutated, []int{1, 2}) {
+		t.Errorf("expected cells mutated %v, found %v", []int{1, 2}, data.Variants[0].CellsMutated)
+	}
+	if dosage := data.CellVar(2, 0).Dosage(); dosage < 1.99 {
+		t.Errorf("expected dosage near 2, found %f", dosage)
+	}
+}
+
+func TestLikelihoodCallerWithoutPL(t *testing.T) {
+	format := []string{"GT", "AD", "DP", "GQ"}
+	record := vcf.Vcf{
+		Chr:    "chr1",
+		Pos:    10,
+		Ref:    "A",
+		Alt:    []string{"C"},
+		Qual:   1000,
+		Format: format,
+		Samples: vcf.ParseNotes("0/0:50,0:50:99\t"+
+			"0/1:25,25:50:99\t"+
+			"1/1:0,50:50:99", format),
+	}
+	cellFilter := CellFilterParam{MinGenotypeQuality: 30, MinGenotypeDepth: 10, Caller: Likelihood, MinPosterior: 0.9}
+	data := &Data{Cells: make([]Cell, 3)}
+	if fromReads := parseVcf(record, cellFilter, nil, Gatk, data); fromReads != 1 {
+		t.Errorf("expected 1 allele called from read counts, found %d", fromReads)
+	}
+	expectedGenotypes := []variants.Zygosity{variants.WildType, variants.Heterozygous, variants.Homozygous}
+	for i := range data.Cells {
+		if cv := data.CellVar(i, 0); cv.Genotype != expectedGenotypes[i] || !cv.HasPosterior() {
+			t.Errorf("cell %d: expected genotype %s with a posterior, found %+v", i, expectedGenotypes[i], cv)
+		}
+	}
+	if !equalInt(data.Variants[0].CellsGenotyped, []int{0, 1, 2}) {
+		t.Errorf("expected cells genotyped %v, found %v", []int{0, 1, 2}, data.Variants[0].CellsGenotyped)
+	}
+}
+
+func TestAlleleLikelihoods(t *testing.T) {
+	// 3 alleles: genotype order 0/0, 0/1, 1/1, 0/2, 1/2, 2/2
+	formatData := []string{"", "0,10,20,30,40,50"}
+	answer, ok := alleleLikelihoods(formatData, 1, 3, 2, func(f float64) float64 { return f })
+	if !ok {
+		t.Fatal("could not parse likelihoods")
+	}
+	expected := [3]float64{0 + 10 + 20, 30 + 40, 50}
+	if answer != expected {
+		t.Errorf("expected %v, found %v", expected, answer)
+	}
+}
+
+func TestBinomialCaller(t *testing.T) {
+	format := []string{"GT", "AD", "DP", "GQ"}
+	notes := "0/0:100,30:130:99"
+	for i := 0; i < 10; i++ {
+		notes += "\t0/0:99,1:100:99"
+	}
+	notes += "\t0/1:98,2:100:99"
+	record := vcf.Vcf{Chr: "chr1", Pos: 10, Ref: "A", Alt: []string{"C"}, Qual: 1000, Format: format, Samples: vcf.ParseNotes(notes, format)}
+
+	cellFilter := CellFilterParam{MinGenotypeQuality: 30, MinGenotypeDepth: 10, MinReadAf: 0.2, Caller: Binomial, MaxPValue: 0.001}
+	data := &Data{Cells: make([]Cell, len(record.Samples))}
+	parseVcf(record, cellFilter, nil, Gatk, data)
+
+	errorRate := data.Variants[0].ErrorRate
+	if errorRate <= 0.005 || errorRate >= 0.01 {
+		t.Errorf("expected error rate between prior and observed rate, found %f", errorRate)
+	}
+	if !equalInt(data.Variants[0].CellsMutated, []int{0}) {
+		t.Errorf("expected cells mutated %v, found %v", []int{0}, data.Variants[0].CellsMutated)
+	}
+	if data.CellVar(0, 0).Genotype != variants.Heterozygous {
+		t.Errorf("expected mutated cell to be Het, found %s", data.CellVar(0, 0).Genotype)
+	}
+	if data.CellVar(11, 0).Genotype != variants.WildType {
+		t.Errorf("expected cell with error-level alt reads to be Ref, found %s", data.CellVar(11, 0).Genotype)
+	}
+}
+
+func TestAltReadsPValue(t *testing.T) {
+	if p := altReadsPValue(10, 10, 0.5, 0); math.Abs(p-1.0/1024) > 1e-12 {
+		t.Errorf("expected binomial p-value %g, found %g", 1.0/1024, p)
+	}
+	binom := altReadsPValue(5, 100, 0.01, 0)
+	betaBinom := altReadsPValue(5, 100, 0.01, 1e-6)
+	if math.Abs(binom-betaBinom)/binom > 0.01 {
+		t.Errorf("beta-binomial with low overdispersion should approximate binomial: %g vs %g", betaBinom, binom)
+	}
+	if overdispersed := altReadsPValue(5, 100, 0.01, 0.05); overdispersed <= binom {
+		t.Errorf("overdispersion should increase p-value: %g vs %g", overdispersed, binom)
+	}
+}
@@ -0,0 +1,40 @@
+package cells
+
+import (
+	"github.com/ddsnellings/weaver/interval"
+	"github.com/ddsnellings/weaver/variants"
+)
+
+// VariantIndex provides lookup of the variants in a Data by Key and by genomic coordinate.
+// The index stores variant Ids and must be rebuilt after variants are filtered or subset.
+type VariantIndex struct {
+	keys map[string]int
+	tree *interval.Tree
+}
+
+// Index builds a VariantIndex for the variants in d.
+func (d *Data) Index() *VariantIndex {
+	answer := &VariantIndex{keys: make(map[string]int, len(d.Variants))}
+	regions := make([]variants.Region, len(d.Variants))
+	for vid, v := range d.Variants {
+		answer.keys[v.Key()] = vid
+		regions[vid] = v.Region()
+	}
+	answer.tree = interval.NewTree(regions)
+	return answer
+}
+
+// Lookup returns the Id of the variant with the input Key and true, or -1 and false if
+// the variant is not present.
+func (idx *VariantIndex) Lookup(key string) (int, bool) {
+	vid, found := idx.keys[key]
+	if !found {
+		return -1, false
+	}
+	return vid, true
+}
+
+// Overlapping returns the Ids of all variants overlapping r sorted by position (see variants.Variant.Region).
+func (idx *VariantIndex) Overlapping(r variants.Region) []int {
+	return idx.tree.Query(r)
+}
@@ -0,0 +1,53 @@
+package cells
+
+import (
+	"github.com/ddsnellings/weaver/variants"
+	"github.com/vertgenlab/gonomics/dna"
+	"testing"
+)
+
+func TestIndex(t *testing.T) {
+	d := &Data{Variants: []variants.Variant{
+		{Id: 0, Chr: "chr2", Pos: 10, Ref: dna.StringToBases("A"), Alt: dna.StringToBases("g")},
+		{Id: 1, Chr: "chr1", Pos: 50, Ref: dna.StringToBases("ACGT"), Alt: dna.StringToBases("")},
+		{Id: 2, Chr: "chr1", Pos: 20, Ref: dna.StringToBases("C"), Alt: dna.StringToBases("T")},
+		{Id: 3, Chr: "chr1", Pos: 52, Ref: dna.StringToBases(""), Alt: dna.StringToBases("TT")},
+	}}
+	idx := d.Index()
+	if vid, found := idx.Lookup("chr2:10:A:G"); !found || vid != 0 {
+		t.Errorf("expected variant 0 for key chr2:10:A:G, found %d", vid)
+	}
+	if _, found := idx.Lookup("chr2:10:A:T"); found {
+		t.Errorf("found key for missing variant")
+	}
+
+	tests := []struct {
+		region   variants.Region
+		expected []int
+	}{
+		{variants.Region{Chr: "chr1", Start: 0, End: 100}, []int{2, 1, 3}},
+		{variants.Region{Chr: "chr1", Start: 21, End: 51}, []int{1}},
+		{variants.Region{Chr: "chr1", Start: 53, End: 60}, []int{1}},
+		{variants.Region{Chr: "chr1", Start: 54, End: 60}, nil},
+		{variants.Region{Chr: "chr3", Start: 0, End: 100}, nil},
+	}
+	var found []int
+	for _, test := range tests {
+		found = idx.Overlapping(test.region)
+		if len(found) != len(test.expected) {
+			t.Errorf("expected %v in %v, found %v", test.expected, test.region, found)
+			continue
+		}
+		for i := range found {
+			if found[i] != test.expected[i] {
+				t.Errorf("expected %v in %v, found %v", test.expected, test.region, found)
+				break
+			}
+		}
+	}
+
+	sub := d.Subset(nil, []int{1, 2})
+	if vid, _ := sub.Index().Lookup(d.Variants[2].Key()); sub.Variants[vid].Key() != d.Variants[2].Key() {
+		t.Errorf("variant key changed after subset")
+	}
+}
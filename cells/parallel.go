@@ -0,0 +1,117 @@
+package cells
+
+import (
+	"bufio"
+	"github.com/ddsnellings/weaver/parallel"
+	"github.com/ddsnellings/weaver/tabix"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"io"
+	"strings"
+)
+
+// recordBatchSize is the number of vcf records parsed together by a worker.
+const recordBatchSize = 64
+
+// recordBatch is a batch of vcf records and the alleles parsed from them.
+type recordBatch struct {
+	lines   []string
+	alleles []parsedAllele
+	done    chan struct{} // closed when alleles are parsed
+}
+
+// readVcfParallel reads a vcf as in ReadVcfWithParam with p.Workers goroutines. bgzip-compressed
+// blocks are decompressed and records are parsed by the workers, then the alleles are added to
+// Data in file order so the result is identical to reading serially. Normalization against
+// p.Reference is done in file order as the reference may not be safe for concurrent use.
+func readVcfParallel(file string, p ReadParam) *Data {
+	workers := parallel.NumWorkers(p.Workers)
+	in := openVcf(file, workers)
+	defer in.Close()
+	reader := bufio.NewReaderSize(in, 1<<20)
+
+	var header []string
+	var line string
+	var done bool
+	for line, done = nextLine(reader); !done && strings.HasPrefix(line, "#"); line, done = nextLine(reader) {
+		header = append(header, line)
+	}
+	answer, adapter := newData(header, p)
+
+	jobs := make(chan *recordBatch, workers)
+	ordered := make(chan *recordBatch, 4*workers)
+	go func() {
+		batch := &recordBatch{done: make(chan struct{})}
+		for ; !done; line, done = nextLine(reader) {
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			batch.lines = append(batch.lines, line)
+			if len(batch.lines) == recordBatchSize {
+				ordered <- batch
+				jobs <- batch
+				batch = &recordBatch{done: make(chan struct{})}
+			}
+		}
+		if len(batch.lines) > 0 {
+			ordered <- batch
+			jobs <- batch
+		}
+		close(ordered)
+		close(jobs)
+	}()
+
+	for w := 0; w < workers; w++ {
+		go func() {
+			for batch := range jobs {
+				for _, line := range batch.lines {
+					record := parseVcfLine(line, file)
+					if record.Qual > p.MinVcfQual {
+						batch.alleles = append(batch.alleles, parseAlleles(record, p.CellFilter, adapter)...)
+					}
+				}
+				close(batch.done)
+			}
+		}()
+	}
+
+	var fromReads int
+	var ok bool
+	for batch := range ordered {
+		<-batch.done
+		for _, allele := range batch.alleles {
+			if p.Reference != nil {
+				if allele.variant, ok = NormalizeVariant(allele.variant, p.Reference); !ok {
+					continue
+				}
+			}
+			if allele.fromReads {
+				fromReads++
+			}
+			answer.AddVariant(allele.variant, allele.cellVars, p.CellFilter)
+		}
+	}
+	warnFromReadCounts(file, fromReads)
+
+	p.GlobalFilter.Apply(answer)
+	return answer
+}
+
+// openVcf returns a reader of the uncompressed vcf. bgzip-compressed files are decompressed by
+// workers goroutines, other gzip files are decompressed by a single goroutine.
+func openVcf(file string, workers int) io.ReadCloser {
+	if strings.HasSuffix(file, ".gz") && tabix.IsBgzf(file) {
+		return tabix.OpenBgzf(file, workers)
+	}
+	return fileio.EasyOpen(file)
+}
+
+// nextLine returns the next line without the trailing newline, and true at the end of the file.
+func nextLine(r *bufio.Reader) (string, bool) {
+	line, err := r.ReadString('\n')
+	if err == io.EOF {
+		return strings.TrimSuffix(line, "\r"), line == ""
+	}
+	exception.PanicOnErr(err)
+	return strings.TrimSuffix(line[:len(line)-1], "\r"), false
+}
@@ -0,0 +1,113 @@
+package cells
+
+import (
+	"fmt"
+	"github.com/ddsnellings/weaver/tabix"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"io"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeRandomVcf writes a vcf with random genotypes and allele counts for numCells cells at
+// numRecords sites. Files ending in .bgz.gz are bgzip-compressed, other files ending in .gz are
+// gzip-compressed.
+func writeRandomVcf(file string, numCells int, numRecords int, seed int64) {
+	rng := rand.New(rand.NewSource(seed))
+	var out io.WriteCloser
+	if strings.HasSuffix(file, ".bgz.gz") {
+		out = tabix.NewWriter(file)
+	} else {
+		out = fileio.EasyCreate(file)
+	}
+	var b strings.Builder
+	b.WriteString("##fileformat=VCFv4.2\n##contig=<ID=chr1,length=248956422>\n##contig=<ID=chr2,length=242193529>\n")
+	b.WriteString("#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT")
+	for i := 0; i < numCells; i++ {
+		fmt.Fprintf(&b, "\tcell%d", i)
+	}
+	b.WriteByte('\n')
+	_, err := io.WriteString(out, b.String())
+	exception.PanicOnErr(err)
+
+	var ref, alt, other, depth int
+	for i := 0; i < numRecords; i++ {
+		b.Reset()
+		chr := "chr1"
+		if i >= numRecords/2 {
+			chr = "chr2"
+		}
+		fmt.Fprintf(&b, "%s\t%d\t.\tA\t", chr, 100*(i%(numRecords/2))+1)
+		multiallelic := i%5 == 0
+		if multiallelic {
+			b.WriteString("C,T")
+		} else {
+			b.WriteString("G")
+		}
+		fmt.Fprintf(&b, "\t%d\tPASS\t.\tGT:AD:DP:GQ:PL", 50+rng.Intn(2000))
+		for c := 0; c < numCells; c++ {
+			ref, alt, other = rng.Intn(60), rng.Intn(30), 0
+			if multiallelic {
+				other = rng.Intn(20)
+			}
+			depth = ref + alt + other + 1
+			switch {
+			case !multiallelic && alt > ref:
+				fmt.Fprintf(&b, "\t1/1:%d,%d:%d:%d:900,%d,0", ref, alt, depth, rng.Intn(100), rng.Intn(200))
+			case !multiallelic:
+				fmt.Fprintf(&b, "\t0/1:%d,%d:%d:%d:%d,0,%d", ref, alt, depth, rng.Intn(100), rng.Intn(200), rng.Intn(900))
+			default:
+				fmt.Fprintf(&b, "\t1/2:%d,%d,%d:%d:%d:900,%d,900,%d,0,900", ref, alt, other, depth, rng.Intn(100), rng.Intn(200), rng.Intn(200))
+			}
+		}
+		b.WriteByte('\n')
+		_, err = io.WriteString(out, b.String())
+		exception.PanicOnErr(err)
+	}
+	exception.PanicOnErr(out.Close())
+}
+
+func TestReadVcfParallel(t *testing.T) {
+	dir := t.TempDir()
+	for _, suffix := range []string{".vcf", ".vcf.gz", ".vcf.bgz.gz"} {
+		file := filepath.Join(dir, "weaver.parallel"+suffix)
+		writeRandomVcf(file, 50, 3*recordBatchSize+7, 1)
+		for _, caller := range []GenotypeCaller{AfThreshold, Likelihood, Binomial} {
+			p := DefaultReadParam
+			p.CellFilter.Caller = caller
+			p.GlobalFilter = GlobalFilterParam{}
+			p.Workers = 1
+			serial := ReadVcfWithParam(file, p)
+			if len(serial.Variants) == 0 {
+				t.Errorf("%s: no variants read", file)
+			}
+			for _, workers := range []int{2, 3, 8} {
+				p.Workers = workers
+				if parallel := ReadVcfWithParam(file, p); !reflect.DeepEqual(serial, parallel) {
+					t.Errorf("%s: reading with %d workers and caller %v differs from serial", file, workers, caller)
+				}
+			}
+		}
+	}
+}
+
+func benchmarkReadVcf(b *testing.B, workers int) {
+	file := filepath.Join(b.TempDir(), "weaver.benchmark.vcf.bgz.gz")
+	writeRandomVcf(file, 2000, 500, 1)
+	p := DefaultReadParam
+	p.Workers = workers
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ReadVcfWithParam(file, p)
+	}
+}
+
+func BenchmarkReadVcf1(b *testing.B)  { benchmarkReadVcf(b, 1) }
+func BenchmarkReadVcf2(b *testing.B)  { benchmarkReadVcf(b, 2) }
+func BenchmarkReadVcf4(b *testing.B)  { benchmarkReadVcf(b, 4) }
+func BenchmarkReadVcf8(b *testing.B)  { benchmarkReadVcf(b, 8) }
+func BenchmarkReadVcf16(b *testing.B) { benchmarkReadVcf(b, 16) }
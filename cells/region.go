@@ -0,0 +1,68 @@
+package cells
+
+import (
+	"github.com/ddsnellings/weaver/interval"
+	"github.com/ddsnellings/weaver/tabix"
+	"github.com/ddsnellings/weaver/variants"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/vcf"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// ReadVcfRegions reads the records of a bgzip-compressed vcf that overlap regions into a Data
+// struct as in ReadVcfWithParam, using the tabix (.tbi) or .csi index of the file to skip the rest
+// of the file. Overlapping regions are merged and each record is read once. Variants are ordered
+// by region with contigs in the order of the vcf header (see Data.Contigs).
+func ReadVcfRegions(file string, regions []variants.Region, p ReadParam) *Data {
+	r := tabix.Open(file)
+	defer r.Close()
+	answer, adapter := newData(r.Header(), p)
+	var record vcf.Vcf
+	var region, prev variants.Region
+	var fromReads int
+	read := func(line string) {
+		record = parseVcfLine(line, file)
+		if record.Pos-1 < region.Start && record.Pos-1 < prev.End && variants.CanonicalChr(record.Chr) == variants.CanonicalChr(prev.Chr) {
+			return // already read in the previous region
+		}
+		if len(record.Samples) != len(answer.Cells) {
+			log.Panicf("expected %d samples in '%s', found %d in record at %s:%d", len(answer.Cells), file, len(record.Samples), record.Chr, record.Pos)
+		}
+		if record.Qual > p.MinVcfQual {
+			fromReads += parseVcf(record, p.CellFilter, p.Reference, adapter, answer)
+		}
+	}
+	merged := interval.Merge(regions)
+	answer.Contigs.SortRegions(merged)
+	for _, region = range merged {
+		r.Query(region, read)
+		prev = region
+	}
+	warnFromReadCounts(file, fromReads)
+
+	p.GlobalFilter.Apply(answer)
+	return answer
+}
+
+// parseVcfLine parses a vcf record as in vcf.GoReadToChan.
+func parseVcfLine(line string, file string) vcf.Vcf {
+	fields := strings.SplitN(line, "\t", 10)
+	if len(fields) < 9 {
+		log.Panicf("expected at least 9 columns in '%s', found line: %s", file, line)
+	}
+	answer := vcf.Vcf{Chr: fields[0], Id: fields[2], Ref: fields[3], Alt: strings.Split(fields[4], ","),
+		Filter: fields[6], Info: fields[7], Format: strings.Split(fields[8], ":"), Qual: 255}
+	var err error
+	answer.Pos, err = strconv.Atoi(fields[1])
+	exception.PanicOnErr(err)
+	if fields[5] != "." {
+		answer.Qual, err = strconv.ParseFloat(fields[5], 64)
+		exception.PanicOnErr(err)
+	}
+	if len(fields) > 9 {
+		answer.Samples = vcf.ParseNotes(fields[9], answer.Format)
+	}
+	return answer
+}
@@ -0,0 +1,48 @@
+package cells
+
+import (
+	"github.com/ddsnellings/weaver/tabix"
+	"github.com/ddsnellings/weaver/variants"
+	"github.com/vertgenlab/gonomics/exception"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadVcfRegions(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "weaver.small.vcf.gz")
+	b, err := ioutil.ReadFile("testdata/small.vcf")
+	exception.PanicOnErr(err)
+	w := tabix.NewWriter(file)
+	_, err = w.Write(b)
+	exception.PanicOnErr(err)
+	exception.PanicOnErr(w.Close())
+	tabix.BuildIndex(file)
+
+	p := ReadParam{CellFilter: defaultCellFilter, GlobalFilter: defaultGlobalFilter, MinVcfQual: defaultVcfQual}
+	data := ReadVcfRegions(file, []variants.Region{{Chr: "chr1", Start: 0, End: 2}, {Chr: "1", Start: 1, End: 10}}, p)
+	if !equal(&expectedData, data) {
+		t.Errorf("problem with indexed vcf readin")
+	}
+
+	data = ReadVcfRegions(file, []variants.Region{{Chr: "chr1", Start: 2, End: 3}}, p)
+	if len(data.Variants) != 2 || data.Variants[0].Pos != 2 {
+		t.Errorf("expected 2 alleles at chr1:3, found %d", len(data.Variants))
+	}
+
+	// regions are read in the contig order of the header
+	lines := "##fileformat=VCFv4.2\n##contig=<ID=chr2,length=1000>\n##contig=<ID=chr1,length=1000>\n" +
+		"#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\ta\n" +
+		"chr2\t5\t.\tA\tG\t500\tPASS\t.\tGT:AD:DP:GQ\t0/1:10,10:20:50\n" +
+		"chr1\t5\t.\tC\tT\t500\tPASS\t.\tGT:AD:DP:GQ\t0/1:10,10:20:50\n"
+	w = tabix.NewWriter(file)
+	_, err = w.Write([]byte(lines))
+	exception.PanicOnErr(err)
+	exception.PanicOnErr(w.Close())
+	tabix.BuildIndex(file)
+	p.GlobalFilter = GlobalFilterParam{}
+	data = ReadVcfRegions(file, []variants.Region{{Chr: "chr1", Start: 0, End: 10}, {Chr: "chr2", Start: 0, End: 10}}, p)
+	if len(data.Variants) != 2 || data.Variants[0].Chr != "chr2" || data.Variants[1].Chr != "chr1" {
+		t.Errorf("expected variants on chr2 then chr1, found %v", data.Variants)
+	}
+}
@@ -0,0 +1,589 @@
+package cells
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/ddsnellings/weaver/variants"
+	"github.com/vertgenlab/gonomics/dna"
+	"github.com/vertgenlab/gonomics/exception"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// SnapshotVersion is the version of the snapshot format written by SaveSnapshot. Snapshots with
+// a different version cannot be loaded and are replaced by ReadVcfCached.
+const SnapshotVersion = 1
+
+// snapshotMagic begins every snapshot file.
+var snapshotMagic = [8]byte{'W', 'V', 'R', 'S', 'N', 'A', 'P', 0}
+
+// SnapshotInfo records how the Data in a snapshot was read, so a snapshot can be reused only
+// when the input vcf and read options are unchanged.
+type SnapshotInfo struct {
+	Version      int    // format version. see SnapshotVersion
+	Input        string // vcf the data was read from
+	Checksum     [sha256.Size]byte
+	CellFilter   CellFilterParam
+	GlobalFilter GlobalFilterParam
+	MinVcfQual   float64
+	Adapter      string            // name of ReadParam.Adapter. empty if detected from the vcf header
+	Normalized   bool              // variants were normalized against ReadParam.Reference
+	Reference    string            // fasta file of ReadParam.Reference if it has a Name, as reference.Fasta does
+	FastaIndex   [sha256.Size]byte // sha256 of the index of the Reference fasta. zero if the index is not found
+	Sparse       bool
+}
+
+// NewSnapshotInfo returns the SnapshotInfo of Data read from input with ReadVcfWithParam and p.
+// The checksum is the sha256 of the input file. The reference used to normalize variants is
+// recorded by its file name and the sha256 of its fasta index, which lists the contigs and their
+// lengths, rather than the sha256 of the whole fasta.
+func NewSnapshotInfo(input string, p ReadParam) SnapshotInfo {
+	answer := SnapshotInfo{
+		Version:      SnapshotVersion,
+		Input:        input,
+		Checksum:     fileChecksum(input),
+		CellFilter:   p.CellFilter,
+		GlobalFilter: p.GlobalFilter,
+		MinVcfQual:   p.MinVcfQual,
+		Normalized:   p.Reference != nil,
+		Sparse:       p.Sparse,
+	}
+	if p.Adapter != nil {
+		answer.Adapter = p.Adapter.Name()
+	}
+	if named, ok := p.Reference.(interface{ Name() string }); ok {
+		answer.Reference = named.Name()
+		if _, err := os.Stat(answer.Reference + ".fai"); err == nil {
+			answer.FastaIndex = fileChecksum(answer.Reference + ".fai")
+		}
+	}
+	return answer
+}
+
+// ReadVcfCached returns the Data read from file with ReadVcfWithParam and p. If cache is a
+// snapshot of file read with the same options, the Data is loaded from the snapshot. Otherwise,
+// including when cache cannot be read or is not a valid snapshot, the vcf is read and saved to
+// cache for later calls.
+func ReadVcfCached(file string, cache string, p ReadParam) *Data {
+	info := NewSnapshotInfo(file, p)
+	if answer, ok := loadCached(cache, info); ok {
+		return answer
+	}
+	answer := ReadVcfWithParam(file, p)
+	SaveSnapshot(cache, answer, info)
+	return answer
+}
+
+// loadCached returns the Data in the snapshot cache if it can be read and was saved with info.
+func loadCached(cache string, info SnapshotInfo) (answer *Data, ok bool) {
+	b, err := ioutil.ReadFile(cache)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("WARNING: could not read snapshot, reading the vcf: %v", err)
+		}
+		return nil, false
+	}
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("WARNING: could not load snapshot, reading the vcf: %v", err)
+			answer, ok = nil, false
+		}
+	}()
+	r := &snapshotReader{b: b, file: cache}
+	if r.version() != SnapshotVersion || r.info() != info {
+		return nil, false
+	}
+	return r.data(), true
+}
+
+// SaveSnapshot writes d and info to file in a versioned binary format that can be loaded with
+// LoadSnapshot. All values are little-endian and each array of genotype values begins at a
+// multiple of 8 bytes. The snapshot is written to a temporary file in the same directory and
+// renamed to file when complete, so readers never see a partial snapshot.
+func SaveSnapshot(file string, d *Data, info SnapshotInfo) {
+	out, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	exception.PanicOnErr(err)
+	exception.PanicOnErr(out.Chmod(0644))
+	defer func() {
+		if err := recover(); err != nil {
+			out.Close()
+			os.Remove(out.Name())
+			log.Panic(err)
+		}
+	}()
+	w := &snapshotWriter{w: bufio.NewWriterSize(out, 1<<20)}
+	info.Version = SnapshotVersion
+	w.bytes(snapshotMagic[:])
+	w.int(info.Version)
+	w.info(info)
+	w.contigs(d.Contigs)
+	w.cells(d.Cells)
+	w.variants(d.Variants)
+	w.genotypes(d.Genotypes)
+	exception.PanicOnErr(w.w.Flush())
+	exception.PanicOnErr(out.Close())
+	exception.PanicOnErr(os.Rename(out.Name(), file))
+}
+
+// LoadSnapshot reads the Data and SnapshotInfo saved to file by SaveSnapshot. The file is read
+// into memory with a single read and decoded, which avoids parsing the vcf but is not
+// memory-mapped, so loading a snapshot briefly uses memory for both the file and the Data.
+func LoadSnapshot(file string) (*Data, SnapshotInfo) {
+	b, err := ioutil.ReadFile(file)
+	exception.PanicOnErr(err)
+	r := &snapshotReader{b: b, file: file}
+	if version := r.version(); version != SnapshotVersion {
+		log.Panicf("%s: snapshot version %d is not supported. expected version %d", file, version, SnapshotVersion)
+	}
+	info := r.info()
+	return r.data(), info
+}
+
+// fileChecksum returns the sha256 of file.
+func fileChecksum(file string) [sha256.Size]byte {
+	var answer [sha256.Size]byte
+	in, err := os.Open(file)
+	exception.PanicOnErr(err)
+	h := sha256.New()
+	_, err = io.Copy(h, in)
+	exception.PanicOnErr(err)
+	exception.PanicOnErr(in.Close())
+	copy(answer[:], h.Sum(nil))
+	return answer
+}
+
+// Genotype column flags in a snapshot.
+const (
+	sparseColumn byte = 1 << iota
+	hasPosterior
+	hasPValue
+	hasConfidence
+	hasBackgroundReads
+)
+
+// snapshotWriter writes the values of a snapshot. Scalars are written as 8 bytes and arrays are
+// padded to a multiple of 8 bytes.
+type snapshotWriter struct {
+	w   *bufio.Writer
+	buf [8]byte
+}
+
+func (w *snapshotWriter) uint(val uint64) {
+	binary.LittleEndian.PutUint64(w.buf[:], val)
+	_, err := w.w.Write(w.buf[:])
+	exception.PanicOnErr(err)
+}
+
+func (w *snapshotWriter) int(val int) {
+	w.uint(uint64(val))
+}
+
+func (w *snapshotWriter) float(val float64) {
+	w.uint(math.Float64bits(val))
+}
+
+func (w *snapshotWriter) bool(val bool) {
+	if val {
+		w.uint(1)
+	} else {
+		w.uint(0)
+	}
+}
+
+// bytes writes b followed by padding to a multiple of 8 bytes. The length is not written.
+func (w *snapshotWriter) bytes(b []byte) {
+	_, err := w.w.Write(b)
+	exception.PanicOnErr(err)
+	_, err = w.w.Write(w.buf[:padding(len(b))])
+	exception.PanicOnErr(err)
+}
+
+func (w *snapshotWriter) string(s string) {
+	w.int(len(s))
+	w.bytes([]byte(s))
+}
+
+func (w *snapshotWriter) bases(s []dna.Base) {
+	b := make([]byte, len(s))
+	for i := range s {
+		b[i] = byte(s[i])
+	}
+	w.int(len(b))
+	w.bytes(b)
+}
+
+// ints writes s as int32.
+func (w *snapshotWriter) ints(s []int) {
+	b := make([]byte, 4*len(s))
+	for i := range s {
+		binary.LittleEndian.PutUint32(b[4*i:], uint32(s[i]))
+	}
+	w.int(len(s))
+	w.bytes(b)
+}
+
+func (w *snapshotWriter) int32s(s []int32) {
+	b := make([]byte, 4*len(s))
+	for i := range s {
+		binary.LittleEndian.PutUint32(b[4*i:], uint32(s[i]))
+	}
+	w.bytes(b)
+}
+
+func (w *snapshotWriter) uint16s(s []uint16) {
+	b := make([]byte, 2*len(s))
+	for i := range s {
+		binary.LittleEndian.PutUint16(b[2*i:], s[i])
+	}
+	w.bytes(b)
+}
+
+func (w *snapshotWriter) floats(s []float64) {
+	for i := range s {
+		w.float(s[i])
+	}
+}
+
+func (w *snapshotWriter) info(info SnapshotInfo) {
+	w.string(info.Input)
+	w.bytes(info.Checksum[:])
+	w.int(info.CellFilter.MinGenotypeQuality)
+	w.int(info.CellFilter.MinGenotypeDepth)
+	w.float(info.CellFilter.MinReadAf)
+	w.int(int(info.CellFilter.Caller))
+	w.float(info.CellFilter.MinPosterior)
+	w.float(info.CellFilter.MaxPValue)
+	w.float(info.CellFilter.Overdispersion)
+	w.float(info.GlobalFilter.MinGenotypedFrac)
+	w.float(info.GlobalFilter.MinGenotypesPresent)
+	w.float(info.GlobalFilter.MinCellAf)
+	w.float(info.MinVcfQual)
+	w.string(info.Adapter)
+	w.bool(info.Normalized)
+	w.string(info.Reference)
+	w.bytes(info.FastaIndex[:])
+	w.bool(info.Sparse)
+}
+
+func (w *snapshotWriter) contigs(c *variants.Contigs) {
+	w.bool(c != nil)
+	if c == nil {
+		return
+	}
+	w.int(len(c.Names))
+	for i := range c.Names {
+		w.string(c.Names[i])
+		w.int(c.Lengths[i])
+	}
+}
+
+func (w *snapshotWriter) cells(c []Cell) {
+	w.int(len(c))
+	for i := range c {
+		w.int(c[i].Id)
+		w.string(c[i].Name)
+		w.float(c[i].GenotypesPresent)
+		w.string(c[i].Batch)
+	}
+}
+
+func (w *snapshotWriter) variants(v []variants.Variant) {
+	w.int(len(v))
+	for i := range v {
+		w.int(v[i].Id)
+		w.string(v[i].Chr)
+		w.int(v[i].Pos)
+		w.bases(v[i].Ref)
+		w.bases(v[i].Alt)
+		w.ints(v[i].CellsGenotyped)
+		w.ints(v[i].CellsMutated)
+		w.float(v[i].GenotypedFrac)
+		w.float(v[i].CellsMutatedFrac)
+		w.float(v[i].CellAf)
+		w.float(v[i].ErrorRate)
+		w.string(v[i].Original)
+		w.int(v[i].PhaseSet)
+		w.int(v[i].PhaseHap)
+		w.int(v[i].Record.Pos)
+		w.string(v[i].Record.Ref)
+		w.string(v[i].Record.Alt)
+	}
+}
+
+func (w *snapshotWriter) genotypes(s *GenotypeStore) {
+	w.bool(s != nil)
+	if s == nil {
+		return
+	}
+	w.bool(s.Sparse)
+	w.int(s.numCells)
+	w.int(len(s.columns))
+	for _, col := range s.columns {
+		var flags byte
+		if col.cells != nil {
+			flags |= sparseColumn
+		}
+		if col.posterior != nil {
+			flags |= hasPosterior
+		}
+		if col.pValue != nil {
+			flags |= hasPValue
+		}
+		if col.confidence != nil {
+			flags |= hasConfidence
+		}
+		if col.bgQuality != nil {
+			flags |= hasBackgroundReads
+		}
+		w.uint(uint64(flags) | uint64(col.background)<<8)
+		w.int(len(col.codes))
+		if col.cells != nil {
+			w.int32s(col.cells)
+		}
+		w.bytes(col.codes)
+		w.bytes(col.quality)
+		w.uint16s(col.depth)
+		w.uint16s(col.alt)
+		for _, p := range col.posterior {
+			w.floats(p[:])
+		}
+		w.floats(col.pValue)
+		w.floats(col.confidence)
+		if col.bgQuality != nil {
+			w.bytes(col.bgQuality)
+			w.uint16s(col.bgDepth)
+			w.bytes(col.bgAlt)
+		}
+	}
+}
+
+// snapshotReader reads the values written by snapshotWriter from the bytes of a snapshot.
+type snapshotReader struct {
+	b    []byte
+	off  int
+	file string
+}
+
+// next returns the next n bytes and skips the padding after them.
+func (r *snapshotReader) next(n int) []byte {
+	if n < 0 || r.off+n+padding(n) > len(r.b) {
+		log.Panicf("%s: snapshot is truncated or corrupt", r.file)
+	}
+	answer := r.b[r.off : r.off+n]
+	r.off += n + padding(n)
+	return answer
+}
+
+// count returns the number of elements of an array, each of which is stored in at least size
+// bytes. count panics if the rest of the snapshot is too short for the array, so a corrupt
+// snapshot does not cause a large allocation.
+func (r *snapshotReader) count(size int) int {
+	n := r.int()
+	if n < 0 || n > (len(r.b)-r.off)/size {
+		log.Panicf("%s: snapshot is truncated or corrupt", r.file)
+	}
+	return n
+}
+
+func (r *snapshotReader) uint() uint64 {
+	return binary.LittleEndian.Uint64(r.next(8))
+}
+
+func (r *snapshotReader) int() int {
+	return int(int64(r.uint()))
+}
+
+func (r *snapshotReader) float() float64 {
+	return math.Float64frombits(r.uint())
+}
+
+func (r *snapshotReader) bool() bool {
+	return r.uint() != 0
+}
+
+func (r *snapshotReader) string() string {
+	return string(r.next(r.int()))
+}
+
+func (r *snapshotReader) bases() []dna.Base {
+	b := r.next(r.int())
+	answer := make([]dna.Base, len(b))
+	for i := range b {
+		answer[i] = dna.Base(b[i])
+	}
+	return answer
+}
+
+func (r *snapshotReader) ints() []int {
+	n := r.int()
+	b := r.next(4 * n)
+	answer := make([]int, n)
+	for i := range answer {
+		answer[i] = int(int32(binary.LittleEndian.Uint32(b[4*i:])))
+	}
+	return answer
+}
+
+func (r *snapshotReader) int32s(n int) []int32 {
+	b := r.next(4 * n)
+	answer := make([]int32, n)
+	for i := range answer {
+		answer[i] = int32(binary.LittleEndian.Uint32(b[4*i:]))
+	}
+	return answer
+}
+
+func (r *snapshotReader) uint16s(n int) []uint16 {
+	b := r.next(2 * n)
+	answer := make([]uint16, n)
+	for i := range answer {
+		answer[i] = binary.LittleEndian.Uint16(b[2*i:])
+	}
+	return answer
+}
+
+func (r *snapshotReader) floats(s []float64) {
+	for i := range s {
+		s[i] = r.float()
+	}
+}
+
+// version checks the magic bytes of the snapshot and returns its version.
+func (r *snapshotReader) version() int {
+	if len(r.b) < len(snapshotMagic) || string(r.next(len(snapshotMagic))) != string(snapshotMagic[:]) {
+		log.Panicf("%s is not a snapshot", r.file)
+	}
+	return r.int()
+}
+
+func (r *snapshotReader) info() SnapshotInfo {
+	answer := SnapshotInfo{Version: SnapshotVersion}
+	answer.Input = r.string()
+	copy(answer.Checksum[:], r.next(sha256.Size))
+	answer.CellFilter.MinGenotypeQuality = r.int()
+	answer.CellFilter.MinGenotypeDepth = r.int()
+	answer.CellFilter.MinReadAf = r.float()
+	answer.CellFilter.Caller = GenotypeCaller(r.int())
+	answer.CellFilter.MinPosterior = r.float()
+	answer.CellFilter.MaxPValue = r.float()
+	answer.CellFilter.Overdispersion = r.float()
+	answer.GlobalFilter.MinGenotypedFrac = r.float()
+	answer.GlobalFilter.MinGenotypesPresent = r.float()
+	answer.GlobalFilter.MinCellAf = r.float()
+	answer.MinVcfQual = r.float()
+	answer.Adapter = r.string()
+	answer.Normalized = r.bool()
+	answer.Reference = r.string()
+	copy(answer.FastaIndex[:], r.next(sha256.Size))
+	answer.Sparse = r.bool()
+	return answer
+}
+
+// data reads the Data following the SnapshotInfo.
+func (r *snapshotReader) data() *Data {
+	answer := new(Data)
+	if r.bool() {
+		n := r.count(16)
+		names, lengths := make([]string, n), make([]int, n)
+		for i := range names {
+			names[i] = r.string()
+			lengths[i] = r.int()
+		}
+		answer.Contigs = variants.NewContigs(names, lengths)
+	}
+
+	answer.Cells = make([]Cell, r.count(32))
+	for i := range answer.Cells {
+		answer.Cells[i].Id = r.int()
+		answer.Cells[i].Name = r.string()
+		answer.Cells[i].GenotypesPresent = r.float()
+		answer.Cells[i].Batch = r.string()
+	}
+
+	answer.Variants = make([]variants.Variant, r.count(8))
+	for i := range answer.Variants {
+		v := &answer.Variants[i]
+		v.Id = r.int()
+		v.Chr = r.string()
+		v.Pos = r.int()
+		v.Ref = r.bases()
+		v.Alt = r.bases()
+		v.CellsGenotyped = r.ints()
+		v.CellsMutated = r.ints()
+		v.GenotypedFrac = r.float()
+		v.CellsMutatedFrac = r.float()
+		v.CellAf = r.float()
+		v.ErrorRate = r.float()
+		v.Original = r.string()
+		v.PhaseSet = r.int()
+		v.PhaseHap = r.int()
+		v.Record.Pos = r.int()
+		v.Record.Ref = r.string()
+		v.Record.Alt = r.string()
+	}
+
+	if r.bool() {
+		sparse := r.bool()
+		answer.Genotypes = NewGenotypeStore(r.int(), sparse)
+		if answer.Genotypes.numCells != len(answer.Cells) {
+			log.Panicf("%s: snapshot has genotypes of %d cells, expected %d", r.file, answer.Genotypes.numCells, len(answer.Cells))
+		}
+		answer.Genotypes.columns = make([]genotypeColumn, r.count(16))
+		for i := range answer.Genotypes.columns {
+			answer.Genotypes.columns[i] = r.column(answer.Genotypes.numCells)
+		}
+		if len(answer.Genotypes.columns) != len(answer.Variants) {
+			log.Panicf("%s: snapshot has genotypes of %d variants, expected %d", r.file, len(answer.Genotypes.columns), len(answer.Variants))
+		}
+	}
+	if r.off != len(r.b) {
+		log.Panicf("%s: found %d unexpected bytes at the end of the snapshot", r.file, len(r.b)-r.off)
+	}
+	return answer
+}
+
+// column reads a genotype column of numCells cells.
+func (r *snapshotReader) column(numCells int) genotypeColumn {
+	var col genotypeColumn
+	header := r.uint()
+	flags := byte(header)
+	col.background = byte(header >> 8)
+	n := r.int()
+	if flags&sparseColumn != 0 {
+		col.cells = r.int32s(n)
+	}
+	col.codes = append([]byte(nil), r.next(n)...)
+	col.quality = append([]uint8(nil), r.next(n)...)
+	col.depth = r.uint16s(n)
+	col.alt = r.uint16s(n)
+	if flags&hasPosterior != 0 {
+		col.posterior = make([][3]float64, n)
+		for i := range col.posterior {
+			r.floats(col.posterior[i][:])
+		}
+	}
+	if flags&hasPValue != 0 {
+		col.pValue = make([]float64, n)
+		r.floats(col.pValue)
+	}
+	if flags&hasConfidence != 0 {
+		col.confidence = make([]float64, n)
+		r.floats(col.confidence)
+	}
+	if flags&hasBackgroundReads != 0 {
+		col.bgQuality = append([]uint8(nil), r.next(numCells)...)
+		col.bgDepth = r.uint16s(numCells)
+		col.bgAlt = append([]uint8(nil), r.next(numCells)...)
+	}
+	return col
+}
+
+// padding returns the number of bytes after n bytes to reach a multiple of 8.
+func padding(n int) int {
+	return (8 - n%8) % 8
+}
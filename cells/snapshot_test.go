@@ -0,0 +1,124 @@
+package cells
+
+import (
+	"github.com/ddsnellings/weaver/reference"
+	"github.com/vertgenlab/gonomics/exception"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "weaver.snapshot.vcf")
+	cache := filepath.Join(dir, "weaver.snapshot.vcf.snap")
+	writeRandomVcf(file, 200, 40, 1)
+
+	p := DefaultReadParam
+	p.GlobalFilter = GlobalFilterParam{}
+	p.CellFilter.Caller = Likelihood
+	p.Sparse = true
+	expected := ReadVcfWithParam(file, p)
+	expected.Cells[3].Batch = "run2"
+	expected.Variants[1].PhaseSet = 100
+	SaveSnapshot(cache, expected, NewSnapshotInfo(file, p))
+
+	d, info := LoadSnapshot(cache)
+	if !reflect.DeepEqual(expected.Cells, d.Cells) || !reflect.DeepEqual(expected.Contigs, d.Contigs) ||
+		!reflect.DeepEqual(expected.Genotypes, d.Genotypes) || !equal(expected, d) {
+		t.Errorf("data loaded from snapshot differs from saved data")
+	}
+	if d.Variants[1].PhaseSet != 100 {
+		t.Errorf("expected PhaseSet 100 in loaded data, found %d", d.Variants[1].PhaseSet)
+	}
+	if info != NewSnapshotInfo(file, p) {
+		t.Errorf("expected snapshot info %+v, found %+v", NewSnapshotInfo(file, p), info)
+	}
+
+	// sparse columns with wild-type cells with reads
+	expected.Genotypes = NewGenotypeStore(len(expected.Cells), true)
+	for _, cellVars := range wildTypeCellVars(len(expected.Cells), len(expected.Variants), 0.05, 5) {
+		expected.Genotypes.AppendVariant(cellVars)
+	}
+	SaveSnapshot(cache, expected, NewSnapshotInfo(file, p))
+	if d, _ = LoadSnapshot(cache); !reflect.DeepEqual(expected.Genotypes, d.Genotypes) {
+		t.Errorf("genotypes loaded from snapshot differ from saved genotypes")
+	}
+
+	// the cache is used if the input and options are unchanged
+	if d = ReadVcfCached(file, cache, p); d.Cells[3].Batch != "run2" {
+		t.Errorf("expected data to be loaded from the cache")
+	}
+	p.CellFilter.MinGenotypeDepth++
+	if d = ReadVcfCached(file, cache, p); d.Cells[3].Batch != "" || !equal(ReadVcfWithParam(file, p), d) {
+		t.Errorf("expected the vcf to be read when the filter changed")
+	}
+	if d = ReadVcfCached(file, cache, p); !equal(ReadVcfWithParam(file, p), d) {
+		t.Errorf("expected the updated cache to match the vcf")
+	}
+	writeRandomVcf(file, 200, 40, 2)
+	if d = ReadVcfCached(file, cache, p); !equal(ReadVcfWithParam(file, p), d) {
+		t.Errorf("expected the vcf to be read when the input changed")
+	}
+
+	b, err := ioutil.ReadFile(cache)
+	exception.PanicOnErr(err)
+	b[8]++ // version
+	exception.PanicOnErr(ioutil.WriteFile(cache, b, 0644))
+	if d = ReadVcfCached(file, cache, p); !equal(ReadVcfWithParam(file, p), d) {
+		t.Errorf("expected the vcf to be read when the snapshot version changed")
+	}
+
+	// corrupt snapshots are replaced
+	b, err = ioutil.ReadFile(cache)
+	exception.PanicOnErr(err)
+	for _, corrupt := range [][]byte{b[:len(b)/2], b[:5], append(b, 0)} {
+		exception.PanicOnErr(ioutil.WriteFile(cache, corrupt, 0644))
+		if d = ReadVcfCached(file, cache, p); !equal(ReadVcfWithParam(file, p), d) {
+			t.Errorf("expected the vcf to be read when the snapshot is corrupt")
+		}
+		if _, info = LoadSnapshot(cache); info != NewSnapshotInfo(file, p) {
+			t.Errorf("expected the corrupt snapshot to be replaced")
+		}
+	}
+	tmp, err := filepath.Glob(cache + ".tmp*")
+	exception.PanicOnErr(err)
+	if len(tmp) > 0 {
+		t.Errorf("expected temporary snapshots to be removed, found %v", tmp)
+	}
+}
+
+func TestSnapshotInfoReference(t *testing.T) {
+	dir := t.TempDir()
+	fasta := filepath.Join(dir, "weaver.snapshot.fa")
+	exception.PanicOnErr(ioutil.WriteFile(fasta, []byte(">chr1\nACGTACGT\n"), 0644))
+	exception.PanicOnErr(ioutil.WriteFile(fasta+".fai", []byte("chr1\t8\t6\t8\t9\n"), 0644))
+	ref := reference.Open(fasta)
+	defer ref.Close()
+
+	file := filepath.Join(dir, "weaver.snapshot.reference.vcf")
+	writeRandomVcf(file, 10, 10, 1)
+	p := DefaultReadParam
+	p.Reference = ref
+	info := NewSnapshotInfo(file, p)
+	if info.Reference != fasta || info.FastaIndex != fileChecksum(fasta+".fai") {
+		t.Errorf("expected reference %s in snapshot info, found %+v", fasta, info)
+	}
+	exception.PanicOnErr(ioutil.WriteFile(fasta+".fai", []byte("chr1\t8\t6\t4\t5\n"), 0644))
+	if NewSnapshotInfo(file, p) == info {
+		t.Errorf("expected snapshot info to change with the fasta index")
+	}
+}
+
+func BenchmarkLoadSnapshot(b *testing.B) {
+	dir := b.TempDir()
+	file := filepath.Join(dir, "weaver.benchmark.vcf.bgz.gz")
+	cache := filepath.Join(dir, "weaver.benchmark.snap")
+	writeRandomVcf(file, 2000, 500, 1)
+	SaveSnapshot(cache, ReadVcfWithParam(file, DefaultReadParam), NewSnapshotInfo(file, DefaultReadParam))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		LoadSnapshot(cache)
+	}
+}
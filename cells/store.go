@@ -0,0 +1,415 @@
+package cells
+
+import (
+	"github.com/ddsnellings/weaver/variants"
+	"log"
+	"math"
+	"sort"
+)
+
+// GenotypeStore stores the CellVar of each cell at each variant in a compact column for each
+// variant. Genotype and Imputed are packed into a single byte, GenotypeQuality is stored in a
+// uint8, ReadDepth and AltReads in uint16 (larger values are capped), and Af is computed from
+// the read counts. Posterior, PValue, and Confidence are only stored for variants where a cell
+// has a non-zero value.
+//
+// If Sparse is set, variants where most cells have the same genotype, such as WildType or
+// NoGenotype, store the read depth, alt reads, and GenotypeQuality of those cells in 4 bytes per
+// cell (or nothing if none of them have reads), and a full entry only for the cells that differ.
+// Sparse storage does not change the values returned by Get.
+//
+// Data stores genotypes in a GenotypeStore and most callers should use the Data accessors
+// (see Data.CellVar and Data.SetCellVar). Get may be called concurrently, but Set and
+// AppendVariant may reallocate a column and must not run concurrently with any other call.
+type GenotypeStore struct {
+	Sparse   bool
+	numCells int
+	columns  []genotypeColumn
+}
+
+// genotypeColumn stores the genotypes of a single variant. Dense columns store an entry for
+// each cell. Sparse columns store an entry for each cell in cells, and cells without an entry
+// have the background genotype and the read counts in bgQuality, bgDepth, and bgAlt.
+type genotypeColumn struct {
+	cells      []int32  // cells with an entry in increasing order. nil if dense
+	background byte     // code of cells without an entry. sparse only
+	bgQuality  []uint8  // GenotypeQuality of each cell without an entry. nil if all are 0. sparse only
+	bgDepth    []uint16 // ReadDepth of each cell without an entry. nil with bgQuality
+	bgAlt      []uint8  // AltReads of each cell without an entry. nil with bgQuality
+	codes      []byte   // Genotype and Imputed flag
+	quality    []uint8
+	depth      []uint16
+	alt        []uint16
+	posterior  [][3]float64 // nil if no entry has a posterior
+	pValue     []float64    // nil if no entry has a p-value
+	confidence []float64    // nil if no entry has a confidence
+}
+
+// imputedFlag is set in the genotype code of imputed entries.
+const imputedFlag byte = 0x80
+
+// Bytes used by each cell in a column. Sparse columns use less memory than dense columns when
+// sparseEntryBytes*entries (+ backgroundBytes*cells if cells without an entry have reads) is
+// less than denseEntryBytes*cells.
+const (
+	denseEntryBytes  = 6  // genotype code, quality, depth, and alt reads
+	sparseEntryBytes = 10 // cell Id and a dense entry
+	backgroundBytes  = 4  // quality, depth, and alt reads of a cell without an entry
+)
+
+// NewGenotypeStore returns an empty GenotypeStore for numCells cells.
+func NewGenotypeStore(numCells int, sparse bool) *GenotypeStore {
+	return &GenotypeStore{Sparse: sparse, numCells: numCells}
+}
+
+// NumCells returns the number of cells in s.
+func (s *GenotypeStore) NumCells() int {
+	return s.numCells
+}
+
+// NumVariants returns the number of variants in s.
+func (s *GenotypeStore) NumVariants() int {
+	return len(s.columns)
+}
+
+// Get returns the CellVar of variant vid in cell cellId.
+func (s *GenotypeStore) Get(cellId, vid int) variants.CellVar {
+	col := &s.columns[vid]
+	i, found := col.entry(s.checkCell(cellId))
+	if !found {
+		answer := variants.CellVar{Vid: vid, Genotype: variants.Zygosity(col.background)}
+		if col.bgQuality != nil {
+			answer.GenotypeQuality = int(col.bgQuality[cellId])
+			answer.ReadDepth = int(col.bgDepth[cellId])
+			answer.AltReads = int(col.bgAlt[cellId])
+			if answer.ReadDepth > 0 {
+				answer.Af = float64(answer.AltReads) / float64(answer.ReadDepth)
+			}
+		}
+		return answer
+	}
+	answer := variants.CellVar{
+		Vid:             vid,
+		Genotype:        variants.Zygosity(col.codes[i] &^ imputedFlag),
+		Imputed:         col.codes[i]&imputedFlag != 0,
+		GenotypeQuality: int(col.quality[i]),
+		ReadDepth:       int(col.depth[i]),
+		AltReads:        int(col.alt[i]),
+	}
+	if answer.ReadDepth > 0 {
+		answer.Af = float64(answer.AltReads) / float64(answer.ReadDepth)
+	}
+	if col.posterior != nil {
+		answer.Posterior = col.posterior[i]
+	}
+	if col.pValue != nil {
+		answer.PValue = col.pValue[i]
+	}
+	if col.confidence != nil {
+		answer.Confidence = col.confidence[i]
+	}
+	return answer
+}
+
+// Zygosity returns the Genotype of variant vid in cell cellId. Faster than Get.
+func (s *GenotypeStore) Zygosity(cellId, vid int) variants.Zygosity {
+	col := &s.columns[vid]
+	if i, found := col.entry(s.checkCell(cellId)); found {
+		return variants.Zygosity(col.codes[i] &^ imputedFlag)
+	}
+	return variants.Zygosity(col.background)
+}
+
+// Set stores cv as the CellVar of variant vid in cell cellId. The Vid and Af of cv are ignored.
+func (s *GenotypeStore) Set(cellId, vid int, cv variants.CellVar) {
+	col := &s.columns[vid]
+	i, found := col.entry(s.checkCell(cellId))
+	if !found {
+		if isBackground(cv, col.background) {
+			col.setBackground(cellId, cv, s.numCells)
+			return
+		}
+		i = col.insert(i, int32(cellId))
+	}
+	col.set(i, cv)
+}
+
+// AppendVariant adds a variant with cellVars[cellId] as the CellVar of each cell.
+func (s *GenotypeStore) AppendVariant(cellVars []variants.CellVar) {
+	if len(cellVars) != s.numCells {
+		log.Panicf("GenotypeStore requires a CellVar for each of %d cells, found %d", s.numCells, len(cellVars))
+	}
+	var col genotypeColumn
+	if s.Sparse {
+		col.background = backgroundCode(cellVars)
+		var entries int
+		var reads bool
+		for i := range cellVars {
+			if !isBackground(cellVars[i], col.background) {
+				entries++
+			} else if hasReads(cellVars[i]) {
+				reads = true
+			}
+		}
+		sparseBytes := sparseEntryBytes * entries
+		if reads {
+			sparseBytes += backgroundBytes * len(cellVars)
+		}
+		if sparseBytes < denseEntryBytes*len(cellVars) {
+			col.cells = make([]int32, 0, entries)
+			col.allocate(entries)
+			for cellId := range cellVars {
+				if !isBackground(cellVars[cellId], col.background) {
+					col.cells = append(col.cells, int32(cellId))
+					col.set(len(col.cells)-1, cellVars[cellId])
+				} else if reads {
+					col.setBackground(cellId, cellVars[cellId], len(cellVars))
+				}
+			}
+			s.columns = append(s.columns, col)
+			return
+		}
+	}
+	col.allocate(len(cellVars))
+	for cellId := range cellVars {
+		col.set(cellId, cellVars[cellId])
+	}
+	s.columns = append(s.columns, col)
+}
+
+// SelectVariants returns a new GenotypeStore with the variants in vids in the input order.
+func (s *GenotypeStore) SelectVariants(vids []int) *GenotypeStore {
+	answer := &GenotypeStore{Sparse: s.Sparse, numCells: s.numCells, columns: make([]genotypeColumn, len(vids))}
+	for i, vid := range vids {
+		answer.columns[i] = s.columns[vid].copy()
+	}
+	return answer
+}
+
+// SelectCells returns a new GenotypeStore with the cells in cellIds in the input order.
+func (s *GenotypeStore) SelectCells(cellIds []int) *GenotypeStore {
+	answer := NewGenotypeStore(len(cellIds), s.Sparse)
+	cellVars := make([]variants.CellVar, len(cellIds))
+	for vid := range s.columns {
+		for i, cellId := range cellIds {
+			cellVars[i] = s.Get(cellId, vid)
+		}
+		answer.AppendVariant(cellVars)
+	}
+	return answer
+}
+
+// Bytes returns the approximate memory used by s in bytes.
+func (s *GenotypeStore) Bytes() int {
+	var answer int
+	for _, col := range s.columns {
+		answer += 4*len(col.cells) + len(col.codes) + len(col.quality) + 2*len(col.depth) + 2*len(col.alt) +
+			len(col.bgQuality) + 2*len(col.bgDepth) + len(col.bgAlt) +
+			24*len(col.posterior) + 8*len(col.pValue) + 8*len(col.confidence)
+	}
+	return answer
+}
+
+func (s *GenotypeStore) checkCell(cellId int) int {
+	if cellId < 0 || cellId >= s.numCells {
+		log.Panicf("cell Id %d is out of range for %d cells", cellId, s.numCells)
+	}
+	return cellId
+}
+
+// entry returns the index of the entry of cellId in col and true if the entry exists. For
+// sparse columns without an entry, returns the index where the entry would be inserted.
+func (col *genotypeColumn) entry(cellId int) (int, bool) {
+	if col.cells == nil {
+		return cellId, true
+	}
+	i := sort.Search(len(col.cells), func(i int) bool { return col.cells[i] >= int32(cellId) })
+	return i, i < len(col.cells) && col.cells[i] == int32(cellId)
+}
+
+// copy returns a copy of col that does not share memory with col.
+func (col genotypeColumn) copy() genotypeColumn {
+	answer := genotypeColumn{background: col.background}
+	if col.cells != nil {
+		answer.cells = append(make([]int32, 0, len(col.cells)), col.cells...)
+	}
+	if col.bgQuality != nil {
+		answer.bgQuality = append([]uint8(nil), col.bgQuality...)
+		answer.bgDepth = append([]uint16(nil), col.bgDepth...)
+		answer.bgAlt = append([]uint8(nil), col.bgAlt...)
+	}
+	answer.codes = append([]byte(nil), col.codes...)
+	answer.quality = append([]uint8(nil), col.quality...)
+	answer.depth = append([]uint16(nil), col.depth...)
+	answer.alt = append([]uint16(nil), col.alt...)
+	if col.posterior != nil {
+		answer.posterior = append([][3]float64(nil), col.posterior...)
+	}
+	if col.pValue != nil {
+		answer.pValue = append([]float64(nil), col.pValue...)
+	}
+	if col.confidence != nil {
+		answer.confidence = append([]float64(nil), col.confidence...)
+	}
+	return answer
+}
+
+// allocate makes the slices of n entries that are stored for all columns.
+func (col *genotypeColumn) allocate(n int) {
+	col.codes = make([]byte, n)
+	col.quality = make([]uint8, n)
+	col.depth = make([]uint16, n)
+	col.alt = make([]uint16, n)
+}
+
+// insert adds an empty entry for cellId at index i of a sparse column and returns i.
+func (col *genotypeColumn) insert(i int, cellId int32) int {
+	col.cells = append(col.cells[:i], append([]int32{cellId}, col.cells[i:]...)...)
+	col.codes = append(col.codes[:i], append([]byte{col.background}, col.codes[i:]...)...)
+	col.quality = append(col.quality[:i], append([]uint8{0}, col.quality[i:]...)...)
+	col.depth = append(col.depth[:i], append([]uint16{0}, col.depth[i:]...)...)
+	col.alt = append(col.alt[:i], append([]uint16{0}, col.alt[i:]...)...)
+	if col.posterior != nil {
+		col.posterior = append(col.posterior[:i], append([][3]float64{{}}, col.posterior[i:]...)...)
+	}
+	if col.pValue != nil {
+		col.pValue = append(col.pValue[:i], append([]float64{0}, col.pValue[i:]...)...)
+	}
+	if col.confidence != nil {
+		col.confidence = append(col.confidence[:i], append([]float64{0}, col.confidence[i:]...)...)
+	}
+	return i
+}
+
+// set stores cv in entry i of col.
+func (col *genotypeColumn) set(i int, cv variants.CellVar) {
+	col.codes[i] = byte(cv.Genotype)
+	if cv.Imputed {
+		col.codes[i] |= imputedFlag
+	}
+	col.quality[i] = uint8(clamp(cv.GenotypeQuality, math.MaxUint8))
+	col.depth[i] = uint16(clamp(cv.ReadDepth, math.MaxUint16))
+	col.alt[i] = uint16(clamp(cv.AltReads, math.MaxUint16))
+	if col.posterior == nil && cv.Posterior != [3]float64{} {
+		col.posterior = make([][3]float64, len(col.codes))
+	}
+	if col.posterior != nil {
+		col.posterior[i] = cv.Posterior
+	}
+	if col.pValue == nil && cv.PValue != 0 {
+		col.pValue = make([]float64, len(col.codes))
+	}
+	if col.pValue != nil {
+		col.pValue[i] = cv.PValue
+	}
+	if col.confidence == nil && cv.Confidence != 0 {
+		col.confidence = make([]float64, len(col.codes))
+	}
+	if col.confidence != nil {
+		col.confidence[i] = cv.Confidence
+	}
+}
+
+// setBackground stores the read counts of cv for cellId, a cell without an entry in a sparse
+// column of numCells cells. cv must be a background CellVar (see isBackground).
+func (col *genotypeColumn) setBackground(cellId int, cv variants.CellVar, numCells int) {
+	if col.bgQuality == nil {
+		if !hasReads(cv) {
+			return
+		}
+		col.bgQuality = make([]uint8, numCells)
+		col.bgDepth = make([]uint16, numCells)
+		col.bgAlt = make([]uint8, numCells)
+	}
+	col.bgQuality[cellId] = uint8(clamp(cv.GenotypeQuality, math.MaxUint8))
+	col.bgDepth[cellId] = uint16(clamp(cv.ReadDepth, math.MaxUint16))
+	col.bgAlt[cellId] = uint8(cv.AltReads)
+}
+
+// backgroundCode returns the most common genotype of the cells that can be stored without an
+// entry in a sparse column.
+func backgroundCode(cellVars []variants.CellVar) byte {
+	var counts [variants.Hemizygous + 1]int
+	for i := range cellVars {
+		if isBackground(cellVars[i], byte(cellVars[i].Genotype)) {
+			counts[cellVars[i].Genotype]++
+		}
+	}
+	var answer int
+	for z := range counts {
+		if counts[z] > counts[answer] {
+			answer = z
+		}
+	}
+	return byte(answer)
+}
+
+// isBackground returns true if cv can be stored in a sparse column as a cell without an entry:
+// the genotype is the background, the cell has at most math.MaxUint8 alt reads, and no other
+// fields are set.
+func isBackground(cv variants.CellVar, background byte) bool {
+	return byte(cv.Genotype) == background && !cv.Imputed && cv.AltReads >= 0 && cv.AltReads <= math.MaxUint8 &&
+		cv.Posterior == [3]float64{} && cv.PValue == 0 && cv.Confidence == 0
+}
+
+// hasReads returns true if cv has reads or a GenotypeQuality, which sparse columns store for
+// cells without an entry.
+func hasReads(cv variants.CellVar) bool {
+	return cv.GenotypeQuality > 0 || cv.ReadDepth > 0 || cv.AltReads > 0
+}
+
+// clamp returns val limited to [0, max].
+func clamp(val int, max int) int {
+	switch {
+	case val < 0:
+		return 0
+	case val > max:
+		return max
+	default:
+		return val
+	}
+}
+
+// CellVar returns the CellVar of variant vid in cell cellId.
+func (d *Data) CellVar(cellId, vid int) variants.CellVar {
+	if d.Genotypes == nil || vid >= d.Genotypes.NumVariants() {
+		return variants.CellVar{Vid: vid}
+	}
+	return d.Genotypes.Get(cellId, vid)
+}
+
+// Genotype returns the Genotype of variant vid in cell cellId.
+func (d *Data) Genotype(cellId, vid int) variants.Zygosity {
+	if d.Genotypes == nil || vid >= d.Genotypes.NumVariants() {
+		return variants.NoGenotype
+	}
+	return d.Genotypes.Zygosity(cellId, vid)
+}
+
+// SetCellVar stores cv as the CellVar of variant vid in cell cellId. Genotypes are created for
+// all cells and variants in d if not present, so Data can be built by setting Cells and Variants
+// and then calling SetCellVar.
+func (d *Data) SetCellVar(cellId, vid int, cv variants.CellVar) {
+	if d.Genotypes == nil {
+		d.Genotypes = NewGenotypeStore(len(d.Cells), false)
+	}
+	if vid >= len(d.Variants) {
+		log.Panicf("variant Id %d is out of range for data with %d variants", vid, len(d.Variants))
+	}
+	if d.Genotypes.NumVariants() < len(d.Variants) {
+		empty := make([]variants.CellVar, d.Genotypes.NumCells())
+		for d.Genotypes.NumVariants() < len(d.Variants) {
+			d.Genotypes.AppendVariant(empty)
+		}
+	}
+	d.Genotypes.Set(cellId, vid, cv)
+}
+
+// CellGenotypes returns the CellVar of each variant in cell cellId, indexed by variant Id.
+func (d *Data) CellGenotypes(cellId int) []variants.CellVar {
+	answer := make([]variants.CellVar, len(d.Variants))
+	for vid := range answer {
+		answer[vid] = d.CellVar(cellId, vid)
+	}
+	return answer
+}
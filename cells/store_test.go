@@ -0,0 +1,228 @@
+package cells
+
+import (
+	"github.com/ddsnellings/weaver/variants"
+	"math/rand"
+	"runtime"
+	"testing"
+)
+
+// randomCellVars returns CellVars for numVariants variants in numCells cells. Each cell has reads
+// at a variant with probability covered, cells without reads are WildType.
+func randomCellVars(numCells int, numVariants int, covered float64, seed int64) [][]variants.CellVar {
+	rng := rand.New(rand.NewSource(seed))
+	answer := make([][]variants.CellVar, numVariants)
+	for vid := range answer {
+		answer[vid] = make([]variants.CellVar, numCells)
+		for i := range answer[vid] {
+			cv := &answer[vid][i]
+			cv.Vid = vid
+			cv.Genotype = variants.WildType
+			if rng.Float64() >= covered {
+				continue
+			}
+			cv.ReadDepth = 1 + rng.Intn(100)
+			cv.AltReads = rng.Intn(cv.ReadDepth + 1)
+			cv.Af = float64(cv.AltReads) / float64(cv.ReadDepth)
+			cv.GenotypeQuality = rng.Intn(100)
+			cv.Genotype = variants.Zygosity(1 + rng.Intn(3))
+			if vid%3 == 0 {
+				cv.Posterior = [3]float64{0.1, 0.2, 0.7}
+			}
+		}
+	}
+	return answer
+}
+
+// wildTypeCellVars returns genotypes as in targeted sequencing, where every cell has reads and
+// the cells without the variant are WildType with a few error alt reads.
+func wildTypeCellVars(numCells int, numVariants int, mutated float64, seed int64) [][]variants.CellVar {
+	rng := rand.New(rand.NewSource(seed))
+	answer := make([][]variants.CellVar, numVariants)
+	for vid := range answer {
+		answer[vid] = make([]variants.CellVar, numCells)
+		for i := range answer[vid] {
+			cv := &answer[vid][i]
+			cv.Vid = vid
+			cv.ReadDepth = 10 + rng.Intn(200)
+			cv.GenotypeQuality = 30 + rng.Intn(70)
+			if rng.Float64() < mutated {
+				cv.Genotype = variants.Heterozygous
+				cv.AltReads = cv.ReadDepth / 2
+			} else {
+				cv.Genotype = variants.WildType
+				cv.AltReads = rng.Intn(3)
+			}
+			cv.Af = float64(cv.AltReads) / float64(cv.ReadDepth)
+		}
+	}
+	return answer
+}
+
+func TestGenotypeStore(t *testing.T) {
+	cellVars := randomCellVars(40, 30, 0.1, 1)
+	cellVars[2][5].Imputed = true
+	cellVars[2][5].Confidence = 0.8
+	cellVars[4][7].Genotype = variants.Homozygous // no reads
+	for _, sparse := range []bool{false, true} {
+		s := NewGenotypeStore(40, sparse)
+		for vid := range cellVars {
+			s.AppendVariant(cellVars[vid])
+		}
+		if s.NumVariants() != 30 || s.NumCells() != 40 {
+			t.Errorf("sparse=%v: expected 30 variants and 40 cells, found %d and %d", sparse, s.NumVariants(), s.NumCells())
+		}
+		for vid := range cellVars {
+			for i := range cellVars[vid] {
+				if cv := s.Get(i, vid); cv != cellVars[vid][i] {
+					t.Errorf("sparse=%v: cell %d variant %d: expected %+v, found %+v", sparse, i, vid, cellVars[vid][i], cv)
+				}
+				if z := s.Zygosity(i, vid); z != cellVars[vid][i].Genotype {
+					t.Errorf("sparse=%v: cell %d variant %d: expected %s, found %s", sparse, i, vid, cellVars[vid][i].Genotype, z)
+				}
+			}
+		}
+
+		cv := variants.CellVar{Vid: 3, Genotype: variants.Heterozygous, ReadDepth: 100000, AltReads: -1, GenotypeQuality: 300, PValue: 0.01}
+		s.Set(11, 3, cv)
+		cv = s.Get(11, 3)
+		if cv.ReadDepth != 65535 || cv.AltReads != 0 || cv.GenotypeQuality != 255 || cv.PValue != 0.01 || cv.Af != 0 {
+			t.Errorf("sparse=%v: expected clamped read counts and quality, found %+v", sparse, cv)
+		}
+		s.Set(11, 3, cellVars[3][11])
+		if cv = s.Get(11, 3); cv != cellVars[3][11] {
+			t.Errorf("sparse=%v: expected %+v after reset, found %+v", sparse, cellVars[3][11], cv)
+		}
+
+		vids := []int{7, 2, 29}
+		sub := s.SelectVariants(vids)
+		sub.Set(0, 0, variants.CellVar{Genotype: variants.Hemizygous})
+		if s.Zygosity(0, 7) == variants.Hemizygous {
+			t.Errorf("sparse=%v: SelectVariants shares memory with the input", sparse)
+		}
+		cellIds := []int{39, 4, 0}
+		sub = s.SelectCells(cellIds).SelectVariants(vids)
+		for j, vid := range vids {
+			for i, cellId := range cellIds {
+				expected := cellVars[vid][cellId]
+				expected.Vid = j
+				if cv = sub.Get(i, j); cv != expected {
+					t.Errorf("sparse=%v: selected cell %d variant %d: expected %+v, found %+v", sparse, i, j, expected, cv)
+				}
+			}
+		}
+	}
+}
+
+func TestGenotypeStoreSparse(t *testing.T) {
+	cellVars := randomCellVars(1000, 20, 0.05, 2)
+	dense, sparse := NewGenotypeStore(1000, false), NewGenotypeStore(1000, true)
+	for vid := range cellVars {
+		dense.AppendVariant(cellVars[vid])
+		sparse.AppendVariant(cellVars[vid])
+	}
+	if sparse.Bytes() >= dense.Bytes()/2 {
+		t.Errorf("expected sparse storage to use less than half of %d bytes, found %d", dense.Bytes(), sparse.Bytes())
+	}
+
+	// mostly covered variants are stored densely
+	cellVars = randomCellVars(1000, 5, 0.9, 3)
+	dense, sparse = NewGenotypeStore(1000, false), NewGenotypeStore(1000, true)
+	for vid := range cellVars {
+		dense.AppendVariant(cellVars[vid])
+		sparse.AppendVariant(cellVars[vid])
+	}
+	if sparse.Bytes() != dense.Bytes() {
+		t.Errorf("expected mostly covered variants to be stored densely, found %d and %d bytes", sparse.Bytes(), dense.Bytes())
+	}
+
+	// wild-type cells with reads
+	cellVars = wildTypeCellVars(1000, 20, 0.05, 4)
+	dense, sparse = NewGenotypeStore(1000, false), NewGenotypeStore(1000, true)
+	for vid := range cellVars {
+		dense.AppendVariant(cellVars[vid])
+		sparse.AppendVariant(cellVars[vid])
+	}
+	if sparse.Bytes() >= dense.Bytes()*4/5 {
+		t.Errorf("expected sparse storage of wild-type cells with reads to use less than 4/5 of %d bytes, found %d", dense.Bytes(), sparse.Bytes())
+	}
+	cellVars[3][10] = variants.CellVar{Vid: 3, Genotype: variants.Homozygous, ReadDepth: 40, AltReads: 40, Af: 1, GenotypeQuality: 99}
+	sparse.Set(10, 3, cellVars[3][10])
+	cellVars[5][11] = variants.CellVar{Vid: 5, ReadDepth: 300, AltReads: 1, Af: 1.0 / 300, GenotypeQuality: 80}
+	sparse.Set(11, 5, cellVars[5][11])
+	for vid := range cellVars {
+		for cellId := range cellVars[vid] {
+			if got := sparse.Get(cellId, vid); got != cellVars[vid][cellId] {
+				t.Errorf("variant %d cell %d: expected %v, found %v", vid, cellId, cellVars[vid][cellId], got)
+			}
+		}
+	}
+}
+
+// benchmarkGenotypeMemory reports the bytes allocated per genotype when storing genotypes for
+// 2000 cells at 500 variants in a [][]variants.CellVar as in Cell.Genotypes before
+// GenotypeStore, or in a GenotypeStore. If wildType is set, every cell has reads and 5% of cells
+// have the variant (see wildTypeCellVars), otherwise covered is the fraction of cells with reads.
+func benchmarkGenotypeMemory(b *testing.B, covered float64, wildType bool, store func([][]variants.CellVar) interface{}) {
+	const numCells, numVariants = 2000, 500
+	cellVars := randomCellVars(numCells, numVariants, covered, 1)
+	if wildType {
+		cellVars = wildTypeCellVars(numCells, numVariants, 0.05, 1)
+	}
+	var before, after runtime.MemStats
+	var answer interface{}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		answer = store(cellVars)
+		runtime.ReadMemStats(&after)
+	}
+	b.StopTimer()
+	runtime.KeepAlive(answer)
+	b.ReportMetric(float64(after.TotalAlloc-before.TotalAlloc)/(numCells*numVariants), "bytes/genotype")
+}
+
+func storeCellVars(cellVars [][]variants.CellVar) interface{} {
+	answer := make([][]variants.CellVar, len(cellVars[0]))
+	for i := range answer {
+		answer[i] = make([]variants.CellVar, len(cellVars))
+		for vid := range cellVars {
+			answer[i][vid] = cellVars[vid][i]
+		}
+	}
+	return answer
+}
+
+func storeGenotypes(sparse bool) func([][]variants.CellVar) interface{} {
+	return func(cellVars [][]variants.CellVar) interface{} {
+		answer := NewGenotypeStore(len(cellVars[0]), sparse)
+		for vid := range cellVars {
+			answer.AppendVariant(cellVars[vid])
+		}
+		return answer
+	}
+}
+
+func BenchmarkMemoryCellVars(b *testing.B) { benchmarkGenotypeMemory(b, 0.8, false, storeCellVars) }
+func BenchmarkMemoryStore(b *testing.B) {
+	benchmarkGenotypeMemory(b, 0.8, false, storeGenotypes(false))
+}
+func BenchmarkMemoryCellVarsLowCov(b *testing.B) {
+	benchmarkGenotypeMemory(b, 0.05, false, storeCellVars)
+}
+func BenchmarkMemoryStoreLowCov(b *testing.B) {
+	benchmarkGenotypeMemory(b, 0.05, false, storeGenotypes(false))
+}
+func BenchmarkMemorySparseStoreLowCov(b *testing.B) {
+	benchmarkGenotypeMemory(b, 0.05, false, storeGenotypes(true))
+}
+func BenchmarkMemoryCellVarsWildType(b *testing.B) {
+	benchmarkGenotypeMemory(b, 0, true, storeCellVars)
+}
+func BenchmarkMemoryStoreWildType(b *testing.B) {
+	benchmarkGenotypeMemory(b, 0, true, storeGenotypes(false))
+}
+func BenchmarkMemorySparseStoreWildType(b *testing.B) {
+	benchmarkGenotypeMemory(b, 0, true, storeGenotypes(true))
+}
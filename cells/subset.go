@@ -0,0 +1,183 @@
+package cells
+
+import (
+	"github.com/ddsnellings/weaver/variants"
+	"log"
+	"strconv"
+)
+
+// Subset returns a new Data containing only the input cells and variants in their original order.
+// A nil cellIds or variantIds keeps all cells or variants respectively. Ids, CellsGenotyped,
+// CellsMutated, and the derived fractions are recomputed for the subset. d is not modified.
+func (d *Data) Subset(cellIds []int, variantIds []int) *Data {
+	ignoreCells := keepOnly(cellIds, len(d.Cells), "cell")
+	ignoreVariants := keepOnly(variantIds, len(d.Variants), "variant")
+	answer := &Data{Cells: d.Cells, Variants: d.Variants, Contigs: d.Contigs, Genotypes: d.Genotypes}
+	removeFailing(answer, ignoreCells, ignoreVariants)
+	return answer
+}
+
+// keepOnly returns a slice of length n that is false for each index in keep and true otherwise.
+// A nil keep returns all false.
+func keepOnly(keep []int, n int, name string) []bool {
+	answer := make([]bool, n)
+	if keep == nil {
+		return answer
+	}
+	for i := range answer {
+		answer[i] = true
+	}
+	for _, id := range keep {
+		if id < 0 || id >= n {
+			log.Panicf("%s Id %d is out of range for data with %d %ss", name, id, n, name)
+		}
+		answer[id] = false
+	}
+	return answer
+}
+
+// SplitBy returns a subset of d for each label such that answer[k] contains the cells with
+// labels[cellId] == k. Cells with a negative label are excluded from all subsets.
+func (d *Data) SplitBy(labels []int) []*Data {
+	if len(labels) != len(d.Cells) {
+		log.Panicf("SplitBy requires a label for each of %d cells, found %d", len(d.Cells), len(labels))
+	}
+	var groups [][]int
+	for cellId, label := range labels {
+		if label < 0 {
+			continue
+		}
+		for len(groups) <= label {
+			groups = append(groups, make([]int, 0))
+		}
+		groups[label] = append(groups[label], cellId)
+	}
+	answer := make([]*Data, len(groups))
+	for k := range groups {
+		answer[k] = d.Subset(groups[k], nil)
+	}
+	return answer
+}
+
+// SetBatch sets the Batch label of all cells in d.
+func (d *Data) SetBatch(label string) {
+	for i := range d.Cells {
+		d.Cells[i].Batch = label
+	}
+}
+
+// Merge combines the cells of multiple datasets into a single Data. Variants are matched by
+// their Key, and variants missing from a dataset have a Genotype of NoGenotype in its cells.
+// Variants are ordered by first appearance in the input datasets. Cells without a Batch label
+// are labeled with the index of their dataset in the input. The Contigs of the first dataset
+// with a contig registry are used. The input datasets are not modified.
+func Merge(datasets ...*Data) *Data {
+	return MergeWithReference(nil, datasets...)
+}
+
+// MergeWithReference combines datasets as in Merge, but indels are left-aligned against ref (see
+// variants.Normalize) before matching, so that variants written differently by different
+// callers are merged. Variants with Ref bases that do not match ref are matched as is. If ref is
+// nil, variants are not normalized.
+func MergeWithReference(ref variants.Reference, datasets ...*Data) *Data {
+	answer := new(Data)
+	variantIds := make(map[string]int)
+	normalized := make([][]variants.Variant, len(datasets))
+	var key string
+	var found bool
+	for batch, d := range datasets {
+		if answer.Contigs == nil {
+			answer.Contigs = d.Contigs
+		}
+		normalized[batch] = make([]variants.Variant, len(d.Variants))
+		for vid, v := range d.Variants {
+			if ref != nil {
+				if variants.MatchesReference(v, ref) {
+					v = variants.Normalize(v, ref)
+				} else {
+					log.Printf("WARNING: variant %s in dataset %d does not match the reference and was not normalized", v, batch)
+				}
+			}
+			normalized[batch][vid] = v
+			key = v.Key()
+			if _, found = variantIds[key]; found {
+				continue
+			}
+			variantIds[key] = len(answer.Variants)
+			v.Id = len(answer.Variants)
+			v.CellsGenotyped = nil
+			v.CellsMutated = nil
+			answer.Variants = append(answer.Variants, v)
+		}
+	}
+
+	var mergedVid int
+	var cell Cell
+	sparse := len(datasets) > 0
+	datasetVids := make([][]int, len(datasets)) // datasetVids[k][mergedVid] is the Id in datasets[k] or -1
+	for batch, d := range datasets {
+		offset := len(answer.Cells)
+		for _, c := range d.Cells {
+			cell = c
+			cell.Id = len(answer.Cells)
+			if cell.Batch == "" {
+				cell.Batch = strconv.Itoa(batch)
+			}
+			answer.Cells = append(answer.Cells, cell)
+		}
+		datasetVids[batch] = make([]int, len(answer.Variants))
+		for i := range datasetVids[batch] {
+			datasetVids[batch][i] = -1
+		}
+		for vid, v := range normalized[batch] {
+			mergedVid = variantIds[v.Key()]
+			if datasetVids[batch][mergedVid] != -1 {
+				log.Printf("WARNING: variants %s and %s in dataset %d are the same after normalization. only the first is merged",
+					d.Variants[datasetVids[batch][mergedVid]], d.Variants[vid], batch)
+				continue
+			}
+			datasetVids[batch][mergedVid] = vid
+			for _, cellId := range v.CellsGenotyped {
+				answer.Variants[mergedVid].CellsGenotyped = append(answer.Variants[mergedVid].CellsGenotyped, cellId+offset)
+			}
+			for _, cellId := range v.CellsMutated {
+				answer.Variants[mergedVid].CellsMutated = append(answer.Variants[mergedVid].CellsMutated, cellId+offset)
+			}
+		}
+		sparse = sparse && d.Genotypes != nil && d.Genotypes.Sparse
+	}
+
+	answer.Genotypes = NewGenotypeStore(len(answer.Cells), sparse)
+	cellVars := make([]variants.CellVar, len(answer.Cells))
+	for mergedVid = range answer.Variants {
+		offset := 0
+		for batch, d := range datasets {
+			for i := range d.Cells {
+				if vid := datasetVids[batch][mergedVid]; vid != -1 {
+					cellVars[offset+i] = d.CellVar(i, vid)
+				} else {
+					cellVars[offset+i] = variants.CellVar{}
+				}
+			}
+			offset += len(d.Cells)
+		}
+		answer.Genotypes.AppendVariant(cellVars)
+	}
+	updateStats(answer)
+
+	// cells only have a CellVar for the variants in their own dataset
+	offset := 0
+	for batch, d := range datasets {
+		var present int
+		for _, vid := range datasetVids[batch] {
+			if vid != -1 {
+				present++
+			}
+		}
+		for i := range d.Cells {
+			answer.Cells[offset+i].GenotypesPresent = float64(present) / float64(len(answer.Variants))
+		}
+		offset += len(d.Cells)
+	}
+	return answer
+}
@@ -0,0 +1,102 @@
+package cells
+
+import (
+	"github.com/ddsnellings/weaver/reference"
+	"github.com/ddsnellings/weaver/variants"
+	"github.com/vertgenlab/gonomics/dna"
+	"testing"
+)
+
+func TestSubset(t *testing.T) {
+	d := ReadVcf("testdata/small.vcf", DefaultCellFilter, GlobalFilterParam{}, 0)
+	sub := d.Subset([]int{1, 2}, []int{1, 3})
+	if len(sub.Cells) != 2 || len(sub.Variants) != 2 {
+		t.Fatalf("expected 2 cells and 2 variants, found %d and %d", len(sub.Cells), len(sub.Variants))
+	}
+	if sub.Cells[0].Id != 0 || sub.Cells[0].Name != d.Cells[1].Name || sub.Variants[1].Id != 1 {
+		t.Errorf("Ids not updated in subset")
+	}
+	for i := range sub.Cells {
+		for j, cv := range sub.CellGenotypes(i) {
+			if cv.Vid != j {
+				t.Errorf("cell %d genotype %d has Vid %d", i, j, cv.Vid)
+			}
+		}
+	}
+	if sub.Variants[0].String() != d.Variants[1].String() || sub.Variants[0].CellAf != 0.5 {
+		t.Errorf("unexpected variant %s with CellAf %f", sub.Variants[0], sub.Variants[0].CellAf)
+	}
+	if len(d.Cells) != 3 || d.Cells[2].Id != 2 || d.Genotypes.NumCells() != 3 || d.Genotypes.NumVariants() != len(d.Variants) {
+		t.Errorf("Subset modified the input data")
+	}
+
+	split := d.SplitBy([]int{1, -1, 1})
+	if len(split) != 2 || len(split[0].Cells) != 0 || len(split[1].Cells) != 2 {
+		t.Errorf("unexpected split sizes")
+	}
+	if split[1].Cells[1].Name != d.Cells[2].Name {
+		t.Errorf("expected cell %s, found %s", d.Cells[2].Name, split[1].Cells[1].Name)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	d := ReadVcf("testdata/small.vcf", DefaultCellFilter, GlobalFilterParam{}, 0)
+	a := d.Subset([]int{0, 1}, []int{0, 1, 2})
+	b := d.Subset([]int{2}, []int{1, 2, 3})
+	b.SetBatch("second")
+	m := Merge(a, b)
+	if len(m.Cells) != 3 || len(m.Variants) != 4 {
+		t.Fatalf("expected 3 cells and 4 variants, found %d and %d", len(m.Cells), len(m.Variants))
+	}
+	for j := range m.Variants {
+		if m.Variants[j].String() != d.Variants[j].String() {
+			t.Errorf("expected variant %s, found %s", d.Variants[j], m.Variants[j])
+		}
+	}
+	if m.Cells[0].Batch != "0" || m.Cells[2].Batch != "second" || m.Cells[2].Id != 2 {
+		t.Errorf("unexpected batch labels %s %s", m.Cells[0].Batch, m.Cells[2].Batch)
+	}
+	if m.CellVar(2, 0).Genotype != variants.NoGenotype || m.CellVar(0, 3).Genotype != variants.NoGenotype {
+		t.Errorf("expected missing genotypes for variants absent from a dataset")
+	}
+	if m.CellVar(2, 3) != d.CellVar(2, 3) {
+		t.Errorf("expected %v, found %v", d.CellVar(2, 3), m.CellVar(2, 3))
+	}
+	if m.Cells[2].GenotypesPresent != 0.75 {
+		t.Errorf("expected GenotypesPresent 0.75, found %f", m.Cells[2].GenotypesPresent)
+	}
+	for j := range m.Variants {
+		for _, cellId := range m.Variants[j].CellsGenotyped {
+			if m.CellVar(cellId, j).Genotype == variants.NoGenotype {
+				t.Errorf("cell %d listed as genotyped for variant %d", cellId, j)
+			}
+		}
+	}
+	if m.Variants[3].GenotypedFrac != float64(1)/3 || m.Variants[1].CellAf != d.Variants[1].CellAf {
+		t.Errorf("variant statistics not updated after merge")
+	}
+}
+
+func TestMergeWithReference(t *testing.T) {
+	ref := reference.Map{"chr1": dna.StringToBases("GCAAAATCAC")}
+	a := &Data{Cells: []Cell{{Id: 0}}}
+	a.AddVariant(variants.Variant{Chr: "chr1", Pos: 5, Ref: dna.StringToBases("A")}, []variants.CellVar{{Genotype: variants.Heterozygous, GenotypeQuality: 99, ReadDepth: 20, AltReads: 10, Af: 0.5}}, DefaultCellFilter)
+	b := &Data{Cells: []Cell{{Id: 0}}}
+	b.AddVariant(variants.Variant{Chr: "chr1", Pos: 2, Ref: dna.StringToBases("A")}, []variants.CellVar{{Genotype: variants.Homozygous, GenotypeQuality: 99, ReadDepth: 20, AltReads: 20, Af: 1}}, DefaultCellFilter)
+	// does not match the reference, so it is merged as is
+	b.AddVariant(variants.Variant{Chr: "chr1", Pos: 7, Ref: dna.StringToBases("G")}, []variants.CellVar{{Genotype: variants.WildType, GenotypeQuality: 99, ReadDepth: 20, Af: 0}}, DefaultCellFilter)
+
+	if m := Merge(a, b); len(m.Variants) != 3 {
+		t.Errorf("expected 3 variants without a reference, found %d", len(m.Variants))
+	}
+	m := MergeWithReference(ref, a, b)
+	if len(m.Variants) != 2 || m.Variants[0].String() != "chr1:2:A:" || m.Variants[1].String() != "chr1:7:G:" {
+		t.Fatalf("expected the deletions to merge, found %v", m.Variants)
+	}
+	if m.CellVar(0, 0).Genotype != variants.Heterozygous || m.CellVar(1, 0).Genotype != variants.Homozygous {
+		t.Errorf("unexpected genotypes %v and %v", m.CellVar(0, 0), m.CellVar(1, 0))
+	}
+	if a.Variants[0].Pos != 5 {
+		t.Errorf("MergeWithReference modified the input")
+	}
+}
@@ -0,0 +1,367 @@
+package cells
+
+import (
+	"fmt"
+	"github.com/ddsnellings/weaver/tabix"
+	"github.com/ddsnellings/weaver/variants"
+	"github.com/vertgenlab/gonomics/dna"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// WriteParam defines the options for writing Data to a vcf file.
+type WriteParam struct {
+	Read        ReadParam          // options the data was read with. the filters are recorded in the vcf header
+	Reference   variants.Reference // reference bases of indels that were not read from a vcf. required for such indels // Default nil
+	JoinAlleles bool               // write the alleles of a multi-allelic record split when reading as a single record // Default true
+}
+
+var DefaultWriteParam = WriteParam{Read: DefaultReadParam, JoinAlleles: true}
+
+// vcfRecord is a record of the vcf written by WriteVcf.
+type vcfRecord struct {
+	chr  string
+	pos  int // zero-based
+	ref  []dna.Base
+	alts [][]dna.Base
+	vids []int // variant Id of each alt allele
+}
+
+// recordKey identifies the vcf record of a variant. ref is empty for variants that were not read
+// from a vcf.
+type recordKey struct {
+	chr string
+	pos int
+	ref string
+}
+
+// WriteVcf writes the cells and variants in d to a vcf file, sorted by position. Files ending in
+// .gz are bgzip-compressed and indexed with tabix. Each cell is a sample with the GT field set to
+// the genotype called by weaver, or missing if the cell did not pass the cell filter and was not
+// imputed. The INFO field has the CellAf, GenotypedFrac, and CellsMutatedFrac of each allele.
+//
+// Variants read from a vcf are written with the POS, REF, and ALT of the record they were read
+// from (see Variant.Record), also if they were moved by Normalize. Other variants are stored
+// without the matching bases of Ref and Alt, so the base before each indel is taken from
+// p.Reference, and WriteVcf panics if it is unknown. If p.JoinAlleles is set, alleles read from
+// the same record are written as a single record, as are alleles of other variants at the same
+// position. Cells carrying more than two alleles of a joined record keep the first two.
+func WriteVcf(file string, d *Data, p WriteParam) {
+	var out io.WriteCloser
+	bgzip := strings.HasSuffix(file, ".gz")
+	records := vcfRecords(d, p)
+	if bgzip {
+		out = tabix.NewWriter(file)
+	} else {
+		out = fileio.EasyCreate(file)
+	}
+	writeVcfHeader(out, d, records, p)
+	genotyped := make([][]bool, 0, 2)
+	var b strings.Builder
+	for _, r := range records {
+		for len(genotyped) < len(r.vids) {
+			genotyped = append(genotyped, make([]bool, len(d.Cells)))
+		}
+		for k, vid := range r.vids {
+			for i := range genotyped[k] {
+				genotyped[k][i] = false
+			}
+			for _, cellId := range d.Variants[vid].CellsGenotyped {
+				genotyped[k][cellId] = true
+			}
+		}
+		b.Reset()
+		writeVcfRecord(&b, d, r, genotyped)
+		_, err := io.WriteString(out, b.String())
+		exception.PanicOnErr(err)
+	}
+	exception.PanicOnErr(out.Close())
+	if bgzip {
+		tabix.BuildIndex(file)
+	}
+}
+
+// vcfRecords returns the records for the variants in d sorted by position.
+func vcfRecords(d *Data, p WriteParam) []vcfRecord {
+	ids := make([]int, len(d.Variants))
+	for i := range ids {
+		ids[i] = i
+	}
+	d.Contigs.SortIdsByCoord(ids, d.Variants)
+
+	var keys []recordKey
+	var groups [][]int
+	index := make(map[recordKey]int)
+	for _, vid := range ids {
+		v := d.Variants[vid]
+		key := recordKey{chr: v.Chr, pos: vcfPos(v)}
+		if v.Record.Pos > 0 {
+			key = recordKey{chr: v.Chr, pos: v.Record.Pos - 1, ref: v.Record.Ref}
+		}
+		if i, found := index[key]; found && p.JoinAlleles {
+			groups[i] = append(groups[i], vid)
+			continue
+		}
+		index[key] = len(groups)
+		keys = append(keys, key)
+		groups = append(groups, []int{vid})
+	}
+
+	answer := make([]vcfRecord, len(groups))
+	for i, key := range keys {
+		if key.ref == "" {
+			answer[i] = newVcfRecord(d, groups[i], p.Reference)
+			continue
+		}
+		// alleles of a record are read in the order of the ALT field
+		sort.Ints(groups[i])
+		answer[i] = vcfRecord{chr: key.chr, pos: key.pos, ref: dna.StringToBases(key.ref), vids: groups[i]}
+		for _, vid := range groups[i] {
+			answer[i].alts = append(answer[i].alts, dna.StringToBases(d.Variants[vid].Record.Alt))
+		}
+	}
+	sort.SliceStable(answer, func(i, j int) bool {
+		if answer[i].chr != answer[j].chr {
+			return d.Contigs.Compare(answer[i].chr, answer[j].chr) < 0
+		}
+		return answer[i].pos < answer[j].pos
+	})
+	return answer
+}
+
+// vcfPos returns the zero-based position of v in a vcf record. Indels begin at the base before
+// the variant.
+func vcfPos(v variants.Variant) int {
+	if len(v.Ref) == 0 || len(v.Alt) == 0 {
+		return v.Pos - 1
+	}
+	return v.Pos
+}
+
+// newVcfRecord returns the record with the alleles of vids, which must be at the same position.
+// Ref bases are taken from the variants and ref. newVcfRecord panics if a ref base is unknown.
+func newVcfRecord(d *Data, vids []int, ref variants.Reference) vcfRecord {
+	first := d.Variants[vids[0]]
+	answer := vcfRecord{chr: first.Chr, pos: vcfPos(first), vids: vids}
+	end := answer.pos + 1
+	for _, vid := range vids {
+		if e := d.Variants[vid].Pos + len(d.Variants[vid].Ref); e > end {
+			end = e
+		}
+	}
+	answer.ref = make([]dna.Base, end-answer.pos)
+	known := make([]bool, len(answer.ref))
+	if ref != nil {
+		seq := ref.Seq(answer.chr, answer.pos, end)
+		copy(answer.ref, seq)
+		for i := range seq {
+			known[i] = true
+		}
+	}
+	for _, vid := range vids {
+		start := d.Variants[vid].Pos - answer.pos
+		copy(answer.ref[start:], d.Variants[vid].Ref)
+		for i := range d.Variants[vid].Ref {
+			known[start+i] = true
+		}
+	}
+	for i := range known {
+		if !known[i] {
+			log.Panicf("reference base at %s:%d of variant %s is unknown. a reference fasta is required to write indels that were not read from a vcf",
+				answer.chr, answer.pos+i+1, first)
+		}
+	}
+	for _, vid := range vids {
+		v := d.Variants[vid]
+		start := v.Pos - answer.pos
+		alt := append(append(append([]dna.Base(nil), answer.ref[:start]...), v.Alt...), answer.ref[start+len(v.Ref):]...)
+		answer.alts = append(answer.alts, alt)
+	}
+	return answer
+}
+
+// writeVcfHeader writes the meta-information lines with the filters in p, and the header line
+// with a sample for each cell.
+func writeVcfHeader(out io.Writer, d *Data, records []vcfRecord, p WriteParam) {
+	f := p.Read.CellFilter
+	g := p.Read.GlobalFilter
+	lines := []string{
+		"##fileformat=VCFv4.2",
+		"##source=weaver",
+		fmt.Sprintf("##weaverCellFilter=<MinGenotypeQuality=%d,MinGenotypeDepth=%d,MinReadAf=%v,Caller=%s,MinPosterior=%v,MaxPValue=%v,Overdispersion=%v>",
+			f.MinGenotypeQuality, f.MinGenotypeDepth, f.MinReadAf, f.Caller, f.MinPosterior, f.MaxPValue, f.Overdispersion),
+		fmt.Sprintf("##weaverGlobalFilter=<MinGenotypedFrac=%v,MinGenotypesPresent=%v,MinCellAf=%v>",
+			g.MinGenotypedFrac, g.MinGenotypesPresent, g.MinCellAf),
+		fmt.Sprintf("##weaverMinVcfQual=%v", p.Read.MinVcfQual),
+	}
+	if d.Contigs != nil {
+		for i := range d.Contigs.Names {
+			if d.Contigs.Lengths[i] > 0 {
+				lines = append(lines, fmt.Sprintf("##contig=<ID=%s,length=%d>", d.Contigs.Names[i], d.Contigs.Lengths[i]))
+			} else {
+				lines = append(lines, fmt.Sprintf("##contig=<ID=%s>", d.Contigs.Names[i]))
+			}
+		}
+	} else {
+		for i := range records {
+			if i == 0 || records[i].chr != records[i-1].chr {
+				lines = append(lines, fmt.Sprintf("##contig=<ID=%s>", records[i].chr))
+			}
+		}
+	}
+	lines = append(lines,
+		"##INFO=<ID=CellAf,Number=A,Type=Float,Description=\"Allele frequency in cells, genotype aware\">",
+		"##INFO=<ID=GenotypedFrac,Number=A,Type=Float,Description=\"Fraction of cells with a genotype passing filters\">",
+		"##INFO=<ID=CellsMutatedFrac,Number=A,Type=Float,Description=\"Fraction of genotyped cells carrying the allele\">",
+		"##FORMAT=<ID=GT,Number=1,Type=String,Description=\"Genotype called by weaver\">",
+		"##FORMAT=<ID=AD,Number=R,Type=Integer,Description=\"Allelic depths for the ref and alt alleles\">",
+		"##FORMAT=<ID=DP,Number=1,Type=Integer,Description=\"Read depth\">",
+		"##FORMAT=<ID=GQ,Number=1,Type=Integer,Description=\"Genotype quality\">",
+		"##FORMAT=<ID=PS,Number=1,Type=Integer,Description=\"Phase set of the phased genotype\">")
+	header := []string{"#CHROM", "POS", "ID", "REF", "ALT", "QUAL", "FILTER", "INFO", "FORMAT"}
+	for i := range d.Cells {
+		header = append(header, d.Cells[i].Name)
+	}
+	lines = append(lines, strings.Join(header, "\t"))
+	for i := range lines {
+		_, err := io.WriteString(out, lines[i]+"\n")
+		exception.PanicOnErr(err)
+	}
+}
+
+// writeVcfRecord writes r to b. genotyped[k][cellId] is true if the cell passed the cell filter
+// for allele k. If an allele of r is phased (see Variant.PhaseSet), the record has a PS field and
+// heterozygous genotypes of the phased allele are written as phased.
+func writeVcfRecord(b *strings.Builder, d *Data, r vcfRecord, genotyped [][]bool) {
+	alts := make([]string, len(r.alts))
+	cellAf := make([]string, len(r.vids))
+	genotypedFrac := make([]string, len(r.vids))
+	mutatedFrac := make([]string, len(r.vids))
+	phased := -1 // index of the phased allele
+	for k, vid := range r.vids {
+		alts[k] = dna.BasesToString(r.alts[k])
+		cellAf[k] = formatInfoFloat(d.Variants[vid].CellAf)
+		genotypedFrac[k] = formatInfoFloat(d.Variants[vid].GenotypedFrac)
+		mutatedFrac[k] = formatInfoFloat(d.Variants[vid].CellsMutatedFrac)
+		if phased == -1 && d.Variants[vid].PhaseSet > 0 {
+			phased = k
+		}
+	}
+	format := "GT:AD:DP:GQ"
+	if phased != -1 {
+		format += ":PS"
+	}
+	fmt.Fprintf(b, "%s\t%d\t.\t%s\t%s\t.\tPASS\tCellAf=%s;GenotypedFrac=%s;CellsMutatedFrac=%s\t%s",
+		r.chr, r.pos+1, dna.BasesToString(r.ref), strings.Join(alts, ","),
+		strings.Join(cellAf, ","), strings.Join(genotypedFrac, ","), strings.Join(mutatedFrac, ","), format)
+
+	for cellId := range d.Cells {
+		var alleles []int
+		var called, uncalled, haploid, consistentDepth bool
+		var depth, quality, altReads int
+		consistentDepth = true
+		for k, vid := range r.vids {
+			cv := d.CellVar(cellId, vid)
+			altReads += cv.AltReads
+			if k > 0 && cv.ReadDepth != depth {
+				consistentDepth = false
+			}
+			if cv.ReadDepth > depth {
+				depth = cv.ReadDepth
+			}
+			if cv.GenotypeQuality > quality {
+				quality = cv.GenotypeQuality
+			}
+			if cv.Genotype == variants.NoGenotype || !(genotyped[k][cellId] || cv.Imputed) {
+				uncalled = true
+				continue
+			}
+			called = true
+			switch cv.Genotype {
+			case variants.Heterozygous:
+				alleles = append(alleles, k+1)
+			case variants.Homozygous:
+				alleles = append(alleles, k+1, k+1)
+			case variants.Hemizygous:
+				alleles = append(alleles, k+1)
+				haploid = true
+			}
+		}
+
+		b.WriteByte('\t')
+		phaseSet := 0
+		if phased != -1 && called && !uncalled && !haploid && len(alleles) == 1 && alleles[0] == phased+1 {
+			v := d.Variants[r.vids[phased]]
+			phaseSet = v.PhaseSet
+			if v.PhaseHap == 0 {
+				fmt.Fprintf(b, "%d|0", alleles[0])
+			} else {
+				fmt.Fprintf(b, "0|%d", alleles[0])
+			}
+		} else {
+			b.WriteString(formatGenotype(alleles, called, uncalled, haploid))
+		}
+
+		// the ref depth is only known if all alleles were counted from the same reads
+		if consistentDepth {
+			if refReads := depth - altReads; refReads > 0 {
+				fmt.Fprintf(b, ":%d", refReads)
+			} else {
+				b.WriteString(":0")
+			}
+		} else {
+			b.WriteString(":.")
+		}
+		for _, vid := range r.vids {
+			fmt.Fprintf(b, ",%d", d.CellVar(cellId, vid).AltReads)
+		}
+		fmt.Fprintf(b, ":%d:%d", depth, quality)
+		switch {
+		case phased == -1:
+		case phaseSet > 0:
+			fmt.Fprintf(b, ":%d", phaseSet)
+		default:
+			b.WriteString(":.")
+		}
+	}
+	b.WriteByte('\n')
+}
+
+// formatGenotype returns the GT field for a cell carrying alleles. Diploid genotypes keep the
+// first two alleles and fill the rest with the ref allele, or with missing alleles if some
+// alleles of the record were not called in the cell.
+func formatGenotype(alleles []int, called bool, uncalled bool, haploid bool) string {
+	switch {
+	case !called:
+		return "./."
+	case haploid:
+		return strconv.Itoa(alleles[0])
+	}
+	fill := 0
+	if uncalled {
+		fill = -1
+	}
+	for len(alleles) < 2 {
+		alleles = append(alleles, fill)
+	}
+	alleles = alleles[:2]
+	sort.Ints(alleles)
+	gt := make([]string, 2)
+	for i := range gt {
+		gt[i] = "."
+		if alleles[i] >= 0 {
+			gt[i] = strconv.Itoa(alleles[i])
+		}
+	}
+	return gt[0] + "/" + gt[1]
+}
+
+// formatInfoFloat formats val for the INFO field.
+func formatInfoFloat(val float64) string {
+	return strconv.FormatFloat(val, 'g', 6, 64)
+}
@@ -0,0 +1,177 @@
+package cells
+
+import (
+	"github.com/ddsnellings/weaver/reference"
+	"github.com/ddsnellings/weaver/variants"
+	"github.com/vertgenlab/gonomics/dna"
+	"github.com/vertgenlab/gonomics/exception"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteVcf(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "weaver.write.in.vcf")
+	writeRandomVcf(in, 30, 20, 1)
+	p := DefaultReadParam
+	p.GlobalFilter = GlobalFilterParam{MinGenotypedFrac: 0.1}
+	expected := ReadVcfWithParam(in, p)
+	if len(expected.Variants) == 0 {
+		t.Fatalf("no variants in test vcf")
+	}
+	wp := DefaultWriteParam
+	wp.Read = p
+
+	for _, suffix := range []string{".vcf", ".vcf.gz"} {
+		out := filepath.Join(dir, "weaver.write.out"+suffix)
+		for _, join := range []bool{true, false} {
+			wp.JoinAlleles = join
+			WriteVcf(out, expected, wp)
+			actual := ReadVcfWithParam(out, p)
+			if !equalVariants(expected.Variants, actual.Variants) {
+				t.Errorf("%s: variants read from written vcf differ from input", out)
+			}
+			for vid := range expected.Variants {
+				for _, cellId := range expected.Variants[vid].CellsGenotyped {
+					e, a := expected.CellVar(cellId, vid), actual.CellVar(cellId, vid)
+					if e.Genotype != a.Genotype || e.AltReads != a.AltReads || e.ReadDepth != a.ReadDepth || e.GenotypeQuality != a.GenotypeQuality {
+						t.Errorf("%s: cell %d variant %d: expected %+v, found %+v", out, cellId, vid, e, a)
+					}
+				}
+			}
+			if suffix == ".vcf.gz" {
+				if _, err := os.Stat(out + ".tbi"); err != nil {
+					t.Errorf("%s: expected tabix index: %v", out, err)
+				}
+				exception.PanicOnErr(os.Remove(out + ".tbi"))
+			}
+		}
+	}
+}
+
+func TestWriteVcfRecords(t *testing.T) {
+	d := &Data{
+		Cells: []Cell{{Id: 0, Name: "a"}, {Id: 1, Name: "b"}, {Id: 2, Name: "c"}},
+		Variants: []variants.Variant{
+			{Id: 0, Chr: "chr1", Pos: 5, Ref: dna.StringToBases("T"), Alt: []dna.Base{}, CellsGenotyped: []int{0, 1}},              // deletion after 4
+			{Id: 1, Chr: "chr1", Pos: 4, Ref: dna.StringToBases("C"), Alt: dna.StringToBases("A"), CellsGenotyped: []int{0, 1, 2}}, // SNP at 4
+			{Id: 2, Chr: "chr1", Pos: 8, Ref: []dna.Base{}, Alt: dna.StringToBases("GG"), CellsGenotyped: []int{0}},                // insertion after 7
+			{Id: 3, Chr: "chr1", Pos: 1, Ref: dna.StringToBases("A"), Alt: dna.StringToBases("G"), CellsGenotyped: []int{1}, CellAf: 0.25, PhaseSet: 2, PhaseHap: 1},
+		},
+	}
+	d.SetCellVar(0, 0, variants.CellVar{Genotype: variants.Heterozygous, ReadDepth: 20, AltReads: 8})
+	d.SetCellVar(0, 1, variants.CellVar{Genotype: variants.Heterozygous, ReadDepth: 20, AltReads: 9})
+	d.SetCellVar(1, 0, variants.CellVar{Genotype: variants.WildType, ReadDepth: 20})
+	d.SetCellVar(1, 1, variants.CellVar{Genotype: variants.Homozygous, ReadDepth: 20, AltReads: 19})
+	d.SetCellVar(2, 0, variants.CellVar{Genotype: variants.Homozygous, ReadDepth: 2, AltReads: 2})
+	d.SetCellVar(2, 1, variants.CellVar{Genotype: variants.Heterozygous, ReadDepth: 2, AltReads: 1})
+	d.SetCellVar(0, 2, variants.CellVar{Genotype: variants.Hemizygous, ReadDepth: 20, AltReads: 20})
+	d.SetCellVar(2, 2, variants.CellVar{Genotype: variants.Heterozygous, Imputed: true, Confidence: 0.9})
+	d.SetCellVar(1, 3, variants.CellVar{Genotype: variants.Heterozygous, ReadDepth: 30, AltReads: 10, GenotypeQuality: 99})
+
+	file := filepath.Join(t.TempDir(), "weaver.write.vcf")
+	p := DefaultWriteParam
+	p.Reference = reference.Map{"chr1": dna.StringToBases("AAAACTGTAAA")}
+	expected := []string{
+		"chr1\t2\t.\tA\tG\t.\tPASS\tCellAf=0.25;GenotypedFrac=0;CellsMutatedFrac=0\tGT:AD:DP:GQ:PS\t./.:0,0:0:0:.\t0|1:20,10:30:99:2\t./.:0,0:0:0:.",
+		"chr1\t5\t.\tCT\tAT,C\t.\tPASS\tCellAf=0,0;GenotypedFrac=0,0;CellsMutatedFrac=0,0\tGT:AD:DP:GQ\t1/2:3,9,8:20:0\t1/1:1,19,0:20:0\t./1:0,1,2:2:0",
+		"chr1\t8\t.\tT\tTGG\t.\tPASS\tCellAf=0;GenotypedFrac=0;CellsMutatedFrac=0\tGT:AD:DP:GQ\t1:0,20:20:0\t./.:0,0:0:0\t0/1:0,0:0:0",
+	}
+	WriteVcf(file, d, p)
+	if records := readRecords(file); strings.Join(records, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected records:\n%s\nfound:\n%s", strings.Join(expected, "\n"), strings.Join(records, "\n"))
+	}
+
+	// the ref depth is unknown if the alleles were counted from different reads
+	d.SetCellVar(2, 1, variants.CellVar{Genotype: variants.Heterozygous, ReadDepth: 3, AltReads: 1})
+	WriteVcf(file, d, p)
+	if records := readRecords(file); !strings.HasSuffix(records[1], "\t./1:.,1,2:3:0") {
+		t.Errorf("expected missing ref depth, found %s", records[1])
+	}
+
+	p.JoinAlleles = false
+	expected = []string{
+		"chr1\t2\t.\tA\tG",
+		"chr1\t5\t.\tC\tA",
+		"chr1\t5\t.\tCT\tC",
+		"chr1\t8\t.\tT\tTGG",
+	}
+	WriteVcf(file, d, p)
+	records := readRecords(file)
+	for i := range records {
+		records[i] = strings.Join(strings.Split(records[i], "\t")[:5], "\t")
+	}
+	if strings.Join(records, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected records:\n%s\nfound:\n%s", strings.Join(expected, "\n"), strings.Join(records, "\n"))
+	}
+
+	// the base before the insertion is unknown without a reference
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected a panic writing an indel with an unknown reference base")
+		}
+	}()
+	WriteVcf(file, d, DefaultWriteParam)
+}
+
+// TestWriteVcfMultiallelic checks that multi-allelic records with SNVs and indels, which are split
+// into variants at different positions when reading, are written as the original records.
+func TestWriteVcfMultiallelic(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "weaver.write.multiallelic.vcf")
+	out := filepath.Join(dir, "weaver.write.multiallelic.out.vcf")
+	records := []string{
+		"chr1\t99\t.\tC\tT",
+		"chr1\t100\t.\tAT\tA,ATT,GT",
+		"chr1\t102\t.\tG\tA",
+		"chr1\t102\t.\tGCC\tG",
+		"chr2\t5\t.\tTA\tT,CA",
+	}
+	lines := []string{
+		"##fileformat=VCFv4.2",
+		"##contig=<ID=chr1,length=1000>",
+		"##contig=<ID=chr2,length=1000>",
+		"#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\ta\tb",
+	}
+	for _, r := range records {
+		numAlts := len(strings.Split(strings.Split(r, "\t")[4], ","))
+		lines = append(lines, r+"\t500\tPASS\t.\tGT:AD:DP:GQ\t0/1:10,10"+strings.Repeat(",0", numAlts-1)+":20:50\t0/0:20"+strings.Repeat(",0", numAlts)+":20:50")
+	}
+	exception.PanicOnErr(ioutil.WriteFile(in, []byte(strings.Join(lines, "\n")+"\n"), 0644))
+
+	p := DefaultReadParam
+	p.GlobalFilter = GlobalFilterParam{}
+	d := ReadVcfWithParam(in, p)
+	if len(d.Variants) != 8 {
+		t.Fatalf("expected 8 variants, found %d", len(d.Variants))
+	}
+	wp := DefaultWriteParam
+	wp.Read = p
+	WriteVcf(out, d, wp)
+	written := readRecords(out)
+	for i := range written {
+		written[i] = strings.Join(strings.Split(written[i], "\t")[:5], "\t")
+	}
+	if strings.Join(written, "\n") != strings.Join(records, "\n") {
+		t.Errorf("expected records:\n%s\nfound:\n%s", strings.Join(records, "\n"), strings.Join(written, "\n"))
+	}
+	if actual := ReadVcfWithParam(out, p); !equalVariants(d.Variants, actual.Variants) {
+		t.Errorf("variants read from written vcf differ from input")
+	}
+}
+
+// readRecords returns the lines of a vcf that are not header lines.
+func readRecords(file string) []string {
+	b, err := ioutil.ReadFile(file)
+	exception.PanicOnErr(err)
+	var answer []string
+	for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			answer = append(answer, line)
+		}
+	}
+	return answer
+}
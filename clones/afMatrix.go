@@ -8,6 +8,11 @@ import (
 	"log"
 )
 
+// PrincipalComponent performs a principal component analysis on the allele frequency matrix of d,
+// with missing genotypes set to -0.5.
+//
+// Deprecated: use PrincipalComponents with a FeatureMatrix, which fills or drops missing
+// genotypes (see NewFeatureMatrix).
 func PrincipalComponent(d *cells.Data) stat.PC {
 	var answer stat.PC
 	ok := answer.PrincipalComponents(generateAfMatrix(d), nil)
@@ -25,16 +30,16 @@ func generateAfMatrix(d *cells.Data) *mat.Dense {
 }
 
 // fetchAfFromData retrieves a slice of allele frequencies for each variant in each cell. Missing genotypes
-// are set to -50. The slice is ordered by cell then by variant
+// are set to -0.5. The slice is ordered by cell then by variant
 // e.g. {C1_VAF1, C1_VAF2, C1_VAF3, C2_VAF1, C2_VAF2, C2_VAF3, ... Cn_VAF3}
 func fetchAfFromData(d *cells.Data) []float64 {
 	answer := make([]float64, len(d.Cells)*len(d.Variants))
 	for i := range d.Cells {
-		for j := range d.Cells[i].Genotypes {
-			if d.Cells[i].Genotypes[j].Genotype == variants.NoGenotype {
-				answer[i*j] = -0.5
+		for j := range d.Variants {
+			if cv := d.CellVar(i, j); cv.Genotype == variants.NoGenotype {
+				answer[i*len(d.Variants)+j] = -0.5
 			} else {
-				answer[i*j] = d.Cells[i].Genotypes[j].Af
+				answer[i*len(d.Variants)+j] = cv.Af
 			}
 		}
 	}
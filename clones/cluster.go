@@ -0,0 +1,253 @@
+package clones
+
+import (
+	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/impute"
+	"github.com/ddsnellings/weaver/parallel"
+	"github.com/ddsnellings/weaver/variants"
+	"math"
+	"math/rand"
+)
+
+// Clustering stores the assignment of each cell to a clone.
+type Clustering struct {
+	Assignment []int   // Assignment[cellId] is the clone of the cell (0 to K-1), or -1 if unassigned
+	K          int     // number of clones
+	Silhouette float64 // mean silhouette width of the clustering. NaN if not computed
+	BIC        float64 // Bayesian information criterion of the clustering (see BIC). NaN if not computed
+}
+
+// ConsensusTable stores the consensus genotype of each clone.
+type ConsensusTable struct {
+	Genotypes [][]variants.Zygosity // Genotypes[clone][variantId] is the most common genotype in the clone
+	Support   [][]float64           // fraction of genotyped cells in the clone with the consensus genotype
+	Cells     []int                 // number of cells assigned to each clone
+}
+
+// maxDosageDistance is the distance between cells that share too few genotyped
+// variants to be compared. It is the maximum possible impute.Distance.
+const maxDosageDistance = 2
+
+// newClustering relabels an assignment so clones are numbered 0 to K-1 in order of first
+// appearance. Negative labels are left unassigned.
+func newClustering(labels []int) Clustering {
+	answer := Clustering{Assignment: make([]int, len(labels)), Silhouette: math.NaN(), BIC: math.NaN()}
+	relabel := make(map[int]int)
+	for i, label := range labels {
+		if label < 0 {
+			answer.Assignment[i] = -1
+			continue
+		}
+		if _, ok := relabel[label]; !ok {
+			relabel[label] = len(relabel)
+		}
+		answer.Assignment[i] = relabel[label]
+	}
+	answer.K = len(relabel)
+	return answer
+}
+
+// Consensus determines the most common genotype of each variant in each clone.
+// Only genotypes that passed cell filters are considered. Variants with no genotyped
+// cells in a clone have a consensus of NoGenotype and a support of 0.
+func Consensus(d *cells.Data, c Clustering) ConsensusTable {
+	mask := impute.GenotypedMask(d)
+	counts := make([][][hemizygousIdx + 1]int, c.K) // counts[clone][variantId][genotype]
+	answer := ConsensusTable{
+		Genotypes: make([][]variants.Zygosity, c.K),
+		Support:   make([][]float64, c.K),
+		Cells:     make([]int, c.K),
+	}
+	for k := range counts {
+		counts[k] = make([][hemizygousIdx + 1]int, len(d.Variants))
+		answer.Genotypes[k] = make([]variants.Zygosity, len(d.Variants))
+		answer.Support[k] = make([]float64, len(d.Variants))
+	}
+
+	for cellId, k := range c.Assignment {
+		if k < 0 {
+			continue
+		}
+		answer.Cells[k]++
+		for vid := range d.Variants {
+			if mask[cellId][vid] && d.Genotype(cellId, vid) != variants.NoGenotype {
+				counts[k][vid][d.Genotype(cellId, vid)]++
+			}
+		}
+	}
+
+	var total, best int
+	for k := range counts {
+		for vid := range counts[k] {
+			total, best = 0, 0
+			for z, count := range counts[k][vid] {
+				total += count
+				if count > best {
+					best = count
+					answer.Genotypes[k][vid] = variants.Zygosity(z)
+				}
+			}
+			if total > 0 {
+				answer.Support[k][vid] = float64(best) / float64(total)
+			}
+		}
+	}
+	return answer
+}
+
+// hemizygousIdx is the largest Zygosity value, used to size genotype count arrays.
+const hemizygousIdx = int(variants.Hemizygous)
+
+// SilhouetteParam defines how the silhouette width of a clustering is computed.
+type SilhouetteParam struct {
+	MaxCells  int   // silhouette is computed on a random subset of at most MaxCells cells // Default 2000
+	MinShared int   // minimum variants genotyped in both cells to compute a distance // Default 5
+	Seed      int64 // seed for selecting the subset of cells
+}
+
+var DefaultSilhouetteParam = SilhouetteParam{MaxCells: 2000, MinShared: 5, Seed: 1}
+
+// Silhouette returns the mean silhouette width of the clustering using the dropout aware
+// distance between cell dosages (impute.Distance). Cells that are unassigned or in a
+// clone of one cell are not scored.
+func Silhouette(d *cells.Data, c Clustering, p SilhouetteParam) float64 {
+	dosage := impute.DosageMatrix(d)
+	var sample []int
+	for i, k := range c.Assignment {
+		if k >= 0 {
+			sample = append(sample, i)
+		}
+	}
+	if len(sample) > p.MaxCells {
+		r := rand.New(rand.NewSource(p.Seed))
+		r.Shuffle(len(sample), func(i, j int) { sample[i], sample[j] = sample[j], sample[i] })
+		sample = sample[:p.MaxCells]
+	}
+
+	widths := make([]float64, len(sample))
+	parallel.For(len(sample), 0, func(s int) {
+		widths[s] = silhouetteWidth(sample[s], sample, dosage, c, p.MinShared)
+	})
+
+	var sum float64
+	var scored int
+	for _, w := range widths {
+		if !math.IsNaN(w) {
+			sum += w
+			scored++
+		}
+	}
+	if scored == 0 {
+		return math.NaN()
+	}
+	return sum / float64(scored)
+}
+
+// silhouetteWidth returns (b - a) / max(a, b) where a is the mean distance from cell i to
+// other cells in its clone and b is the smallest mean distance to the cells of another clone.
+func silhouetteWidth(i int, sample []int, dosage [][]float64, c Clustering, minShared int) float64 {
+	sums := make([]float64, c.K)
+	counts := make([]int, c.K)
+	var dist float64
+	for _, j := range sample {
+		if i == j {
+			continue
+		}
+		dist = impute.Distance(dosage[i], dosage[j], minShared)
+		if math.IsInf(dist, 1) {
+			dist = maxDosageDistance
+		}
+		sums[c.Assignment[j]] += dist
+		counts[c.Assignment[j]]++
+	}
+
+	own := c.Assignment[i]
+	if counts[own] == 0 {
+		return math.NaN()
+	}
+	a := sums[own] / float64(counts[own])
+	b := math.Inf(1)
+	for k := range sums {
+		if k != own && counts[k] > 0 {
+			b = math.Min(b, sums[k]/float64(counts[k]))
+		}
+	}
+	if math.IsInf(b, 1) || math.Max(a, b) == 0 {
+		return 0
+	}
+	return (b - a) / math.Max(a, b)
+}
+
+// SelectBySilhouette computes the silhouette width of each candidate clustering and returns
+// the index of the candidate with the greatest width. The Silhouette field of each candidate is set.
+func SelectBySilhouette(d *cells.Data, candidates []Clustering, p SilhouetteParam) int {
+	best := -1
+	for i := range candidates {
+		candidates[i].Silhouette = Silhouette(d, candidates[i], p)
+		if best == -1 || candidates[i].Silhouette > candidates[best].Silhouette ||
+			math.IsNaN(candidates[best].Silhouette) {
+			best = i
+		}
+	}
+	return best
+}
+
+// BIC returns the Bayesian information criterion of the clustering. Lower values are better.
+// The clone of each cell is drawn from the clone frequencies, and the genotypes of the cells in
+// a clone are drawn independently at each variant from a distribution over 0, 1, or 2 copies of
+// the alt allele estimated from the clone. Missing genotypes and unassigned cells are ignored.
+func BIC(d *cells.Data, c Clustering) float64 {
+	mask := impute.GenotypedMask(d)
+	counts := make([][][3]int, c.K) // counts[clone][variantId][altCopies]
+	cloneCells := make([]int, c.K)
+	for k := range counts {
+		counts[k] = make([][3]int, len(d.Variants))
+	}
+	var n int
+	for cellId, k := range c.Assignment {
+		if k < 0 {
+			continue
+		}
+		cloneCells[k]++
+		n++
+		for vid := range d.Variants {
+			if mask[cellId][vid] && d.Genotype(cellId, vid) != variants.NoGenotype {
+				counts[k][vid][altCopies(d.Genotype(cellId, vid))]++
+			}
+		}
+	}
+	if n == 0 {
+		return math.NaN()
+	}
+
+	var logLikelihood float64
+	var total int
+	for k := range counts {
+		if cloneCells[k] > 0 {
+			logLikelihood += float64(cloneCells[k]) * math.Log(float64(cloneCells[k])/float64(n))
+		}
+		for vid := range counts[k] {
+			total = counts[k][vid][0] + counts[k][vid][1] + counts[k][vid][2]
+			for _, count := range counts[k][vid] {
+				if count > 0 {
+					logLikelihood += float64(count) * math.Log(float64(count)/float64(total))
+				}
+			}
+		}
+	}
+	params := c.K*len(d.Variants)*2 + c.K - 1
+	return -2*logLikelihood + float64(params)*math.Log(float64(n))
+}
+
+// SelectByBIC computes the BIC of each candidate clustering and returns the index of the
+// candidate with the lowest BIC. The BIC field of each candidate is set.
+func SelectByBIC(d *cells.Data, candidates []Clustering) int {
+	best := -1
+	for i := range candidates {
+		candidates[i].BIC = BIC(d, candidates[i])
+		if best == -1 || candidates[i].BIC < candidates[best].BIC || math.IsNaN(candidates[best].BIC) {
+			best = i
+		}
+	}
+	return best
+}
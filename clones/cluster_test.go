@@ -0,0 +1,124 @@
+package clones
+
+import (
+	"github.com/ddsnellings/weaver/cells/cellstest"
+	"github.com/ddsnellings/weaver/variants"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// cloneGenotypes are the true genotypes of 3 clones across 12 variants.
+var cloneGenotypes = [][]int{
+	{1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0, 0},
+	{1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0},
+	{1, 1, 1, 1, 0, 0, 0, 0, 2, 2, 2, 2},
+}
+
+// simulateClones returns cellsPerClone cells from each clone with genotypes dropped at rate dropout.
+func simulateClones(cellsPerClone int, dropout float64) [][]int {
+	r := rand.New(rand.NewSource(3))
+	var answer [][]int
+	for c := range cloneGenotypes {
+		for i := 0; i < cellsPerClone; i++ {
+			cell := make([]int, len(cloneGenotypes[c]))
+			for j := range cell {
+				if r.Float64() < dropout {
+					cell[j] = -1
+				} else {
+					cell[j] = cloneGenotypes[c][j]
+				}
+			}
+			answer = append(answer, cell)
+		}
+	}
+	return answer
+}
+
+// recovered returns true if the clustering exactly matches the simulated clones.
+func recovered(c Clustering, cellsPerClone int) bool {
+	if c.K != len(cloneGenotypes) {
+		return false
+	}
+	for i := range c.Assignment {
+		if c.Assignment[i] != c.Assignment[(i/cellsPerClone)*cellsPerClone] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestHierarchical(t *testing.T) {
+	d := cellstest.FromGenotypes(simulateClones(20, 0.15))
+	den := Hierarchical(d, 3)
+	if len(den.Merges) != len(d.Cells)-1 {
+		t.Errorf("expected %d merges, found %d", len(d.Cells)-1, len(den.Merges))
+	}
+	if c := den.Cut(3); !recovered(c, 20) {
+		t.Errorf("hierarchical clustering did not recover clones: %v", c.Assignment)
+	}
+
+	defer func(max int) {
+		MaxHierarchicalCells = max
+		if recover() == nil {
+			t.Errorf("expected panic with more than MaxHierarchicalCells cells")
+		}
+	}(MaxHierarchicalCells)
+	MaxHierarchicalCells = len(d.Cells) - 1
+	Hierarchical(d, 3)
+}
+
+func TestKModes(t *testing.T) {
+	d := cellstest.FromGenotypes(simulateClones(20, 0.15))
+	if c := KModes(d, 3, KModesParam{MaxIter: 100, Restarts: 5, MinShared: 3, Seed: 1}); !recovered(c, 20) {
+		t.Errorf("k-modes did not recover clones: %v", c.Assignment)
+	}
+}
+
+func TestLouvain(t *testing.T) {
+	d := cellstest.FromGenotypes(simulateClones(20, 0.15))
+	if c := Louvain(d, LouvainParam{Neighbors: 10, Resolution: 1, MinShared: 3, Seed: 1}); !recovered(c, 20) {
+		t.Errorf("louvain did not recover clones: %v", c.Assignment)
+	}
+}
+
+func TestSelectBySilhouette(t *testing.T) {
+	d := cellstest.FromGenotypes(simulateClones(20, 0.15))
+	den := Hierarchical(d, 3)
+	candidates := []Clustering{den.Cut(2), den.Cut(3), den.Cut(4), den.Cut(5)}
+	if best := SelectBySilhouette(d, candidates, SilhouetteParam{MaxCells: 1000, MinShared: 3, Seed: 1}); best != 1 {
+		t.Errorf("expected silhouette to select 3 clones, selected %d", candidates[best].K)
+	}
+}
+
+func TestSelectByBIC(t *testing.T) {
+	d := cellstest.FromGenotypes(simulateClones(20, 0.15))
+	den := Hierarchical(d, 3)
+	candidates := []Clustering{den.Cut(2), den.Cut(3), den.Cut(4), den.Cut(5)}
+	if best := SelectByBIC(d, candidates); best != 1 {
+		t.Errorf("expected BIC to select 3 clones, selected %d", candidates[best].K)
+	}
+	for _, c := range candidates {
+		if math.IsNaN(c.BIC) {
+			t.Errorf("BIC not set for %d clones", c.K)
+		}
+	}
+}
+
+func TestConsensus(t *testing.T) {
+	d := cellstest.FromGenotypes(simulateClones(20, 0.15))
+	c := KModes(d, 3, KModesParam{MaxIter: 100, Restarts: 5, MinShared: 3, Seed: 1})
+	table := Consensus(d, c)
+	for clone := range cloneGenotypes {
+		k := c.Assignment[clone*20]
+		if table.Cells[k] != 20 {
+			t.Errorf("expected 20 cells in clone, found %d", table.Cells[k])
+		}
+		for vid, g := range cloneGenotypes[clone] {
+			if table.Genotypes[k][vid] != variants.Zygosity(g+1) || table.Support[k][vid] != 1 {
+				t.Errorf("clone %d variant %d: expected consensus %s, found %s (support %f)",
+					clone, vid, variants.Zygosity(g+1), table.Genotypes[k][vid], table.Support[k][vid])
+			}
+		}
+	}
+}
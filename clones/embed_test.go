@@ -0,0 +1,96 @@
+package clones
+
+import (
+	"gonum.org/v1/gonum/mat"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// twoBlobs returns n points in each of two well separated gaussian clusters.
+func twoBlobs(n int, dims int) *mat.Dense {
+	r := rand.New(rand.NewSource(7))
+	answer := mat.NewDense(2*n, dims, nil)
+	for i := 0; i < 2*n; i++ {
+		for d := 0; d < dims; d++ {
+			answer.Set(i, d, r.NormFloat64()+float64(10*(i/n)))
+		}
+	}
+	return answer
+}
+
+// separated returns true if every point in the embedding is closer to the
+// centroid of its own cluster than to the centroid of the other cluster.
+func separated(embedding *mat.Dense, n int) bool {
+	_, dims := embedding.Dims()
+	centroids := [2][]float64{make([]float64, dims), make([]float64, dims)}
+	for i := 0; i < 2*n; i++ {
+		for d := 0; d < dims; d++ {
+			centroids[i/n][d] += embedding.At(i, d) / float64(n)
+		}
+	}
+	for i := 0; i < 2*n; i++ {
+		row := mat.Row(nil, i, embedding)
+		if sqDist(row, centroids[i/n]) >= sqDist(row, centroids[1-i/n]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestUmap(t *testing.T) {
+	x := twoBlobs(40, 5)
+	p := DefaultUmapParam
+	p.Neighbors = 10
+	p.Epochs = 200
+	p.Workers = 1
+	serial := Umap(x, p)
+	p.Workers = 4
+	parallel := Umap(x, p)
+
+	if !mat.Equal(serial, parallel) {
+		t.Errorf("umap embedding depends on number of workers")
+	}
+	if !separated(serial, 40) {
+		t.Errorf("umap embedding does not separate clusters")
+	}
+}
+
+func TestTsne(t *testing.T) {
+	x := twoBlobs(40, 5)
+	p := DefaultTsneParam
+	p.Perplexity = 10
+	p.Iterations = 400
+	p.Workers = 1
+	serial := Tsne(x, p)
+	p.Workers = 4
+	parallel := Tsne(x, p)
+
+	if !mat.Equal(serial, parallel) {
+		t.Errorf("t-SNE embedding depends on number of workers")
+	}
+	if !separated(serial, 40) {
+		t.Errorf("t-SNE embedding does not separate clusters")
+	}
+}
+
+func TestFindAB(t *testing.T) {
+	a, b := findAB(1, 0.1)
+	if math.Abs(a-1.577) > 0.05 || math.Abs(b-0.895) > 0.02 {
+		t.Errorf("expected a ~ 1.577 and b ~ 0.895, found %f and %f", a, b)
+	}
+}
+
+func TestNearestNeighbors(t *testing.T) {
+	x := [][]float64{{0}, {1}, {3}, {6}}
+	knn := nearestNeighbors(x, 2, 2)
+	expected := [][]int{{1, 2}, {0, 2}, {1, 0}, {2, 1}}
+	for i := range expected {
+		for n := range expected[i] {
+			if knn.Idx[i][n] != expected[i][n] {
+				t.Errorf("row %d: expected neighbors %v, found %v", i, expected[i], knn.Idx[i])
+				break
+			}
+		}
+	}
+}
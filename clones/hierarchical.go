@@ -0,0 +1,170 @@
+package clones
+
+import (
+	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/impute"
+	"github.com/ddsnellings/weaver/parallel"
+	"log"
+	"math"
+	"sort"
+)
+
+// Merge records the joining of two clusters in a Dendrogram. Clusters are
+// identified by the Id of one of their cells.
+type Merge struct {
+	A, B   int     // clusters joined
+	Height float64 // average linkage distance between A and B
+}
+
+// Dendrogram stores the merges from hierarchical clustering of cells in order of increasing height.
+type Dendrogram struct {
+	Cells  int
+	Merges []Merge
+}
+
+// MaxHierarchicalCells is the largest number of cells clustered by Hierarchical.
+var MaxHierarchicalCells = 50000
+
+// Hierarchical performs average linkage hierarchical clustering of cells using the dropout aware
+// distance between cell dosages (impute.Distance). Cells sharing fewer than minShared genotyped
+// variants are assigned the maximum distance. Uses the nearest neighbor chain algorithm with a
+// condensed float32 distance matrix, so memory use is 2 * cells^2 bytes (e.g. 5 GB for 50,000
+// cells). Panics with more than MaxHierarchicalCells cells. KModes and Louvain use memory linear
+// in the number of cells, though Louvain compares all pairs of cells to build its knn graph.
+func Hierarchical(d *cells.Data, minShared int) Dendrogram {
+	if len(d.Cells) > MaxHierarchicalCells {
+		log.Panicf("hierarchical clustering of %d cells requires %.1f GB for distances. the maximum is %d cells. use KModes or Louvain instead",
+			len(d.Cells), 2*float64(len(d.Cells))*float64(len(d.Cells))/1e9, MaxHierarchicalCells)
+	}
+	dosage := impute.DosageMatrix(d)
+	n := len(dosage)
+	dist := newCondensed(n)
+	parallel.For(n, 0, func(i int) {
+		var curr float64
+		for j := i + 1; j < n; j++ {
+			curr = impute.Distance(dosage[i], dosage[j], minShared)
+			if math.IsInf(curr, 1) {
+				curr = maxDosageDistance
+			}
+			dist.set(i, j, float32(curr))
+		}
+	})
+	return averageLinkage(dist)
+}
+
+// Cut returns the clustering obtained by stopping the dendrogram at k clusters.
+func (den Dendrogram) Cut(k int) Clustering {
+	parent := make([]int, den.Cells)
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	for m := 0; m < len(den.Merges) && m < den.Cells-k; m++ {
+		parent[find(den.Merges[m].A)] = find(den.Merges[m].B)
+	}
+	labels := make([]int, den.Cells)
+	for i := range labels {
+		labels[i] = find(i)
+	}
+	return newClustering(labels)
+}
+
+// condensed stores the upper triangle of a symmetric distance matrix.
+type condensed struct {
+	n    int
+	vals []float32
+}
+
+func newCondensed(n int) condensed {
+	return condensed{n: n, vals: make([]float32, n*(n-1)/2)}
+}
+
+func (c condensed) idx(i, j int) int {
+	if i > j {
+		i, j = j, i
+	}
+	return i*c.n - i*(i+1)/2 + j - i - 1
+}
+
+func (c condensed) get(i, j int) float32 {
+	return c.vals[c.idx(i, j)]
+}
+
+func (c condensed) set(i, j int, val float32) {
+	c.vals[c.idx(i, j)] = val
+}
+
+// averageLinkage clusters with the nearest neighbor chain algorithm. The input
+// distances are overwritten with Lance-Williams updates.
+func averageLinkage(dist condensed) Dendrogram {
+	n := dist.n
+	if n < 2 {
+		return Dendrogram{Cells: n}
+	}
+	size := make([]int, n)
+	active := make([]bool, n)
+	for i := range size {
+		size[i] = 1
+		active[i] = true
+	}
+
+	answer := Dendrogram{Cells: n, Merges: make([]Merge, 0, n-1)}
+	chain := make([]int, 0, n)
+	var a, b, next int
+	var best, curr float32
+	for len(answer.Merges) < n-1 {
+		if len(chain) == 0 {
+			for i := range active {
+				if active[i] {
+					chain = append(chain, i)
+					break
+				}
+			}
+		}
+		a = chain[len(chain)-1]
+
+		// nearest active neighbor of a. prefer the previous cluster in the chain on ties
+		next, best = -1, float32(math.Inf(1))
+		if len(chain) > 1 {
+			next = chain[len(chain)-2]
+			best = dist.get(a, next)
+		}
+		for i := range active {
+			if !active[i] || i == a {
+				continue
+			}
+			curr = dist.get(a, i)
+			if curr < best {
+				best, next = curr, i
+			}
+		}
+
+		if len(chain) > 1 && next == chain[len(chain)-2] {
+			b = next
+			chain = chain[:len(chain)-2]
+			answer.Merges = append(answer.Merges, Merge{A: a, B: b, Height: float64(best)})
+			// merged cluster is stored in b
+			for i := range active {
+				if !active[i] || i == a || i == b {
+					continue
+				}
+				dist.set(b, i, (float32(size[a])*dist.get(a, i)+float32(size[b])*dist.get(b, i))/float32(size[a]+size[b]))
+			}
+			size[b] += size[a]
+			active[a] = false
+		} else {
+			chain = append(chain, next)
+		}
+	}
+
+	sort.SliceStable(answer.Merges, func(i, j int) bool {
+		return answer.Merges[i].Height < answer.Merges[j].Height
+	})
+	return answer
+}
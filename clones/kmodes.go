@@ -0,0 +1,187 @@
+package clones
+
+import (
+	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/impute"
+	"github.com/ddsnellings/weaver/parallel"
+	"github.com/ddsnellings/weaver/variants"
+	"math/rand"
+)
+
+// KModesParam defines the parameters for k-modes clustering.
+type KModesParam struct {
+	MaxIter   int   // maximum iterations per run // Default 100
+	Restarts  int   // number of random initializations. the run with the lowest cost is kept // Default 10
+	MinShared int   // minimum variants genotyped in both a cell and mode to compute a distance // Default 5
+	Seed      int64 // seed for initialization
+}
+
+var DefaultKModesParam = KModesParam{MaxIter: 100, Restarts: 10, MinShared: 5, Seed: 1}
+
+// missingCode marks a genotype that did not pass cell filters in a genotype code matrix.
+const missingCode int8 = -1
+
+// genotypeCodes returns a matrix such that answer[cellId][variantId] is the Zygosity of the
+// cell, or missingCode if the genotype did not pass cell filters.
+func genotypeCodes(d *cells.Data) [][]int8 {
+	mask := impute.GenotypedMask(d)
+	answer := make([][]int8, len(d.Cells))
+	for i := range d.Cells {
+		answer[i] = make([]int8, len(d.Variants))
+		for j := range d.Variants {
+			if !mask[i][j] || d.Genotype(i, j) == variants.NoGenotype {
+				answer[i][j] = missingCode
+			} else {
+				answer[i][j] = int8(d.Genotype(i, j))
+			}
+		}
+	}
+	return answer
+}
+
+// mismatch returns the fraction of variants genotyped in both a and b with different genotypes.
+// Returns 1 if fewer than minShared variants are genotyped in both.
+func mismatch(a, b []int8, minShared int) float64 {
+	var shared, diff int
+	for i := range a {
+		if a[i] == missingCode || b[i] == missingCode {
+			continue
+		}
+		shared++
+		if a[i] != b[i] {
+			diff++
+		}
+	}
+	if shared == 0 || shared < minShared {
+		return 1
+	}
+	return float64(diff) / float64(shared)
+}
+
+// KModes clusters cells into k clones by their genotypes. Each clone is represented by its
+// mode (most common genotype at each variant) and cells are assigned to the mode with the
+// smallest fraction of mismatched genotypes among variants genotyped in both, so that missing
+// genotypes do not count toward the distance. Initial modes are chosen with k-means++ seeding.
+func KModes(d *cells.Data, k int, p KModesParam) Clustering {
+	codes := genotypeCodes(d)
+	r := rand.New(rand.NewSource(p.Seed))
+	var bestLabels []int
+	var bestCost float64
+	for run := 0; run < p.Restarts || run == 0; run++ {
+		labels, cost := kModesRun(codes, k, p, r)
+		if bestLabels == nil || cost < bestCost {
+			bestLabels, bestCost = labels, cost
+		}
+	}
+	return newClustering(bestLabels)
+}
+
+// kModesRun performs a single k-modes clustering. Returns the labels and total cost.
+func kModesRun(codes [][]int8, k int, p KModesParam, r *rand.Rand) ([]int, float64) {
+	modes := kModesInit(codes, k, p.MinShared, r)
+	labels := make([]int, len(codes))
+	costs := make([]float64, len(codes))
+	for i := range labels {
+		labels[i] = -1
+	}
+
+	next := make([]int, len(codes))
+	var changed bool
+	for iter := 0; iter < p.MaxIter; iter++ {
+		parallel.For(len(codes), 0, func(i int) {
+			best, bestDist := 0, 2.0
+			var dist float64
+			for m := range modes {
+				dist = mismatch(codes[i], modes[m], p.MinShared)
+				if dist < bestDist {
+					best, bestDist = m, dist
+				}
+			}
+			costs[i] = bestDist
+			next[i] = best
+		})
+		changed = false
+		for i := range labels {
+			if labels[i] != next[i] {
+				labels[i] = next[i]
+				changed = true
+			}
+		}
+		if !changed {
+			break
+		}
+		updateModes(codes, labels, modes)
+	}
+
+	var cost float64
+	for i := range costs {
+		cost += costs[i]
+	}
+	return labels, cost
+}
+
+// kModesInit chooses k initial modes from the cells. The first mode is chosen at random and
+// each subsequent mode is chosen with probability proportional to its squared distance to the
+// nearest existing mode.
+func kModesInit(codes [][]int8, k int, minShared int, r *rand.Rand) [][]int8 {
+	modes := make([][]int8, 0, k)
+	modes = append(modes, append([]int8{}, codes[r.Intn(len(codes))]...))
+	minDist := make([]float64, len(codes))
+	for i := range minDist {
+		minDist[i] = 2
+	}
+
+	var total, target, dist float64
+	var chosen int
+	for len(modes) < k {
+		total = 0
+		for i := range codes {
+			dist = mismatch(codes[i], modes[len(modes)-1], minShared)
+			if dist < minDist[i] {
+				minDist[i] = dist
+			}
+			total += minDist[i] * minDist[i]
+		}
+		chosen = r.Intn(len(codes))
+		if total > 0 {
+			target = r.Float64() * total
+			for i := range codes {
+				target -= minDist[i] * minDist[i]
+				if target <= 0 {
+					chosen = i
+					break
+				}
+			}
+		}
+		modes = append(modes, append([]int8{}, codes[chosen]...))
+	}
+	return modes
+}
+
+// updateModes sets each mode to the most common non-missing genotype of its cells.
+// Variants with no genotyped cells in a clone keep their previous mode.
+func updateModes(codes [][]int8, labels []int, modes [][]int8) {
+	counts := make([][][hemizygousIdx + 1]int, len(modes))
+	for m := range counts {
+		counts[m] = make([][hemizygousIdx + 1]int, len(codes[0]))
+	}
+	for i := range codes {
+		for j, code := range codes[i] {
+			if code != missingCode {
+				counts[labels[i]][j][code]++
+			}
+		}
+	}
+	var best int
+	for m := range modes {
+		for j := range modes[m] {
+			best = 0
+			for z, count := range counts[m][j] {
+				if count > best {
+					best = count
+					modes[m][j] = int8(z)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package clones
+
+import (
+	"container/heap"
+	"github.com/ddsnellings/weaver/parallel"
+	"gonum.org/v1/gonum/mat"
+	"math"
+)
+
+// neighbors stores the k nearest neighbors of each row in a matrix such that
+// Idx[i][n] is the row index of the n-th nearest neighbor of row i and Dist[i][n]
+// is the euclidean distance between them. Neighbors are sorted by increasing distance
+// and a row is never its own neighbor.
+type neighbors struct {
+	Idx  [][]int
+	Dist [][]float64
+}
+
+// rows copies the rows of m into a [][]float64.
+func rows(m mat.Matrix) [][]float64 {
+	r, _ := m.Dims()
+	answer := make([][]float64, r)
+	for i := range answer {
+		answer[i] = mat.Row(nil, i, m)
+	}
+	return answer
+}
+
+// nearestNeighbors finds the exact k nearest neighbors for each row of x by brute force.
+// Rows are processed in parallel.
+func nearestNeighbors(x [][]float64, k int, workers int) neighbors {
+	if k >= len(x) {
+		k = len(x) - 1
+	}
+	answer := neighbors{Idx: make([][]int, len(x)), Dist: make([][]float64, len(x))}
+	parallel.For(len(x), workers, func(i int) {
+		h := make(maxHeap, 0, k+1)
+		for j := range x {
+			if i == j {
+				continue
+			}
+			d := sqDist(x[i], x[j])
+			if len(h) < k {
+				heap.Push(&h, heapItem{idx: j, dist: d})
+			} else if d < h[0].dist {
+				h[0] = heapItem{idx: j, dist: d}
+				heap.Fix(&h, 0)
+			}
+		}
+		answer.Idx[i] = make([]int, len(h))
+		answer.Dist[i] = make([]float64, len(h))
+		for n := len(h) - 1; n >= 0; n-- {
+			item := heap.Pop(&h).(heapItem)
+			answer.Idx[i][n] = item.idx
+			answer.Dist[i][n] = math.Sqrt(item.dist)
+		}
+	})
+	return answer
+}
+
+// sqDist returns the squared euclidean distance between a and b.
+func sqDist(a, b []float64) float64 {
+	var answer, diff float64
+	for i := range a {
+		diff = a[i] - b[i]
+		answer += diff * diff
+	}
+	return answer
+}
+
+type heapItem struct {
+	idx  int
+	dist float64
+}
+
+// maxHeap keeps the farthest of the current nearest neighbors at the root.
+// Ties are broken by index so that results are deterministic.
+type maxHeap []heapItem
+
+func (h maxHeap) Len() int { return len(h) }
+func (h maxHeap) Less(i, j int) bool {
+	if h[i].dist == h[j].dist {
+		return h[i].idx > h[j].idx
+	}
+	return h[i].dist > h[j].dist
+}
+func (h maxHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *maxHeap) Push(x interface{}) { *h = append(*h, x.(heapItem)) }
+func (h *maxHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// rng is a small splitmix64 random number generator. It is cheap to create so that
+// parallel work can draw from independent streams seeded by (seed, iteration, index)
+// and give identical results regardless of the number of workers.
+type rng uint64
+
+func newRng(seed int64, a, b int) rng {
+	r := rng(uint64(seed) ^ uint64(a)*0x9E3779B97F4A7C15 ^ uint64(b)*0xC2B2AE3D27D4EB4F)
+	r.next()
+	return r
+}
+
+func (r *rng) next() uint64 {
+	*r += 0x9E3779B97F4A7C15
+	z := uint64(*r)
+	z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+	z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+	return z ^ (z >> 31)
+}
+
+// intn returns a random int in [0, n).
+func (r *rng) intn(n int) int {
+	return int(r.next() % uint64(n))
+}
@@ -0,0 +1,236 @@
+package clones
+
+import (
+	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/impute"
+	"github.com/ddsnellings/weaver/parallel"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// LouvainParam defines the parameters for graph based clustering.
+type LouvainParam struct {
+	Neighbors  int     // number of nearest neighbors of each cell in the graph // Default 15
+	Resolution float64 // larger values give more, smaller clones // Default 1
+	MinShared  int     // minimum variants genotyped in both cells to compute a distance // Default 5
+	Seed       int64   // seed for the order in which cells are visited
+}
+
+var DefaultLouvainParam = LouvainParam{Neighbors: 15, Resolution: 1, MinShared: 5, Seed: 1}
+
+// graphEdge is a weighted edge in an undirected graph stored as adjacency lists.
+type graphEdge struct {
+	to     int
+	weight float64
+}
+
+// Louvain clusters cells by maximizing the modularity of a k nearest neighbor graph with
+// the Louvain method (Blondel et al. 2008). Neighbors are found with the dropout aware
+// distance between cell dosages (impute.Distance).
+func Louvain(d *cells.Data, p LouvainParam) Clustering {
+	dosage := impute.DosageMatrix(d)
+	return newClustering(louvain(knnGraph(dosage, p.Neighbors, p.MinShared), p.Resolution, p.Seed))
+}
+
+// knnGraph connects each cell to its k nearest neighbors. The graph is symmetric with an
+// edge of weight 1 if either cell is a neighbor of the other. Cells sharing fewer than
+// minShared genotyped variants are never neighbors.
+func knnGraph(dosage [][]float64, k int, minShared int) [][]graphEdge {
+	n := len(dosage)
+	knn := make([][]int, n)
+	parallel.For(n, 0, func(i int) {
+		var candidates []neighborDist
+		var dist float64
+		for j := range dosage {
+			if i == j {
+				continue
+			}
+			dist = impute.Distance(dosage[i], dosage[j], minShared)
+			if !math.IsInf(dist, 1) {
+				candidates = append(candidates, neighborDist{idx: j, dist: dist})
+			}
+		}
+		sort.Slice(candidates, func(a, b int) bool {
+			if candidates[a].dist == candidates[b].dist {
+				return candidates[a].idx < candidates[b].idx
+			}
+			return candidates[a].dist < candidates[b].dist
+		})
+		for c := 0; c < k && c < len(candidates); c++ {
+			knn[i] = append(knn[i], candidates[c].idx)
+		}
+	})
+
+	adj := make([]map[int]bool, n)
+	for i := range adj {
+		adj[i] = make(map[int]bool)
+	}
+	for i := range knn {
+		for _, j := range knn[i] {
+			adj[i][j] = true
+			adj[j][i] = true
+		}
+	}
+	graph := make([][]graphEdge, n)
+	for i := range adj {
+		for j := range adj[i] {
+			graph[i] = append(graph[i], graphEdge{to: j, weight: 1})
+		}
+		sort.Slice(graph[i], func(a, b int) bool { return graph[i][a].to < graph[i][b].to })
+	}
+	return graph
+}
+
+type neighborDist struct {
+	idx  int
+	dist float64
+}
+
+// louvain returns the community of each node in the graph.
+func louvain(graph [][]graphEdge, resolution float64, seed int64) []int {
+	r := rand.New(rand.NewSource(seed))
+	membership := make([]int, len(graph))
+	for i := range membership {
+		membership[i] = i
+	}
+	degree := make([]float64, len(graph))
+	for i := range graph {
+		for _, e := range graph[i] {
+			degree[i] += e.weight
+		}
+	}
+
+	var comm []int
+	var moved bool
+	for {
+		comm, moved = louvainLevel(graph, degree, resolution, r)
+		if !moved {
+			break
+		}
+		comm = renumber(comm)
+		if maxInt(comm)+1 == len(graph) { // no communities were merged
+			break
+		}
+		for i := range membership {
+			membership[i] = comm[membership[i]]
+		}
+		graph, degree = aggregate(graph, degree, comm)
+	}
+	return membership
+}
+
+// maxLouvainPasses limits the number of passes over all nodes in a single level.
+const maxLouvainPasses = 100
+
+// louvainLevel moves single nodes between communities until modularity cannot be improved.
+// Returns the community of each node and whether any node was moved.
+func louvainLevel(graph [][]graphEdge, degree []float64, resolution float64, r *rand.Rand) ([]int, bool) {
+	n := len(graph)
+	comm := make([]int, n)
+	tot := make([]float64, n)
+	var m2 float64
+	for i := range comm {
+		comm[i] = i
+		tot[i] = degree[i]
+		m2 += degree[i]
+	}
+	if m2 == 0 {
+		return comm, false
+	}
+
+	order := r.Perm(n)
+	neighWeight := make([]float64, n)
+	neighComms := make([]int, 0)
+	var anyMoved, improved bool
+	var best int
+	var bestGain, gain float64
+	for pass := 0; pass < maxLouvainPasses; pass++ {
+		improved = false
+		for _, i := range order {
+			neighComms = neighComms[:0]
+			for _, e := range graph[i] {
+				if e.to == i {
+					continue
+				}
+				if neighWeight[comm[e.to]] == 0 {
+					neighComms = append(neighComms, comm[e.to])
+				}
+				neighWeight[comm[e.to]] += e.weight
+			}
+
+			tot[comm[i]] -= degree[i]
+			best = comm[i]
+			bestGain = neighWeight[comm[i]] - resolution*tot[comm[i]]*degree[i]/m2
+			for _, c := range neighComms {
+				gain = neighWeight[c] - resolution*tot[c]*degree[i]/m2
+				if gain > bestGain {
+					best, bestGain = c, gain
+				}
+			}
+			tot[best] += degree[i]
+			if best != comm[i] {
+				comm[i] = best
+				improved = true
+				anyMoved = true
+			}
+
+			for _, c := range neighComms {
+				neighWeight[c] = 0
+			}
+		}
+		if !improved {
+			break
+		}
+	}
+	return comm, anyMoved
+}
+
+// renumber relabels communities as 0 to k-1 in order of first appearance.
+func renumber(comm []int) []int {
+	relabel := make(map[int]int)
+	answer := make([]int, len(comm))
+	for i, c := range comm {
+		if _, ok := relabel[c]; !ok {
+			relabel[c] = len(relabel)
+		}
+		answer[i] = relabel[c]
+	}
+	return answer
+}
+
+// aggregate builds a graph where each node is a community of the input graph. Edges within
+// a community become a self loop.
+func aggregate(graph [][]graphEdge, degree []float64, comm []int) ([][]graphEdge, []float64) {
+	k := maxInt(comm) + 1
+	weights := make([]map[int]float64, k)
+	newDegree := make([]float64, k)
+	for i := range weights {
+		weights[i] = make(map[int]float64)
+	}
+	for i := range graph {
+		newDegree[comm[i]] += degree[i]
+		for _, e := range graph[i] {
+			weights[comm[i]][comm[e.to]] += e.weight
+		}
+	}
+	answer := make([][]graphEdge, k)
+	for i := range weights {
+		for j, w := range weights[i] {
+			answer[i] = append(answer[i], graphEdge{to: j, weight: w})
+		}
+		sort.Slice(answer[i], func(a, b int) bool { return answer[i][a].to < answer[i][b].to })
+	}
+	return answer, newDegree
+}
+
+// maxInt returns the largest value in a, or -1 if a is empty.
+func maxInt(a []int) int {
+	answer := -1
+	for _, val := range a {
+		if val > answer {
+			answer = val
+		}
+	}
+	return answer
+}
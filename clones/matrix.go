@@ -0,0 +1,139 @@
+package clones
+
+import (
+	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/impute"
+	"github.com/ddsnellings/weaver/variants"
+	"gonum.org/v1/gonum/mat"
+	"log"
+	"math"
+)
+
+// Feature selects the value stored for each cell and variant in a FeatureMatrix.
+type Feature byte
+
+const (
+	AlleleFrequency Feature = iota // read allele frequency (CellVar.Af)
+	Dosage                         // number of mutant alleles in the called genotype (0, 1, 2)
+	SoftDosage                     // expected number of mutant alleles from genotype posteriors if present
+)
+
+// Missing selects how genotypes that did not pass cell filters are handled in a FeatureMatrix.
+type Missing byte
+
+const (
+	MeanFill  Missing = iota // missing values are set to the mean of the observed values for the variant
+	Imputed                  // imputed genotypes are used if present (see package impute), otherwise MeanFill
+	DropCells                // cells with any missing value are removed from the matrix
+)
+
+// FeatureMatrix stores a value for each cell (rows) and variant (columns).
+// Row i corresponds to the cell with Id CellIds[i] and column j corresponds
+// to the variant with Id VariantIds[j].
+type FeatureMatrix struct {
+	Values     *mat.Dense
+	CellIds    []int
+	VariantIds []int
+}
+
+// NewFeatureMatrix builds a cell by variant matrix from d for all variants.
+func NewFeatureMatrix(d *cells.Data, feature Feature, missing Missing) FeatureMatrix {
+	variantIds := make([]int, len(d.Variants))
+	for i := range variantIds {
+		variantIds[i] = i
+	}
+	return NewFeatureMatrixFromVariants(d, variantIds, feature, missing)
+}
+
+// NewFeatureMatrixFromVariants builds a cell by variant matrix from d for the input variantIds.
+func NewFeatureMatrixFromVariants(d *cells.Data, variantIds []int, feature Feature, missing Missing) FeatureMatrix {
+	mask := impute.GenotypedMask(d)
+	vals := make([][]float64, len(d.Cells)) // vals[cellId][column]. NaN if missing
+	for i := range d.Cells {
+		vals[i] = make([]float64, len(variantIds))
+		for j, vid := range variantIds {
+			vals[i][j] = featureValue(d.CellVar(i, vid), mask[i][vid], feature, missing)
+		}
+	}
+
+	var cellIds []int
+	for i := range vals {
+		if missing == DropCells && hasNaN(vals[i]) {
+			continue
+		}
+		cellIds = append(cellIds, i)
+	}
+	if len(cellIds) == 0 || len(variantIds) == 0 {
+		log.Panicf("error: feature matrix would have %d cells and %d variants", len(cellIds), len(variantIds))
+	}
+
+	means := columnMeans(vals, cellIds)
+	answer := FeatureMatrix{
+		Values:     mat.NewDense(len(cellIds), len(variantIds), nil),
+		CellIds:    cellIds,
+		VariantIds: variantIds,
+	}
+	for row, cellId := range cellIds {
+		for col := range variantIds {
+			if math.IsNaN(vals[cellId][col]) {
+				answer.Values.Set(row, col, means[col])
+			} else {
+				answer.Values.Set(row, col, vals[cellId][col])
+			}
+		}
+	}
+	return answer
+}
+
+// featureValue returns the feature value for a CellVar, or NaN if the value is missing.
+func featureValue(cv variants.CellVar, genotyped bool, feature Feature, missing Missing) float64 {
+	if cv.Genotype == variants.NoGenotype || (!genotyped && !(missing == Imputed && cv.Imputed)) {
+		return math.NaN()
+	}
+	switch feature {
+	case AlleleFrequency:
+		if !genotyped { // imputed genotypes have no read evidence
+			return cv.Dosage() / 2
+		}
+		return cv.Af
+	case Dosage:
+		cv.Posterior = [3]float64{}
+		return cv.Dosage()
+	case SoftDosage:
+		return cv.Dosage()
+	default:
+		log.Panicf("unknown feature: %d", feature)
+		return 0
+	}
+}
+
+// columnMeans returns the mean of the non-NaN values in each column for the rows in cellIds.
+// Columns with no observed values have a mean of 0.
+func columnMeans(vals [][]float64, cellIds []int) []float64 {
+	answer := make([]float64, len(vals[0]))
+	counts := make([]int, len(answer))
+	for _, cellId := range cellIds {
+		for j := range answer {
+			if !math.IsNaN(vals[cellId][j]) {
+				answer[j] += vals[cellId][j]
+				counts[j]++
+			}
+		}
+	}
+	for j := range answer {
+		if counts[j] > 0 {
+			answer[j] /= float64(counts[j])
+		}
+	}
+	return answer
+}
+
+// hasNaN returns true if any value in f is NaN.
+func hasNaN(f []float64) bool {
+	for i := range f {
+		if math.IsNaN(f[i]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,500 @@
+package clones
+
+import (
+	"encoding/json"
+	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/parallel"
+	"github.com/ddsnellings/weaver/variants"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"gonum.org/v1/gonum/floats"
+	"log"
+	"math"
+	"math/rand"
+)
+
+// CloneModel is a generative mixture model of the read counts observed in each cell. Each clone
+// has a genotype at every variant. Reads from a cell in a clone are drawn from its genotype with
+// a per-cell sequencing error rate and a per-cell rate of allelic dropout at heterozygous sites.
+// Doublets are modeled as an even mixture of two clones.
+type CloneModel struct {
+	Variants      []string  // variant keys (see variants.Variant.Key) in model order
+	Genotypes     [][]int   // Genotypes[clone][variant] is the number of copies of the alt allele (0, 1, or 2)
+	Weights       []float64 // fraction of singlet cells from each clone
+	DoubletRate   float64   // fraction of cells that are doublets
+	ErrorRate     float64   // mean sequencing error rate of cells used to fit the model
+	DropoutRate   float64   // mean allelic dropout rate of cells used to fit the model
+	LogLikelihood float64   // log likelihood of the fitted data, up to a constant
+}
+
+// ModelParam defines the parameters for fitting a CloneModel.
+type ModelParam struct {
+	K              int     // number of clones
+	DoubletRate    float64 // initial doublet rate. 0 disables the doublet component // Default 0.05
+	MaxDoubletRate float64 // upper limit of the fitted doublet rate // Default 0.3
+	ErrorRate      float64 // prior mean sequencing error rate of each cell // Default 0.005
+	ErrorPrior     float64 // weight of the error rate prior in pseudo-reads // Default 1000
+	DropoutRate    float64 // prior mean allelic dropout rate of each cell // Default 0.1
+	DropoutPrior   float64 // weight of the dropout rate prior in pseudo-sites // Default 10
+	MaxIter        int     // maximum EM iterations per restart // Default 200
+	Tolerance      float64 // EM stops when the log likelihood improves by less than Tolerance per cell // Default 1e-6
+	Restarts       int     // number of k-modes initializations. the fit with the greatest likelihood is kept // Default 5
+	Seed           int64   // seed for initialization
+}
+
+var DefaultModelParam = ModelParam{DoubletRate: 0.05, MaxDoubletRate: 0.3, ErrorRate: 0.005, ErrorPrior: 1000,
+	DropoutRate: 0.1, DropoutPrior: 10, MaxIter: 200, Tolerance: 1e-6, Restarts: 5, Seed: 1}
+
+// Membership stores the posterior clone membership of each cell under a CloneModel.
+type Membership struct {
+	Posterior     [][]float64 // Posterior[cellId][clone] is the probability the cell is a singlet from the clone
+	Doublet       []float64   // probability each cell is a doublet
+	ErrorRate     []float64   // estimated sequencing error rate of each cell
+	DropoutRate   []float64   // estimated allelic dropout rate of each cell
+	LogLikelihood float64     // log likelihood of all cells, up to a constant
+}
+
+// Clustering returns the most probable clone of each cell. Cells are unassigned if they are
+// more likely to be a doublet than a member of any single clone, or if the posterior of their
+// most probable clone is less than minPosterior.
+func (m Membership) Clustering(minPosterior float64) Clustering {
+	labels := make([]int, len(m.Posterior))
+	for i := range m.Posterior {
+		labels[i] = -1
+		best := floats.MaxIdx(m.Posterior[i])
+		if best >= 0 && m.Posterior[i][best] >= minPosterior && m.Posterior[i][best] > m.Doublet[i] {
+			labels[i] = best
+		}
+	}
+	answer := Clustering{Assignment: labels, Silhouette: math.NaN(), BIC: math.NaN()}
+	if len(m.Posterior) > 0 {
+		answer.K = len(m.Posterior[0])
+	}
+	return answer
+}
+
+// readObs is the read count of a cell at a single model variant.
+type readObs struct {
+	v, alt, depth int
+}
+
+// cellObs returns the reads observed in each cell at each model variant. varIdx[vid] is the
+// model index of each variant in d, or -1 if the variant is not in the model.
+func cellObs(d *cells.Data, varIdx []int) [][]readObs {
+	answer := make([][]readObs, len(d.Cells))
+	var cv variants.CellVar
+	for i := range d.Cells {
+		for vid := range d.Variants {
+			cv = d.CellVar(i, vid)
+			if varIdx[vid] < 0 || cv.ReadDepth <= 0 {
+				continue
+			}
+			if cv.AltReads > cv.ReadDepth {
+				cv.AltReads = cv.ReadDepth
+			}
+			answer[i] = append(answer[i], readObs{v: varIdx[vid], alt: cv.AltReads, depth: cv.ReadDepth})
+		}
+	}
+	return answer
+}
+
+// logBinom returns the log probability of alt successes in depth trials with success probability
+// p, omitting the binomial coefficient which is constant for a given observation.
+func logBinom(alt, depth int, p float64) float64 {
+	return float64(alt)*math.Log(p) + float64(depth-alt)*math.Log1p(-p)
+}
+
+// logSumExp returns log(sum(exp(x))).
+func logSumExp(x []float64) float64 {
+	max := math.Inf(-1)
+	for _, val := range x {
+		max = math.Max(max, val)
+	}
+	if math.IsInf(max, -1) {
+		return max
+	}
+	var sum float64
+	for _, val := range x {
+		sum += math.Exp(val - max)
+	}
+	return max + math.Log(sum)
+}
+
+// singletLik returns the log likelihood of a read observation given the number of alt copies,
+// the error rate, and the dropout rate of the cell.
+func singletLik(o readObs, copies int, errRate, dropout float64) float64 {
+	switch copies {
+	case 0:
+		return logBinom(o.alt, o.depth, errRate)
+	case 2:
+		return logBinom(o.alt, o.depth, 1-errRate)
+	default:
+		return logSumExp([]float64{
+			math.Log1p(-dropout) + logBinom(o.alt, o.depth, 0.5),
+			math.Log(dropout/2) + logBinom(o.alt, o.depth, errRate),
+			math.Log(dropout/2) + logBinom(o.alt, o.depth, 1-errRate),
+		})
+	}
+}
+
+// doubletLik returns the log likelihood of a read observation from an even mixture of cells
+// with copiesA and copiesB alt alleles.
+func doubletLik(o readObs, copiesA, copiesB int, errRate float64) float64 {
+	return logBinom(o.alt, o.depth, (altFrac(copiesA, errRate)+altFrac(copiesB, errRate))/2)
+}
+
+// altFrac returns the expected fraction of alt reads for a number of alt copies.
+func altFrac(copies int, errRate float64) float64 {
+	switch copies {
+	case 0:
+		return errRate
+	case 2:
+		return 1 - errRate
+	default:
+		return 0.5
+	}
+}
+
+// modelState stores the parameters and posteriors during EM.
+type modelState struct {
+	m       *CloneModel
+	obs     [][]readObs
+	pairs   [][2]int // clones in each doublet component
+	member  Membership
+	fixed   bool // model parameters are held fixed and only cell parameters are updated
+	param   ModelParam
+	numVars int
+}
+
+// FitModel fits a CloneModel with p.K clones to the read counts in d by expectation
+// maximization. Each restart is initialized from the consensus genotypes of a k-modes
+// clustering. Returns the model and the posterior membership of each cell.
+func FitModel(d *cells.Data, p ModelParam) (*CloneModel, Membership) {
+	if p.K < 1 {
+		log.Panicf("model must have at least one clone. found K=%d", p.K)
+	}
+	varIdx := make([]int, len(d.Variants))
+	keys := make([]string, len(d.Variants))
+	for vid := range d.Variants {
+		varIdx[vid] = vid
+		keys[vid] = d.Variants[vid].Key()
+	}
+	obs := cellObs(d, varIdx)
+
+	var best *modelState
+	r := rand.New(rand.NewSource(p.Seed))
+	kp := DefaultKModesParam
+	kp.Restarts = 1
+	var cellId int
+	for run := 0; run < p.Restarts || run == 0; run++ {
+		kp.Seed = p.Seed + int64(run)
+		init := Consensus(d, KModes(d, p.K, kp))
+		m := &CloneModel{Variants: keys, DoubletRate: p.DoubletRate, ErrorRate: p.ErrorRate, DropoutRate: p.DropoutRate}
+		m.Genotypes = make([][]int, p.K)
+		m.Weights = make([]float64, p.K)
+		for k := range m.Genotypes {
+			m.Weights[k] = 1 / float64(p.K)
+			m.Genotypes[k] = make([]int, len(keys))
+			if k < len(init.Genotypes) {
+				for vid := range keys {
+					m.Genotypes[k][vid] = altCopies(init.Genotypes[k][vid])
+				}
+				continue
+			}
+			// k-modes found fewer than K clones. start from the genotypes of a random cell
+			cellId = r.Intn(len(d.Cells))
+			for vid := range keys {
+				m.Genotypes[k][vid] = altCopies(d.Genotype(cellId, vid))
+			}
+		}
+		s := newModelState(m, obs, p, false)
+		s.run()
+		if best == nil || s.member.LogLikelihood > best.member.LogLikelihood {
+			best = s
+		}
+	}
+	best.m.LogLikelihood = best.member.LogLikelihood
+	return best.m, best.member
+}
+
+// AssignCells computes the posterior membership of cells in d under a fitted model. The model
+// is not changed; the error and dropout rates of each cell are estimated with the model fixed.
+// Variants are matched to the model by key and variants not in the model are ignored. The
+// fields of p used are the priors, MaxIter, and Tolerance.
+func AssignCells(d *cells.Data, m *CloneModel, p ModelParam) Membership {
+	modelIdx := make(map[string]int, len(m.Variants))
+	for i, key := range m.Variants {
+		modelIdx[key] = i
+	}
+	varIdx := make([]int, len(d.Variants))
+	var found int
+	for vid := range d.Variants {
+		idx, ok := modelIdx[d.Variants[vid].Key()]
+		if !ok {
+			idx = -1
+		} else {
+			found++
+		}
+		varIdx[vid] = idx
+	}
+	if found == 0 {
+		log.Panicf("no variants in the data are present in the clone model")
+	}
+	s := newModelState(m, cellObs(d, varIdx), p, true)
+	s.run()
+	return s.member
+}
+
+// altCopies converts a Zygosity to the number of copies of the alt allele.
+func altCopies(z variants.Zygosity) int {
+	switch z {
+	case variants.Heterozygous:
+		return 1
+	case variants.Homozygous, variants.Hemizygous:
+		return 2
+	default:
+		return 0
+	}
+}
+
+func newModelState(m *CloneModel, obs [][]readObs, p ModelParam, fixed bool) *modelState {
+	s := &modelState{m: m, obs: obs, param: p, fixed: fixed, numVars: len(m.Variants)}
+	if m.DoubletRate > 0 {
+		for a := 0; a < len(m.Genotypes); a++ {
+			for b := a + 1; b < len(m.Genotypes); b++ {
+				s.pairs = append(s.pairs, [2]int{a, b})
+			}
+		}
+	}
+	s.member = Membership{
+		Posterior:   make([][]float64, len(obs)),
+		Doublet:     make([]float64, len(obs)),
+		ErrorRate:   make([]float64, len(obs)),
+		DropoutRate: make([]float64, len(obs)),
+	}
+	for i := range obs {
+		s.member.Posterior[i] = make([]float64, len(m.Genotypes))
+		s.member.ErrorRate[i] = m.ErrorRate
+		s.member.DropoutRate[i] = m.DropoutRate
+	}
+	return s
+}
+
+// run iterates expectation and maximization steps until convergence.
+func (s *modelState) run() {
+	prev := math.Inf(-1)
+	tol := s.param.Tolerance * float64(len(s.obs))
+	for iter := 0; iter < s.param.MaxIter; iter++ {
+		s.expectation()
+		if s.member.LogLikelihood-prev < tol {
+			break
+		}
+		prev = s.member.LogLikelihood
+		if !s.fixed {
+			s.updateModel()
+		}
+		s.updateCells()
+	}
+}
+
+// expectation computes the posterior membership of each cell and the total log likelihood.
+func (s *modelState) expectation() {
+	k := len(s.m.Genotypes)
+	doubletRate := s.m.DoubletRate
+	if len(s.pairs) == 0 {
+		doubletRate = 0
+	}
+	logWeight := make([]float64, k)
+	for c := range logWeight {
+		logWeight[c] = math.Log(s.m.Weights[c]) + math.Log1p(-doubletRate)
+	}
+	logPairWeight := make([]float64, len(s.pairs))
+	var pairNorm float64
+	for _, pair := range s.pairs {
+		pairNorm += s.m.Weights[pair[0]] * s.m.Weights[pair[1]]
+	}
+	for i, pair := range s.pairs {
+		logPairWeight[i] = math.Log(doubletRate) + math.Log(s.m.Weights[pair[0]]*s.m.Weights[pair[1]]/pairNorm)
+	}
+
+	cellLik := make([]float64, len(s.obs))
+	parallel.For(len(s.obs), 0, func(i int) {
+		errRate, dropout := s.member.ErrorRate[i], s.member.DropoutRate[i]
+		logp := make([]float64, k+len(s.pairs))
+		for c := 0; c < k; c++ {
+			logp[c] = logWeight[c]
+			for _, o := range s.obs[i] {
+				logp[c] += singletLik(o, s.m.Genotypes[c][o.v], errRate, dropout)
+			}
+		}
+		for j, pair := range s.pairs {
+			logp[k+j] = logPairWeight[j]
+			for _, o := range s.obs[i] {
+				logp[k+j] += doubletLik(o, s.m.Genotypes[pair[0]][o.v], s.m.Genotypes[pair[1]][o.v], errRate)
+			}
+		}
+		cellLik[i] = logSumExp(logp)
+		s.member.Doublet[i] = 0
+		for c := range logp {
+			if c < k {
+				s.member.Posterior[i][c] = math.Exp(logp[c] - cellLik[i])
+			} else {
+				s.member.Doublet[i] += math.Exp(logp[c] - cellLik[i])
+			}
+		}
+	})
+
+	s.member.LogLikelihood = 0
+	for _, lik := range cellLik {
+		s.member.LogLikelihood += lik
+	}
+}
+
+// minResponsibility is the smallest posterior for which a cell contributes to the parameters of a clone.
+const minResponsibility = 1e-6
+
+// updateModel sets the clone weights, doublet rate, and clone genotypes to their maximum
+// likelihood values given the current posteriors. Doublets are not used to update genotypes.
+func (s *modelState) updateModel() {
+	k := len(s.m.Genotypes)
+	var doublets float64
+	for i := range s.obs {
+		doublets += s.member.Doublet[i]
+	}
+	if s.m.DoubletRate > 0 {
+		s.m.DoubletRate = math.Min(math.Max(doublets/float64(len(s.obs)), minResponsibility), s.param.MaxDoubletRate)
+	}
+
+	// weights are smoothed by one pseudo-cell per clone so that empty clones remain valid
+	var total float64
+	for c := 0; c < k; c++ {
+		s.m.Weights[c] = 1
+		for i := range s.obs {
+			s.m.Weights[c] += s.member.Posterior[i][c]
+		}
+		total += s.m.Weights[c]
+	}
+	for c := range s.m.Weights {
+		s.m.Weights[c] /= total
+	}
+
+	parallel.For(k, 0, func(c int) {
+		score := make([][3]float64, s.numVars)
+		seen := make([]bool, s.numVars)
+		var r float64
+		for i := range s.obs {
+			r = s.member.Posterior[i][c]
+			if r < minResponsibility {
+				continue
+			}
+			for _, o := range s.obs[i] {
+				seen[o.v] = true
+				for copies := range score[o.v] {
+					score[o.v][copies] += r * singletLik(o, copies, s.member.ErrorRate[i], s.member.DropoutRate[i])
+				}
+			}
+		}
+		for v := range score {
+			if seen[v] {
+				s.m.Genotypes[c][v] = floats.MaxIdx(score[v][:])
+			}
+		}
+	})
+}
+
+// Limits of per-cell rates to keep likelihoods finite.
+const (
+	minErrorRate = 1e-5
+	maxErrorRate = 0.25
+	minDropout   = 1e-4
+	maxDropout   = 0.95
+)
+
+// updateCells sets the error and dropout rate of each cell to their maximum a posteriori values
+// given the genotypes of the clones weighted by the posterior of the cell in each clone.
+func (s *modelState) updateCells() {
+	k := len(s.m.Genotypes)
+	parallel.For(len(s.obs), 0, func(i int) {
+		var singlet float64
+		for c := 0; c < k; c++ {
+			singlet += s.member.Posterior[i][c]
+		}
+		errRate, dropout := s.member.ErrorRate[i], s.member.DropoutRate[i]
+		var errs, errTrials, drops, hetSites, r, total, lik float64
+		for c := 0; singlet > 0 && c < k; c++ {
+			r = s.member.Posterior[i][c] / singlet
+			if r < minResponsibility {
+				continue
+			}
+			for _, o := range s.obs[i] {
+				switch s.m.Genotypes[c][o.v] {
+				case 0:
+					errs += r * float64(o.alt)
+					errTrials += r * float64(o.depth)
+				case 2:
+					errs += r * float64(o.depth-o.alt)
+					errTrials += r * float64(o.depth)
+				default:
+					// posterior of no dropout, dropout of the alt allele, and dropout of the ref allele
+					total = singletLik(o, 1, errRate, dropout)
+					lik = math.Exp(math.Log(dropout/2) + logBinom(o.alt, o.depth, errRate) - total)
+					errs += r * lik * float64(o.alt)
+					errTrials += r * lik * float64(o.depth)
+					drops += r * lik
+					lik = math.Exp(math.Log(dropout/2) + logBinom(o.alt, o.depth, 1-errRate) - total)
+					errs += r * lik * float64(o.depth-o.alt)
+					errTrials += r * lik * float64(o.depth)
+					drops += r * lik
+					hetSites += r
+				}
+			}
+		}
+		s.member.ErrorRate[i] = clamp((errs+s.param.ErrorRate*s.param.ErrorPrior)/(errTrials+s.param.ErrorPrior), minErrorRate, maxErrorRate)
+		s.member.DropoutRate[i] = clamp((drops+s.param.DropoutRate*s.param.DropoutPrior)/(hetSites+s.param.DropoutPrior), minDropout, maxDropout)
+	})
+
+	if !s.fixed {
+		s.m.ErrorRate, s.m.DropoutRate = mean(s.member.ErrorRate), mean(s.member.DropoutRate)
+	}
+}
+
+func clamp(x, min, max float64) float64 {
+	return math.Min(math.Max(x, min), max)
+}
+
+func mean(x []float64) float64 {
+	if len(x) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, val := range x {
+		sum += val
+	}
+	return sum / float64(len(x))
+}
+
+// WriteModel writes a CloneModel to a file as JSON.
+func WriteModel(file string, m *CloneModel) {
+	out := fileio.EasyCreate(file)
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	exception.PanicOnErr(enc.Encode(m))
+	exception.PanicOnErr(out.Close())
+}
+
+// ReadModel reads a CloneModel written by WriteModel.
+func ReadModel(file string) *CloneModel {
+	in := fileio.EasyOpen(file)
+	m := new(CloneModel)
+	exception.PanicOnErr(json.NewDecoder(in).Decode(m))
+	exception.PanicOnErr(in.Close())
+	if len(m.Genotypes) != len(m.Weights) {
+		log.Panicf("malformed clone model '%s'. found %d clone genotypes and %d clone weights", file, len(m.Genotypes), len(m.Weights))
+	}
+	for k := range m.Genotypes {
+		if len(m.Genotypes[k]) != len(m.Variants) {
+			log.Panicf("malformed clone model '%s'. clone %d has %d genotypes for %d variants", file, k, len(m.Genotypes[k]), len(m.Variants))
+		}
+	}
+	return m
+}
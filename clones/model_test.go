@@ -0,0 +1,102 @@
+package clones
+
+import (
+	"github.com/ddsnellings/weaver/cells/cellstest"
+	"gonum.org/v1/gonum/floats"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+// simulateReads returns data with reads drawn from each cell's clone genotype with allelic dropout
+// and sequencing errors. The last doublets cells are mixtures of the first and last clone.
+func simulateReads(cellsPerClone int, doublets int) ([][]int, [][]int) {
+	r := rand.New(rand.NewSource(5))
+	genotypes := simulateClones(cellsPerClone, 0.1)
+	first, last := cloneGenotypes[0], cloneGenotypes[len(cloneGenotypes)-1]
+	for i := 0; i < doublets; i++ {
+		cell := make([]int, len(first))
+		for j := range cell {
+			cell[j] = (first[j] + last[j]) / 2
+		}
+		genotypes = append(genotypes, cell)
+	}
+
+	alt := make([][]int, len(genotypes))
+	var af float64
+	for i := range genotypes {
+		alt[i] = make([]int, len(genotypes[i]))
+		for j, g := range genotypes[i] {
+			if g == -1 {
+				continue
+			}
+			af = float64(g) / 2
+			if i >= len(genotypes)-doublets {
+				af = float64(first[j]+last[j]) / 4
+			} else if g == 1 && r.Float64() < 0.1 {
+				af = float64(r.Intn(2))
+			}
+			af = af*0.99 + (1-af)*0.01
+			for k := 0; k < 20; k++ {
+				if r.Float64() < af {
+					alt[i][j]++
+				}
+			}
+		}
+	}
+	return genotypes, alt
+}
+
+func TestFitModel(t *testing.T) {
+	genotypes, alt := simulateReads(20, 4)
+	d := cellstest.FromGenotypes(genotypes)
+	for j := range d.Variants {
+		d.Variants[j].Chr = "chr1"
+		d.Variants[j].Pos = j
+	}
+	for i := range d.Cells {
+		for j := range d.Variants {
+			if genotypes[i][j] != -1 {
+				cv := d.CellVar(i, j)
+				cv.ReadDepth = 20
+				cv.AltReads = alt[i][j]
+				d.SetCellVar(i, j, cv)
+			}
+		}
+	}
+
+	p := DefaultModelParam
+	p.K = 3
+	m, member := FitModel(d, p)
+	c := member.Clustering(0.9)
+	c.K = 3
+	singlets := Clustering{Assignment: c.Assignment[:60], K: c.K}
+	if !recovered(singlets, 20) {
+		t.Errorf("clone model did not recover clones: %v", c.Assignment)
+	}
+	for i := 60; i < len(d.Cells); i++ {
+		if member.Doublet[i] < 0.9 || c.Assignment[i] != -1 {
+			t.Errorf("expected cell %d to be called as a doublet. doublet probability %f", i, member.Doublet[i])
+		}
+	}
+	var k int
+	for clone, truth := range cloneGenotypes {
+		k = c.Assignment[clone*20]
+		for v := range truth {
+			if k < 0 || m.Genotypes[k][v] != truth[v] {
+				t.Errorf("clone %d genotypes do not match %v", k, truth)
+				break
+			}
+		}
+	}
+
+	file := filepath.Join(t.TempDir(), "weaver.model.json")
+	WriteModel(file, m)
+	loaded := ReadModel(file)
+	assigned := AssignCells(d, loaded, p)
+	for i := range d.Cells {
+		if floats.MaxIdx(assigned.Posterior[i]) != floats.MaxIdx(member.Posterior[i]) {
+			t.Errorf("cell %d assigned to a different clone after reloading model", i)
+		}
+	}
+}
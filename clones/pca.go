@@ -0,0 +1,95 @@
+package clones
+
+import (
+	"gonum.org/v1/gonum/mat"
+	"gonum.org/v1/gonum/stat"
+	"log"
+)
+
+// PCA stores the result of a principal component analysis of a FeatureMatrix.
+type PCA struct {
+	Scores            *mat.Dense // cell by component. projection of each cell onto each component
+	Loadings          *mat.Dense // variant by component. weight of each variant in each component
+	ExplainedVariance []float64  // fraction of the total variance explained by each component
+	SuggestedK        int        // suggested number of components to retain (broken stick model)
+	CellIds           []int      // Scores row i corresponds to Cell.Id CellIds[i]
+	VariantIds        []int      // Loadings row j corresponds to Variant.Id VariantIds[j]
+}
+
+// PrincipalComponents performs a principal component analysis on the input FeatureMatrix.
+// Columns are centered but not scaled.
+func PrincipalComponents(m FeatureMatrix) PCA {
+	var pc stat.PC
+	ok := pc.PrincipalComponents(m.Values, nil)
+	if !ok {
+		log.Panic("problem with PC analysis")
+	}
+
+	answer := PCA{
+		Loadings:   new(mat.Dense),
+		Scores:     new(mat.Dense),
+		CellIds:    m.CellIds,
+		VariantIds: m.VariantIds,
+	}
+	pc.VectorsTo(answer.Loadings)
+	answer.Scores.Mul(centered(m.Values), answer.Loadings)
+	answer.ExplainedVariance = explainedVariance(pc.VarsTo(nil))
+	answer.SuggestedK = brokenStick(answer.ExplainedVariance)
+	return answer
+}
+
+// Components returns the number of components in the PCA.
+func (p PCA) Components() int {
+	return len(p.ExplainedVariance)
+}
+
+// centered returns a copy of m with the mean of each column subtracted.
+func centered(m *mat.Dense) *mat.Dense {
+	rows, cols := m.Dims()
+	answer := mat.DenseCopyOf(m)
+	var mean float64
+	for j := 0; j < cols; j++ {
+		mean = stat.Mean(mat.Col(nil, j, m), nil)
+		for i := 0; i < rows; i++ {
+			answer.Set(i, j, answer.At(i, j)-mean)
+		}
+	}
+	return answer
+}
+
+// explainedVariance converts component variances to the fraction of total variance.
+func explainedVariance(vars []float64) []float64 {
+	var total float64
+	for i := range vars {
+		total += vars[i]
+	}
+	answer := make([]float64, len(vars))
+	if total == 0 {
+		return answer
+	}
+	for i := range vars {
+		answer[i] = vars[i] / total
+	}
+	return answer
+}
+
+// brokenStick returns the number of leading components that explain more variance than
+// expected under the broken stick model, where the expected fraction explained by
+// component k of p is (1/p) * sum_{i=k}^{p} 1/i. Always returns at least 1.
+func brokenStick(explained []float64) int {
+	p := len(explained)
+	expected := make([]float64, p)
+	var sum float64
+	for k := p; k >= 1; k-- {
+		sum += 1 / float64(k)
+		expected[k-1] = sum / float64(p)
+	}
+	var answer int
+	for answer < p && explained[answer] > expected[answer] {
+		answer++
+	}
+	if answer == 0 {
+		return 1
+	}
+	return answer
+}
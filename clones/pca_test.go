@@ -0,0 +1,49 @@
+package clones
+
+import (
+	"github.com/ddsnellings/weaver/cells/cellstest"
+	"math"
+	"testing"
+)
+
+func TestNewFeatureMatrix(t *testing.T) {
+	d := cellstest.FromGenotypes(cellstest.TwoClones())
+	m := NewFeatureMatrix(d, Dosage, MeanFill)
+	if m.Values.At(3, 4) != 2 || m.Values.At(1, 0) != 1 {
+		t.Errorf("feature matrix values not ordered by cell then variant")
+	}
+	if m.Values.At(0, 1) != 0.4 { // mean of 1, 1, 0, 0, 0
+		t.Errorf("expected missing value to be filled with mean 0.4, found %f", m.Values.At(0, 1))
+	}
+
+	m = NewFeatureMatrix(d, AlleleFrequency, DropCells)
+	if len(m.CellIds) != 3 || m.CellIds[0] != 1 || m.CellIds[1] != 3 {
+		t.Errorf("expected cells 1, 3, and 5 after dropping missing, found %v", m.CellIds)
+	}
+	if m.Values.At(1, 3) != 1 {
+		t.Errorf("expected af of 1, found %f", m.Values.At(1, 3))
+	}
+}
+
+func TestPrincipalComponents(t *testing.T) {
+	d := cellstest.FromGenotypes(cellstest.TwoClones())
+	p := PrincipalComponents(NewFeatureMatrix(d, Dosage, MeanFill))
+	if p.SuggestedK != 1 {
+		t.Errorf("expected 1 suggested component, found %d", p.SuggestedK)
+	}
+	if p.ExplainedVariance[0] < 0.9 {
+		t.Errorf("expected first component to explain most variance, found %f", p.ExplainedVariance[0])
+	}
+	for i := 0; i < 3; i++ {
+		if math.Signbit(p.Scores.At(i, 0)) == math.Signbit(p.Scores.At(i+3, 0)) {
+			t.Errorf("first component does not separate clones")
+		}
+	}
+}
+
+func TestPrincipalComponent(t *testing.T) {
+	pc := PrincipalComponent(cellstest.FromGenotypes(cellstest.TwoClones()))
+	if vars := pc.VarsTo(nil); len(vars) != 6 || vars[0] <= vars[1] {
+		t.Errorf("expected 6 decreasing variances, found %v", vars)
+	}
+}
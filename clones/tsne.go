@@ -0,0 +1,342 @@
+package clones
+
+import (
+	"github.com/ddsnellings/weaver/parallel"
+	"gonum.org/v1/gonum/mat"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// TsneParam defines the parameters for a Barnes-Hut t-SNE embedding.
+type TsneParam struct {
+	Perplexity             float64 // effective number of neighbors for each point // Default 30
+	Theta                  float64 // Barnes-Hut accuracy. 0 is exact, larger is faster // Default 0.5
+	Iterations             int     // number of gradient descent iterations // Default 1000
+	LearningRate           float64 // 0 uses max(cells / EarlyExaggeration, 50)
+	EarlyExaggeration      float64 // multiplier of input affinities early in optimization // Default 12
+	ExaggerationIterations int     // number of iterations with early exaggeration // Default 250
+	Seed                   int64   // seed for random number generation. identical seeds give identical embeddings
+	Workers                int     // number of goroutines. 0 uses all available cores
+}
+
+var DefaultTsneParam = TsneParam{Perplexity: 30, Theta: 0.5, Iterations: 1000, EarlyExaggeration: 12, ExaggerationIterations: 250, Seed: 1}
+
+// sparseRow stores the non-zero affinities of one point, sorted by column.
+type sparseRow struct {
+	cols []int
+	vals []float64
+}
+
+// Tsne embeds each row of x (e.g. PCA scores of each cell) into 2 dimensions with
+// Barnes-Hut t-distributed stochastic neighbor embedding (van der Maaten 2014).
+// Input affinities are computed from the 3*Perplexity nearest neighbors of each point.
+// Forces are computed in parallel from a shared quadtree, such that the embedding is
+// identical for a given seed regardless of the number of workers.
+// Returns a matrix with a row for each row of x and 2 columns.
+func Tsne(x mat.Matrix, p TsneParam) *mat.Dense {
+	data := rows(x)
+	n := len(data)
+	if float64(n-1) < 3*p.Perplexity {
+		log.Panicf("error: perplexity %g is too large for %d cells. must be < (cells - 1) / 3", p.Perplexity, n)
+	}
+	if p.LearningRate == 0 {
+		p.LearningRate = math.Max(float64(n)/p.EarlyExaggeration, 50)
+	}
+
+	knn := nearestNeighbors(data, int(3*p.Perplexity), p.Workers)
+	affinities := tsneAffinities(knn, p.Perplexity, p.Workers)
+
+	r := rand.New(rand.NewSource(p.Seed))
+	y := make([][2]float64, n)
+	for i := range y {
+		y[i] = [2]float64{r.NormFloat64() * 1e-4, r.NormFloat64() * 1e-4}
+	}
+	update := make([][2]float64, n)
+	gains := make([][2]float64, n)
+	for i := range gains {
+		gains[i] = [2]float64{1, 1}
+	}
+
+	attr := make([][2]float64, n)
+	rep := make([][2]float64, n)
+	z := make([]float64, n)
+	exaggeration, momentum := p.EarlyExaggeration, 0.5
+	var tree quadtree
+	var sumZ, grad float64
+	for iter := 0; iter < p.Iterations; iter++ {
+		if iter == p.ExaggerationIterations {
+			exaggeration, momentum = 1, 0.8
+		}
+
+		tree.build(y)
+		parallel.For(n, p.Workers, func(i int) {
+			attr[i] = tsneAttractive(i, y, affinities[i], exaggeration)
+			rep[i], z[i] = tree.repulsive(i, y[i], p.Theta)
+		})
+
+		sumZ = 0
+		for i := range z {
+			sumZ += z[i]
+		}
+		for i := range y {
+			for d := 0; d < 2; d++ {
+				grad = 4 * (attr[i][d] - rep[i][d]/sumZ)
+				if math.Signbit(grad) != math.Signbit(update[i][d]) {
+					gains[i][d] += 0.2
+				} else {
+					gains[i][d] = math.Max(gains[i][d]*0.8, 0.01)
+				}
+				update[i][d] = momentum*update[i][d] - p.LearningRate*gains[i][d]*grad
+				y[i][d] += update[i][d]
+			}
+		}
+		center(y)
+	}
+
+	answer := mat.NewDense(n, 2, nil)
+	for i := range y {
+		answer.Set(i, 0, y[i][0])
+		answer.Set(i, 1, y[i][1])
+	}
+	return answer
+}
+
+// tsneAffinities finds the conditional probabilities p(j|i) for each neighbor that give the
+// target perplexity, then symmetrizes them as p_ij = (p(j|i) + p(i|j)) / 2n.
+func tsneAffinities(knn neighbors, perplexity float64, workers int) []sparseRow {
+	n := len(knn.Idx)
+	conditional := make([][]float64, n)
+	target := math.Log(perplexity)
+	parallel.For(n, workers, func(i int) {
+		conditional[i] = perplexityRow(knn.Dist[i], target)
+	})
+
+	sym := make([]map[int]float64, n)
+	for i := range sym {
+		sym[i] = make(map[int]float64, len(knn.Idx[i]))
+	}
+	for i := range knn.Idx {
+		for nIdx, j := range knn.Idx[i] {
+			sym[i][j] += conditional[i][nIdx] / float64(2*n)
+			sym[j][i] += conditional[i][nIdx] / float64(2*n)
+		}
+	}
+
+	answer := make([]sparseRow, n)
+	for i := range sym {
+		answer[i].cols = make([]int, 0, len(sym[i]))
+		for j := range sym[i] {
+			answer[i].cols = append(answer[i].cols, j)
+		}
+		sort.Ints(answer[i].cols)
+		answer[i].vals = make([]float64, len(answer[i].cols))
+		for c, j := range answer[i].cols {
+			answer[i].vals[c] = sym[i][j]
+		}
+	}
+	return answer
+}
+
+// perplexityRow uses a binary search for the gaussian precision that gives the
+// target entropy (in nats) over neighbors at the input distances.
+// Returns the normalized conditional probability of each neighbor.
+func perplexityRow(dist []float64, target float64) []float64 {
+	answer := make([]float64, len(dist))
+	beta, lo, hi := 1.0, 0.0, math.Inf(1)
+	var sum, sumDP, entropy float64
+	for iter := 0; iter < 200; iter++ {
+		sum, sumDP = 0, 0
+		for j, d := range dist {
+			answer[j] = math.Exp(-beta * d * d)
+			sum += answer[j]
+			sumDP += d * d * answer[j]
+		}
+		if sum == 0 {
+			sum = math.SmallestNonzeroFloat64
+		}
+		entropy = math.Log(sum) + beta*sumDP/sum
+		if math.Abs(entropy-target) < 1e-5 {
+			break
+		}
+		if entropy > target {
+			lo = beta
+			if math.IsInf(hi, 1) {
+				beta *= 2
+			} else {
+				beta = (lo + hi) / 2
+			}
+		} else {
+			hi = beta
+			beta = (lo + hi) / 2
+		}
+	}
+	for j := range answer {
+		answer[j] /= sum
+	}
+	return answer
+}
+
+// tsneAttractive returns the attractive force on point i from its input neighbors.
+func tsneAttractive(i int, y [][2]float64, row sparseRow, exaggeration float64) [2]float64 {
+	var answer [2]float64
+	var dx, dy, q float64
+	for c, j := range row.cols {
+		dx = y[i][0] - y[j][0]
+		dy = y[i][1] - y[j][1]
+		q = 1 / (1 + dx*dx + dy*dy)
+		answer[0] += exaggeration * row.vals[c] * q * dx
+		answer[1] += exaggeration * row.vals[c] * q * dy
+	}
+	return answer
+}
+
+// center subtracts the mean from each dimension of y.
+func center(y [][2]float64) {
+	var mean [2]float64
+	for i := range y {
+		mean[0] += y[i][0]
+		mean[1] += y[i][1]
+	}
+	mean[0] /= float64(len(y))
+	mean[1] /= float64(len(y))
+	for i := range y {
+		y[i][0] -= mean[0]
+		y[i][1] -= mean[1]
+	}
+}
+
+// quadtree partitions 2D points for Barnes-Hut approximation of repulsive forces.
+// Nodes are stored in a slice and reused between iterations.
+type quadtree struct {
+	nodes []quadNode
+}
+
+type quadNode struct {
+	cx, cy     float64 // center of the cell
+	halfWidth  float64
+	comX, comY float64 // center of mass of points in the cell
+	count      int
+	point      int      // index of the single point in a leaf, -1 otherwise
+	children   [4]int32 // index of child nodes. 0 if the node is a leaf
+}
+
+// maxQuadDepth limits subdivision so identical points share a leaf.
+const maxQuadDepth = 50
+
+// build constructs the quadtree over all points in y.
+func (t *quadtree) build(y [][2]float64) {
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for i := range y {
+		minX, maxX = math.Min(minX, y[i][0]), math.Max(maxX, y[i][0])
+		minY, maxY = math.Min(minY, y[i][1]), math.Max(maxY, y[i][1])
+	}
+	t.nodes = t.nodes[:0]
+	t.nodes = append(t.nodes, quadNode{
+		cx:        (minX + maxX) / 2,
+		cy:        (minY + maxY) / 2,
+		halfWidth: math.Max(maxX-minX, maxY-minY)/2 + 1e-5,
+		point:     -1,
+	})
+	for i := range y {
+		t.insert(0, i, y, 0)
+	}
+}
+
+// insert adds point i to the subtree rooted at node.
+func (t *quadtree) insert(node int, i int, y [][2]float64, depth int) {
+	for {
+		nd := &t.nodes[node]
+		nd.comX = (nd.comX*float64(nd.count) + y[i][0]) / float64(nd.count+1)
+		nd.comY = (nd.comY*float64(nd.count) + y[i][1]) / float64(nd.count+1)
+		nd.count++
+
+		if nd.children[0] == 0 { // leaf
+			if nd.count == 1 {
+				nd.point = i
+				return
+			}
+			if depth >= maxQuadDepth {
+				nd.point = -1
+				return
+			}
+			existing := nd.point
+			nd.point = -1
+			t.subdivide(node)
+			if existing != -1 {
+				child := t.childFor(node, y[existing])
+				t.nodes[child].comX, t.nodes[child].comY = y[existing][0], y[existing][1]
+				t.nodes[child].count = 1
+				t.nodes[child].point = existing
+			}
+		}
+		node = t.childFor(node, y[i])
+		depth++
+	}
+}
+
+// subdivide creates the 4 children of node.
+func (t *quadtree) subdivide(node int) {
+	hw := t.nodes[node].halfWidth / 2
+	cx, cy := t.nodes[node].cx, t.nodes[node].cy
+	for c := 0; c < 4; c++ {
+		child := quadNode{halfWidth: hw, point: -1, cx: cx - hw, cy: cy - hw}
+		if c&1 == 1 {
+			child.cx = cx + hw
+		}
+		if c&2 == 2 {
+			child.cy = cy + hw
+		}
+		t.nodes = append(t.nodes, child)
+		t.nodes[node].children[c] = int32(len(t.nodes) - 1)
+	}
+}
+
+// childFor returns the child of node containing point p.
+func (t *quadtree) childFor(node int, p [2]float64) int {
+	var c int
+	if p[0] >= t.nodes[node].cx {
+		c |= 1
+	}
+	if p[1] >= t.nodes[node].cy {
+		c |= 2
+	}
+	return int(t.nodes[node].children[c])
+}
+
+// repulsive returns the unnormalized repulsive force on point i at position p
+// and its contribution to the normalization term Z.
+func (t *quadtree) repulsive(i int, p [2]float64, theta float64) (force [2]float64, z float64) {
+	stack := make([]int, 1, 64)
+	var node, count int
+	var nd *quadNode
+	var dx, dy, d2, q float64
+	for len(stack) > 0 {
+		node = stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		nd = &t.nodes[node]
+		if nd.count == 0 || nd.point == i {
+			continue
+		}
+		dx = p[0] - nd.comX
+		dy = p[1] - nd.comY
+		d2 = dx*dx + dy*dy
+		if nd.children[0] == 0 || 4*nd.halfWidth*nd.halfWidth < theta*theta*d2 {
+			count = nd.count
+			if d2 == 0 { // i shares this leaf with identical points
+				count--
+			}
+			q = 1 / (1 + d2)
+			z += float64(count) * q
+			force[0] += float64(count) * q * q * dx
+			force[1] += float64(count) * q * q * dy
+			continue
+		}
+		for _, child := range nd.children {
+			stack = append(stack, int(child))
+		}
+	}
+	return force, z
+}
@@ -0,0 +1,292 @@
+package clones
+
+import (
+	"github.com/ddsnellings/weaver/parallel"
+	"gonum.org/v1/gonum/mat"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// UmapParam defines the parameters for a UMAP embedding.
+type UmapParam struct {
+	Neighbors       int     // number of nearest neighbors used to build the fuzzy graph // Default 15
+	MinDist         float64 // minimum distance between embedded points // Default 0.1
+	Spread          float64 // scale of embedded points // Default 1
+	Dims            int     // number of embedding dimensions // Default 2
+	Epochs          int     // optimization epochs. 0 uses 500 for < 10000 cells and 200 otherwise
+	LearningRate    float64 // initial learning rate // Default 1
+	NegativeSamples int     // negative samples per positive sample // Default 5
+	Seed            int64   // seed for random number generation. identical seeds give identical embeddings
+	Workers         int     // number of goroutines. 0 uses all available cores
+}
+
+var DefaultUmapParam = UmapParam{Neighbors: 15, MinDist: 0.1, Spread: 1, Dims: 2, LearningRate: 1, NegativeSamples: 5, Seed: 1}
+
+// umapEdge is an edge in the symmetric fuzzy simplicial set. Each vertex
+// owns its outgoing edges and the sampling schedule for those edges.
+type umapEdge struct {
+	to                      int
+	epochsPerSample         float64
+	nextSample              float64
+	epochsPerNegativeSample float64
+	nextNegativeSample      float64
+}
+
+// Umap embeds each row of x (e.g. PCA scores of each cell) into p.Dims dimensions with
+// uniform manifold approximation and projection (McInnes et al. 2018). Positions are
+// updated in parallel with all randomness drawn from streams seeded by p.Seed, such that
+// the embedding is identical for a given seed regardless of the number of workers.
+// Returns a matrix with a row for each row of x.
+func Umap(x mat.Matrix, p UmapParam) *mat.Dense {
+	data := rows(x)
+	n := len(data)
+	if n < 3 {
+		log.Panicf("error: umap requires at least 3 cells, found %d", n)
+	}
+	if p.Epochs == 0 {
+		p.Epochs = 500
+		if n >= 10000 {
+			p.Epochs = 200
+		}
+	}
+
+	knn := nearestNeighbors(data, p.Neighbors, p.Workers)
+	graph := fuzzySimplicialSet(knn, p.Epochs, p.NegativeSamples)
+	a, b := findAB(p.Spread, p.MinDist)
+
+	r := rand.New(rand.NewSource(p.Seed))
+	curr := make([][]float64, n)
+	next := make([][]float64, n)
+	for i := range curr {
+		curr[i] = make([]float64, p.Dims)
+		next[i] = make([]float64, p.Dims)
+		for d := range curr[i] {
+			curr[i][d] = r.Float64()*20 - 10
+		}
+	}
+
+	for epoch := 0; epoch < p.Epochs; epoch++ {
+		alpha := p.LearningRate * (1 - float64(epoch)/float64(p.Epochs))
+		parallel.For(n, p.Workers, func(i int) {
+			umapUpdateVertex(i, epoch, graph[i], curr, next[i], a, b, alpha, p.Seed)
+		})
+		curr, next = next, curr
+	}
+
+	answer := mat.NewDense(n, p.Dims, nil)
+	for i := range curr {
+		answer.SetRow(i, curr[i])
+	}
+	return answer
+}
+
+// umapUpdateVertex applies the attractive and repulsive forces for all edges of
+// vertex i scheduled in the current epoch. Reads positions from curr and writes the
+// updated position of vertex i to out.
+func umapUpdateVertex(i int, epoch int, edges []umapEdge, curr [][]float64, out []float64, a, b, alpha float64, seed int64) {
+	copy(out, curr[i])
+	r := newRng(seed, epoch, i)
+	e := float64(epoch)
+	var distSq, coeff float64
+	var numNeg, k, s int
+	for j := range edges {
+		if edges[j].nextSample > e {
+			continue
+		}
+
+		distSq = sqDist(out, curr[edges[j].to])
+		if distSq > 0 {
+			coeff = -2 * a * b * math.Pow(distSq, b-1) / (a*math.Pow(distSq, b) + 1)
+			for d := range out {
+				out[d] += clip(coeff*(out[d]-curr[edges[j].to][d])) * alpha
+			}
+		}
+		edges[j].nextSample += edges[j].epochsPerSample
+
+		numNeg = int((e - edges[j].nextNegativeSample) / edges[j].epochsPerNegativeSample)
+		for s = 0; s < numNeg; s++ {
+			k = r.intn(len(curr))
+			if k == i {
+				continue
+			}
+			distSq = sqDist(out, curr[k])
+			if distSq > 0 {
+				coeff = 2 * b / ((0.001 + distSq) * (a*math.Pow(distSq, b) + 1))
+				for d := range out {
+					out[d] += clip(coeff*(out[d]-curr[k][d])) * alpha
+				}
+			} else {
+				for d := range out {
+					out[d] += 4 * alpha
+				}
+			}
+		}
+		edges[j].nextNegativeSample += float64(numNeg) * edges[j].epochsPerNegativeSample
+	}
+}
+
+// clip limits gradients to [-4, 4].
+func clip(x float64) float64 {
+	return math.Max(-4, math.Min(4, x))
+}
+
+// fuzzySimplicialSet converts the k nearest neighbors into a symmetric weighted graph
+// and determines how often each edge is sampled during optimization. Returns the
+// outgoing edges for each vertex sorted by the target vertex.
+func fuzzySimplicialSet(knn neighbors, epochs int, negativeSamples int) [][]umapEdge {
+	n := len(knn.Idx)
+	sigma, rho := smoothKnnDist(knn.Dist)
+
+	directed := make([]map[int]float64, n)
+	for i := range directed {
+		directed[i] = make(map[int]float64, len(knn.Idx[i]))
+	}
+	var w float64
+	for i := range knn.Idx {
+		for nIdx, j := range knn.Idx[i] {
+			w = 1
+			if knn.Dist[i][nIdx]-rho[i] > 0 && sigma[i] > 0 {
+				w = math.Exp(-(knn.Dist[i][nIdx] - rho[i]) / sigma[i])
+			}
+			directed[i][j] = w
+		}
+	}
+
+	// fuzzy union: w_ij = a + b - a*b
+	weights := make([]map[int]float64, n)
+	for i := range weights {
+		weights[i] = make(map[int]float64)
+	}
+	var maxWeight float64
+	for i := range directed {
+		for j, wij := range directed[i] {
+			wji := directed[j][i]
+			w = wij + wji - wij*wji
+			weights[i][j] = w
+			weights[j][i] = w
+			maxWeight = math.Max(maxWeight, w)
+		}
+	}
+
+	answer := make([][]umapEdge, n)
+	for i := range weights {
+		for j, w := range weights[i] {
+			if w < maxWeight/float64(epochs) {
+				continue
+			}
+			eps := maxWeight / w
+			answer[i] = append(answer[i], umapEdge{
+				to:                      j,
+				epochsPerSample:         eps,
+				nextSample:              eps,
+				epochsPerNegativeSample: eps / float64(negativeSamples),
+				nextNegativeSample:      eps / float64(negativeSamples),
+			})
+		}
+		sort.Slice(answer[i], func(a, b int) bool {
+			return answer[i][a].to < answer[i][b].to
+		})
+	}
+	return answer
+}
+
+// smoothKnnDist finds for each point the distance to its nearest neighbor (rho) and
+// a bandwidth (sigma) such that the sum of edge weights to its neighbors is log2(k).
+func smoothKnnDist(dist [][]float64) (sigma []float64, rho []float64) {
+	sigma = make([]float64, len(dist))
+	rho = make([]float64, len(dist))
+	var lo, hi, mid, psum, meanDist, d float64
+	for i := range dist {
+		if len(dist[i]) == 0 {
+			continue
+		}
+		target := math.Log2(float64(len(dist[i])))
+		meanDist = 0
+		for _, d = range dist[i] {
+			meanDist += d
+			if rho[i] == 0 && d > 0 {
+				rho[i] = d
+			}
+		}
+		meanDist /= float64(len(dist[i]))
+
+		lo, hi, mid = 0, math.Inf(1), 1
+		for iter := 0; iter < 64; iter++ {
+			psum = 0
+			for _, d = range dist[i] {
+				if d-rho[i] > 0 {
+					psum += math.Exp(-(d - rho[i]) / mid)
+				} else {
+					psum++
+				}
+			}
+			if math.Abs(psum-target) < 1e-5 {
+				break
+			}
+			if psum > target {
+				hi = mid
+				mid = (lo + hi) / 2
+			} else {
+				lo = mid
+				if math.IsInf(hi, 1) {
+					mid *= 2
+				} else {
+					mid = (lo + hi) / 2
+				}
+			}
+		}
+		sigma[i] = math.Max(mid, 0.001*meanDist)
+	}
+	return sigma, rho
+}
+
+// findAB fits the curve 1 / (1 + a*x^(2b)) to the target membership function that is 1
+// for x < minDist and exp(-(x - minDist) / spread) otherwise. Uses an iteratively
+// refined grid search so that the fit is deterministic.
+func findAB(spread, minDist float64) (a, b float64) {
+	xs := make([]float64, 300)
+	ys := make([]float64, len(xs))
+	for i := range xs {
+		xs[i] = 3 * spread * float64(i+1) / float64(len(xs))
+		if xs[i] < minDist {
+			ys[i] = 1
+		} else {
+			ys[i] = math.Exp(-(xs[i] - minDist) / spread)
+		}
+	}
+
+	sse := func(a, b float64) float64 {
+		var answer, diff float64
+		for i := range xs {
+			diff = 1/(1+a*math.Pow(xs[i], 2*b)) - ys[i]
+			answer += diff * diff
+		}
+		return answer
+	}
+
+	logA, bestB := 0.0, 1.0
+	widthLogA, widthB := 3.0, 0.9
+	best := math.Inf(1)
+	var currLogA, currB, currSse float64
+	for refine := 0; refine < 8; refine++ {
+		centerLogA, centerB := logA, bestB
+		for ai := -10; ai <= 10; ai++ {
+			for bi := -10; bi <= 10; bi++ {
+				currLogA = centerLogA + widthLogA*float64(ai)/10
+				currB = centerB + widthB*float64(bi)/10
+				if currB <= 0 {
+					continue
+				}
+				currSse = sse(math.Exp(currLogA), currB)
+				if currSse < best {
+					best, logA, bestB = currSse, currLogA, currB
+				}
+			}
+		}
+		widthLogA /= 4
+		widthB /= 4
+	}
+	return math.Exp(logA), bestB
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ddsnellings/weaver/bam"
+	"github.com/ddsnellings/weaver/interval"
+	"github.com/ddsnellings/weaver/reference"
+	"github.com/ddsnellings/weaver/variants"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"log"
+	"sort"
+	"strings"
+)
+
+func usage() {
+	fmt.Print(
+		"bamGenotype - Genotype cells directly from a multi-cell BAM file split by the cell barcode tag.\n\n" +
+			"Usage:\n" +
+			"  bamGenotype -i infile.bam -sites sites.vcf.gz\n" +
+			"  bamGenotype -i infile.bam -bed regions.bed -fasta ref.fa\n" +
+			"  bamGenotype -i infile.bam -sites sites.vcf.gz -phase phased.csv\n\n" +
+			"Options:\n\n")
+	flag.PrintDefaults()
+}
+
+func genotype(infile string, outfile string, sitesFile string, bedFile string, fastaFile string, phaseFile string, p bam.Param) {
+	var ref *reference.Fasta
+	if fastaFile != "" {
+		ref = reference.Open(fastaFile)
+		defer ref.Close()
+	}
+	var sites []variants.Variant
+	switch {
+	case sitesFile != "" && ref != nil:
+		sites = bam.ReadSitesVcf(sitesFile, ref)
+	case sitesFile != "":
+		sites = bam.ReadSitesVcf(sitesFile, nil)
+	case ref != nil:
+		sites = bam.FindSites(infile, interval.ReadBed(bedFile), ref, p)
+		log.Printf("found %d sites", len(sites))
+	default:
+		log.Panic("-bed requires -fasta")
+	}
+
+	if phaseFile != "" {
+		pairs := bam.Phase(infile, sites, p)
+		bam.SetPhase(sites, pairs, p)
+		writePhase(phaseFile, sites, pairs)
+		log.Printf("phased %d blocks", len(variants.PhaseBlocks(sites)))
+	}
+
+	d := bam.Genotype(infile, sites, p)
+	log.Printf("genotyped %d cells at %d sites", len(d.Cells), len(d.Variants))
+
+	out := fileio.EasyCreate(outfile)
+	var err error
+	_, err = fmt.Fprintln(out, "Cell,Barcode,Variant,Depth,AltReads,Genotype,GenotypeQuality")
+	exception.PanicOnErr(err)
+	for i := range d.Cells {
+		for vid := range d.Variants {
+			cv := d.CellVar(i, vid)
+			if cv.ReadDepth == 0 {
+				continue
+			}
+			_, err = fmt.Fprintf(out, "%d,%s,%s,%d,%d,%s,%d\n", i, d.Cells[i].Name, d.Variants[cv.Vid].Key(),
+				cv.ReadDepth, cv.AltReads, cv.Genotype, cv.GenotypeQuality)
+			exception.PanicOnErr(err)
+		}
+	}
+	exception.PanicOnErr(out.Close())
+}
+
+// writePhase writes the pooled support of each pair followed by the support in each cell.
+func writePhase(file string, sites []variants.Variant, pairs []bam.PhasedPair) {
+	out := fileio.EasyCreate(file)
+	var err error
+	_, err = fmt.Fprintln(out, "VariantA,VariantB,Cell,RefRef,RefAlt,AltRef,AltAlt,PhaseSet")
+	exception.PanicOnErr(err)
+	var barcodes []string
+	var s [2][2]int
+	for _, pp := range pairs {
+		phaseSet := 0
+		if sites[pp.A].PhaseSet == sites[pp.B].PhaseSet {
+			phaseSet = sites[pp.A].PhaseSet
+		}
+		barcodes = barcodes[:0]
+		for barcode := range pp.Cells {
+			barcodes = append(barcodes, barcode)
+		}
+		sort.Strings(barcodes)
+		barcodes = append([]string{"pooled"}, barcodes...)
+		for _, barcode := range barcodes {
+			if barcode == "pooled" {
+				s = pp.Support
+			} else {
+				s = pp.Cells[barcode]
+			}
+			_, err = fmt.Fprintf(out, "%s,%s,%s,%d,%d,%d,%d,%d\n", sites[pp.A].Key(), sites[pp.B].Key(), barcode,
+				s[0][0], s[0][1], s[1][0], s[1][1], phaseSet)
+			exception.PanicOnErr(err)
+		}
+	}
+	exception.PanicOnErr(out.Close())
+}
+
+func main() {
+	var infile *string = flag.String("i", "", "Input bam file (or sam file ending in .sam or .sam.gz)")
+	var outfile *string = flag.String("o", "infile.genotypes.csv", "Output genotype table with one row per cell and covered site")
+	var sitesFile *string = flag.String("sites", "", "VCF file of sites to genotype")
+	var bedFile *string = flag.String("bed", "", "BED file of regions to search for sites. Requires -fasta. Ignored if -sites is given")
+	var fasta *string = flag.String("fasta", "", "Indexed reference fasta. Used to find sites in -bed regions and to left-align indels in -sites")
+	var barcodesFile *string = flag.String("barcodes", "", "File with one cell barcode per line. By default every barcode with at least -minCellReads reads is genotyped")
+	var tag *string = flag.String("tag", bam.DefaultParam.BarcodeTag, "Tag storing the cell barcode of each read")
+	var minCellReads *int = flag.Int("minCellReads", bam.DefaultParam.MinCellReads, "Minimum reads overlapping the sites for a barcode to be called a cell")
+	var minMapQ *int = flag.Int("minMapQ", bam.DefaultParam.MinMapQ, "Minimum mapping quality of reads")
+	var minBaseQual *int = flag.Int("minBaseQual", bam.DefaultParam.MinBaseQual, "Minimum base quality of bases at a site")
+	var phaseFile *string = flag.String("phase", "", "Output file for read-backed phasing of nearby sites, with the support of each pair pooled and in each cell")
+	var maxPhaseDist *int = flag.Int("maxPhaseDist", bam.DefaultParam.MaxPhaseDist, "Maximum distance between phased sites")
+	var minPhaseReads *int = flag.Int("minPhaseReads", bam.DefaultParam.MinPhaseReads, "Minimum reads covering both sites of a pair to join them in a phased block")
+	var minPhaseFrac *float64 = flag.Float64("minPhaseFrac", bam.DefaultParam.MinPhaseFrac, "Minimum fraction of reads supporting the cis or trans phase of a pair to join them in a phased block")
+	var minAltReads *int = flag.Int("minAltReads", bam.DefaultParam.MinAltReads, "Minimum alt reads pooled across cells to report a site found in -bed regions")
+	flag.Parse()
+
+	if *infile == "" || (*sitesFile == "" && *bedFile == "") {
+		usage()
+		return
+	}
+
+	if *outfile == "infile.genotypes.csv" {
+		*outfile = strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(*infile, ".gz"), ".bam"), ".sam") + ".genotypes.csv"
+	}
+
+	p := bam.DefaultParam
+	p.BarcodeTag = *tag
+	p.MinCellReads = *minCellReads
+	p.MinMapQ = *minMapQ
+	p.MinBaseQual = *minBaseQual
+	p.MinAltReads = *minAltReads
+	p.MaxPhaseDist = *maxPhaseDist
+	p.MinPhaseReads = *minPhaseReads
+	p.MinPhaseFrac = *minPhaseFrac
+	if *barcodesFile != "" {
+		for _, line := range fileio.Read(*barcodesFile) {
+			if line = strings.TrimSpace(line); line != "" {
+				p.Barcodes = append(p.Barcodes, line)
+			}
+		}
+	}
+	genotype(*infile, *outfile, *sitesFile, *bedFile, *fasta, *phaseFile, p)
+}
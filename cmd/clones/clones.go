@@ -0,0 +1,511 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/clones"
+	"github.com/ddsnellings/weaver/impute"
+	"github.com/ddsnellings/weaver/reference"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"gonum.org/v1/gonum/mat"
+	"log"
+	"os"
+	"strings"
+)
+
+func usage() {
+	fmt.Print(
+		"clones - Cluster and embed cells by their genotypes.\n\n" +
+			"Usage:\n" +
+			"  clones <command> [options] -i infile.vcf.gz\n\n" +
+			"Commands:\n" +
+			"  pca       Principal component analysis of the cell by variant matrix\n" +
+			"  umap      UMAP embedding of cells\n" +
+			"  tsne      Barnes-Hut t-SNE embedding of cells\n" +
+			"  cluster   Assign cells to clones and report clone consensus genotypes\n" +
+			"  model     Fit a probabilistic clone model, or assign cells to a saved model\n\n" +
+			"Run 'clones <command> -h' for command options.\n")
+}
+
+// matrixFlags are the options shared by all commands to build the cell by variant matrix.
+type matrixFlags struct {
+	infile  *string
+	cache   *string
+	fasta   *string
+	adapter *string
+	feature *string
+	missing *string
+}
+
+func addMatrixFlags(fs *flag.FlagSet) matrixFlags {
+	return matrixFlags{
+		infile:  fs.String("i", "", "Input vcf file (may be vcf.gz)"),
+		cache:   fs.String("cache", "", cacheUsage),
+		fasta:   fs.String("fasta", "", fastaUsage),
+		adapter: fs.String("adapter", "", adapterUsage),
+		feature: fs.String("feature", "af", "Value for each cell and variant: af, dosage, or soft (posterior dosage)"),
+		missing: fs.String("missing", "mean", "Handling of missing genotypes: mean, impute, or drop"),
+	}
+}
+
+const cacheUsage = "Snapshot of the filtered input. Loaded if infile and the filters are unchanged, otherwise written after reading infile"
+
+const fastaUsage = "Indexed reference fasta used to left-align indels so variant keys match other callers"
+
+const adapterUsage = "Variant caller that wrote infile: gatk, bcftools, freebayes, or strelka. Detected from the vcf header if empty"
+
+// readData reads infile, or loads the filtered data from cache if it is a snapshot of infile.
+// Indels are left-aligned against fasta if it is not empty, and FORMAT data is read with the
+// named adapter if it is not empty (see cells.AdapterByName).
+func readData(infile string, cache string, fasta string, adapter string) *cells.Data {
+	p := cells.DefaultReadParam
+	if adapter != "" {
+		p.Adapter = cells.AdapterByName(adapter)
+	}
+	if fasta != "" {
+		ref := reference.Open(fasta)
+		defer ref.Close()
+		p.Reference = ref
+	}
+	if cache == "" {
+		return cells.ReadVcfWithParam(infile, p)
+	}
+	return cells.ReadVcfCached(infile, cache, p)
+}
+
+// build reads the input vcf and returns the data and cell by variant matrix.
+func (m matrixFlags) build() (*cells.Data, clones.FeatureMatrix) {
+	d := readData(*m.infile, *m.cache, *m.fasta, *m.adapter)
+	missing := parseMissing(*m.missing)
+	if missing == clones.Imputed {
+		impute.Knn(d, impute.DefaultParam)
+	}
+	return d, clones.NewFeatureMatrix(d, parseFeature(*m.feature), missing)
+}
+
+func parseFeature(s string) clones.Feature {
+	switch s {
+	case "af":
+		return clones.AlleleFrequency
+	case "dosage":
+		return clones.Dosage
+	case "soft":
+		return clones.SoftDosage
+	default:
+		log.Fatalf("unknown feature '%s'. must be af, dosage, or soft", s)
+		return 0
+	}
+}
+
+func parseMissing(s string) clones.Missing {
+	switch s {
+	case "mean":
+		return clones.MeanFill
+	case "impute":
+		return clones.Imputed
+	case "drop":
+		return clones.DropCells
+	default:
+		log.Fatalf("unknown missing value handling '%s'. must be mean, impute, or drop", s)
+		return 0
+	}
+}
+
+func pca(args []string) {
+	fs := flag.NewFlagSet("pca", flag.ExitOnError)
+	m := addMatrixFlags(fs)
+	var k *int = fs.Int("k", 0, "Number of components to output. 0 uses the suggested number of components")
+	var outPrefix *string = fs.String("o", "", "Prefix for output files. Defaults to the input file name")
+	exception.PanicOnErr(fs.Parse(args))
+	if *m.infile == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *outPrefix == "" {
+		*outPrefix = trimVcfSuffix(*m.infile)
+	}
+
+	d, matrix := m.build()
+	p := clones.PrincipalComponents(matrix)
+	switch {
+	case *k < 0 || *k > p.Components():
+		log.Fatalf("-k must be between 1 and the number of components %d, found %d", p.Components(), *k)
+	case *k == 0:
+		*k = p.SuggestedK
+	}
+
+	componentNames := make([]string, *k)
+	for i := range componentNames {
+		componentNames[i] = fmt.Sprintf("PC%d", i+1)
+	}
+	writeCellCoordinates(*outPrefix+".pca.scores.csv", d, p.CellIds, componentNames, p.Scores)
+	writeLoadings(*outPrefix+".pca.loadings.csv", d, p, componentNames)
+	writeVariance(*outPrefix+".pca.variance.csv", p)
+}
+
+// embedFlags are the options shared by the embedding commands.
+type embedFlags struct {
+	pcs       *int
+	seed      *int64
+	threads   *int
+	outPrefix *string
+}
+
+func addEmbedFlags(fs *flag.FlagSet) embedFlags {
+	return embedFlags{
+		pcs:       fs.Int("pcs", 0, "Number of principal components used as input. 0 uses the suggested number of components, -1 uses the full matrix"),
+		seed:      fs.Int64("seed", 1, "Seed for random number generation"),
+		threads:   fs.Int("threads", 0, "Number of threads. 0 uses all available cores"),
+		outPrefix: fs.String("o", "", "Prefix for output files. Defaults to the input file name"),
+	}
+}
+
+// input returns the matrix to be embedded and the cell Id of each row.
+func (e embedFlags) input(matrix clones.FeatureMatrix) (mat.Matrix, []int) {
+	if *e.pcs == -1 {
+		return matrix.Values, matrix.CellIds
+	}
+	p := clones.PrincipalComponents(matrix)
+	k := *e.pcs
+	if k == 0 || k > p.Components() {
+		k = p.SuggestedK
+	}
+	if k < 2 && p.Components() >= 2 {
+		k = 2
+	}
+	rows, _ := p.Scores.Dims()
+	return p.Scores.Slice(0, rows, 0, k), p.CellIds
+}
+
+func umap(args []string) {
+	fs := flag.NewFlagSet("umap", flag.ExitOnError)
+	m := addMatrixFlags(fs)
+	e := addEmbedFlags(fs)
+	var neighbors *int = fs.Int("neighbors", clones.DefaultUmapParam.Neighbors, "Number of nearest neighbors")
+	var minDist *float64 = fs.Float64("minDist", clones.DefaultUmapParam.MinDist, "Minimum distance between embedded cells")
+	var epochs *int = fs.Int("epochs", 0, "Number of optimization epochs. 0 selects by number of cells")
+	exception.PanicOnErr(fs.Parse(args))
+	if *m.infile == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *e.outPrefix == "" {
+		*e.outPrefix = trimVcfSuffix(*m.infile)
+	}
+
+	d, matrix := m.build()
+	x, cellIds := e.input(matrix)
+	p := clones.DefaultUmapParam
+	p.Neighbors = *neighbors
+	p.MinDist = *minDist
+	p.Epochs = *epochs
+	p.Seed = *e.seed
+	p.Workers = *e.threads
+	writeCellCoordinates(*e.outPrefix+".umap.csv", d, cellIds, []string{"UMAP1", "UMAP2"}, clones.Umap(x, p))
+}
+
+func tsne(args []string) {
+	fs := flag.NewFlagSet("tsne", flag.ExitOnError)
+	m := addMatrixFlags(fs)
+	e := addEmbedFlags(fs)
+	var perplexity *float64 = fs.Float64("perplexity", clones.DefaultTsneParam.Perplexity, "Effective number of neighbors for each cell")
+	var theta *float64 = fs.Float64("theta", clones.DefaultTsneParam.Theta, "Barnes-Hut accuracy. 0 is exact, larger is faster")
+	var iterations *int = fs.Int("iterations", clones.DefaultTsneParam.Iterations, "Number of gradient descent iterations")
+	exception.PanicOnErr(fs.Parse(args))
+	if *m.infile == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *e.outPrefix == "" {
+		*e.outPrefix = trimVcfSuffix(*m.infile)
+	}
+
+	d, matrix := m.build()
+	x, cellIds := e.input(matrix)
+	p := clones.DefaultTsneParam
+	p.Perplexity = *perplexity
+	p.Theta = *theta
+	p.Iterations = *iterations
+	p.Seed = *e.seed
+	p.Workers = *e.threads
+	writeCellCoordinates(*e.outPrefix+".tsne.csv", d, cellIds, []string{"TSNE1", "TSNE2"}, clones.Tsne(x, p))
+}
+
+func cluster(args []string) {
+	fs := flag.NewFlagSet("cluster", flag.ExitOnError)
+	var infile *string = fs.String("i", "", "Input vcf file (may be vcf.gz)")
+	var cache *string = fs.String("cache", "", cacheUsage)
+	var fasta *string = fs.String("fasta", "", fastaUsage)
+	var adapter *string = fs.String("adapter", "", adapterUsage)
+	var method *string = fs.String("method", "hierarchical", "Clustering method: hierarchical, kmodes, or louvain")
+	var k *int = fs.Int("k", 0, "Number of clones for hierarchical and kmodes. 0 selects between 2 and maxK by -criterion")
+	var maxK *int = fs.Int("maxK", 10, "Maximum number of clones considered when selecting k")
+	var criterion *string = fs.String("criterion", "silhouette", "Criterion for selecting k: silhouette (greatest mean silhouette width) or bic (lowest BIC)")
+	var resolution *float64 = fs.Float64("resolution", clones.DefaultLouvainParam.Resolution, "Louvain resolution. Larger values give more clones")
+	var neighbors *int = fs.Int("neighbors", clones.DefaultLouvainParam.Neighbors, "Number of nearest neighbors in the louvain graph")
+	var minShared *int = fs.Int("minShared", 5, "Minimum variants genotyped in both cells to compare them")
+	var seed *int64 = fs.Int64("seed", 1, "Seed for random number generation")
+	var outPrefix *string = fs.String("o", "", "Prefix for output files. Defaults to the input file name")
+	exception.PanicOnErr(fs.Parse(args))
+	if *infile == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *outPrefix == "" {
+		*outPrefix = trimVcfSuffix(*infile)
+	}
+
+	d := readData(*infile, *cache, *fasta, *adapter)
+	silhouette := clones.DefaultSilhouetteParam
+	silhouette.MinShared = *minShared
+	silhouette.Seed = *seed
+	if *criterion != "silhouette" && *criterion != "bic" {
+		log.Fatalf("unknown criterion '%s'. must be silhouette or bic", *criterion)
+	}
+
+	var c clones.Clustering
+	switch *method {
+	case "hierarchical":
+		den := clones.Hierarchical(d, *minShared)
+		c = selectK(d, *k, *maxK, *criterion, silhouette, den.Cut)
+	case "kmodes":
+		p := clones.DefaultKModesParam
+		p.MinShared = *minShared
+		p.Seed = *seed
+		c = selectK(d, *k, *maxK, *criterion, silhouette, func(k int) clones.Clustering { return clones.KModes(d, k, p) })
+	case "louvain":
+		p := clones.DefaultLouvainParam
+		p.Neighbors = *neighbors
+		p.Resolution = *resolution
+		p.MinShared = *minShared
+		p.Seed = *seed
+		c = clones.Louvain(d, p)
+		c.Silhouette = clones.Silhouette(d, c, silhouette)
+	default:
+		log.Fatalf("unknown clustering method '%s'. must be hierarchical, kmodes, or louvain", *method)
+	}
+	log.Printf("found %d clones with mean silhouette width %.4f", c.K, c.Silhouette)
+
+	writeAssignment(*outPrefix+".clones.csv", d, c)
+	writeConsensus(*outPrefix+".consensus.csv", *outPrefix+".consensus_support.csv", d, clones.Consensus(d, c))
+}
+
+// selectK returns clustering(k) if k > 0, otherwise the clustering with between 2 and
+// maxK clones with the greatest silhouette width or the lowest BIC, depending on criterion.
+func selectK(d *cells.Data, k int, maxK int, criterion string, p clones.SilhouetteParam, clustering func(k int) clones.Clustering) clones.Clustering {
+	if k > 0 {
+		answer := clustering(k)
+		answer.Silhouette = clones.Silhouette(d, answer, p)
+		return answer
+	}
+	var candidates []clones.Clustering
+	for k = 2; k <= maxK && k <= len(d.Cells); k++ {
+		candidates = append(candidates, clustering(k))
+	}
+	if criterion == "bic" {
+		best := clones.SelectByBIC(d, candidates)
+		for i := range candidates {
+			log.Printf("k=%d bic=%.4f", candidates[i].K, candidates[i].BIC)
+		}
+		candidates[best].Silhouette = clones.Silhouette(d, candidates[best], p)
+		return candidates[best]
+	}
+	best := clones.SelectBySilhouette(d, candidates, p)
+	for i := range candidates {
+		log.Printf("k=%d silhouette=%.4f", candidates[i].K, candidates[i].Silhouette)
+	}
+	return candidates[best]
+}
+
+func writeAssignment(outfile string, d *cells.Data, c clones.Clustering) {
+	out := fileio.EasyCreate(outfile)
+	var err error
+	_, err = fmt.Fprintln(out, "Cell,Barcode,Clone")
+	exception.PanicOnErr(err)
+	for cellId, k := range c.Assignment {
+		_, err = fmt.Fprintf(out, "%d,%s,%d\n", cellId, d.Cells[cellId].Name, k)
+		exception.PanicOnErr(err)
+	}
+	exception.PanicOnErr(out.Close())
+}
+
+// writeConsensus writes the consensus genotype and support of each variant (rows) in each clone (columns).
+func writeConsensus(genotypeFile string, supportFile string, d *cells.Data, table clones.ConsensusTable) {
+	outGenotype := fileio.EasyCreate(genotypeFile)
+	outSupport := fileio.EasyCreate(supportFile)
+	var err error
+	header := "Variant"
+	for k := range table.Cells {
+		header += fmt.Sprintf(",Clone_%d", k)
+	}
+	_, err = fmt.Fprintln(outGenotype, header)
+	exception.PanicOnErr(err)
+	_, err = fmt.Fprintln(outSupport, header)
+	exception.PanicOnErr(err)
+
+	for vid := range d.Variants {
+		_, err = fmt.Fprint(outGenotype, d.Variants[vid].Key())
+		exception.PanicOnErr(err)
+		_, err = fmt.Fprint(outSupport, d.Variants[vid].Key())
+		exception.PanicOnErr(err)
+		for k := range table.Cells {
+			_, err = fmt.Fprintf(outGenotype, ",%s", table.Genotypes[k][vid])
+			exception.PanicOnErr(err)
+			_, err = fmt.Fprintf(outSupport, ",%.4f", table.Support[k][vid])
+			exception.PanicOnErr(err)
+		}
+		_, err = fmt.Fprintln(outGenotype)
+		exception.PanicOnErr(err)
+		_, err = fmt.Fprintln(outSupport)
+		exception.PanicOnErr(err)
+	}
+	exception.PanicOnErr(outGenotype.Close())
+	exception.PanicOnErr(outSupport.Close())
+}
+
+func model(args []string) {
+	fs := flag.NewFlagSet("model", flag.ExitOnError)
+	var infile *string = fs.String("i", "", "Input vcf file (may be vcf.gz)")
+	var cache *string = fs.String("cache", "", cacheUsage)
+	var fasta *string = fs.String("fasta", "", fastaUsage)
+	var adapter *string = fs.String("adapter", "", adapterUsage)
+	var k *int = fs.Int("k", 0, "Number of clones to fit. Required unless -model is set")
+	var modelFile *string = fs.String("model", "", "Assign cells to a previously fit model (json) instead of fitting a new model")
+	var doubletRate *float64 = fs.Float64("doubletRate", clones.DefaultModelParam.DoubletRate, "Initial doublet rate. 0 disables the doublet component")
+	var restarts *int = fs.Int("restarts", clones.DefaultModelParam.Restarts, "Number of random initializations")
+	var minPosterior *float64 = fs.Float64("minPosterior", 0.9, "Minimum posterior probability to assign a cell to a clone")
+	var seed *int64 = fs.Int64("seed", 1, "Seed for random number generation")
+	var outPrefix *string = fs.String("o", "", "Prefix for output files. Defaults to the input file name")
+	exception.PanicOnErr(fs.Parse(args))
+	if *infile == "" || (*k < 1 && *modelFile == "") {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if *outPrefix == "" {
+		*outPrefix = trimVcfSuffix(*infile)
+	}
+
+	d := readData(*infile, *cache, *fasta, *adapter)
+	p := clones.DefaultModelParam
+	p.K = *k
+	p.DoubletRate = *doubletRate
+	p.Restarts = *restarts
+	p.Seed = *seed
+
+	var member clones.Membership
+	if *modelFile != "" {
+		member = clones.AssignCells(d, clones.ReadModel(*modelFile), p)
+	} else {
+		var m *clones.CloneModel
+		m, member = clones.FitModel(d, p)
+		log.Printf("fit %d clones with doublet rate %.4f, error rate %.4f, and dropout rate %.4f",
+			len(m.Genotypes), m.DoubletRate, m.ErrorRate, m.DropoutRate)
+		clones.WriteModel(*outPrefix+".model.json", m)
+	}
+	c := member.Clustering(*minPosterior)
+	writeAssignment(*outPrefix+".clones.csv", d, c)
+	writeMembership(*outPrefix+".posterior.csv", d, member)
+}
+
+// writeMembership writes the posterior probability of each cell in each clone and as a doublet.
+func writeMembership(outfile string, d *cells.Data, member clones.Membership) {
+	out := fileio.EasyCreate(outfile)
+	var err error
+	header := "Cell,Barcode"
+	if len(member.Posterior) > 0 {
+		for k := range member.Posterior[0] {
+			header += fmt.Sprintf(",Clone_%d", k)
+		}
+	}
+	_, err = fmt.Fprintln(out, header+",Doublet,ErrorRate,DropoutRate")
+	exception.PanicOnErr(err)
+	for cellId := range member.Posterior {
+		_, err = fmt.Fprintf(out, "%d,%s", cellId, d.Cells[cellId].Name)
+		exception.PanicOnErr(err)
+		for _, post := range member.Posterior[cellId] {
+			_, err = fmt.Fprintf(out, ",%.4g", post)
+			exception.PanicOnErr(err)
+		}
+		_, err = fmt.Fprintf(out, ",%.4g,%.4g,%.4g\n", member.Doublet[cellId], member.ErrorRate[cellId], member.DropoutRate[cellId])
+		exception.PanicOnErr(err)
+	}
+	exception.PanicOnErr(out.Close())
+}
+
+// writeCellCoordinates writes a csv with the Id, barcode, and the first len(colNames)
+// columns of coords for each cell.
+func writeCellCoordinates(outfile string, d *cells.Data, cellIds []int, colNames []string, coords mat.Matrix) {
+	out := fileio.EasyCreate(outfile)
+	var err error
+	_, err = fmt.Fprintf(out, "Cell,Barcode,%s\n", strings.Join(colNames, ","))
+	exception.PanicOnErr(err)
+	for row, cellId := range cellIds {
+		_, err = fmt.Fprintf(out, "%d,%s", cellId, d.Cells[cellId].Name)
+		exception.PanicOnErr(err)
+		for col := range colNames {
+			_, err = fmt.Fprintf(out, ",%.6g", coords.At(row, col))
+			exception.PanicOnErr(err)
+		}
+		_, err = fmt.Fprintln(out)
+		exception.PanicOnErr(err)
+	}
+	exception.PanicOnErr(out.Close())
+}
+
+func writeLoadings(outfile string, d *cells.Data, p clones.PCA, colNames []string) {
+	out := fileio.EasyCreate(outfile)
+	var err error
+	_, err = fmt.Fprintf(out, "Variant,%s\n", strings.Join(colNames, ","))
+	exception.PanicOnErr(err)
+	for row, vid := range p.VariantIds {
+		_, err = fmt.Fprint(out, d.Variants[vid].Key())
+		exception.PanicOnErr(err)
+		for col := range colNames {
+			_, err = fmt.Fprintf(out, ",%.6g", p.Loadings.At(row, col))
+			exception.PanicOnErr(err)
+		}
+		_, err = fmt.Fprintln(out)
+		exception.PanicOnErr(err)
+	}
+	exception.PanicOnErr(out.Close())
+}
+
+func writeVariance(outfile string, p clones.PCA) {
+	out := fileio.EasyCreate(outfile)
+	var err error
+	_, err = fmt.Fprintln(out, "Component,ExplainedVariance,Suggested")
+	exception.PanicOnErr(err)
+	for i := range p.ExplainedVariance {
+		_, err = fmt.Fprintf(out, "PC%d,%.6g,%t\n", i+1, p.ExplainedVariance[i], i < p.SuggestedK)
+		exception.PanicOnErr(err)
+	}
+	exception.PanicOnErr(out.Close())
+}
+
+func trimVcfSuffix(s string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(s, ".gz"), ".vcf")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		return
+	}
+
+	switch os.Args[1] {
+	case "pca":
+		pca(os.Args[2:])
+	case "umap":
+		umap(os.Args[2:])
+	case "tsne":
+		tsne(os.Args[2:])
+	case "cluster":
+		cluster(os.Args[2:])
+	case "model":
+		model(os.Args[2:])
+	default:
+		usage()
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/demux"
+	"github.com/ddsnellings/weaver/reference"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"log"
+	"strings"
+)
+
+func usage() {
+	fmt.Print(
+		"demux - Assign cells pooled from several donors to their donor using germline SNPs.\n\n" +
+			"Usage:\n" +
+			"  demux -i infile.vcf.gz -donors 3\n" +
+			"  demux -i infile.vcf.gz -known donors.vcf.gz\n\n" +
+			"Options:\n\n")
+	flag.PrintDefaults()
+}
+
+func demultiplex(infile string, outfile string, knownFile string, fastaFile string, adapter string, threads int, p demux.Param) {
+	// keep every cell and variant with reads so that SNPs are only selected by demux.Param
+	readParam := cells.DefaultReadParam
+	readParam.CellFilter = cells.CellFilterParam{MinGenotypeQuality: -1, MinReadAf: cells.DefaultCellFilter.MinReadAf}
+	readParam.GlobalFilter = cells.GlobalFilterParam{}
+	readParam.Workers = threads
+	if adapter != "" {
+		readParam.Adapter = cells.AdapterByName(adapter)
+	}
+	if fastaFile != "" {
+		ref := reference.Open(fastaFile)
+		defer ref.Close()
+		readParam.Reference = ref
+	}
+	d := cells.ReadVcfWithParam(infile, readParam)
+	var res demux.Result
+	if knownFile != "" {
+		res = demux.DemultiplexKnown(d, demux.ReadDonorVcf(knownFile, readParam.Reference), p)
+	} else {
+		res = demux.Demultiplex(d, p)
+	}
+
+	out := fileio.EasyCreate(outfile)
+	var err error
+	_, err = fmt.Fprintf(out, "Cell,Barcode,Donor,DoubletProb,%s\n", strings.Join(res.DonorNames, ","))
+	exception.PanicOnErr(err)
+	counts := make([]int, len(res.DonorNames))
+	var doublets, unassigned int
+	var label string
+	for i := range d.Cells {
+		switch res.Donor[i] {
+		case demux.Doublet:
+			label = "doublet"
+			doublets++
+		case -1:
+			label = "unassigned"
+			unassigned++
+		default:
+			label = res.DonorNames[res.Donor[i]]
+			counts[res.Donor[i]]++
+		}
+		_, err = fmt.Fprintf(out, "%d,%s,%s,%.4f", i, d.Cells[i].Name, label, res.Doublet[i])
+		exception.PanicOnErr(err)
+		for k := range res.Posterior[i] {
+			_, err = fmt.Fprintf(out, ",%.4f", res.Posterior[i][k])
+			exception.PanicOnErr(err)
+		}
+		_, err = fmt.Fprintln(out)
+		exception.PanicOnErr(err)
+	}
+	exception.PanicOnErr(out.Close())
+	for k := range counts {
+		log.Printf("assigned %d cells to %s", counts[k], res.DonorNames[k])
+	}
+	log.Printf("called %d cells as doublets. %d cells unassigned", doublets, unassigned)
+}
+
+func main() {
+	var infile *string = flag.String("i", "", "Input vcf file (may be vcf.gz)")
+	var outfile *string = flag.String("o", "infile.donors.csv", "Output donor assignment file")
+	var donors *int = flag.Int("donors", 0, "Number of donors. Required if -known is not given")
+	var known *string = flag.String("known", "", "VCF file with the genotypes of each donor. Sample names are used as donor names")
+	var fasta *string = flag.String("fasta", "", "Indexed reference fasta used to left-align indels before matching known genotypes")
+	var minCellFrac *float64 = flag.Float64("minCellFrac", demux.DefaultParam.MinCellFrac, "Only use SNPs with reads in at least this fraction of cells")
+	var doubletRate *float64 = flag.Float64("doubletRate", demux.DefaultParam.DoubletRate, "Initial rate of inter-donor doublets. 0 disables doublet detection")
+	var minPosterior *float64 = flag.Float64("minPosterior", demux.DefaultParam.MinPosterior, "Minimum posterior probability to assign a cell to a donor")
+	var restarts *int = flag.Int("restarts", demux.DefaultParam.Restarts, "Number of random initializations")
+	var seed *int64 = flag.Int64("seed", 1, "Seed for random number generation")
+	var threads *int = flag.Int("threads", 0, "Number of threads used to read infile. 0 uses all available cores")
+	var adapter *string = flag.String("adapter", "", "Variant caller that wrote infile: gatk, bcftools, freebayes, or strelka. Detected from the vcf header if empty")
+	flag.Parse()
+
+	if *infile == "" || (*donors < 1 && *known == "") {
+		usage()
+		return
+	}
+
+	if *outfile == "infile.donors.csv" {
+		*outfile = strings.TrimSuffix(strings.TrimSuffix(*infile, ".gz"), ".vcf") + ".donors.csv"
+	}
+
+	p := demux.DefaultParam
+	p.Donors = *donors
+	p.MinCellFrac = *minCellFrac
+	p.DoubletRate = *doubletRate
+	p.MinPosterior = *minPosterior
+	p.Restarts = *restarts
+	p.Seed = *seed
+	demultiplex(*infile, *outfile, *known, *fasta, *adapter, *threads, p)
+}
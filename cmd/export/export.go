@@ -0,0 +1,81 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/external"
+	"github.com/ddsnellings/weaver/reference"
+	"log"
+	"strings"
+)
+
+func usage() {
+	fmt.Print(
+		"export - Write cell genotypes as input for external phylogeny tools.\n\n" +
+			"Usage:\n" +
+			"  export -i infile.vcf.gz -format scite\n\n" +
+			"Formats:\n" +
+			"  scite        <prefix>.scite.txt, variants as rows, missing as 3\n" +
+			"  infscite     <prefix>.infscite.txt, same layout as scite\n" +
+			"  siclonefit   <prefix>.siclonefit.txt, binary, variants as rows with index column, missing as 3\n" +
+			"  compass      <prefix>_variants.csv, ref:alt read counts per cell\n" +
+			"  counts       <prefix>.ref.txt and <prefix>.alt.txt read count matrices\n" +
+			"  vcf          <prefix>.filtered.vcf.gz with passing cells and variants and weaver genotypes, indexed with tabix\n\n" +
+			"All formats also write <prefix>.variants.txt and <prefix>.cells.txt.\n\n" +
+			"Options:\n\n")
+	flag.PrintDefaults()
+}
+
+func export(infile string, outPrefix string, format string, cellsAsRows bool, fastaFile string, adapter string) {
+	p := cells.DefaultWriteParam
+	if adapter != "" {
+		p.Read.Adapter = cells.AdapterByName(adapter)
+	}
+	if fastaFile != "" {
+		ref := reference.Open(fastaFile)
+		defer ref.Close()
+		p.Read.Reference = ref
+		p.Reference = ref
+	}
+	d := cells.ReadVcfWithParam(infile, p.Read)
+	switch format {
+	case "scite":
+		external.WriteMatrix(outPrefix+".scite.txt", d, external.Scite)
+	case "infscite":
+		external.WriteMatrix(outPrefix+".infscite.txt", d, external.InfScite)
+	case "siclonefit":
+		external.WriteMatrix(outPrefix+".siclonefit.txt", d, external.SiCloneFit)
+	case "compass":
+		external.WriteCompass(outPrefix+"_variants.csv", d)
+	case "counts":
+		external.WriteReadCounts(outPrefix+".ref.txt", outPrefix+".alt.txt", d, cellsAsRows, " ")
+	case "vcf":
+		cells.WriteVcf(outPrefix+".filtered.vcf.gz", d, p)
+	default:
+		log.Fatalf("unknown format '%s'", format)
+	}
+	external.WriteVariantNames(outPrefix+".variants.txt", d)
+	external.WriteCellNames(outPrefix+".cells.txt", d)
+}
+
+func main() {
+	var infile *string = flag.String("i", "", "Input vcf file (may be vcf.gz)")
+	var format *string = flag.String("format", "scite", "Output format: scite, infscite, siclonefit, compass, counts, or vcf")
+	var outPrefix *string = flag.String("o", "", "Prefix for output files. Defaults to the input file name")
+	var cellsAsRows *bool = flag.Bool("cellsAsRows", false, "Write cells as rows of read count matrices")
+	var fasta *string = flag.String("fasta", "", "Indexed reference fasta used to left-align indels. The vcf format keeps the records of the input file")
+	var adapter *string = flag.String("adapter", "", "Variant caller that wrote infile: gatk, bcftools, freebayes, or strelka. Detected from the vcf header if empty")
+	flag.Parse()
+
+	if *infile == "" {
+		usage()
+		return
+	}
+
+	if *outPrefix == "" {
+		*outPrefix = strings.TrimSuffix(strings.TrimSuffix(*infile, ".gz"), ".vcf")
+	}
+
+	export(*infile, *outPrefix, *format, *cellsAsRows, *fasta, *adapter)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/doublet"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"log"
+	"strings"
+)
+
+func usage() {
+	fmt.Print(
+		"findDoublets - Score cells as doublets from genotypes and read depth.\n\n" +
+			"Usage:\n" +
+			"  findDoublets -i infile.vcf.gz\n\n" +
+			"Options:\n\n")
+	flag.PrintDefaults()
+}
+
+func findDoublets(infile string, outfile string, adapter string, p doublet.Param) {
+	readParam := cells.DefaultReadParam
+	if adapter != "" {
+		readParam.Adapter = cells.AdapterByName(adapter)
+	}
+	d := cells.ReadVcfWithParam(infile, readParam)
+	res := doublet.Score(d, p)
+
+	out := fileio.EasyCreate(outfile)
+	var err error
+	var called int
+	_, err = fmt.Fprintln(out, "Cell,Barcode,Depth,Score,Doublet")
+	exception.PanicOnErr(err)
+	for i := range d.Cells {
+		_, err = fmt.Fprintf(out, "%d,%s,%d,%.4f,%t\n", i, d.Cells[i].Name, res.Depth[i], res.Score[i], res.Doublet[i])
+		exception.PanicOnErr(err)
+		if res.Doublet[i] {
+			called++
+		}
+	}
+	exception.PanicOnErr(out.Close())
+	log.Printf("called %d of %d cells as doublets with score threshold %.4f", called, len(d.Cells), res.Threshold)
+}
+
+func main() {
+	var infile *string = flag.String("i", "", "Input vcf file (may be vcf.gz)")
+	var outfile *string = flag.String("o", "infile.doublets.csv", "Output doublet score file")
+	var expectedRate *float64 = flag.Float64("expectedRate", doublet.DefaultParam.ExpectedRate, "Expected fraction of cells that are doublets")
+	var k *int = flag.Int("k", doublet.DefaultParam.K, "Number of nearest neighbors used to score each cell")
+	var simulatedRatio *float64 = flag.Float64("simulatedRatio", doublet.DefaultParam.SimulatedRatio, "Number of artificial doublets per cell")
+	var depthWeight *float64 = flag.Float64("depthWeight", doublet.DefaultParam.DepthWeight, "Weight of total read depth in the distance between cells")
+	var seed *int64 = flag.Int64("seed", 1, "Seed for random number generation")
+	var adapter *string = flag.String("adapter", "", "Variant caller that wrote infile: gatk, bcftools, freebayes, or strelka. Detected from the vcf header if empty")
+	flag.Parse()
+
+	if *infile == "" {
+		usage()
+		return
+	}
+
+	if *outfile == "infile.doublets.csv" {
+		*outfile = strings.TrimSuffix(strings.TrimSuffix(*infile, ".gz"), ".vcf") + ".doublets.csv"
+	}
+
+	p := doublet.DefaultParam
+	p.ExpectedRate = *expectedRate
+	p.K = *k
+	p.SimulatedRatio = *simulatedRatio
+	p.DepthWeight = *depthWeight
+	p.Seed = *seed
+	findDoublets(*infile, *outfile, *adapter, p)
+}
@@ -4,7 +4,10 @@ import (
 	"flag"
 	"fmt"
 	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/interval"
 	"github.com/ddsnellings/weaver/loh"
+	"github.com/ddsnellings/weaver/reference"
+	"github.com/ddsnellings/weaver/variants"
 	"github.com/vertgenlab/gonomics/dna"
 	"github.com/vertgenlab/gonomics/exception"
 	"os"
@@ -15,13 +18,30 @@ func usage() {
 	fmt.Print(
 		"findRoh - Find runs of homozygosity.\n\n" +
 			"Usage:\n" +
-			"  findRoh -i infile.vcf.gz\n\n" +
+			"  findRoh -i infile.vcf.gz\n" +
+			"  findRoh -i infile.vcf.gz -region chr7 (requires infile.vcf.gz.tbi or .csi)\n\n" +
 			"Options:\n\n")
 	flag.PrintDefaults()
 }
 
-func findRoh(infile string, outfile string, varfile string, minRunLength int, minCounts int) {
-	d := cells.ReadVcf(infile, cells.DefaultCellFilter, cells.DefaultGlobalFilter, cells.DefaultVcfQual)
+func findRoh(infile string, outfile string, varfile string, readRegions []variants.Region, cache string, fasta string, adapter string, minRunLength int, minCounts int) {
+	p := cells.DefaultReadParam
+	if adapter != "" {
+		p.Adapter = cells.AdapterByName(adapter)
+	}
+	if fasta != "" {
+		ref := reference.Open(fasta)
+		defer ref.Close()
+		p.Reference = ref
+	}
+	var d *cells.Data
+	if len(readRegions) > 0 {
+		d = cells.ReadVcfRegions(infile, readRegions, p)
+	} else if cache != "" {
+		d = cells.ReadVcfCached(infile, cache, p)
+	} else {
+		d = cells.ReadVcfWithParam(infile, p)
+	}
 	roh := loh.FindAllRunsOfHomozygosity(d, minRunLength)
 	counts := loh.CountRohHaplotypes(roh, d)
 
@@ -35,10 +55,16 @@ func findRoh(infile string, outfile string, varfile string, minRunLength int, mi
 
 	_, err = fmt.Fprintln(outRoh, "Chr,Start,End,Length,Variants,Zygosity,Count")
 	exception.PanicOnErr(err)
-	_, err = fmt.Fprintln(outVar, "Id,Chr,Pos,Ref,Alt")
+	_, err = fmt.Fprintln(outVar, "Id,Key,Chr,Pos,Ref,Alt")
 	exception.PanicOnErr(err)
 
-	for key, val := range counts {
+	regions := make([]variants.Region, 0, len(counts))
+	for key := range counts {
+		regions = append(regions, key)
+	}
+	d.Contigs.SortRegions(regions)
+	for _, key := range regions {
+		val := counts[key]
 		for i := range val.Haplotypes {
 			if val.HaplotypeCounts[i] < minCounts {
 				continue
@@ -48,7 +74,8 @@ func findRoh(infile string, outfile string, varfile string, minRunLength int, mi
 		}
 	}
 	for i := range d.Variants {
-		_, err = fmt.Fprintf(outVar, "%d,%s,%d,%s,%s\n", i,
+		_, err = fmt.Fprintf(outVar, "%d,%s,%s,%d,%s,%s\n", i,
+			d.Variants[i].Key(),
 			d.Variants[i].Chr,
 			d.Variants[i].Pos,
 			getBaseString(d.Variants[i].Ref),
@@ -71,6 +98,13 @@ func main() {
 	var infile *string = flag.String("i", "", "Input vcf file (may be vcf.gz)")
 	var outfile *string = flag.String("o", "infile.roh.csv", "Output roh file")
 	var varfile *string = flag.String("v", "infile.var.csv", "Output variant ID file")
+	var region *string = flag.String("region", "", "Only read records in this region (e.g. chr7 or chr7:1-5,000,000) using the tabix or csi index of infile")
+	var bedFile *string = flag.String("bed", "", "Only read records in the regions of this BED file using the tabix or csi index of infile")
+	var genes *string = flag.String("genes", "", "Only read records in these comma separated genes using the tabix or csi index of infile. Requires -annotation")
+	var annotation *string = flag.String("annotation", "", "GTF or BED file with the locations of -genes")
+	var cache *string = flag.String("cache", "", "Snapshot of the filtered input. Loaded if infile is unchanged, otherwise written after reading infile. Ignored with -region, -bed, or -genes")
+	var fasta *string = flag.String("fasta", "", "Indexed reference fasta used to left-align indels so variant keys match other callers")
+	var adapter *string = flag.String("adapter", "", "Variant caller that wrote infile: gatk, bcftools, freebayes, or strelka. Detected from the vcf header if empty")
 	flag.Parse()
 
 	if *infile == "" {
@@ -86,5 +120,20 @@ func main() {
 		*varfile = strings.TrimSuffix(strings.TrimSuffix(*infile, ".gz"), ".vcf") + ".var.csv"
 	}
 
-	findRoh(*infile, *outfile, *varfile, *minRunLength, *minCounts)
+	var regions []variants.Region
+	if *region != "" {
+		regions = append(regions, interval.Parse(*region))
+	}
+	if *bedFile != "" {
+		regions = append(regions, interval.ReadBed(*bedFile)...)
+	}
+	if *genes != "" {
+		if *annotation == "" {
+			usage()
+			return
+		}
+		regions = append(regions, interval.ReadGenes(*annotation, strings.Split(*genes, ","))...)
+	}
+
+	findRoh(*infile, *outfile, *varfile, regions, *cache, *fasta, *adapter, *minRunLength, *minCounts)
 }
@@ -1,16 +1,30 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/impute"
+	"github.com/ddsnellings/weaver/reference"
 	"github.com/ddsnellings/weaver/variants"
 	"github.com/vertgenlab/gonomics/dna"
+	"github.com/vertgenlab/gonomics/exception"
 	"github.com/vertgenlab/gonomics/fileio"
 	"log"
 	"strings"
 )
 
+func usage() {
+	fmt.Print(
+		"generateTable - Write a table of the genotype of each cell at each variant passing filters.\n\n" +
+			"Usage:\n" +
+			"  generateTable -i infile.vcf.gz -o outfile.csv\n\n" +
+			"Options:\n\n")
+	flag.PrintDefaults()
+}
+
 type row struct {
+	Key       string
 	Chr       string
 	Pos       int
 	Ref       []dna.Base
@@ -18,15 +32,24 @@ type row struct {
 	Genotypes []variants.Zygosity
 }
 
-func generateTable(filename string, outfile string, cellFilter cells.CellFilterParam, globalFilter cells.GlobalFilterParam, minVcfQual float64, delim string, genotypeAsString bool, minCellAf float64, maxCellAf float64) {
-	data := cells.ReadVcf(filename, cellFilter, globalFilter, minVcfQual)
-	rows := getRows(data, minCellAf, maxCellAf)
+func generateTable(filename string, outfile string, p cells.ReadParam, delim string, genotypeAsString bool, minCellAf float64, maxCellAf float64, showImputed bool, qcFile string, pValueFile string) {
+	data := cells.ReadVcfWithParam(filename, p)
+	if showImputed {
+		impute.Knn(data, impute.DefaultParam)
+	}
+	rows := getRows(data, minCellAf, maxCellAf, showImputed)
 	writeTable(outfile, generateColNames(data, delim), rows, delim, genotypeAsString)
+	if qcFile != "" {
+		writeVariantQc(qcFile, data, rows, delim)
+	}
+	if pValueFile != "" {
+		writePValues(pValueFile, data, rows, delim)
+	}
 }
 
 func generateColNames(d *cells.Data, delim string) string {
 	var s strings.Builder
-	s.WriteString("Chromosome" + delim + "Position" + delim + "Ref" + delim + "Alt")
+	s.WriteString("Key" + delim + "Chromosome" + delim + "Position" + delim + "Ref" + delim + "Alt")
 	s.Grow(len(d.Cells) * (len(delim) + 5 + 5)) // 5 bytes for "Cell_" and 5 bytes for up to 99999 cells. More will be added dynamically if needed.
 	for i := range d.Cells {
 		s.WriteString(fmt.Sprintf("%sCell_%d", delim, d.Cells[i].Id)) // could just be i, but using the Id to be safe
@@ -34,20 +57,28 @@ func generateColNames(d *cells.Data, delim string) string {
 	return s.String()
 }
 
-func getRows(d *cells.Data, minCellAf float64, maxCellAf float64) []row {
+func getRows(d *cells.Data, minCellAf float64, maxCellAf float64, showImputed bool) []row {
 	rows := make([]row, len(d.Variants))
 
 	for i := range d.Variants {
 		if d.Variants[i].CellAf > maxCellAf || d.Variants[i].CellAf < minCellAf {
 			continue
 		}
+		rows[i].Key = d.Variants[i].Key()
 		rows[i].Chr = d.Variants[i].Chr
 		rows[i].Pos = d.Variants[i].Pos + 1 // back to 1-base for user
 		rows[i].Ref = d.Variants[i].Ref
 		rows[i].Alt = d.Variants[i].Alt
 		rows[i].Genotypes = make([]variants.Zygosity, len(d.Cells))
 		for _, cellId := range d.Variants[i].CellsGenotyped {
-			rows[i].Genotypes[cellId] = d.Cells[cellId].Genotypes[i].Genotype
+			rows[i].Genotypes[cellId] = d.Genotype(cellId, i)
+		}
+		if showImputed {
+			for cellId := range d.Cells {
+				if d.CellVar(cellId, i).Imputed {
+					rows[i].Genotypes[cellId] = d.Genotype(cellId, i)
+				}
+			}
 		}
 	}
 	return rows
@@ -80,7 +111,7 @@ func writeTable(outfile string, colNames string, rows []row, delim string, genot
 
 func rowToString(r row, delim string, genotypeAsString bool) string {
 	var answer strings.Builder
-	_, err := answer.WriteString(fmt.Sprintf("%s%s%d%s%s%s%s", r.Chr, delim, r.Pos, delim, dna.BasesToString(r.Ref), delim, dna.BasesToString(r.Alt)))
+	_, err := answer.WriteString(fmt.Sprintf("%s%s%s%s%d%s%s%s%s", r.Key, delim, r.Chr, delim, r.Pos, delim, dna.BasesToString(r.Ref), delim, dna.BasesToString(r.Alt)))
 	if err != nil {
 		log.Panic(err)
 	}
@@ -102,6 +133,57 @@ func rowToString(r row, delim string, genotypeAsString bool) string {
 	return answer.String()
 }
 
+// writeVariantQc writes the summary statistics of each variant in rows. ErrorRate is the background
+// rate of alt reads estimated by the Binomial caller, and NA for other callers.
+func writeVariantQc(outfile string, d *cells.Data, rows []row, delim string) {
+	out := fileio.EasyCreate(outfile)
+	_, err := fmt.Fprintln(out, strings.Join([]string{"Key", "CellAf", "GenotypedFrac", "CellsMutatedFrac", "CellsGenotyped", "CellsMutated", "ErrorRate"}, delim))
+	exception.PanicOnErr(err)
+	var errorRate string
+	for i, v := range d.Variants {
+		if rows[i].Chr == "" { // row was filtered out
+			continue
+		}
+		errorRate = "NA"
+		if v.ErrorRate > 0 {
+			errorRate = fmt.Sprint(v.ErrorRate)
+		}
+		_, err = fmt.Fprintln(out, strings.Join([]string{v.Key(), fmt.Sprint(v.CellAf), fmt.Sprint(v.GenotypedFrac), fmt.Sprint(v.CellsMutatedFrac),
+			fmt.Sprint(len(v.CellsGenotyped)), fmt.Sprint(len(v.CellsMutated)), errorRate}, delim))
+		exception.PanicOnErr(err)
+	}
+	exception.PanicOnErr(out.Close())
+}
+
+// writePValues writes the p-value of the alt reads of each genotyped cell under the error rate of
+// each variant in rows, in the layout of the genotype table. Cells that are not genotyped are NA.
+func writePValues(outfile string, d *cells.Data, rows []row, delim string) {
+	out := fileio.EasyCreate(outfile)
+	_, err := fmt.Fprintln(out, generateColNames(d, delim))
+	exception.PanicOnErr(err)
+	var s strings.Builder
+	pValues := make([]string, len(d.Cells))
+	for i := range rows {
+		if rows[i].Chr == "" { // row was filtered out
+			continue
+		}
+		for cellId := range pValues {
+			pValues[cellId] = "NA"
+		}
+		for _, cellId := range d.Variants[i].CellsGenotyped {
+			pValues[cellId] = fmt.Sprint(d.CellVar(cellId, i).PValue)
+		}
+		s.Reset()
+		fmt.Fprintf(&s, "%s%s%s%s%d%s%s%s%s", rows[i].Key, delim, rows[i].Chr, delim, rows[i].Pos, delim, dna.BasesToString(rows[i].Ref), delim, dna.BasesToString(rows[i].Alt))
+		for _, pValue := range pValues {
+			s.WriteString(delim + pValue)
+		}
+		_, err = fmt.Fprintln(out, s.String())
+		exception.PanicOnErr(err)
+	}
+	exception.PanicOnErr(out.Close())
+}
+
 func genotypeToInt(z variants.Zygosity) int {
 	switch z {
 	case variants.NoGenotype:
@@ -119,14 +201,42 @@ func genotypeToInt(z variants.Zygosity) int {
 	}
 }
 
-var defaultVcfQual float64 = 100
-var defaultCellFilter = cells.CellFilterParam{MinGenotypeQuality: 30, MinGenotypeDepth: 10, MinReadAf: 0.2}
-var defaultGlobalFilter = cells.GlobalFilterParam{MinGenotypedFrac: 0.5, MinGenotypesPresent: 0.5, MinCellAf: 0.01}
-
-var infile = "/Users/danielsnellings/Desktop/CCM2066.vcf.gz"
-var v1file = "/Users/danielsnellings/Desktop/Data/21-04-06_Tapestri_Run/CM2001_R/CM2001.vcf.gz"
-var v2file = "/Users/danielsnellings/Desktop/Data/21-04-06_Tapestri_Run/V2_Analysis/CM2001_2.vcf.gz"
-
 func main() {
-	generateTable(infile, "CCM2066.csv", defaultCellFilter, defaultGlobalFilter, defaultVcfQual, ",", false, .2, .8)
+	var infile *string = flag.String("i", "", "Input vcf file (may be vcf.gz)")
+	var outfile *string = flag.String("o", "", "Output genotype table. Defaults to the input file name with a .csv suffix")
+	var delim *string = flag.String("delim", ",", "Column delimiter")
+	var genotypeAsString *bool = flag.Bool("genotypeAsString", false, "Write genotypes as names instead of 0 (WildType), 1 (Heterozygous), 2 (Homozygous), and 3 (Hemizygous)")
+	var minCellAf *float64 = flag.Float64("minCellAf", 0.2, "Minimum CellAf of variants in the table")
+	var maxCellAf *float64 = flag.Float64("maxCellAf", 0.8, "Maximum CellAf of variants in the table")
+	var caller *string = flag.String("caller", cells.DefaultCellFilter.Caller.String(), "Genotype caller: AfThreshold, Likelihood, or Binomial")
+	var minPosterior *float64 = flag.Float64("minPosterior", cells.DefaultCellFilter.MinPosterior, "Cells are genotyped if the posterior of their most likely genotype is at least minPosterior. Likelihood caller only")
+	var maxPValue *float64 = flag.Float64("maxPValue", 0.001, "Cells are mutated if the p-value of their alt reads under the site error rate is below maxPValue. Binomial caller only")
+	var qcFile *string = flag.String("qc", "", "Output table of summary statistics of each variant, including the error rate estimated by the Binomial caller")
+	var pValueFile *string = flag.String("pValues", "", "Output table of the p-value of the alt reads of each cell at each variant. Binomial caller only")
+	var fasta *string = flag.String("fasta", "", "Indexed reference fasta used to left-align indels so variant keys match other callers")
+	var adapter *string = flag.String("adapter", "", "Variant caller that wrote infile: gatk, bcftools, freebayes, or strelka. Detected from the vcf header if empty")
+	var showImputed *bool = flag.Bool("showImputed", false, "Impute missing genotypes from the nearest cells (see impute.Knn) and include them in the table")
+	flag.Parse()
+
+	if *infile == "" {
+		usage()
+		return
+	}
+	if *outfile == "" {
+		*outfile = strings.TrimSuffix(strings.TrimSuffix(*infile, ".gz"), ".vcf") + ".csv"
+	}
+
+	p := cells.DefaultReadParam
+	p.CellFilter.Caller = cells.GenotypeCallerByName(*caller)
+	p.CellFilter.MinPosterior = *minPosterior
+	p.CellFilter.MaxPValue = *maxPValue
+	if *adapter != "" {
+		p.Adapter = cells.AdapterByName(*adapter)
+	}
+	if *fasta != "" {
+		ref := reference.Open(*fasta)
+		defer ref.Close()
+		p.Reference = ref
+	}
+	generateTable(*infile, *outfile, p, *delim, *genotypeAsString, *minCellAf, *maxCellAf, *showImputed, *qcFile, *pValueFile)
 }
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/loh"
+	"github.com/ddsnellings/weaver/phylogeny"
+	"log"
+	"strings"
+)
+
+func usage() {
+	fmt.Print(
+		"phylogeny - Infer a mutation tree from cell genotypes.\n\n" +
+			"Usage:\n" +
+			"  phylogeny -i infile.vcf.gz\n\n" +
+			"Options:\n\n")
+	flag.PrintDefaults()
+}
+
+func buildTree(infile string, outPrefix string, adapter string, minRunLength int, minCells int, bootstrap int, p phylogeny.Param) {
+	readParam := cells.DefaultReadParam
+	if adapter != "" {
+		readParam.Adapter = cells.AdapterByName(adapter)
+	}
+	d := cells.ReadVcfWithParam(infile, readParam)
+
+	var lohEvents []loh.Haplotype
+	if minRunLength > 0 {
+		roh := loh.FindAllRunsOfHomozygosity(d, minRunLength)
+		lohEvents = phylogeny.LohEvents(loh.CountRohHaplotypes(roh, d), d.Contigs, minCells)
+	}
+	log.Printf("inferring tree with %d mutations and %d LOH events", len(d.Variants), len(lohEvents))
+
+	tree := phylogeny.Infer(d, nil, lohEvents, p)
+	log.Printf("best tree log likelihood: %.4f", tree.LogLikelihood)
+	if bootstrap > 0 {
+		tree.SetSupport(phylogeny.Bootstrap(d, nil, lohEvents, p, bootstrap))
+	}
+
+	phylogeny.WriteNewick(outPrefix+".nwk", tree, d)
+	phylogeny.WriteJson(outPrefix+".tree.json", tree, d)
+}
+
+func main() {
+	var infile *string = flag.String("i", "", "Input vcf file (may be vcf.gz)")
+	var outPrefix *string = flag.String("o", "", "Prefix for output files (.nwk and .tree.json). Defaults to the input file name")
+	var minRunLength *int = flag.Int("minRunLength", 5, "Minimum number of adjacent homozygous SNPs for a candidate LOH event. 0 disables LOH events")
+	var minCells *int = flag.Int("minCells", 2, "Minimum number of cells with a run of homozygosity for a candidate LOH event")
+	var bootstrap *int = flag.Int("bootstrap", 0, "Number of bootstrap replicates used to compute edge support")
+	var fp *float64 = flag.Float64("fp", phylogeny.DefaultParam.FalsePositive, "False positive rate")
+	var fn *float64 = flag.Float64("fn", phylogeny.DefaultParam.FalseNegative, "False negative (allelic dropout) rate")
+	var iterations *int = flag.Int("iterations", phylogeny.DefaultParam.Iterations, "Number of MCMC proposals per chain")
+	var chains *int = flag.Int("chains", phylogeny.DefaultParam.Chains, "Number of independent MCMC chains")
+	var seed *int64 = flag.Int64("seed", 1, "Seed for random number generation")
+	var adapter *string = flag.String("adapter", "", "Variant caller that wrote infile: gatk, bcftools, freebayes, or strelka. Detected from the vcf header if empty")
+	flag.Parse()
+
+	if *infile == "" {
+		usage()
+		return
+	}
+
+	if *outPrefix == "" {
+		*outPrefix = strings.TrimSuffix(strings.TrimSuffix(*infile, ".gz"), ".vcf")
+	}
+
+	p := phylogeny.DefaultParam
+	p.FalsePositive = *fp
+	p.FalseNegative = *fn
+	p.Iterations = *iterations
+	p.Chains = *chains
+	p.Seed = *seed
+	buildTree(*infile, *outPrefix, *adapter, *minRunLength, *minCells, *bootstrap, p)
+}
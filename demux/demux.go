@@ -0,0 +1,355 @@
+// Package demux assigns cells pooled from several donors to their donor of origin using
+// the reads observed at germline SNPs, in the style of vireo (Huang et al. 2019) and
+// souporcell (Heaton et al. 2020).
+//
+// Each donor has a genotype at every SNP which is either learned from the cells or taken
+// from a VCF of known donor genotypes. The reads of each cell are binomial with an alt allele
+// fraction determined by the genotype of its donor, and doublets of cells from two donors
+// are modeled as an even mixture of the two genotypes.
+package demux
+
+import (
+	"fmt"
+	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/parallel"
+	"github.com/ddsnellings/weaver/variants"
+	"gonum.org/v1/gonum/floats"
+	"log"
+	"math"
+	"math/rand"
+)
+
+// Param defines the parameters for demultiplexing.
+type Param struct {
+	Donors       int     // number of donors. ignored if known donor genotypes are given
+	MinCellFrac  float64 // SNPs with reads in < MinCellFrac of cells are not used // Default 0.1
+	ErrorRate    float64 // fraction of reads with the wrong allele at homozygous sites // Default 0.01
+	DoubletRate  float64 // initial rate of inter-donor doublets. 0 disables doublet detection // Default 0.05
+	MinPosterior float64 // cells with posterior < MinPosterior for their most probable donor are unassigned // Default 0.9
+	MaxIter      int     // maximum EM iterations per restart // Default 100
+	Restarts     int     // number of random initializations. ignored if known donor genotypes are given // Default 5
+	Seed         int64   // seed for initialization
+}
+
+var DefaultParam = Param{MinCellFrac: 0.1, ErrorRate: 0.01, DoubletRate: 0.05, MinPosterior: 0.9, MaxIter: 100, Restarts: 5, Seed: 1}
+
+// Result stores the donor assignment of each cell.
+type Result struct {
+	Donor       []int                 // Donor[cellId] is the assigned donor, -1 if unassigned, or -2 if called as a doublet
+	Posterior   [][]float64           // Posterior[cellId][donor] is the probability the cell is a singlet from the donor
+	Doublet     []float64             // probability each cell is an inter-donor doublet
+	DonorNames  []string              // name of each donor. sample names if known genotypes were given
+	Genotypes   [][]variants.Zygosity // Genotypes[donor][variantId] is the most probable genotype. NoGenotype if the SNP was not used
+	DoubletRate float64               // fitted doublet rate
+}
+
+// Doublet is the Donor label for cells called as doublets.
+const Doublet = -2
+
+// numThetas is the number of distinct alt allele fractions. Index i is the fraction for a
+// doublet with i total alt copies across both donors, and a singlet with g copies is index 2g.
+const numThetas = 5
+
+// state stores the data and parameters during EM.
+type state struct {
+	logBinom [][]cellSnp // logBinom[cell] are the log likelihoods at each SNP with reads
+	geno     [][][3]float64
+	fixed    [][]bool // fixed[donor][snp] is true if the genotype is known
+	weights  []float64
+	doublet  float64
+	post     [][]float64
+	dblPost  []float64
+	lik      float64
+}
+
+// cellSnp is the log likelihood of the reads of a cell at a SNP for each alt allele fraction.
+type cellSnp struct {
+	snp int
+	lik [numThetas]float64
+}
+
+// Demultiplex assigns each cell to one of p.Donors donors with genotypes learned from the cells.
+func Demultiplex(d *cells.Data, p Param) Result {
+	if p.Donors < 1 {
+		log.Panicf("demultiplexing requires at least one donor. found Donors=%d", p.Donors)
+	}
+	snps := selectSnps(d, p.MinCellFrac)
+	obs := cellLikelihoods(d, snps, p.ErrorRate)
+	r := rand.New(rand.NewSource(p.Seed))
+	var best *state
+	for run := 0; run < p.Restarts || run == 0; run++ {
+		s := newState(obs, len(snps), p.Donors, p.DoubletRate)
+		s.randomInit(r)
+		s.run(p)
+		if best == nil || s.lik > best.lik {
+			best = s
+		}
+	}
+	names := make([]string, p.Donors)
+	for k := range names {
+		names[k] = fmt.Sprintf("donor%d", k)
+	}
+	return best.result(d, snps, names, p)
+}
+
+// DemultiplexKnown assigns each cell to a donor with known genotypes. Genotypes for SNPs that
+// are missing from a donor are learned from the cells.
+func DemultiplexKnown(d *cells.Data, known KnownGenotypes, p Param) Result {
+	snps := selectSnps(d, p.MinCellFrac)
+	obs := cellLikelihoods(d, snps, p.ErrorRate)
+	s := newState(obs, len(snps), len(known.Names), p.DoubletRate)
+	for i, vid := range snps {
+		genotypes, found := known.Genotypes[d.Variants[vid].Key()]
+		for k := range known.Names {
+			s.geno[k][i] = [3]float64{1.0 / 3, 1.0 / 3, 1.0 / 3}
+			if !found || genotypes[k] < 0 {
+				continue
+			}
+			s.geno[k][i] = [3]float64{p.ErrorRate, p.ErrorRate, p.ErrorRate}
+			s.geno[k][i][genotypes[k]] = 1 - 2*p.ErrorRate
+			s.fixed[k][i] = true
+		}
+	}
+	s.run(p)
+	return s.result(d, snps, known.Names, p)
+}
+
+// selectSnps returns the variant Ids with reads in at least minCellFrac of cells.
+func selectSnps(d *cells.Data, minCellFrac float64) []int {
+	counts := make([]int, len(d.Variants))
+	for i := range d.Cells {
+		for vid := range d.Variants {
+			if d.CellVar(i, vid).ReadDepth > 0 {
+				counts[vid]++
+			}
+		}
+	}
+	var answer []int
+	for vid := range counts {
+		if counts[vid] > 0 && float64(counts[vid]) >= minCellFrac*float64(len(d.Cells)) {
+			answer = append(answer, vid)
+		}
+	}
+	if len(answer) == 0 {
+		log.Panicf("no SNPs have reads in at least %g of cells", minCellFrac)
+	}
+	return answer
+}
+
+// cellLikelihoods computes the log likelihood of the reads in each cell at each alt allele fraction.
+func cellLikelihoods(d *cells.Data, snps []int, errRate float64) [][]cellSnp {
+	thetas := [numThetas]float64{errRate, (errRate + 0.5) / 2, 0.5, (1.5 - errRate) / 2, 1 - errRate}
+	answer := make([][]cellSnp, len(d.Cells))
+	var cv variants.CellVar
+	var alt, depth float64
+	for i := range d.Cells {
+		for idx, vid := range snps {
+			cv = d.CellVar(i, vid)
+			if cv.ReadDepth <= 0 {
+				continue
+			}
+			alt, depth = float64(cv.AltReads), float64(cv.ReadDepth)
+			alt = math.Min(alt, depth)
+			o := cellSnp{snp: idx}
+			for t, theta := range thetas {
+				o.lik[t] = alt*math.Log(theta) + (depth-alt)*math.Log1p(-theta)
+			}
+			answer[i] = append(answer[i], o)
+		}
+	}
+	return answer
+}
+
+func newState(obs [][]cellSnp, numSnps int, donors int, doubletRate float64) *state {
+	s := &state{logBinom: obs, doublet: doubletRate}
+	s.geno = make([][][3]float64, donors)
+	s.fixed = make([][]bool, donors)
+	s.weights = make([]float64, donors)
+	for k := range s.geno {
+		s.geno[k] = make([][3]float64, numSnps)
+		s.fixed[k] = make([]bool, numSnps)
+		s.weights[k] = 1 / float64(donors)
+	}
+	s.post = make([][]float64, len(obs))
+	for i := range s.post {
+		s.post[i] = make([]float64, donors)
+	}
+	s.dblPost = make([]float64, len(obs))
+	return s
+}
+
+// randomInit assigns each cell to a random donor and computes the initial donor genotypes.
+func (s *state) randomInit(r *rand.Rand) {
+	for i := range s.post {
+		s.post[i][r.Intn(len(s.weights))] = 1
+	}
+	s.updateGenotypes()
+}
+
+// run iterates expectation and maximization steps until the likelihood stops improving.
+func (s *state) run(p Param) {
+	prev := math.Inf(-1)
+	for iter := 0; iter < p.MaxIter; iter++ {
+		s.expectation()
+		if s.lik-prev < 1e-6*float64(len(s.post)) {
+			break
+		}
+		prev = s.lik
+		s.updateWeights(p)
+		s.updateGenotypes()
+	}
+}
+
+// expectation computes the posterior of each cell for each donor and donor pair using the
+// expected log likelihood under the current donor genotype probabilities.
+func (s *state) expectation() {
+	k := len(s.weights)
+	cellLik := make([]float64, len(s.post))
+	parallel.For(len(s.post), 0, func(i int) {
+		logp := make([]float64, k, k+k*(k-1)/2)
+		for a := 0; a < k; a++ {
+			logp[a] = math.Log(s.weights[a])
+			if s.doublet > 0 {
+				logp[a] += math.Log1p(-s.doublet)
+			}
+			for _, o := range s.logBinom[i] {
+				for g := 0; g < 3; g++ {
+					logp[a] += s.geno[a][o.snp][g] * o.lik[2*g]
+				}
+			}
+		}
+		if s.doublet > 0 && k > 1 {
+			var norm float64
+			for a := 0; a < k; a++ {
+				for b := a + 1; b < k; b++ {
+					norm += s.weights[a] * s.weights[b]
+				}
+			}
+			var lik float64
+			for a := 0; a < k; a++ {
+				for b := a + 1; b < k; b++ {
+					lik = math.Log(s.doublet) + math.Log(s.weights[a]*s.weights[b]/norm)
+					for _, o := range s.logBinom[i] {
+						for ga := 0; ga < 3; ga++ {
+							for gb := 0; gb < 3; gb++ {
+								lik += s.geno[a][o.snp][ga] * s.geno[b][o.snp][gb] * o.lik[ga+gb]
+							}
+						}
+					}
+					logp = append(logp, lik)
+				}
+			}
+		}
+
+		max := math.Inf(-1)
+		for _, val := range logp {
+			max = math.Max(max, val)
+		}
+		var sum float64
+		for _, val := range logp {
+			sum += math.Exp(val - max)
+		}
+		cellLik[i] = max + math.Log(sum)
+		s.dblPost[i] = 0
+		for c, val := range logp {
+			if c < k {
+				s.post[i][c] = math.Exp(val - cellLik[i])
+			} else {
+				s.dblPost[i] += math.Exp(val - cellLik[i])
+			}
+		}
+	})
+	s.lik = 0
+	for _, val := range cellLik {
+		s.lik += val
+	}
+}
+
+// maxDoubletRate is the upper limit of the fitted doublet rate.
+const maxDoubletRate = 0.5
+
+// updateWeights sets the donor weights and doublet rate from the current posteriors.
+// Weights are smoothed by one pseudo-cell per donor.
+func (s *state) updateWeights(p Param) {
+	var total, doublets float64
+	for k := range s.weights {
+		s.weights[k] = 1
+		for i := range s.post {
+			s.weights[k] += s.post[i][k]
+		}
+		total += s.weights[k]
+	}
+	for k := range s.weights {
+		s.weights[k] /= total
+	}
+	if s.doublet > 0 {
+		for i := range s.dblPost {
+			doublets += s.dblPost[i]
+		}
+		s.doublet = math.Min(math.Max(doublets/float64(len(s.dblPost)), 1e-6), maxDoubletRate)
+	}
+}
+
+// updateGenotypes sets the genotype probabilities of each donor at each SNP that is not fixed
+// to the posterior given the reads of the cells assigned to the donor and a uniform prior.
+func (s *state) updateGenotypes() {
+	parallel.For(len(s.geno), 0, func(k int) {
+		score := make([][3]float64, len(s.geno[k]))
+		for i := range s.post {
+			if s.post[i][k] < 1e-6 {
+				continue
+			}
+			for _, o := range s.logBinom[i] {
+				for g := 0; g < 3; g++ {
+					score[o.snp][g] += s.post[i][k] * o.lik[2*g]
+				}
+			}
+		}
+		var max, sum float64
+		for snp := range score {
+			if s.fixed[k][snp] {
+				continue
+			}
+			max = math.Max(score[snp][0], math.Max(score[snp][1], score[snp][2]))
+			sum = 0
+			for g := range score[snp] {
+				s.geno[k][snp][g] = math.Exp(score[snp][g] - max)
+				sum += s.geno[k][snp][g]
+			}
+			for g := range score[snp] {
+				s.geno[k][snp][g] /= sum
+			}
+		}
+	})
+}
+
+// result converts the final state to a Result.
+func (s *state) result(d *cells.Data, snps []int, names []string, p Param) Result {
+	answer := Result{
+		Donor:       make([]int, len(s.post)),
+		Posterior:   s.post,
+		Doublet:     s.dblPost,
+		DonorNames:  names,
+		Genotypes:   make([][]variants.Zygosity, len(s.geno)),
+		DoubletRate: s.doublet,
+	}
+	for k := range s.geno {
+		answer.Genotypes[k] = make([]variants.Zygosity, len(d.Variants))
+		for idx, vid := range snps {
+			answer.Genotypes[k][vid] = variants.WildType + variants.Zygosity(floats.MaxIdx(s.geno[k][idx][:]))
+		}
+	}
+	var best int
+	for i := range s.post {
+		best = floats.MaxIdx(s.post[i])
+		switch {
+		case s.dblPost[i] > s.post[i][best]:
+			answer.Donor[i] = Doublet
+		case s.post[i][best] >= p.MinPosterior:
+			answer.Donor[i] = best
+		default:
+			answer.Donor[i] = -1
+		}
+	}
+	return answer
+}
@@ -0,0 +1,134 @@
+package demux
+
+import (
+	"fmt"
+	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/cells/cellstest"
+	"github.com/ddsnellings/weaver/variants"
+	"math/rand"
+	"testing"
+)
+
+// simulateDonors returns data with cellsPerDonor cells from each of the donor genotypes followed
+// by doublets of cells from the first two donors. Reads at each SNP are missing in 30% of cells.
+func simulateDonors(donors [][]int, cellsPerDonor int, doublets int) *cells.Data {
+	r := rand.New(rand.NewSource(3))
+	var af float64
+	var alt, depth [][]int
+	addCell := func(a, b int) {
+		cellAlt, cellDepth := make([]int, len(donors[0])), make([]int, len(donors[0]))
+		for j := range cellDepth {
+			if r.Float64() < 0.3 {
+				continue
+			}
+			af = float64(donors[a][j]+donors[b][j])/4*0.98 + 0.01
+			cellDepth[j] = 5 + r.Intn(10)
+			for k := 0; k < cellDepth[j]; k++ {
+				if r.Float64() < af {
+					cellAlt[j]++
+				}
+			}
+		}
+		alt = append(alt, cellAlt)
+		depth = append(depth, cellDepth)
+	}
+	for k := range donors {
+		for i := 0; i < cellsPerDonor; i++ {
+			addCell(k, k)
+		}
+	}
+	for i := 0; i < doublets; i++ {
+		addCell(0, 1)
+	}
+	d := cellstest.FromReadCounts(alt, depth)
+	for i := range d.Cells {
+		d.Cells[i].Name = fmt.Sprintf("cell%d", i)
+	}
+	for j := range d.Variants {
+		d.Variants[j].Chr = "chr1"
+		d.Variants[j].Pos = 100 * j
+	}
+	return d
+}
+
+// randomDonors returns the genotypes of n donors at numSnps SNPs.
+func randomDonors(n int, numSnps int) [][]int {
+	r := rand.New(rand.NewSource(11))
+	answer := make([][]int, n)
+	for k := range answer {
+		answer[k] = make([]int, numSnps)
+		for j := range answer[k] {
+			answer[k][j] = r.Intn(3)
+		}
+	}
+	return answer
+}
+
+func TestDemultiplex(t *testing.T) {
+	donors := randomDonors(3, 60)
+	d := simulateDonors(donors, 30, 5)
+	p := DefaultParam
+	p.Donors = 3
+	res := Demultiplex(d, p)
+
+	// map each donor label to the true donor using the first cell of each donor
+	label := make(map[int]int)
+	for k := range donors {
+		label[res.Donor[k*30]] = k
+	}
+	if len(label) != 3 {
+		t.Fatalf("expected 3 distinct donors, found %v", res.Donor[:90])
+	}
+	for i := 0; i < 90; i++ {
+		if truth, found := label[res.Donor[i]]; !found || truth != i/30 {
+			t.Errorf("cell %d assigned to donor %d, expected %d", i, res.Donor[i], i/30)
+		}
+	}
+	for i := 90; i < len(d.Cells); i++ {
+		if res.Donor[i] != Doublet {
+			t.Errorf("expected cell %d to be called as a doublet. doublet probability %f", i, res.Doublet[i])
+		}
+	}
+	for donor, truth := range label {
+		for j := range donors[truth] {
+			if res.Genotypes[donor][j] != variants.Zygosity(donors[truth][j]+1) {
+				t.Errorf("donor %d genotype at SNP %d does not match %d", donor, j, donors[truth][j])
+			}
+		}
+	}
+
+	split := Split(d, res)
+	for k := range split {
+		if len(split[k].Cells) != 30 {
+			t.Errorf("expected 30 cells for donor %d, found %d", k, len(split[k].Cells))
+		}
+		for i := range split[k].Cells {
+			if split[k].Cells[i].Id != i {
+				t.Errorf("cell Ids not recomputed for donor %d", k)
+			}
+		}
+	}
+	if len(d.Cells) != 95 {
+		t.Errorf("Split modified the input data")
+	}
+}
+
+func TestDemultiplexKnown(t *testing.T) {
+	donors := randomDonors(2, 40)
+	d := simulateDonors(donors, 20, 3)
+	known := KnownGenotypes{Names: []string{"A", "B"}, Genotypes: make(map[string][]int)}
+	for j := range d.Variants {
+		known.Genotypes[d.Variants[j].String()] = []int{donors[0][j], donors[1][j]}
+	}
+	res := DemultiplexKnown(d, known, DefaultParam)
+	for i := 0; i < 40; i++ {
+		if res.Donor[i] != i/20 {
+			t.Errorf("cell %d assigned to donor %d, expected %d", i, res.Donor[i], i/20)
+		}
+	}
+	for i := 40; i < len(d.Cells); i++ {
+		if res.Donor[i] != Doublet {
+			t.Errorf("expected cell %d to be called as a doublet. doublet probability %f", i, res.Doublet[i])
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package demux
+
+import (
+	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/variants"
+	"github.com/vertgenlab/gonomics/vcf"
+	"strings"
+)
+
+// KnownGenotypes stores the germline genotypes of each donor from a VCF.
+type KnownGenotypes struct {
+	Names     []string         // sample name of each donor
+	Genotypes map[string][]int // Genotypes[variant.Key()][donor] is the number of alt copies, -1 if missing
+}
+
+// ReadDonorVcf reads the GT field of each sample in a VCF of donor genotypes. Multiallelic
+// records are split into one entry per alt allele with the same normalization as cells.ReadVcf
+// so that variants can be matched by their Key. If ref is not nil, indels are left-aligned
+// (see variants.Normalize) and ref should match the reference used to read the cells.
+func ReadDonorVcf(file string, ref variants.Reference) KnownGenotypes {
+	vcfChan, header := vcf.GoReadToChan(file)
+	colNames := strings.Split(header.Text[len(header.Text)-1], "\t")
+	answer := KnownGenotypes{Names: colNames[9:], Genotypes: make(map[string][]int)}
+	var key string
+	var variant variants.Variant
+	var ok bool
+	for record := range vcfChan {
+		for alleleIdx := range record.Alt {
+			if record.Alt[alleleIdx] == "." {
+				continue
+			}
+			variant = cells.NewVariant(record, alleleIdx)
+			if ref != nil {
+				if variant, ok = cells.NormalizeVariant(variant, ref); !ok {
+					continue
+				}
+			}
+			key = variant.Key()
+			answer.Genotypes[key] = make([]int, len(record.Samples))
+			for k, s := range record.Samples {
+				answer.Genotypes[key][k] = altCopies(s, int16(alleleIdx+1))
+			}
+		}
+	}
+	return answer
+}
+
+// altCopies returns the number of copies of allele in the genotype, or -1 if the genotype is missing.
+// Hemizygous genotypes are counted as homozygous.
+func altCopies(s vcf.GenomeSample, allele int16) int {
+	if s.AlleleOne == -1 {
+		return -1
+	}
+	if s.AlleleTwo == -1 {
+		if s.AlleleOne == allele {
+			return 2
+		}
+		return 0
+	}
+	var answer int
+	if s.AlleleOne == allele {
+		answer++
+	}
+	if s.AlleleTwo == allele {
+		answer++
+	}
+	return answer
+}
+
+// Split returns a subset of d for each donor containing the cells assigned to that donor.
+// Unassigned cells and doublets are excluded. Cell and variant Ids are recomputed in each subset.
+func Split(d *cells.Data, r Result) []*cells.Data {
+	answer := d.SplitBy(r.Donor)
+	for len(answer) < len(r.DonorNames) {
+		answer = append(answer, d.Subset(make([]int, 0), nil))
+	}
+	return answer
+}
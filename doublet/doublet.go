@@ -0,0 +1,203 @@
+// Package doublet identifies cell doublets in single-cell DNA sequencing data.
+//
+// Doublets are droplets containing two cells. They appear as cells carrying the mutations
+// of two clones, as heterozygous calls at sites that are homozygous in every clone, and
+// with greater total read depth than singlets. Artificial doublets are simulated by summing
+// the read counts of random pairs of cells, and each real cell is scored by the fraction of
+// its nearest neighbors that are artificial doublets (Bais and Kostka 2020; McGinnis et al. 2019).
+package doublet
+
+import (
+	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/impute"
+	"github.com/ddsnellings/weaver/parallel"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// Param defines the parameters for doublet scoring.
+type Param struct {
+	SimulatedRatio float64 // number of artificial doublets per real cell // Default 0.5
+	K              int     // number of nearest neighbors used to score each cell // Default 20
+	MinDepth       int     // read depth required to use the allele frequency of a variant in a cell // Default 10
+	MinShared      int     // minimum variants observed in both cells to compute a distance // Default 5
+	DepthWeight    float64 // weight of the difference in standardized log total depth in the distance // Default 0.1
+	ExpectedRate   float64 // expected fraction of doublets. the cells with the greatest scores are called as doublets // Default 0.05
+	Seed           int64   // seed for selecting cell pairs
+}
+
+var DefaultParam = Param{SimulatedRatio: 0.5, K: 20, MinDepth: 10, MinShared: 5, DepthWeight: 0.1, ExpectedRate: 0.05, Seed: 1}
+
+// Result stores the doublet score and call of each cell.
+type Result struct {
+	Score     []float64 // fraction of the K nearest neighbors of each cell that are artificial doublets
+	Doublet   []bool    // true if the cell is called as a doublet
+	Depth     []int     // total read depth of each cell across all variants
+	Threshold float64   // cells with Score >= Threshold are called as doublets
+}
+
+// profile is the allele frequency of each variant and the total read depth of a real or artificial cell.
+type profile struct {
+	af    []float64 // NaN if the variant has insufficient depth
+	depth float64   // standardized log total depth
+}
+
+// Score computes the doublet score of each cell and calls the cells with the greatest scores
+// as doublets. Cells are only called if their score is greater than the fraction of all
+// profiles that are artificial doublets, i.e. if artificial doublets are enriched among
+// their neighbors.
+func Score(d *cells.Data, p Param) Result {
+	n := len(d.Cells)
+	numSim := int(math.Round(p.SimulatedRatio * float64(n)))
+	answer := Result{Score: make([]float64, n), Doublet: make([]bool, n), Depth: make([]int, n)}
+	if n < 2 {
+		return answer
+	}
+
+	// read counts of real cells followed by artificial doublets
+	alt := make([][]int, n+numSim)
+	depth := make([][]int, n+numSim)
+	for i := range d.Cells {
+		alt[i] = make([]int, len(d.Variants))
+		depth[i] = make([]int, len(d.Variants))
+		for vid := range d.Variants {
+			cv := d.CellVar(i, vid)
+			alt[i][vid], depth[i][vid] = cv.AltReads, cv.ReadDepth
+			answer.Depth[i] += cv.ReadDepth
+		}
+	}
+	r := rand.New(rand.NewSource(p.Seed))
+	parents := make([][2]int, numSim)
+	var a, b int
+	for s := n; s < len(alt); s++ {
+		a, b = r.Intn(n), r.Intn(n-1)
+		if b >= a {
+			b++
+		}
+		parents[s-n] = [2]int{a, b}
+		alt[s] = make([]int, len(d.Variants))
+		depth[s] = make([]int, len(d.Variants))
+		for vid := range d.Variants {
+			alt[s][vid] = alt[a][vid] + alt[b][vid]
+			depth[s][vid] = depth[a][vid] + depth[b][vid]
+		}
+	}
+	profiles := makeProfiles(alt, depth, p.MinDepth, n)
+
+	k := p.K
+	if k > len(profiles)-1 {
+		k = len(profiles) - 1
+	}
+	parallel.For(n, 0, func(i int) {
+		answer.Score[i] = simulatedFraction(i, profiles, parents, k, p)
+	})
+
+	baseline := float64(numSim) / float64(n+numSim)
+	sorted := append([]float64{}, answer.Score...)
+	sort.Float64s(sorted)
+	idx := int(math.Ceil(float64(n)*(1-p.ExpectedRate))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	answer.Threshold = math.Max(sorted[idx], math.Nextafter(baseline, 1))
+	if p.ExpectedRate <= 0 {
+		answer.Threshold = math.Inf(1)
+	}
+	for i := range answer.Score {
+		answer.Doublet[i] = answer.Score[i] >= answer.Threshold
+	}
+	return answer
+}
+
+// makeProfiles computes the allele frequencies of each cell and the log total depth standardized
+// by the mean and standard deviation of the first numReal cells.
+func makeProfiles(alt [][]int, depth [][]int, minDepth int, numReal int) []profile {
+	answer := make([]profile, len(alt))
+	var total int
+	for i := range alt {
+		answer[i].af = make([]float64, len(alt[i]))
+		total = 0
+		for vid := range alt[i] {
+			total += depth[i][vid]
+			if depth[i][vid] < minDepth || depth[i][vid] == 0 {
+				answer[i].af[vid] = math.NaN()
+			} else {
+				answer[i].af[vid] = float64(alt[i][vid]) / float64(depth[i][vid])
+			}
+		}
+		answer[i].depth = math.Log1p(float64(total))
+	}
+
+	var mean, sd float64
+	for i := 0; i < numReal; i++ {
+		mean += answer[i].depth
+	}
+	mean /= float64(numReal)
+	for i := 0; i < numReal; i++ {
+		sd += (answer[i].depth - mean) * (answer[i].depth - mean)
+	}
+	sd = math.Sqrt(sd / float64(numReal))
+	if sd == 0 {
+		sd = 1
+	}
+	for i := range answer {
+		answer[i].depth = (answer[i].depth - mean) / sd
+	}
+	return answer
+}
+
+// distance between two profiles. The allele frequency term is the dropout aware distance
+// from impute.Distance. Returns +Inf if too few variants are observed in both.
+func distance(a, b profile, p Param) float64 {
+	return impute.Distance(a.af, b.af, p.MinShared) + p.DepthWeight*math.Abs(a.depth-b.depth)
+}
+
+// neighbor is a profile and its distance from a query cell.
+type neighbor struct {
+	idx  int
+	dist float64
+}
+
+// simulatedFraction returns the fraction of the k nearest neighbors of cell i that are
+// artificial doublets. parents[s] are the cells combined to make the artificial doublet at
+// profiles[numReal+s]. The cell itself and the artificial doublets built from it are excluded
+// from the neighbors.
+func simulatedFraction(i int, profiles []profile, parents [][2]int, k int, p Param) float64 {
+	numReal := len(profiles) - len(parents)
+	candidates := make([]neighbor, 0, len(profiles))
+	var dist float64
+	for j := range profiles {
+		if j == i || (j >= numReal && (parents[j-numReal][0] == i || parents[j-numReal][1] == i)) {
+			continue
+		}
+		dist = distance(profiles[i], profiles[j], p)
+		if !math.IsInf(dist, 1) {
+			candidates = append(candidates, neighbor{idx: j, dist: dist})
+		}
+	}
+	if len(candidates) == 0 {
+		return 0
+	}
+	sort.Slice(candidates, func(a, b int) bool {
+		if candidates[a].dist == candidates[b].dist {
+			return candidates[a].idx < candidates[b].idx
+		}
+		return candidates[a].dist < candidates[b].dist
+	})
+	if k > len(candidates) {
+		k = len(candidates)
+	}
+	var simulated int
+	for _, c := range candidates[:k] {
+		if c.idx >= numReal {
+			simulated++
+		}
+	}
+	return float64(simulated) / float64(k)
+}
+
+// Filter removes all cells called as doublets from d.
+func Filter(d *cells.Data, r Result) {
+	d.RemoveCells(r.Doublet)
+}
@@ -0,0 +1,88 @@
+package doublet
+
+import (
+	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/cells/cellstest"
+	"math/rand"
+	"testing"
+)
+
+// cloneGenotypes are the number of copies of 12 variants in 3 clones.
+var cloneGenotypes = [][]int{
+	{1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0, 0},
+	{1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0},
+	{1, 1, 1, 1, 0, 0, 0, 0, 2, 2, 2, 2},
+}
+
+// simulateReads returns the alt and total read counts of a cell from a clone.
+func simulateReads(r *rand.Rand, clone int) (alt []int, depth []int) {
+	alt = make([]int, len(cloneGenotypes[clone]))
+	depth = make([]int, len(cloneGenotypes[clone]))
+	var af float64
+	for j, g := range cloneGenotypes[clone] {
+		depth[j] = 20 + r.Intn(20)
+		af = float64(g)/2*0.98 + 0.01
+		for k := 0; k < depth[j]; k++ {
+			if r.Float64() < af {
+				alt[j]++
+			}
+		}
+	}
+	return alt, depth
+}
+
+// simulateData returns cellsPerClone singlets from each clone followed by numDoublets
+// doublets of cells from two different clones.
+func simulateData(cellsPerClone int, numDoublets int) *cells.Data {
+	r := rand.New(rand.NewSource(11))
+	var alt, depth [][]int
+	add := func(a, d []int) {
+		alt = append(alt, a)
+		depth = append(depth, d)
+	}
+	for c := range cloneGenotypes {
+		for i := 0; i < cellsPerClone; i++ {
+			add(simulateReads(r, c))
+		}
+	}
+	for i := 0; i < numDoublets; i++ {
+		a := i % len(cloneGenotypes)
+		altA, depthA := simulateReads(r, a)
+		altB, depthB := simulateReads(r, (a+1)%len(cloneGenotypes))
+		for j := range altA {
+			altA[j] += altB[j]
+			depthA[j] += depthB[j]
+		}
+		add(altA, depthA)
+	}
+	return cellstest.FromReadCounts(alt, depth)
+}
+
+func TestScore(t *testing.T) {
+	d := simulateData(60, 9)
+	p := DefaultParam
+	res := Score(d, p)
+	var falsePositives int
+	for i := range d.Cells {
+		if i >= 180 && !res.Doublet[i] {
+			t.Errorf("doublet %d was not called. score %f threshold %f", i, res.Score[i], res.Threshold)
+		}
+		if i < 180 && res.Doublet[i] {
+			falsePositives++
+		}
+	}
+	if falsePositives > 3 {
+		t.Errorf("%d singlets called as doublets", falsePositives)
+	}
+
+	Filter(d, res)
+	var called int
+	for _, doublet := range res.Doublet {
+		if doublet {
+			called++
+		}
+	}
+	if len(d.Cells) != 189-called {
+		t.Errorf("expected %d cells after filtering doublets, found %d", 189-called, len(d.Cells))
+	}
+}
@@ -0,0 +1,186 @@
+// Package external reads and writes the file formats of external tools for tumor
+// phylogeny and clone inference, such as SCITE, infSCITE, SiCloneFit, and COMPASS.
+//
+// Exported matrices are accompanied by a variant name file and a cell name file with one
+// name per line in matrix order, so that tool output can be mapped back onto cells.Data.
+package external
+
+import (
+	"fmt"
+	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/impute"
+	"github.com/ddsnellings/weaver/variants"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"io"
+	"strings"
+)
+
+// MatrixFormat defines the layout of a genotype matrix. Genotypes are written as the number
+// of copies of the variant (0, 1, or 2) unless the format is Binary.
+type MatrixFormat struct {
+	CellsAsRows bool   // cells are rows and variants are columns. variants are rows if false
+	Missing     string // value written for missing genotypes
+	Binary      bool   // heterozygous and homozygous genotypes are both written as 1
+	RowIndex    bool   // the first column of each row is the 1-based row index
+	Delim       string // column delimiter
+}
+
+var (
+	// Scite is the genotype matrix for SCITE. Rows are variants.
+	Scite = MatrixFormat{Missing: "3", Delim: " "}
+
+	// InfScite is the genotype matrix for infSCITE, which shares the SCITE input format.
+	InfScite = Scite
+
+	// SiCloneFit is the binary genotype matrix for SiCloneFit. Rows are variants with the row index in the first column.
+	SiCloneFit = MatrixFormat{Missing: "3", Binary: true, RowIndex: true, Delim: " "}
+)
+
+// genotypeCode returns the number of copies of the variant in a cell, or -1 if the genotype is missing.
+func genotypeCode(cv variants.CellVar, genotyped bool) int {
+	if !genotyped {
+		return -1
+	}
+	switch cv.Genotype {
+	case variants.WildType:
+		return 0
+	case variants.Heterozygous:
+		return 1
+	case variants.Homozygous, variants.Hemizygous:
+		return 2
+	default:
+		return -1
+	}
+}
+
+// WriteMatrix writes the genotype of each cell at each variant in the input format.
+// Genotypes that did not pass cell filters are written as missing.
+func WriteMatrix(file string, d *cells.Data, f MatrixFormat) {
+	mask := impute.GenotypedMask(d)
+	value := func(cellId, vid int) string {
+		code := genotypeCode(d.CellVar(cellId, vid), mask[cellId][vid])
+		switch {
+		case code == -1:
+			return f.Missing
+		case f.Binary && code > 1:
+			return "1"
+		default:
+			return fmt.Sprint(code)
+		}
+	}
+
+	rows, cols := len(d.Variants), len(d.Cells)
+	if f.CellsAsRows {
+		rows, cols = cols, rows
+	}
+	out := fileio.EasyCreate(file)
+	fields := make([]string, 0, cols+1)
+	for i := 0; i < rows; i++ {
+		fields = fields[:0]
+		if f.RowIndex {
+			fields = append(fields, fmt.Sprint(i+1))
+		}
+		for j := 0; j < cols; j++ {
+			if f.CellsAsRows {
+				fields = append(fields, value(i, j))
+			} else {
+				fields = append(fields, value(j, i))
+			}
+		}
+		writeLine(out, strings.Join(fields, f.Delim))
+	}
+	exception.PanicOnErr(out.Close())
+}
+
+// WriteReadCounts writes separate matrices of reference and alternate read counts for
+// tools that model reads directly. Rows are variants unless cellsAsRows is set.
+// All reads are written regardless of whether the genotype passed cell filters.
+func WriteReadCounts(refFile string, altFile string, d *cells.Data, cellsAsRows bool, delim string) {
+	outRef := fileio.EasyCreate(refFile)
+	outAlt := fileio.EasyCreate(altFile)
+	rows, cols := len(d.Variants), len(d.Cells)
+	if cellsAsRows {
+		rows, cols = cols, rows
+	}
+	ref := make([]string, cols)
+	alt := make([]string, cols)
+	var cellId, vid int
+	for i := 0; i < rows; i++ {
+		for j := 0; j < cols; j++ {
+			cellId, vid = j, i
+			if cellsAsRows {
+				cellId, vid = i, j
+			}
+			r, a := readCounts(d.CellVar(cellId, vid))
+			ref[j], alt[j] = fmt.Sprint(r), fmt.Sprint(a)
+		}
+		writeLine(outRef, strings.Join(ref, delim))
+		writeLine(outAlt, strings.Join(alt, delim))
+	}
+	exception.PanicOnErr(outRef.Close())
+	exception.PanicOnErr(outAlt.Close())
+}
+
+// readCounts returns the number of reference and alternate reads in a CellVar.
+func readCounts(cv variants.CellVar) (ref int, alt int) {
+	ref = cv.ReadDepth - cv.AltReads
+	if ref < 0 {
+		ref = 0
+	}
+	return ref, cv.AltReads
+}
+
+// WriteCompass writes the variant file for COMPASS. Each row is a variant with the columns
+// CHR, REGION, NAME, and FREQ followed by the ref:alt read counts of each cell. REGION is set to
+// the chromosome and FREQ is set to 0 (somatic) for all variants.
+func WriteCompass(file string, d *cells.Data) {
+	out := fileio.EasyCreate(file)
+	fields := make([]string, 0, len(d.Cells)+4)
+	fields = append(fields, "CHR", "REGION", "NAME", "FREQ")
+	for i := range d.Cells {
+		fields = append(fields, cellName(d, i))
+	}
+	writeLine(out, strings.Join(fields, ","))
+	for vid := range d.Variants {
+		fields = fields[:0]
+		fields = append(fields, d.Variants[vid].Chr, d.Variants[vid].Chr, d.Variants[vid].Key(), "0")
+		for i := range d.Cells {
+			ref, alt := readCounts(d.CellVar(i, vid))
+			fields = append(fields, fmt.Sprintf("%d:%d", ref, alt))
+		}
+		writeLine(out, strings.Join(fields, ","))
+	}
+	exception.PanicOnErr(out.Close())
+}
+
+// WriteVariantNames writes the name of each variant (see variants.Variant.Key) on a separate line.
+func WriteVariantNames(file string, d *cells.Data) {
+	out := fileio.EasyCreate(file)
+	for vid := range d.Variants {
+		writeLine(out, d.Variants[vid].Key())
+	}
+	exception.PanicOnErr(out.Close())
+}
+
+// WriteCellNames writes the name of each cell on a separate line.
+func WriteCellNames(file string, d *cells.Data) {
+	out := fileio.EasyCreate(file)
+	for i := range d.Cells {
+		writeLine(out, cellName(d, i))
+	}
+	exception.PanicOnErr(out.Close())
+}
+
+// cellName returns the name of a cell, or its Id if the cell has no name.
+func cellName(d *cells.Data, cellId int) string {
+	if d.Cells[cellId].Name == "" {
+		return fmt.Sprint(d.Cells[cellId].Id)
+	}
+	return d.Cells[cellId].Name
+}
+
+func writeLine(out io.Writer, s string) {
+	_, err := fmt.Fprintln(out, s)
+	exception.PanicOnErr(err)
+}
@@ -0,0 +1,125 @@
+package external
+
+import (
+	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/phylogeny"
+	"github.com/vertgenlab/gonomics/fileio"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testfile = "../cells/testdata/small.vcf"
+
+// readTmp returns the lines of a temporary file and removes it.
+func readTmp(t *testing.T, file string) string {
+	answer := strings.Join(fileio.Read(file), "\n")
+	if err := os.Remove(file); err != nil {
+		t.Error(err)
+	}
+	return answer
+}
+
+// writeTmp writes a file in a temporary directory removed after the test and returns its path.
+func writeTmp(t *testing.T, name string, s string) string {
+	file := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(file, []byte(s), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestWriteMatrix(t *testing.T) {
+	d := cells.ReadVcf(testfile, cells.DefaultCellFilter, cells.DefaultGlobalFilter, cells.DefaultVcfQual)
+	d.Variants[0].CellsGenotyped = d.Variants[0].CellsGenotyped[1:] // cell 0 is missing at variant 0
+	file := filepath.Join(t.TempDir(), "weaver.matrix.txt")
+	tests := []struct {
+		format   MatrixFormat
+		expected string
+	}{
+		{Scite, "3 1 1\n0 0 1\n0 2 0\n0 0 1"},
+		{SiCloneFit, "1 3 1 1\n2 0 0 1\n3 0 1 0\n4 0 0 1"},
+		{MatrixFormat{CellsAsRows: true, Missing: "-1", Delim: "\t"}, "-1\t0\t0\t0\n1\t0\t2\t0\n1\t1\t0\t1"},
+	}
+	for _, test := range tests {
+		WriteMatrix(file, d, test.format)
+		if found := readTmp(t, file); found != test.expected {
+			t.Errorf("expected matrix\n%s\nfound\n%s", test.expected, found)
+		}
+	}
+
+	WriteCompass(file, d)
+	expected := "CHR,REGION,NAME,FREQ,AACAACCTATGGAGAACC-1,AACAACTGGGCGTGATAC-1,AACAATGCAAGCATTGTT-1\n" +
+		"chr1,chr1,chr1:1:A:C,0,100:0,70:30,50:50\n" +
+		"chr1,chr1,chr1:1:A:G,0,100:0,98:2,60:40\n" +
+		"chr1,chr1,chr1:2:T:C,0,98:2,10:90,100:0\n" +
+		"chr1,chr1,chr1:2:T:A,0,100:0,99:1,50:50"
+	if found := readTmp(t, file); found != expected {
+		t.Errorf("unexpected compass file\n%s", found)
+	}
+	WriteReadCounts(file, file+".alt", d, false, " ")
+	if found := readTmp(t, file) + "\n" + readTmp(t, file+".alt"); found != "100 70 50\n100 98 60\n98 10 100\n100 99 50\n0 30 50\n0 2 40\n2 90 0\n0 1 50" {
+		t.Errorf("unexpected read count files\n%s", found)
+	}
+}
+
+func TestReadGraphviz(t *testing.T) {
+	d := cells.ReadVcf(testfile, cells.DefaultCellFilter, cells.DefaultGlobalFilter, cells.DefaultVcfQual)
+	file := writeTmp(t, "weaver.tree.gv", "digraph G {\nnode [color=deeppink4, style=filled, fontcolor=white];\n"+
+		"5 -> 1;\n1 -> 3;\n\"chr1:2:T:A\" -> \"chr1:1:A:G\";\n5 -> 4;\n"+
+		"node [color=lightgrey, style=filled, fontcolor=black];\n5 -> s0;\n3 -> s1;\n4 -> s2;\n}\n")
+	tree := ReadGraphviz(file, d, phylogeny.DefaultParam)
+	expectedParent := []int{4, 3, 0, 4, -1}
+	expectedAttachment := []int{4, 2, 3}
+	for i := range expectedParent {
+		if tree.Parent[i] != expectedParent[i] {
+			t.Errorf("expected parents %v, found %v", expectedParent, tree.Parent)
+			break
+		}
+	}
+	for i := range expectedAttachment {
+		if tree.Attachment[i] != expectedAttachment[i] {
+			t.Errorf("expected attachments %v, found %v", expectedAttachment, tree.Attachment)
+			break
+		}
+	}
+}
+
+func TestReadAssignments(t *testing.T) {
+	d := cells.ReadVcf(testfile, cells.DefaultCellFilter, cells.DefaultGlobalFilter, cells.DefaultVcfQual)
+	file := writeTmp(t, "weaver.assignments.tsv", "cell\tnode\tdoublet\nAACAATGCAAGCATTGTT-1\t2\tno\nAACAACCTATGGAGAACC-1\t0\tno\n")
+	found := ReadAssignments(file, d)
+	if found[0] != 0 || found[1] != -1 || found[2] != 2 {
+		t.Errorf("expected assignments [0 -1 2], found %v", found)
+	}
+}
+
+func TestReadNewick(t *testing.T) {
+	file := writeTmp(t, "weaver.tree.nwk", "((cell_1:0.5,'cell''2':1)[&support=1]:0.25,cell3);\n")
+	tree := ReadNewick(file)
+	leaves := tree.Leaves()
+	if len(leaves) != 3 || leaves[0] != "cell_1" || leaves[1] != "cell'2" || leaves[2] != "cell3" {
+		t.Errorf("unexpected leaves %v", leaves)
+	}
+	if tree.Children[0].Length != 0.25 || tree.Children[0].Children[1].Length != 1 {
+		t.Errorf("branch lengths not parsed")
+	}
+}
+
+func TestLeafCells(t *testing.T) {
+	d := &cells.Data{Cells: []cells.Cell{{Id: 0, Name: "cell3"}, {Id: 1, Name: "cell_1"}, {Id: 2, Name: "cell'2"}}}
+	file := writeTmp(t, "weaver.tree.nwk", "((cell_1:0.5,'cell''2':1):0.25,cell3);\n")
+	tree := ReadNewick(file)
+	if found := tree.LeafCells(d); len(found) != 3 || found[0] != 1 || found[1] != 2 || found[2] != 0 {
+		t.Errorf("expected leaf cells [1 2 0], found %v", found)
+	}
+
+	tree.Children[1].Name = "cell4"
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic for leaf not in data")
+		}
+	}()
+	tree.LeafCells(d)
+}
@@ -0,0 +1,283 @@
+package external
+
+import (
+	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/phylogeny"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ReadGraphviz reads a mutation tree in the graphviz format written by SCITE and infSCITE.
+// Nodes may be named by variant name (see WriteVariantNames) or by the 1-based variant index,
+// in which case the root is variant count + 1. Cells attached with the SCITE -a option are
+// named s0, s1, ... in cell order. If no cells are attached in the file, cells are attached to
+// their most probable node under p (see phylogeny.Attach).
+func ReadGraphviz(file string, d *cells.Data, p phylogeny.Param) phylogeny.Tree {
+	names := make(map[string]int, len(d.Variants))
+	for vid := range d.Variants {
+		names[d.Variants[vid].Key()] = vid
+	}
+	root := len(d.Variants)
+	t := phylogeny.Tree{
+		Events:     make([]phylogeny.Event, root+1),
+		Parent:     make([]int, root+1),
+		Attachment: make([]int, len(d.Cells)),
+		Support:    make([]float64, root+1),
+	}
+	for vid := range d.Variants {
+		t.Events[vid] = phylogeny.Event{Type: phylogeny.Mutation, Variant: vid}
+		t.Parent[vid] = root
+		t.Support[vid] = math.NaN()
+	}
+	t.Events[root] = phylogeny.Event{Type: phylogeny.Root, Variant: -1}
+	t.Parent[root] = -1
+	t.Support[root] = math.NaN()
+	for i := range t.Attachment {
+		t.Attachment[i] = -1
+	}
+
+	var attached bool
+	var from, to, cellId int
+	var isCell bool
+	lines := fileio.Read(file)
+	for _, line := range lines {
+		if !strings.Contains(line, "->") {
+			continue
+		}
+		fields := strings.SplitN(line, "->", 2)
+		from, _ = graphvizNode(fields[0], names, root, file)
+		to, isCell = graphvizNode(fields[1], names, root, file)
+		if isCell {
+			cellId = to
+			if cellId >= len(d.Cells) {
+				log.Panicf("cell s%d in '%s' is outside the %d cells in data", cellId, file, len(d.Cells))
+			}
+			t.Attachment[cellId] = from
+			attached = true
+			continue
+		}
+		t.Parent[to] = from
+	}
+
+	if !attached {
+		phylogeny.Attach(d, &t, p)
+	}
+	for i := range t.Attachment {
+		if t.Attachment[i] == -1 {
+			t.Attachment[i] = root
+		}
+	}
+	return t
+}
+
+// graphvizNode converts a node in a graphviz edge to a node index. If the node is a cell,
+// the cell index is returned and isCell is true.
+func graphvizNode(s string, names map[string]int, root int, file string) (node int, isCell bool) {
+	if idx := strings.Index(s, "["); idx != -1 {
+		s = s[:idx]
+	}
+	s = strings.Trim(strings.TrimSpace(s), "\";")
+	s = strings.TrimSpace(s)
+	if vid, ok := names[s]; ok {
+		return vid, false
+	}
+	if s == "Root" || s == "root" {
+		return root, false
+	}
+	if strings.HasPrefix(s, "s") {
+		if cellId, err := strconv.Atoi(s[1:]); err == nil {
+			return cellId, true
+		}
+	}
+	idx, err := strconv.Atoi(s)
+	if err != nil || idx < 1 || idx > root+1 {
+		log.Panicf("could not match node '%s' in '%s' to a variant", s, file)
+	}
+	return idx - 1, false
+}
+
+// ReadAssignments reads a table of cell assignments to clones or tree nodes, such as the cell
+// assignment output of COMPASS or SiCloneFit. Each line has the cell name in the first column
+// and an integer label in the second column. Lines where the second column is not an integer
+// (e.g. a header) are skipped. Returns the label of each cell in d, or -1 for cells not in the file.
+func ReadAssignments(file string, d *cells.Data) []int {
+	cellIds := make(map[string]int, len(d.Cells))
+	for i := range d.Cells {
+		cellIds[cellName(d, i)] = i
+	}
+	answer := make([]int, len(d.Cells))
+	for i := range answer {
+		answer[i] = -1
+	}
+
+	var fields []string
+	var label, cellId int
+	var err error
+	var ok bool
+	for _, line := range fileio.Read(file) {
+		fields = strings.FieldsFunc(line, func(r rune) bool { return r == '\t' || r == ',' || r == ' ' })
+		if len(fields) < 2 {
+			continue
+		}
+		if label, err = strconv.Atoi(fields[1]); err != nil {
+			continue
+		}
+		if cellId, ok = cellIds[fields[0]]; !ok {
+			log.Panicf("cell '%s' in '%s' was not found in data", fields[0], file)
+		}
+		answer[cellId] = label
+	}
+	return answer
+}
+
+// NewickNode is a node in a tree read from Newick format.
+type NewickNode struct {
+	Name     string
+	Length   float64 // length of the branch to the parent. NaN if not present
+	Children []*NewickNode
+}
+
+// Leaves returns the names of all leaves below n in left to right order.
+func (n *NewickNode) Leaves() []string {
+	if len(n.Children) == 0 {
+		return []string{n.Name}
+	}
+	var answer []string
+	for _, child := range n.Children {
+		answer = append(answer, child.Leaves()...)
+	}
+	return answer
+}
+
+// LeafCells returns the index in d.Cells of each leaf below n, in the order of Leaves. Leaves are
+// matched to cells by name as written by WriteCellNames. Panics if a leaf does not match a cell
+// or if a cell is named by more than one leaf.
+func (n *NewickNode) LeafCells(d *cells.Data) []int {
+	cellIds := make(map[string]int, len(d.Cells))
+	for i := range d.Cells {
+		cellIds[cellName(d, i)] = i
+	}
+	leaves := n.Leaves()
+	answer := make([]int, len(leaves))
+	seen := make([]bool, len(d.Cells))
+	var ok bool
+	for i := range leaves {
+		if answer[i], ok = cellIds[leaves[i]]; !ok {
+			log.Panicf("leaf '%s' in newick tree was not found in data", leaves[i])
+		}
+		if seen[answer[i]] {
+			log.Panicf("cell '%s' is found in more than one leaf of newick tree", leaves[i])
+		}
+		seen[answer[i]] = true
+	}
+	return answer
+}
+
+// ReadNewick reads the first tree in a Newick file, such as the cell trees output by SiCloneFit.
+// Comments in square brackets are ignored. Leaves are mapped to cells by LeafCells.
+func ReadNewick(file string) *NewickNode {
+	s := strings.TrimSpace(fileio.ReadFileToSingleLineString(file))
+	if idx := strings.Index(s, ";"); idx != -1 {
+		s = s[:idx]
+	}
+	p := newickParser{s: s, file: file}
+	answer := p.node()
+	if p.pos != len(p.s) {
+		log.Panicf("unexpected '%c' at position %d in newick file '%s'", p.s[p.pos], p.pos, file)
+	}
+	return answer
+}
+
+// newickParser is a recursive descent parser for Newick trees.
+type newickParser struct {
+	s    string
+	pos  int
+	file string
+}
+
+// node parses a node and its children.
+func (p *newickParser) node() *NewickNode {
+	answer := &NewickNode{Length: math.NaN()}
+	p.skip()
+	if p.pos < len(p.s) && p.s[p.pos] == '(' {
+		p.pos++
+		for {
+			answer.Children = append(answer.Children, p.node())
+			p.skip()
+			if p.pos >= len(p.s) {
+				log.Panicf("unbalanced parentheses in newick file '%s'", p.file)
+			}
+			if p.s[p.pos] == ')' {
+				p.pos++
+				break
+			}
+			if p.s[p.pos] != ',' {
+				log.Panicf("unexpected '%c' at position %d in newick file '%s'", p.s[p.pos], p.pos, p.file)
+			}
+			p.pos++
+		}
+	}
+	answer.Name = p.label()
+	p.skip()
+	if p.pos < len(p.s) && p.s[p.pos] == ':' {
+		p.pos++
+		start := p.pos
+		for p.pos < len(p.s) && !strings.ContainsRune(",)[", rune(p.s[p.pos])) {
+			p.pos++
+		}
+		var err error
+		answer.Length, err = strconv.ParseFloat(strings.TrimSpace(p.s[start:p.pos]), 64)
+		exception.PanicOnErr(err)
+		p.skip()
+	}
+	return answer
+}
+
+// label parses a quoted or unquoted node label. Underscores in unquoted labels are spaces in
+// the Newick standard, but are kept as is since cell barcodes and names commonly contain them.
+func (p *newickParser) label() string {
+	p.skip()
+	if p.pos < len(p.s) && p.s[p.pos] == '\'' {
+		var sb strings.Builder
+		for p.pos++; p.pos < len(p.s); p.pos++ {
+			if p.s[p.pos] == '\'' {
+				if p.pos+1 < len(p.s) && p.s[p.pos+1] == '\'' {
+					sb.WriteByte('\'')
+					p.pos++
+					continue
+				}
+				p.pos++
+				return sb.String()
+			}
+			sb.WriteByte(p.s[p.pos])
+		}
+		log.Panicf("unterminated quoted label in newick file '%s'", p.file)
+	}
+	start := p.pos
+	for p.pos < len(p.s) && !strings.ContainsRune("(),:;[", rune(p.s[p.pos])) {
+		p.pos++
+	}
+	return strings.TrimSpace(p.s[start:p.pos])
+}
+
+// skip advances past whitespace and comments.
+func (p *newickParser) skip() {
+	for p.pos < len(p.s) {
+		switch p.s[p.pos] {
+		case ' ', '\t', '\n', '\r':
+			p.pos++
+		case '[':
+			end := strings.IndexByte(p.s[p.pos:], ']')
+			if end == -1 {
+				log.Panicf("unterminated comment in newick file '%s'", p.file)
+			}
+			p.pos += end + 1
+		default:
+			return
+		}
+	}
+}
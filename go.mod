@@ -3,7 +3,7 @@ module github.com/ddsnellings/weaver
 go 1.16
 
 require (
-	github.com/vertgenlab/gonomics v0.0.0-20210426150348-d947b7df2ed9 // indirect
+	github.com/vertgenlab/gonomics v0.0.0-20210426150348-d947b7df2ed9
 	golang.org/x/exp v0.0.0-20210426150846-937debaa2ed7 // indirect
-	gonum.org/v1/gonum v0.9.1 // indirect
+	gonum.org/v1/gonum v0.9.1
 )
@@ -0,0 +1,237 @@
+// Package impute provides tools for filling missing genotypes in cells.Data
+// using the genotypes observed in similar cells.
+//
+// A genotype is considered missing if the cell is not in Variant.CellsGenotyped,
+// either because the genotype failed cell filters or because it was never called.
+// Imputed genotypes are written to the cell's CellVar with Imputed set to true and a
+// Confidence score so that downstream output can choose to show or hide them.
+// Imputed cells are not added to Variant.CellsGenotyped, so all variant statistics
+// continue to reflect only observed genotypes.
+package impute
+
+import (
+	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/parallel"
+	"github.com/ddsnellings/weaver/variants"
+	"math"
+	"sort"
+)
+
+// Param defines how missing genotypes are imputed.
+type Param struct {
+	K             int     // number of nearest genotyped cells used to impute each missing genotype // Default 10
+	MinShared     int     // minimum number of variants genotyped in both cells to compute a distance // Default 5
+	MinConfidence float64 // imputed genotypes with confidence < MinConfidence are left missing // Default 0.5
+	Workers       int     // number of goroutines finding neighbors in Knn. 0 uses all available cores // Default 0
+}
+
+var DefaultParam = Param{K: 10, MinShared: 5, MinConfidence: 0.5}
+
+// GenotypedMask returns a matrix such that answer[cellId][variantId] is true if the cell
+// passed filters for the variant (i.e. cell is in Variant.CellsGenotyped).
+func GenotypedMask(d *cells.Data) [][]bool {
+	answer := make([][]bool, len(d.Cells))
+	for i := range answer {
+		answer[i] = make([]bool, len(d.Variants))
+	}
+	for i := range d.Variants {
+		for _, cellId := range d.Variants[i].CellsGenotyped {
+			answer[cellId][i] = true
+		}
+	}
+	return answer
+}
+
+// DosageMatrix returns the mutant allele dosage of each cell such that answer[cellId][variantId]
+// is the dosage of variant in cell. Missing genotypes are set to NaN.
+func DosageMatrix(d *cells.Data) [][]float64 {
+	mask := GenotypedMask(d)
+	answer := make([][]float64, len(d.Cells))
+	for i := range d.Cells {
+		answer[i] = make([]float64, len(d.Variants))
+		for j := range d.Variants {
+			if mask[i][j] && d.Genotype(i, j) != variants.NoGenotype {
+				answer[i][j] = d.CellVar(i, j).Dosage()
+			} else {
+				answer[i][j] = math.NaN()
+			}
+		}
+	}
+	return answer
+}
+
+// Distance between two rows of a DosageMatrix that is aware of dropout. The distance is the
+// mean absolute dosage difference over variants genotyped in both cells, such that missing
+// genotypes neither add to nor reduce the distance. Returns +Inf if fewer than minShared
+// variants are genotyped in both cells.
+func Distance(a, b []float64, minShared int) float64 {
+	var sum float64
+	var shared int
+	for i := range a {
+		if math.IsNaN(a[i]) || math.IsNaN(b[i]) {
+			continue
+		}
+		sum += math.Abs(a[i] - b[i])
+		shared++
+	}
+	if shared == 0 || shared < minShared {
+		return math.Inf(1)
+	}
+	return sum / float64(shared)
+}
+
+// neighbor is a cell and its distance from a query cell.
+type neighbor struct {
+	cellId   int
+	distance float64
+}
+
+// Knn imputes each missing genotype from the K nearest cells in which the variant was
+// genotyped. Neighbors vote for their genotype with weight 1 / (distance + 0.01) and the
+// Confidence of the imputed genotype is the fraction of the total weight with the winning
+// genotype. Distances are computed in parallel by p.Workers goroutines.
+// Returns the number of genotypes imputed.
+func Knn(d *cells.Data, p Param) int {
+	dosage := DosageMatrix(d)
+	mask := GenotypedMask(d)
+	imputed := make([][]variants.CellVar, len(d.Cells))
+
+	parallel.For(len(d.Cells), p.Workers, func(cellId int) {
+		imputed[cellId] = imputeCell(d, cellId, dosage, mask, p)
+	})
+
+	// genotypes are set after all cells are imputed as GenotypeStore does not support concurrent writes
+	var answer int
+	for cellId := range imputed {
+		for _, cv := range imputed[cellId] {
+			d.SetCellVar(cellId, cv.Vid, cv)
+		}
+		answer += len(imputed[cellId])
+	}
+	return answer
+}
+
+// imputeCell returns the imputed CellVar of each missing genotype in a single cell that
+// passes p.MinConfidence. Does not modify d.
+func imputeCell(d *cells.Data, cellId int, dosage [][]float64, mask [][]bool, p Param) []variants.CellVar {
+	if countMissing(mask[cellId]) == 0 {
+		return nil
+	}
+
+	neighbors := make([]neighbor, 0, len(d.Cells)-1)
+	var dist float64
+	for i := range d.Cells {
+		if i == cellId {
+			continue
+		}
+		dist = Distance(dosage[cellId], dosage[i], p.MinShared)
+		if !math.IsInf(dist, 1) {
+			neighbors = append(neighbors, neighbor{cellId: i, distance: dist})
+		}
+	}
+	sort.Slice(neighbors, func(i, j int) bool {
+		return neighbors[i].distance < neighbors[j].distance
+	})
+
+	var answer []variants.CellVar
+	var used int
+	var votes map[variants.Zygosity]float64
+	for vid := range d.Variants {
+		if mask[cellId][vid] {
+			continue
+		}
+		votes = make(map[variants.Zygosity]float64)
+		used = 0
+		for _, n := range neighbors {
+			if used == p.K {
+				break
+			}
+			if !mask[n.cellId][vid] || d.Genotype(n.cellId, vid) == variants.NoGenotype {
+				continue
+			}
+			votes[d.Genotype(n.cellId, vid)] += 1 / (n.distance + 0.01)
+			used++
+		}
+		cv := d.CellVar(cellId, vid)
+		if setImputed(&cv, votes, p.MinConfidence) {
+			answer = append(answer, cv)
+		}
+	}
+	return answer
+}
+
+// FromClones imputes each missing genotype from the consensus genotype of the cell's clone.
+// The input clone is a slice such that clone[cellId] is the clone label of the cell, or
+// -1 if the cell is unassigned. The Confidence of an imputed genotype is the fraction of
+// genotyped cells in the clone with the consensus genotype. Returns the number of genotypes imputed.
+func FromClones(d *cells.Data, clone []int, p Param) int {
+	mask := GenotypedMask(d)
+	votes := make(map[int][]map[variants.Zygosity]float64) // votes[clone][variantId][genotype]
+	for cellId, label := range clone {
+		if label < 0 {
+			continue
+		}
+		if _, ok := votes[label]; !ok {
+			votes[label] = make([]map[variants.Zygosity]float64, len(d.Variants))
+			for i := range votes[label] {
+				votes[label][i] = make(map[variants.Zygosity]float64)
+			}
+		}
+		for vid := range d.Variants {
+			if mask[cellId][vid] && d.Genotype(cellId, vid) != variants.NoGenotype {
+				votes[label][vid][d.Genotype(cellId, vid)]++
+			}
+		}
+	}
+
+	var answer int
+	for cellId, label := range clone {
+		if label < 0 {
+			continue
+		}
+		for vid := range d.Variants {
+			if mask[cellId][vid] {
+				continue
+			}
+			cv := d.CellVar(cellId, vid)
+			if setImputed(&cv, votes[label][vid], p.MinConfidence) {
+				d.SetCellVar(cellId, vid, cv)
+				answer++
+			}
+		}
+	}
+	return answer
+}
+
+// setImputed sets the genotype of cv to the genotype with the most votes if the fraction of
+// votes for the winning genotype is >= minConfidence. Returns true if cv was imputed.
+func setImputed(cv *variants.CellVar, votes map[variants.Zygosity]float64, minConfidence float64) bool {
+	var total, best float64
+	var bestGenotype variants.Zygosity
+	for _, z := range []variants.Zygosity{variants.WildType, variants.Heterozygous, variants.Homozygous, variants.Hemizygous} {
+		total += votes[z]
+		if votes[z] > best {
+			best = votes[z]
+			bestGenotype = z
+		}
+	}
+	if total == 0 || best/total < minConfidence {
+		return false
+	}
+	cv.Genotype = bestGenotype
+	cv.Posterior = [3]float64{} // dosage is taken from the imputed genotype
+	cv.Imputed = true
+	cv.Confidence = best / total
+	return true
+}
+
+// countMissing returns the number of false values in a row of a GenotypedMask.
+func countMissing(mask []bool) int {
+	var answer int
+	for i := range mask {
+		if !mask[i] {
+			answer++
+		}
+	}
+	return answer
+}
@@ -0,0 +1,91 @@
+package impute
+
+import (
+	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/cells/cellstest"
+	"github.com/ddsnellings/weaver/variants"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func TestKnn(t *testing.T) {
+	d := cellstest.FromGenotypes(cellstest.TwoClones())
+	imputed := Knn(d, Param{K: 2, MinShared: 3, MinConfidence: 0.5})
+	if imputed != 3 {
+		t.Errorf("expected 3 imputed genotypes, found %d", imputed)
+	}
+	checkImputed(t, d)
+}
+
+// TestKnnWorkers checks that imputing with several workers matches imputing serially. Run with
+// -race to check that workers do not write to the genotypes concurrently.
+func TestKnnWorkers(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	genotypes := make([][]int, 60)
+	for i := range genotypes {
+		genotypes[i] = make([]int, 40)
+		for j := range genotypes[i] {
+			genotypes[i][j] = (i/20 + j) % 3
+			if r.Float64() < 0.2 {
+				genotypes[i][j] = -1
+			}
+		}
+	}
+	p := Param{K: 5, MinShared: 5, MinConfidence: 0.5, Workers: 1}
+	serial := cellstest.FromGenotypes(genotypes)
+	expected := Knn(serial, p)
+	p.Workers = 4
+	d := cellstest.FromGenotypes(genotypes)
+	if imputed := Knn(d, p); imputed != expected || imputed == 0 {
+		t.Errorf("expected %d imputed genotypes with 4 workers, found %d", expected, imputed)
+	}
+	for i := range d.Cells {
+		for j := range d.Variants {
+			if d.CellVar(i, j) != serial.CellVar(i, j) {
+				t.Errorf("cell %d variant %d: expected %+v, found %+v", i, j, serial.CellVar(i, j), d.CellVar(i, j))
+			}
+		}
+	}
+}
+
+func TestFromClones(t *testing.T) {
+	d := cellstest.FromGenotypes(cellstest.TwoClones())
+	imputed := FromClones(d, []int{0, 0, 0, 1, 1, 1}, DefaultParam)
+	if imputed != 3 {
+		t.Errorf("expected 3 imputed genotypes, found %d", imputed)
+	}
+	checkImputed(t, d)
+}
+
+func checkImputed(t *testing.T, d *cells.Data) {
+	expected := []struct {
+		cell, variant int
+		genotype      variants.Zygosity
+	}{
+		{0, 1, variants.Heterozygous},
+		{2, 5, variants.WildType},
+		{4, 2, variants.WildType},
+	}
+	for _, e := range expected {
+		cv := d.CellVar(e.cell, e.variant)
+		if !cv.Imputed || cv.Genotype != e.genotype || cv.Confidence != 1 {
+			t.Errorf("cell %d variant %d: expected imputed %s with confidence 1, found imputed=%v %s confidence %f",
+				e.cell, e.variant, e.genotype, cv.Imputed, cv.Genotype, cv.Confidence)
+		}
+	}
+	if d.CellVar(1, 1).Imputed {
+		t.Errorf("observed genotype was marked imputed")
+	}
+}
+
+func TestDistance(t *testing.T) {
+	a := []float64{0, 1, math.NaN(), 2}
+	b := []float64{1, 1, 2, math.NaN()}
+	if dist := Distance(a, b, 2); dist != 0.5 {
+		t.Errorf("expected distance 0.5, found %f", dist)
+	}
+	if dist := Distance(a, b, 3); !math.IsInf(dist, 1) {
+		t.Errorf("expected infinite distance with too few shared variants, found %f", dist)
+	}
+}
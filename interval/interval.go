@@ -0,0 +1,299 @@
+// Package interval provides operations on genomic regions (see variants.Region) and an
+// interval tree for fast overlap queries. Regions are half-open with a 0-based Start and
+// 1-based End, as in BED files. Contig names that are aliases (e.g. chr1 and 1) are treated
+// as the same contig.
+package interval
+
+import (
+	"fmt"
+	"github.com/ddsnellings/weaver/variants"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Parse a region in the samtools format chr:start-end with 1-based inclusive coordinates.
+// Commas in positions are ignored. A region with only a chromosome name spans the whole chromosome,
+// and a region with only a start position spans a single base.
+func Parse(s string) variants.Region {
+	s = strings.TrimSpace(s)
+	colon := strings.LastIndex(s, ":")
+	if colon == -1 {
+		return variants.Region{Chr: s, Start: 0, End: math.MaxInt32}
+	}
+	answer := variants.Region{Chr: s[:colon]}
+	coords := strings.ReplaceAll(s[colon+1:], ",", "")
+	startStr, endStr := coords, coords
+	if dash := strings.Index(coords, "-"); dash != -1 {
+		startStr, endStr = coords[:dash], coords[dash+1:]
+	}
+	start, err := strconv.Atoi(startStr)
+	if err != nil {
+		log.Panicf("could not parse start position in region '%s'", s)
+	}
+	answer.End, err = strconv.Atoi(endStr)
+	if err != nil {
+		log.Panicf("could not parse end position in region '%s'", s)
+	}
+	answer.Start = start - 1
+	if answer.Start < 0 || answer.End <= answer.Start {
+		log.Panicf("invalid coordinates in region '%s'", s)
+	}
+	return answer
+}
+
+// Format returns r in the format read by Parse.
+func Format(r variants.Region) string {
+	return fmt.Sprintf("%s:%d-%d", r.Chr, r.Start+1, r.End)
+}
+
+// ReadBed reads the first three columns of each line in a BED file. Header, track, and browser lines are skipped.
+func ReadBed(file string) []variants.Region {
+	var answer []variants.Region
+	var fields []string
+	var r variants.Region
+	var err error
+	for _, line := range fileio.Read(file) {
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "track") || strings.HasPrefix(line, "browser") {
+			continue
+		}
+		fields = strings.Fields(line)
+		if len(fields) < 3 {
+			log.Panicf("expected at least 3 columns in bed file '%s', found line: %s", file, line)
+		}
+		r.Chr = fields[0]
+		r.Start, err = strconv.Atoi(fields[1])
+		exception.PanicOnErr(err)
+		r.End, err = strconv.Atoi(fields[2])
+		exception.PanicOnErr(err)
+		answer = append(answer, r)
+	}
+	return answer
+}
+
+// ReadGenes returns the regions of the named genes in an annotation file, which may be a GTF
+// file, where gene records are matched by the gene_name or gene_id attribute, or a BED file
+// where regions are matched by the name in the fourth column. Names are matched ignoring case,
+// and every matching record is returned, such as each amplicon of a gene in a panel BED file.
+func ReadGenes(file string, genes []string) []variants.Region {
+	wanted := make(map[string]bool, len(genes))
+	for _, g := range genes {
+		wanted[strings.ToUpper(g)] = false
+	}
+	var answer []variants.Region
+	var fields []string
+	var r variants.Region
+	var names []string
+	var err error
+	for _, line := range fileio.Read(file) {
+		fields = strings.Split(line, "\t")
+		names = names[:0]
+		switch {
+		case len(fields) >= 9 && fields[2] == "gene": // gtf
+			names = append(names, gtfAttribute(fields[8], "gene_name"), gtfAttribute(fields[8], "gene_id"))
+			r.Chr = fields[0]
+			r.Start, err = strconv.Atoi(fields[3])
+			exception.PanicOnErr(err)
+			r.Start-- // gtf is 1-based inclusive
+			r.End, err = strconv.Atoi(fields[4])
+			exception.PanicOnErr(err)
+		case len(fields) >= 4 && len(fields) < 9: // bed
+			if strings.HasPrefix(line, "track") || strings.HasPrefix(line, "browser") {
+				continue
+			}
+			names = append(names, fields[3])
+			r.Chr = fields[0]
+			r.Start, err = strconv.Atoi(fields[1])
+			exception.PanicOnErr(err)
+			r.End, err = strconv.Atoi(fields[2])
+			exception.PanicOnErr(err)
+		default:
+			continue
+		}
+		for _, name := range names {
+			if _, found := wanted[strings.ToUpper(name)]; found && name != "" {
+				wanted[strings.ToUpper(name)] = true
+				answer = append(answer, r)
+				break
+			}
+		}
+	}
+	for _, g := range genes {
+		if !wanted[strings.ToUpper(g)] {
+			log.Panicf("gene '%s' was not found in '%s'", g, file)
+		}
+	}
+	return answer
+}
+
+// gtfAttribute returns the value of key in the attribute column of a gtf record, or "" if not present.
+func gtfAttribute(attributes string, key string) string {
+	for _, attr := range strings.Split(attributes, ";") {
+		attr = strings.TrimSpace(attr)
+		if strings.HasPrefix(attr, key+" ") {
+			return strings.Trim(strings.TrimSpace(attr[len(key):]), "\"")
+		}
+	}
+	return ""
+}
+
+// WriteBed writes each region as a line in a BED file.
+func WriteBed(file string, regions []variants.Region) {
+	out := fileio.EasyCreate(file)
+	var err error
+	for _, r := range regions {
+		_, err = fmt.Fprintf(out, "%s\t%d\t%d\n", r.Chr, r.Start, r.End)
+		exception.PanicOnErr(err)
+	}
+	exception.PanicOnErr(out.Close())
+}
+
+// Len returns the number of bases in r.
+func Len(r variants.Region) int {
+	return r.End - r.Start
+}
+
+// Overlap returns true if a and b share at least one base.
+func Overlap(a, b variants.Region) bool {
+	return SameChr(a.Chr, b.Chr) && a.Start < b.End && b.Start < a.End
+}
+
+// Contains returns true if the 0-based position pos on chr is in r.
+func Contains(r variants.Region, chr string, pos int) bool {
+	return SameChr(r.Chr, chr) && pos >= r.Start && pos < r.End
+}
+
+// Intersect returns the bases shared by a and b, and false if a and b do not overlap.
+func Intersect(a, b variants.Region) (variants.Region, bool) {
+	if !Overlap(a, b) {
+		return variants.Region{}, false
+	}
+	return variants.Region{Chr: a.Chr, Start: maxInt(a.Start, b.Start), End: minInt(a.End, b.End)}, true
+}
+
+// Distance returns the number of bases between a and b, 0 if they overlap or are adjacent,
+// or -1 if they are on different chromosomes.
+func Distance(a, b variants.Region) int {
+	switch {
+	case !SameChr(a.Chr, b.Chr):
+		return -1
+	case a.End <= b.Start:
+		return b.Start - a.End
+	case b.End <= a.Start:
+		return a.Start - b.End
+	default:
+		return 0
+	}
+}
+
+// Sort regions by chromosome in the order of c, then by start and end position. Contigs are
+// sorted in natural order (see variants.CompareChr) if c is nil, such as for a vcf without
+// ##contig header lines.
+func Sort(regions []variants.Region, c *variants.Contigs) {
+	c.SortRegions(regions)
+}
+
+func less(a, b variants.Region) bool {
+	if cmp := variants.CompareChr(a.Chr, b.Chr); cmp != 0 {
+		return cmp < 0
+	}
+	if a.Start != b.Start {
+		return a.Start < b.Start
+	}
+	return a.End < b.End
+}
+
+// Merge returns the set of regions covering the same bases as the input, with overlapping and
+// adjacent regions combined, sorted with contigs in natural order (see Sort). The input is not
+// modified.
+func Merge(regions []variants.Region) []variants.Region {
+	if len(regions) == 0 {
+		return nil
+	}
+	sorted := make([]variants.Region, len(regions))
+	copy(sorted, regions)
+	Sort(sorted, nil)
+	answer := []variants.Region{sorted[0]}
+	var last *variants.Region
+	for _, r := range sorted[1:] {
+		last = &answer[len(answer)-1]
+		if SameChr(r.Chr, last.Chr) && r.Start <= last.End {
+			last.End = maxInt(last.End, r.End)
+			continue
+		}
+		answer = append(answer, r)
+	}
+	return answer
+}
+
+// Union returns the merged set of bases covered by a or b.
+func Union(a, b []variants.Region) []variants.Region {
+	all := make([]variants.Region, 0, len(a)+len(b))
+	all = append(all, a...)
+	all = append(all, b...)
+	return Merge(all)
+}
+
+// Intersection returns the merged set of bases covered by both a and b.
+func Intersection(a, b []variants.Region) []variants.Region {
+	a, b = Merge(a), Merge(b)
+	var answer []variants.Region
+	var i, j int
+	for i < len(a) && j < len(b) {
+		if r, ok := Intersect(a[i], b[j]); ok {
+			answer = append(answer, r)
+		}
+		if less(variants.Region{Chr: a[i].Chr, Start: a[i].End}, variants.Region{Chr: b[j].Chr, Start: b[j].End}) {
+			i++
+		} else {
+			j++
+		}
+	}
+	return answer
+}
+
+// Subtract returns the merged set of bases covered by a and not by b.
+func Subtract(a, b []variants.Region) []variants.Region {
+	a, b = Merge(a), Merge(b)
+	var answer []variants.Region
+	var j int
+	var curr variants.Region
+	for _, r := range a {
+		curr = r
+		for j < len(b) && less(variants.Region{Chr: b[j].Chr, Start: b[j].End}, variants.Region{Chr: curr.Chr, Start: curr.Start + 1}) {
+			j++ // b[j] ends before curr
+		}
+		for k := j; k < len(b) && SameChr(b[k].Chr, curr.Chr) && b[k].Start < curr.End; k++ {
+			if b[k].Start > curr.Start {
+				answer = append(answer, variants.Region{Chr: curr.Chr, Start: curr.Start, End: b[k].Start})
+			}
+			curr.Start = maxInt(curr.Start, b[k].End)
+		}
+		if curr.Start < curr.End {
+			answer = append(answer, curr)
+		}
+	}
+	return answer
+}
+
+// SameChr returns true if a and b are names for the same contig (see variants.CanonicalChr).
+func SameChr(a, b string) bool {
+	return a == b || variants.CanonicalChr(a) == variants.CanonicalChr(b)
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
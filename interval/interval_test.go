@@ -0,0 +1,177 @@
+package interval
+
+import (
+	"github.com/ddsnellings/weaver/variants"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func r(chr string, start, end int) variants.Region {
+	return variants.Region{Chr: chr, Start: start, End: end}
+}
+
+func equal(a, b []variants.Region) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected variants.Region
+	}{
+		{"chr1:101-200", r("chr1", 100, 200)},
+		{"chr1:1,001-2,000", r("chr1", 1000, 2000)},
+		{"chr2:50", r("chr2", 49, 50)},
+		{"HLA-A*01:01:1-10", r("HLA-A*01:01", 0, 10)},
+	}
+	for _, test := range tests {
+		if found := Parse(test.in); found != test.expected {
+			t.Errorf("expected %v for %s, found %v", test.expected, test.in, found)
+		}
+	}
+	if found := Parse("chrX"); found.Chr != "chrX" || found.Start != 0 || Len(found) < 1e8 {
+		t.Errorf("expected whole chromosome for chrX, found %v", found)
+	}
+	if Format(r("chr1", 100, 200)) != "chr1:101-200" {
+		t.Errorf("unexpected format %s", Format(r("chr1", 100, 200)))
+	}
+}
+
+func TestBed(t *testing.T) {
+	regions := []variants.Region{r("chr1", 0, 10), r("chr2", 5, 8)}
+	file := filepath.Join(t.TempDir(), "weaver.regions.bed")
+	WriteBed(file, regions)
+	if found := ReadBed(file); !equal(found, regions) {
+		t.Errorf("expected %v, found %v", regions, found)
+	}
+}
+
+func TestReadGenes(t *testing.T) {
+	dir := t.TempDir()
+	gtf := filepath.Join(dir, "weaver.genes.gtf")
+	lines := "#!genome-build GRCh38\n" +
+		"chr7\tHAVANA\tgene\t140719327\t140924929\t.\t-\t.\tgene_id \"ENSG00000157764\"; gene_name \"BRAF\";\n" +
+		"chr7\tHAVANA\texon\t140719327\t140726516\t.\t-\t.\tgene_id \"ENSG00000157764\"; gene_name \"BRAF\";\n" +
+		"chr7\tHAVANA\tgene\t55019017\t55211628\t.\t+\t.\tgene_id \"ENSG00000146648\"; gene_name \"EGFR\";\n"
+	bed := filepath.Join(dir, "weaver.amplicons.bed")
+	amplicons := "chr7\t55174700\t55174900\tEGFR\nchr7\t55181300\t55181500\tEGFR\nchr12\t25245200\t25245400\tKRAS\n"
+	if err := os.WriteFile(gtf, []byte(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(bed, []byte(amplicons), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []variants.Region{r("chr7", 140719326, 140924929)}
+	if found := ReadGenes(gtf, []string{"braf"}); !equal(found, expected) {
+		t.Errorf("expected %v, found %v", expected, found)
+	}
+	expected = []variants.Region{r("chr7", 55019016, 55211628)}
+	if found := ReadGenes(gtf, []string{"ENSG00000146648"}); !equal(found, expected) {
+		t.Errorf("expected %v, found %v", expected, found)
+	}
+	expected = []variants.Region{r("chr7", 55174700, 55174900), r("chr7", 55181300, 55181500)}
+	if found := ReadGenes(bed, []string{"EGFR"}); !equal(found, expected) {
+		t.Errorf("expected %v, found %v", expected, found)
+	}
+}
+
+func TestPairOperations(t *testing.T) {
+	a, b, c := r("chr1", 10, 20), r("chr1", 15, 30), r("chr1", 20, 25)
+	if !Overlap(a, b) || Overlap(a, c) || Overlap(a, r("chr2", 10, 20)) {
+		t.Errorf("unexpected overlap")
+	}
+	if i, ok := Intersect(a, b); !ok || i != r("chr1", 15, 20) {
+		t.Errorf("unexpected intersection %v", i)
+	}
+	if Distance(a, c) != 0 || Distance(a, r("chr1", 25, 30)) != 5 || Distance(r("chr1", 25, 30), a) != 5 || Distance(a, r("chr2", 0, 1)) != -1 {
+		t.Errorf("unexpected distance")
+	}
+	if !Contains(a, "chr1", 10) || Contains(a, "chr1", 20) {
+		t.Errorf("unexpected contains")
+	}
+}
+
+func TestSetOperations(t *testing.T) {
+	a := []variants.Region{r("chr2", 0, 5), r("chr1", 10, 20), r("chr1", 15, 30), r("chr1", 30, 35), r("chr1", 50, 60)}
+	b := []variants.Region{r("chr1", 12, 14), r("chr1", 25, 55), r("chr2", 3, 10)}
+	tests := []struct {
+		name     string
+		found    []variants.Region
+		expected []variants.Region
+	}{
+		{"merge", Merge(a), []variants.Region{r("chr1", 10, 35), r("chr1", 50, 60), r("chr2", 0, 5)}},
+		{"union", Union(a, b), []variants.Region{r("chr1", 10, 60), r("chr2", 0, 10)}},
+		{"intersection", Intersection(a, b), []variants.Region{r("chr1", 12, 14), r("chr1", 25, 35), r("chr1", 50, 55), r("chr2", 3, 5)}},
+		{"subtract", Subtract(a, b), []variants.Region{r("chr1", 10, 12), r("chr1", 14, 25), r("chr1", 55, 60), r("chr2", 0, 3)}},
+		{"subtract reverse", Subtract(b, a), []variants.Region{r("chr1", 35, 50), r("chr2", 5, 10)}},
+	}
+	for _, test := range tests {
+		if !equal(test.found, test.expected) {
+			t.Errorf("%s: expected %v, found %v", test.name, test.expected, test.found)
+		}
+	}
+}
+
+func TestSort(t *testing.T) {
+	regions := []variants.Region{r("chr10", 0, 5), r("chr2", 10, 20), r("chr1", 5, 8), r("chr2", 3, 4)}
+	Sort(regions, nil)
+	if expected := []variants.Region{r("chr1", 5, 8), r("chr2", 3, 4), r("chr2", 10, 20), r("chr10", 0, 5)}; !equal(regions, expected) {
+		t.Errorf("expected natural order %v, found %v", expected, regions)
+	}
+	c := variants.ContigsFromHeader([]string{"##contig=<ID=chr10>", "##contig=<ID=chr2>", "##contig=<ID=chr1>", "#CHROM"})
+	Sort(regions, c)
+	if expected := []variants.Region{r("chr10", 0, 5), r("chr2", 3, 4), r("chr2", 10, 20), r("chr1", 5, 8)}; !equal(regions, expected) {
+		t.Errorf("expected header order %v, found %v", expected, regions)
+	}
+}
+
+func TestTree(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	chroms := []string{"chr1", "chr2"}
+	regions := make([]variants.Region, 500)
+	var start int
+	for i := range regions {
+		start = rnd.Intn(10000)
+		regions[i] = r(chroms[rnd.Intn(2)], start, start+1+rnd.Intn(200))
+	}
+	tree := NewTree(regions)
+	var query variants.Region
+	var found []int
+	var expected int
+	for i := 0; i < 200; i++ {
+		start = rnd.Intn(10000)
+		query = r(chroms[rnd.Intn(2)], start, start+1+rnd.Intn(100))
+		found = tree.Query(query)
+		expected = 0
+		for j := range regions {
+			if Overlap(regions[j], query) {
+				expected++
+			}
+		}
+		if len(found) != expected {
+			t.Errorf("expected %d regions overlapping %v, found %d", expected, query, len(found))
+		}
+		for k, idx := range found {
+			if !Overlap(regions[idx], query) {
+				t.Errorf("region %v does not overlap %v", regions[idx], query)
+			}
+			if k > 0 && regions[found[k-1]].Start > regions[idx].Start {
+				t.Errorf("query results not sorted by start")
+			}
+		}
+	}
+	if found = tree.QueryPoint("chr3", 5); len(found) != 0 {
+		t.Errorf("expected no regions on chr3")
+	}
+}
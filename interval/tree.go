@@ -0,0 +1,95 @@
+package interval
+
+import (
+	"github.com/ddsnellings/weaver/variants"
+	"sort"
+)
+
+// Tree is a static interval tree over a slice of regions. Queries return indices into the
+// slice used to build the tree, so any data with a region (e.g. variants, amplicons, or runs
+// of homozygosity) can be indexed by building the tree from a parallel slice of regions.
+type Tree struct {
+	regions []variants.Region
+	byChr   map[string]*chrTree
+}
+
+// chrTree stores the regions on one chromosome sorted by start position. The tree is implicit:
+// the root of the subtree over sorted[lo:hi] is at (lo+hi)/2, and maxEnd stores the greatest
+// End in each subtree.
+type chrTree struct {
+	sorted []int // indices into Tree.regions
+	maxEnd []int
+}
+
+// NewTree builds a Tree from the input regions. The regions are not copied and must not be
+// modified while the tree is in use.
+func NewTree(regions []variants.Region) *Tree {
+	answer := &Tree{regions: regions, byChr: make(map[string]*chrTree)}
+	var chr string
+	for i, r := range regions {
+		chr = variants.CanonicalChr(r.Chr)
+		if answer.byChr[chr] == nil {
+			answer.byChr[chr] = new(chrTree)
+		}
+		answer.byChr[chr].sorted = append(answer.byChr[chr].sorted, i)
+	}
+	for _, c := range answer.byChr {
+		sort.SliceStable(c.sorted, func(i, j int) bool {
+			return regions[c.sorted[i]].Start < regions[c.sorted[j]].Start
+		})
+		c.maxEnd = make([]int, len(c.sorted))
+		c.build(regions, 0, len(c.sorted))
+	}
+	return answer
+}
+
+// build sets maxEnd for the subtree over sorted[lo:hi] and returns it.
+func (c *chrTree) build(regions []variants.Region, lo, hi int) int {
+	if lo >= hi {
+		return -1
+	}
+	mid := (lo + hi) / 2
+	c.maxEnd[mid] = maxInt(regions[c.sorted[mid]].End, maxInt(c.build(regions, lo, mid), c.build(regions, mid+1, hi)))
+	return c.maxEnd[mid]
+}
+
+// Query returns the indices of all regions overlapping r, sorted by start position.
+func (t *Tree) Query(r variants.Region) []int {
+	c := t.byChr[variants.CanonicalChr(r.Chr)]
+	if c == nil {
+		return nil
+	}
+	var answer []int
+	c.query(t.regions, r, 0, len(c.sorted), &answer)
+	return answer
+}
+
+// QueryPoint returns the indices of all regions containing the 0-based position pos on chr.
+func (t *Tree) QueryPoint(chr string, pos int) []int {
+	return t.Query(variants.Region{Chr: chr, Start: pos, End: pos + 1})
+}
+
+// query appends the indices in sorted[lo:hi] that overlap r in order of start position.
+func (c *chrTree) query(regions []variants.Region, r variants.Region, lo, hi int, answer *[]int) {
+	if lo >= hi {
+		return
+	}
+	mid := (lo + hi) / 2
+	if c.maxEnd[mid] <= r.Start { // nothing in this subtree ends after the query starts
+		return
+	}
+	c.query(regions, r, lo, mid, answer)
+	curr := regions[c.sorted[mid]]
+	if curr.Start >= r.End { // everything to the right starts after the query ends
+		return
+	}
+	if curr.End > r.Start {
+		*answer = append(*answer, c.sorted[mid])
+	}
+	c.query(regions, r, mid+1, hi, answer)
+}
+
+// Len returns the number of regions in the tree.
+func (t *Tree) Len() int {
+	return len(t.regions)
+}
@@ -11,7 +11,9 @@ package loh
 import (
 	"fmt"
 	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/interval"
 	"github.com/ddsnellings/weaver/variants"
+	"sort"
 )
 
 // RunOfHomozygosity stores the variant Id for each contiguous homozygous variant
@@ -76,42 +78,67 @@ type RohHaplotypes struct {
 func FindAllRunsOfHomozygosity(d *cells.Data, minVars int) [][]RunOfHomozygosity {
 	answer := make([][]RunOfHomozygosity, len(d.Cells))
 	hetVariantIds := variants.FindHeterozygous(d.Variants)
-	variants.SortIdsByCoord(hetVariantIds, d.Variants)
+	d.Contigs.SortIdsByCoord(hetVariantIds, d.Variants)
 
 	for i := range d.Cells {
-		answer[i] = FindRunsOfHomozygosity(d.Cells[i], hetVariantIds, d.Variants, minVars)
+		answer[i] = FindRunsOfHomozygosity(d, i, hetVariantIds, minVars)
 	}
 	return answer
 }
 
 // FindRunsOfHomozygosity identifies constitutionally heterozygous variants go to
-// homozygosity across a contiguous genomic span in the input cell.
+// homozygosity across a contiguous genomic span in the cell with Id == cellId.
 // The hetVariantIds input should be a slice of constitutional heterozygous variants
-// sorted by genomic coordinate with variants.SortIdsByCoord. A putative ROH is only
+// sorted by genomic coordinate with Contigs.SortIdsByCoord. A putative ROH is only
 // considered after is defined by > minVars of variants.
 // i.e. an ROH defined by 2 SNPs is not returned if minVars == 3
-func FindRunsOfHomozygosity(c cells.Cell, hetVariantIds []int, vars []variants.Variant, minVars int) []RunOfHomozygosity {
+//
+// Phased variants (see variants.Variant.PhaseSet) are treated as units. Variants in the same
+// phased block count as a single variant towards minVars, and a run is broken where homozygous
+// variants of the same block disagree on which haplotype was retained.
+
+func FindRunsOfHomozygosity(d *cells.Data, cellId int, hetVariantIds []int, minVars int) []RunOfHomozygosity {
 	var answer []RunOfHomozygosity
+	vars := d.Variants
 	var currRun RunOfHomozygosity
+	retained := make(map[int]int) // haplotype retained in each phased block of currRun
 	for i := range hetVariantIds {
 
 		// do not let ROH span different chromosomes
-		if i > 0 && vars[hetVariantIds[i]].Chr != vars[hetVariantIds[i-1]].Chr {
-			if len(currRun) >= minVars {
+		if i > 0 && !interval.SameChr(vars[hetVariantIds[i]].Chr, vars[hetVariantIds[i-1]].Chr) {
+			if runUnits(currRun, vars) >= minVars {
 				answer = append(answer, currRun)
 			}
 			currRun = nil
+			retained = make(map[int]int)
 		}
 
-		switch c.Genotypes[hetVariantIds[i]].Genotype {
+		switch z := d.Genotype(cellId, hetVariantIds[i]); z {
 		case variants.Heterozygous:
-			if len(currRun) >= minVars {
+			if runUnits(currRun, vars) >= minVars {
 				answer = append(answer, currRun)
 			}
 			currRun = nil
+			retained = make(map[int]int)
 			continue
 
 		case variants.Homozygous, variants.WildType:
+			v := vars[hetVariantIds[i]]
+			if v.PhaseSet > 0 {
+				hap := v.PhaseHap // haplotype carrying the alt allele is retained
+				if z == variants.WildType {
+					hap = 1 - hap
+				}
+				if prev, found := retained[v.PhaseSet]; found && prev != hap {
+					// phased alleles from both haplotypes remain, so the run ends here
+					if runUnits(currRun, vars) >= minVars {
+						answer = append(answer, currRun)
+					}
+					currRun = nil
+					retained = make(map[int]int)
+				}
+				retained[v.PhaseSet] = hap
+			}
 			currRun = append(currRun, hetVariantIds[i])
 
 		case variants.NoGenotype, variants.Hemizygous:
@@ -119,12 +146,29 @@ func FindRunsOfHomozygosity(c cells.Cell, hetVariantIds []int, vars []variants.V
 		}
 	}
 
-	if len(currRun) >= minVars { // in case we end in an ongoing run
+	if runUnits(currRun, vars) >= minVars { // in case we end in an ongoing run
 		answer = append(answer, currRun)
 	}
 	return answer
 }
 
+// runUnits returns the number of variants in run, counting the variants of a phased
+// block once.
+func runUnits(run RunOfHomozygosity, v []variants.Variant) int {
+	var answer int
+	seen := make(map[int]bool)
+	for _, vid := range run {
+		if v[vid].PhaseSet > 0 {
+			if seen[v[vid].PhaseSet] {
+				continue
+			}
+			seen[v[vid].PhaseSet] = true
+		}
+		answer++
+	}
+	return answer
+}
+
 // CountRohHaplotypes determines the number of cells harboring each unique run of homozygosity.
 // The return map is keyed on the genomic region spanned by the ROH and give the number of cells with
 // ROH across the keyed region.
@@ -144,7 +188,7 @@ func addHaplotype(cellId int, run RunOfHomozygosity, answer map[variants.Region]
 	haplotype.VariantIds = run
 	haplotype.Genotypes = make([]variants.Zygosity, len(run))
 	for i := range run {
-		haplotype.Genotypes[i] = d.Cells[cellId].Genotypes[run[i]].Genotype
+		haplotype.Genotypes[i] = d.Genotype(cellId, run[i])
 	}
 
 	var rohHap *RohHaplotypes
@@ -164,6 +208,54 @@ func addHaplotype(cellId int, run RunOfHomozygosity, answer map[variants.Region]
 	}
 }
 
+// Index stores the runs of homozygosity of all cells in an interval tree (see interval.Tree)
+// for fast queries of the runs overlapping a genomic region.
+type Index struct {
+	tree    *interval.Tree
+	runs    []RunOfHomozygosity
+	cellIds []int
+}
+
+// NewIndex builds an Index from the runs of each cell returned by FindAllRunsOfHomozygosity.
+func NewIndex(r [][]RunOfHomozygosity, d *cells.Data) *Index {
+	answer := new(Index)
+	var regions []variants.Region
+	for cellId := range r {
+		for _, run := range r[cellId] {
+			answer.runs = append(answer.runs, run)
+			answer.cellIds = append(answer.cellIds, cellId)
+			regions = append(regions, run.Region(d.Variants))
+		}
+	}
+	answer.tree = interval.NewTree(regions)
+	return answer
+}
+
+// Query returns the runs overlapping region and the Id of the cell with each run, sorted by
+// the start position of the run.
+func (x *Index) Query(region variants.Region) (runs []RunOfHomozygosity, cellIds []int) {
+	for _, i := range x.tree.Query(region) {
+		runs = append(runs, x.runs[i])
+		cellIds = append(cellIds, x.cellIds[i])
+	}
+	return runs, cellIds
+}
+
+// CellsWithRoh returns the sorted Ids of cells with a run of homozygosity containing the 0-based
+// position pos on chr.
+func (x *Index) CellsWithRoh(chr string, pos int) []int {
+	var answer []int
+	seen := make(map[int]bool)
+	for _, i := range x.tree.QueryPoint(chr, pos) {
+		if !seen[x.cellIds[i]] {
+			seen[x.cellIds[i]] = true
+			answer = append(answer, x.cellIds[i])
+		}
+	}
+	sort.Ints(answer)
+	return answer
+}
+
 func findHaplotypeIdx(val Haplotype, searchHaps []Haplotype) (idx int, found bool) {
 	for i := range searchHaps {
 		if matchingHaplotype(val, searchHaps[i]) {
@@ -3,6 +3,7 @@ package loh
 import (
 	"fmt"
 	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/variants"
 	"testing"
 )
 
@@ -76,3 +77,60 @@ func TestFindRoh(t *testing.T) {
  */
 
 }
+
+func TestFindRunsOfHomozygosityPhased(t *testing.T) {
+	d := &cells.Data{Cells: []cells.Cell{{Id: 0}, {Id: 1}}}
+	for i := 0; i < 4; i++ {
+		d.Variants = append(d.Variants, variants.Variant{Id: i, Chr: "chr1", Pos: 100 * i})
+	}
+	// variants 1 and 2 are phased with the alt alleles in trans
+	d.Variants[1].PhaseSet, d.Variants[1].PhaseHap = 101, 0
+	d.Variants[2].PhaseSet, d.Variants[2].PhaseHap = 101, 1
+	genotypes := [][]variants.Zygosity{
+		{variants.Homozygous, variants.Homozygous, variants.WildType, variants.Homozygous},  // lost haplotype 1
+		{variants.Homozygous, variants.Homozygous, variants.Homozygous, variants.Homozygous}, // phased alts of both haplotypes
+	}
+	for i := range genotypes {
+		for vid, z := range genotypes[i] {
+			d.SetCellVar(i, vid, variants.CellVar{Genotype: z})
+		}
+	}
+	hetVariantIds := []int{0, 1, 2, 3}
+
+	if runs := FindRunsOfHomozygosity(d, 0, hetVariantIds, 3); len(runs) != 1 || len(runs[0]) != 4 {
+		t.Errorf("expected a run of 4 variants in 3 units, found %v", runs)
+	}
+	if runs := FindRunsOfHomozygosity(d, 0, hetVariantIds, 4); len(runs) != 0 {
+		t.Errorf("expected the phased block to count once, found %v", runs)
+	}
+	if runs := FindRunsOfHomozygosity(d, 1, hetVariantIds, 2); len(runs) != 2 || fmt.Sprint(runs) != "[[0 1] [2 3]]" {
+		t.Errorf("expected the run to break within the phased block, found %v", runs)
+	}
+}
+
+func TestIndex(t *testing.T) {
+	d := &cells.Data{Cells: []cells.Cell{{Id: 0}, {Id: 1}, {Id: 2}}}
+	for i, pos := range []int{100, 200, 300, 400} {
+		d.Variants = append(d.Variants, variants.Variant{Id: i, Chr: "chr1", Pos: pos})
+	}
+	d.Variants = append(d.Variants, variants.Variant{Id: 4, Chr: "chr2", Pos: 100})
+	r := [][]RunOfHomozygosity{
+		{{0, 1, 2}},
+		{{2, 3}, {4}},
+		nil,
+	}
+	x := NewIndex(r, d)
+	runs, cellIds := x.Query(variants.Region{Chr: "1", Start: 250, End: 350}) // contig aliases are matched
+	if len(runs) != 2 || fmt.Sprint(cellIds) != "[0 1]" {
+		t.Errorf("expected runs of cells [0 1], found %v in cells %v", runs, cellIds)
+	}
+	if found := x.CellsWithRoh("chr1", 150); fmt.Sprint(found) != "[0]" {
+		t.Errorf("expected cell [0] with roh at chr1:150, found %v", found)
+	}
+	if found := x.CellsWithRoh("chr2", 100); fmt.Sprint(found) != "[1]" {
+		t.Errorf("expected cell [1] with roh at chr2:100, found %v", found)
+	}
+	if found := x.CellsWithRoh("chr1", 450); len(found) != 0 {
+		t.Errorf("expected no cells with roh at chr1:450, found %v", found)
+	}
+}
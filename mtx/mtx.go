@@ -0,0 +1,234 @@
+// Package mtx reads per-cell allele counts stored as sparse Matrix Market matrices, as output
+// by cellSNP-lite and vartrix, into cells.Data.
+//
+// Both tools store a matrix with a row for each variant and a column for each cell, along with
+// a vcf of the variants in row order and a file with one cell barcode per line in column order.
+// Genotypes are called from the allele counts (see cells.CallFromReadCounts) and filtered as
+// when reading a vcf, so the returned data can be used in place of cells.ReadVcf.
+//
+// The matrices store a single alt count for each variant, so only the first ALT of a
+// multi-allelic record is read, and a warning is logged for each such record. Split
+// multi-allelic records before counting (e.g. bcftools norm -m-) to genotype every allele.
+package mtx
+
+import (
+	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/variants"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"github.com/vertgenlab/gonomics/vcf"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Param defines the parameters for reading allele count matrices.
+type Param struct {
+	ReadParam cells.ReadParam // filters and reference applied as in cells.ReadVcfWithParam // Default cells.DefaultReadParam
+	ErrorRate float64         // probability a read shows the wrong allele when calling genotypes. must be > 0 and < 0.5 // Default 0.01
+}
+
+var DefaultParam = Param{ReadParam: cells.DefaultReadParam, ErrorRate: 0.01}
+
+// Entry is a nonzero value in a sparse matrix.
+type Entry struct {
+	Col   int // 0-based column
+	Value int
+}
+
+// Matrix is a sparse integer matrix with the nonzero entries of each row.
+type Matrix struct {
+	Rows, Cols int
+	Entries    [][]Entry // Entries[row] in file order
+}
+
+// Read reads a Matrix Market coordinate matrix (may be .gz). Only integer and real values are
+// supported, and real values are rounded to the nearest integer.
+func Read(file string) Matrix {
+	var answer Matrix
+	er := fileio.EasyOpen(file)
+	var line string
+	var done, sized bool
+	var fields []string
+	var row, col int
+	var val float64
+	var err error
+	for line, done = fileio.EasyNextLine(er); !done; line, done = fileio.EasyNextLine(er) {
+		if strings.HasPrefix(line, "%%MatrixMarket") {
+			if !strings.Contains(line, "coordinate") {
+				log.Panicf("'%s' is not a coordinate matrix. found header: %s", file, line)
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "%") || strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields = strings.Fields(line)
+		if len(fields) != 3 {
+			log.Panicf("expected 3 columns in '%s', found line: %s", file, line)
+		}
+		if !sized {
+			answer.Rows, err = strconv.Atoi(fields[0])
+			exception.PanicOnErr(err)
+			answer.Cols, err = strconv.Atoi(fields[1])
+			exception.PanicOnErr(err)
+			answer.Entries = make([][]Entry, answer.Rows)
+			sized = true
+			continue
+		}
+		row, err = strconv.Atoi(fields[0])
+		exception.PanicOnErr(err)
+		col, err = strconv.Atoi(fields[1])
+		exception.PanicOnErr(err)
+		val, err = strconv.ParseFloat(fields[2], 64)
+		exception.PanicOnErr(err)
+		if row < 1 || row > answer.Rows || col < 1 || col > answer.Cols {
+			log.Panicf("entry %d,%d is outside the %dx%d matrix in '%s'", row, col, answer.Rows, answer.Cols, file)
+		}
+		answer.Entries[row-1] = append(answer.Entries[row-1], Entry{Col: col - 1, Value: int(val + 0.5)})
+	}
+	exception.PanicOnErr(er.Close())
+	if !sized {
+		log.Panicf("no matrix size line found in '%s'", file)
+	}
+	return answer
+}
+
+// Dense returns the values of row as a dense slice of length m.Cols.
+func (m Matrix) Dense(row int) []int {
+	answer := make([]int, m.Cols)
+	for _, e := range m.Entries[row] {
+		answer[e.Col] += e.Value
+	}
+	return answer
+}
+
+// ReadCellSnp reads the output directory of cellSNP-lite. Alt reads are read from cellSNP.tag.AD.mtx,
+// read depth from cellSNP.tag.DP.mtx, cells from cellSNP.samples.tsv, and variants from
+// cellSNP.base.vcf or cellSNP.base.vcf.gz.
+func ReadCellSnp(dir string, p Param) *cells.Data {
+	vcfFile := filepath.Join(dir, "cellSNP.base.vcf")
+	if _, err := os.Stat(vcfFile); os.IsNotExist(err) {
+		vcfFile += ".gz"
+	}
+	ad := Read(filepath.Join(dir, "cellSNP.tag.AD.mtx"))
+	dp := Read(filepath.Join(dir, "cellSNP.tag.DP.mtx"))
+	return fromCounts(ad, dp, false, ReadBarcodes(filepath.Join(dir, "cellSNP.samples.tsv")), vcfFile, p)
+}
+
+// ReadVartrix reads the output of vartrix run with --scoring-method coverage, where refFile and
+// altFile are the ref and alt read count matrices. barcodesFile and vcfFile are the cell barcodes
+// and variants input to vartrix.
+func ReadVartrix(refFile, altFile, barcodesFile, vcfFile string, p Param) *cells.Data {
+	return fromCounts(Read(altFile), Read(refFile), true, ReadBarcodes(barcodesFile), vcfFile, p)
+}
+
+// ReadBarcodes reads a file with one cell barcode per line (may be .gz), such as the
+// barcodes.tsv output by cellranger. Only the first column of each line is used.
+func ReadBarcodes(file string) []string {
+	var answer []string
+	er := fileio.EasyOpen(file)
+	var line string
+	var done bool
+	for line, done = fileio.EasyNextLine(er); !done; line, done = fileio.EasyNextLine(er) {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			answer = append(answer, fields[0])
+		}
+	}
+	exception.PanicOnErr(er.Close())
+	return answer
+}
+
+// fromCounts builds Data from a matrix of alt reads and a matrix of either ref reads or read
+// depth, with a row for each record in vcfFile and a column for each barcode.
+func fromCounts(alt, other Matrix, otherIsRef bool, barcodes []string, vcfFile string, p Param) *cells.Data {
+	if p.ErrorRate <= 0 || p.ErrorRate >= 0.5 {
+		log.Panicf("ErrorRate must be > 0 and < 0.5, found %v", p.ErrorRate)
+	}
+	records, header := readSites(vcfFile)
+	if alt.Rows != len(records) || other.Rows != len(records) {
+		log.Panicf("found %d variants in '%s', but matrices have %d and %d rows", len(records), vcfFile, alt.Rows, other.Rows)
+	}
+	if alt.Cols != len(barcodes) || other.Cols != len(barcodes) {
+		log.Panicf("found %d barcodes, but matrices have %d and %d columns", len(barcodes), alt.Cols, other.Cols)
+	}
+
+	d := new(cells.Data)
+	d.Contigs = variants.ContigsFromHeader(header)
+	d.Cells = make([]cells.Cell, len(barcodes))
+	for i := range d.Cells {
+		d.Cells[i].Id = i
+		d.Cells[i].Name = barcodes[i]
+	}
+
+	var altReads, otherReads []int
+	var cellVars []variants.CellVar
+	var variant variants.Variant
+	var ok bool
+	for row, record := range records {
+		if record.Qual <= p.ReadParam.MinVcfQual || record.Alt[0] == "." {
+			continue
+		}
+		if len(record.Alt) > 1 {
+			log.Printf("WARNING: only the first alt allele of %s:%d is read from count matrices", record.Chr, record.Pos)
+		}
+		variant = cells.NewVariant(record, 0)
+		if p.ReadParam.Reference != nil {
+			if variant, ok = cells.NormalizeVariant(variant, p.ReadParam.Reference); !ok {
+				continue
+			}
+		}
+		altReads, otherReads = alt.Dense(row), other.Dense(row)
+		cellVars = make([]variants.CellVar, len(d.Cells))
+		for i := range cellVars {
+			cellVars[i].AltReads = altReads[i]
+			cellVars[i].ReadDepth = otherReads[i]
+			if otherIsRef {
+				cellVars[i].ReadDepth += altReads[i]
+			}
+			if cellVars[i].ReadDepth > 0 {
+				cellVars[i].Af = float64(cellVars[i].AltReads) / float64(cellVars[i].ReadDepth)
+			}
+		}
+		cells.CallFromReadCounts(cellVars, p.ErrorRate)
+		d.AddVariant(variant, cellVars, p.ReadParam.CellFilter)
+	}
+
+	p.ReadParam.GlobalFilter.Apply(d)
+	return d
+}
+
+// readSites reads the first 8 columns of each record in a vcf file, which may have no sample
+// columns as in the base vcf output by cellSNP-lite. Returns the records and the header lines.
+func readSites(file string) ([]vcf.Vcf, []string) {
+	var records []vcf.Vcf
+	var header []string
+	var fields []string
+	var err error
+	var record vcf.Vcf
+	er := fileio.EasyOpen(file)
+	var line string
+	var done bool
+	for line, done = fileio.EasyNextLine(er); !done; line, done = fileio.EasyNextLine(er) {
+		if strings.HasPrefix(line, "#") {
+			header = append(header, line)
+			continue
+		}
+		fields = strings.SplitN(line, "\t", 9)
+		if len(fields) < 8 {
+			log.Panicf("expected at least 8 columns in '%s', found line: %s", file, line)
+		}
+		record = vcf.Vcf{Chr: fields[0], Id: fields[2], Ref: fields[3], Alt: strings.Split(fields[4], ","), Qual: 255}
+		record.Pos, err = strconv.Atoi(fields[1])
+		exception.PanicOnErr(err)
+		if fields[5] != "." {
+			record.Qual, err = strconv.ParseFloat(fields[5], 64)
+			exception.PanicOnErr(err)
+		}
+		records = append(records, record)
+	}
+	exception.PanicOnErr(er.Close())
+	return records, header
+}
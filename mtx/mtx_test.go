@@ -0,0 +1,125 @@
+package mtx
+
+import (
+	"fmt"
+	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/variants"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testVcf = "##fileformat=VCFv4.2\n" +
+	"##contig=<ID=chr1,length=1000>\n" +
+	"#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\n" +
+	"chr1\t100\t.\tA\tG\t.\tPASS\tAD=30;DP=60\n" +
+	"chr1\t200\t.\tC\tT\t.\tPASS\tAD=20;DP=80\n" +
+	"chr1\t300\t.\tG\tC\t.\tPASS\tAD=0;DP=0\n"
+
+const testBarcodes = "AAAC-1\nCCCG-1\nGGGT-1\nTTTA-1\n"
+
+// alt and depth of each variant (rows) in each cell (columns)
+var testAlt = [][]int{{20, 10, 0, 0}, {0, 0, 10, 10}, {0, 0, 0, 0}}
+var testDepth = [][]int{{20, 20, 20, 0}, {20, 20, 20, 20}, {0, 0, 0, 0}}
+
+// writeMatrix writes m in Matrix Market format, with entries in column order as written by cellSNP-lite.
+func writeMatrix(t *testing.T, file string, m [][]int) {
+	var entries strings.Builder
+	var n int
+	for j := range m[0] {
+		for i := range m {
+			if m[i][j] != 0 {
+				fmt.Fprintf(&entries, "%d %d %d\n", i+1, j+1, m[i][j])
+				n++
+			}
+		}
+	}
+	writeFile(t, file, fmt.Sprintf("%%%%MatrixMarket matrix coordinate integer general\n%%\n%d\t%d\t%d\n%s", len(m), len(m[0]), n, entries.String()))
+}
+
+func writeFile(t *testing.T, file string, s string) {
+	if err := os.WriteFile(file, []byte(s), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkData(t *testing.T, d *cells.Data, source string) {
+	if len(d.Cells) != 4 || len(d.Variants) != 3 {
+		t.Fatalf("%s: expected 4 cells and 3 variants, found %d and %d", source, len(d.Cells), len(d.Variants))
+	}
+	if d.Cells[2].Name != "GGGT-1" || d.Variants[1].Pos != 199 || d.Contigs == nil {
+		t.Errorf("%s: unexpected cell %s, variant %s, or contigs %v", source, d.Cells[2].Name, d.Variants[1], d.Contigs)
+	}
+	expected := [][]variants.Zygosity{
+		{variants.Homozygous, variants.Heterozygous, variants.WildType, variants.NoGenotype},
+		{variants.WildType, variants.WildType, variants.Heterozygous, variants.Heterozygous},
+		{variants.NoGenotype, variants.NoGenotype, variants.NoGenotype, variants.NoGenotype},
+	}
+	for vid := range expected {
+		for i := range expected[vid] {
+			cv := d.CellVar(i, vid)
+			if cv.Genotype != expected[vid][i] || cv.AltReads != testAlt[vid][i] || cv.ReadDepth != testDepth[vid][i] {
+				t.Errorf("%s: cell %d variant %d: expected %s with %d/%d reads, found %s with %d/%d", source, i, vid,
+					expected[vid][i], testAlt[vid][i], testDepth[vid][i], cv.Genotype, cv.AltReads, cv.ReadDepth)
+			}
+		}
+	}
+	if len(d.Variants[0].CellsGenotyped) != 3 || len(d.Variants[0].CellsMutated) != 2 || len(d.Variants[2].CellsGenotyped) != 0 {
+		t.Errorf("%s: expected cell filter to be applied, found %v genotyped and %v mutated", source,
+			d.Variants[0].CellsGenotyped, d.Variants[0].CellsMutated)
+	}
+}
+
+func TestReadCellSnp(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "cellSNP.base.vcf"), testVcf)
+	writeFile(t, filepath.Join(dir, "cellSNP.samples.tsv"), testBarcodes)
+	writeMatrix(t, filepath.Join(dir, "cellSNP.tag.AD.mtx"), testAlt)
+	writeMatrix(t, filepath.Join(dir, "cellSNP.tag.DP.mtx"), testDepth)
+
+	p := DefaultParam
+	p.ReadParam.GlobalFilter = cells.GlobalFilterParam{}
+	checkData(t, ReadCellSnp(dir, p), "cellSNP-lite")
+
+	p.ReadParam.GlobalFilter = cells.DefaultGlobalFilter
+	d := ReadCellSnp(dir, p)
+	if len(d.Variants) != 2 {
+		t.Errorf("expected global filter to remove the variant without reads, found %d variants", len(d.Variants))
+	}
+
+	for _, errorRate := range []float64{0, 0.5} {
+		p.ErrorRate = errorRate
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected panic for ErrorRate %v", errorRate)
+				}
+			}()
+			ReadCellSnp(dir, p)
+		}()
+	}
+}
+
+func TestReadVartrix(t *testing.T) {
+	dir := t.TempDir()
+	refFile := filepath.Join(dir, "weaver.vartrix.ref.mtx")
+	altFile := filepath.Join(dir, "weaver.vartrix.alt.mtx")
+	barcodesFile := filepath.Join(dir, "weaver.vartrix.barcodes.tsv")
+	vcfFile := filepath.Join(dir, "weaver.vartrix.vcf")
+	ref := make([][]int, len(testDepth))
+	for i := range ref {
+		ref[i] = make([]int, len(testDepth[i]))
+		for j := range ref[i] {
+			ref[i][j] = testDepth[i][j] - testAlt[i][j]
+		}
+	}
+	writeMatrix(t, refFile, ref)
+	writeMatrix(t, altFile, testAlt)
+	writeFile(t, barcodesFile, testBarcodes)
+	writeFile(t, vcfFile, testVcf)
+
+	p := DefaultParam
+	p.ReadParam.GlobalFilter = cells.GlobalFilterParam{}
+	checkData(t, ReadVartrix(refFile, altFile, barcodesFile, vcfFile, p), "vartrix")
+}
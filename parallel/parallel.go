@@ -0,0 +1,37 @@
+// Package parallel runs independent jobs on a pool of goroutines.
+package parallel
+
+import (
+	"runtime"
+	"sync"
+)
+
+// NumWorkers returns workers if > 0, otherwise the number of available cores.
+func NumWorkers(workers int) int {
+	if workers > 0 {
+		return workers
+	}
+	return runtime.NumCPU()
+}
+
+// For calls f(i) for all 0 <= i < n on NumWorkers(workers) goroutines and returns when all
+// calls are done. Each i is processed exactly once, so results written to index i of a slice
+// are deterministic. f must not modify state shared with other calls without synchronization.
+func For(n int, workers int, f func(i int)) {
+	jobs := make(chan int, 1024)
+	var wg sync.WaitGroup
+	for w := 0; w < NumWorkers(workers); w++ {
+		wg.Add(1)
+		go func() {
+			for i := range jobs {
+				f(i)
+			}
+			wg.Done()
+		}()
+	}
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
@@ -0,0 +1,22 @@
+package parallel
+
+import (
+	"testing"
+)
+
+func TestFor(t *testing.T) {
+	for _, workers := range []int{0, 1, 3, 50} {
+		counts := make([]int, 2000)
+		For(len(counts), workers, func(i int) {
+			counts[i]++
+		})
+		for i := range counts {
+			if counts[i] != 1 {
+				t.Errorf("workers=%d: expected job %d to run once, found %d", workers, i, counts[i])
+			}
+		}
+	}
+	For(0, 2, func(i int) {
+		t.Errorf("unexpected job %d", i)
+	})
+}
@@ -0,0 +1,144 @@
+package phylogeny
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/loh"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"math"
+	"strings"
+)
+
+// Name returns a readable name for the event at a node. Mutations are named by variant and
+// LOH events by the region spanned by their haplotype.
+func (t Tree) Name(node int, d *cells.Data) string {
+	e := t.Events[node]
+	switch e.Type {
+	case Mutation:
+		return d.Variants[e.Variant].Key()
+	case Loh:
+		r := loh.RunOfHomozygosity(e.Haplotype.VariantIds).Region(d.Variants)
+		return fmt.Sprintf("LOH:%s:%d-%d", r.Chr, r.Start, r.End)
+	default:
+		return "root"
+	}
+}
+
+// children returns the children of each node in t.
+func (t Tree) children() [][]int {
+	answer := make([][]int, len(t.Parent))
+	for node, parent := range t.Parent {
+		if parent != -1 {
+			answer[parent] = append(answer[parent], node)
+		}
+	}
+	return answer
+}
+
+// root returns the index of the root node.
+func (t Tree) root() int {
+	for node, parent := range t.Parent {
+		if parent == -1 {
+			return node
+		}
+	}
+	return -1
+}
+
+// cellCounts returns the number of cells attached to each node.
+func (t Tree) cellCounts() []int {
+	answer := make([]int, len(t.Parent))
+	for _, node := range t.Attachment {
+		answer[node]++
+	}
+	return answer
+}
+
+// Newick returns the tree in Newick format. Every node is labeled with its event name and
+// annotated with the number of attached cells and, if computed, the support of the edge to
+// its parent, e.g. 'chr1:100:A:T'[&cells=12,support=0.95].
+func (t Tree) Newick(d *cells.Data) string {
+	var sb strings.Builder
+	children := t.children()
+	counts := t.cellCounts()
+	var write func(node int)
+	write = func(node int) {
+		if len(children[node]) > 0 {
+			sb.WriteByte('(')
+			for i, child := range children[node] {
+				if i > 0 {
+					sb.WriteByte(',')
+				}
+				write(child)
+			}
+			sb.WriteByte(')')
+		}
+		sb.WriteString("'" + strings.ReplaceAll(t.Name(node, d), "'", "''") + "'")
+		sb.WriteString(fmt.Sprintf("[&cells=%d", counts[node]))
+		if t.Parent[node] != -1 && !math.IsNaN(t.Support[node]) {
+			sb.WriteString(fmt.Sprintf(",support=%.3f", t.Support[node]))
+		}
+		sb.WriteByte(']')
+	}
+	write(t.root())
+	sb.WriteByte(';')
+	return sb.String()
+}
+
+// WriteNewick writes the tree to a file in Newick format.
+func WriteNewick(file string, t Tree, d *cells.Data) {
+	out := fileio.EasyCreate(file)
+	_, err := fmt.Fprintln(out, t.Newick(d))
+	exception.PanicOnErr(err)
+	exception.PanicOnErr(out.Close())
+}
+
+// JsonNode is a node of a tree with nested children for output as JSON.
+type JsonNode struct {
+	Name     string      `json:"name"`
+	Event    string      `json:"event"`
+	Variant  *int        `json:"variant,omitempty"`  // variant Id of a mutation
+	Variants []int       `json:"variants,omitempty"` // variant Ids affected by an LOH event
+	Support  *float64    `json:"support,omitempty"`
+	Cells    []string    `json:"cells"` // names of the cells attached to the node
+	Children []*JsonNode `json:"children,omitempty"`
+}
+
+// Json converts the tree to nested JsonNodes starting from the root.
+func (t Tree) Json(d *cells.Data) *JsonNode {
+	nodes := make([]*JsonNode, len(t.Parent))
+	for node := range nodes {
+		nodes[node] = &JsonNode{Name: t.Name(node, d), Event: t.Events[node].Type.String(), Cells: []string{}}
+		switch t.Events[node].Type {
+		case Mutation:
+			vid := t.Events[node].Variant
+			nodes[node].Variant = &vid
+		case Loh:
+			nodes[node].Variants = t.Events[node].Haplotype.VariantIds
+		}
+		if !math.IsNaN(t.Support[node]) {
+			support := t.Support[node]
+			nodes[node].Support = &support
+		}
+	}
+	for cellId, node := range t.Attachment {
+		nodes[node].Cells = append(nodes[node].Cells, d.Cells[cellId].Name)
+	}
+	for node, parent := range t.Parent {
+		if parent != -1 {
+			nodes[parent].Children = append(nodes[parent].Children, nodes[node])
+		}
+	}
+	return nodes[t.root()]
+}
+
+// WriteJson writes the tree to a file as JSON.
+func WriteJson(file string, t Tree, d *cells.Data) {
+	out := fileio.EasyCreate(file)
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	exception.PanicOnErr(enc.Encode(t.Json(d)))
+	exception.PanicOnErr(out.Close())
+}
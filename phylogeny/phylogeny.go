@@ -0,0 +1,568 @@
+// Package phylogeny infers the evolutionary history of tumor cells from their genotypes.
+//
+// Trees are mutation trees as in SCITE (Jahn et al. 2016). Each node is a single event,
+// either a mutation or a loss of heterozygosity (LOH), and cells are attached to the node of
+// the last event they carry. Mutations obey the infinite sites model: each variant is gained
+// exactly once and is present in every cell attached to its node or any descendant node.
+// LOH events may revert heterozygous mutations gained earlier in the tree, either to wild-type
+// or to homozygous depending on which allele was lost.
+//
+// Observed genotypes are compared to the expected genotype of each node with rates of false
+// positive calls and false negative calls due to allelic dropout. Missing genotypes do not
+// contribute to the likelihood. The tree is found by Markov chain Monte Carlo over tree
+// topologies, keeping the tree with the greatest likelihood after marginalizing over the
+// attachment of each cell.
+package phylogeny
+
+import (
+	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/impute"
+	"github.com/ddsnellings/weaver/interval"
+	"github.com/ddsnellings/weaver/loh"
+	"github.com/ddsnellings/weaver/parallel"
+	"github.com/ddsnellings/weaver/variants"
+	"log"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// EventType is the kind of event at a node in the tree.
+type EventType byte
+
+const (
+	Root     EventType = iota // root of the tree. cells attached to the root carry no events
+	Mutation                  // gain of a single variant
+	Loh                       // loss of heterozygosity across a region
+)
+
+// String converts type EventType to a string.
+func (e EventType) String() string {
+	switch e {
+	case Root:
+		return "root"
+	case Mutation:
+		return "mutation"
+	case Loh:
+		return "loh"
+	default:
+		return "NOT FOUND"
+	}
+}
+
+// Event is the change in genotype at a node in the tree.
+type Event struct {
+	Type      EventType
+	Variant   int           // variant Id gained. only set for Mutation
+	Haplotype loh.Haplotype // genotype of each variant after LOH. only set for Loh
+}
+
+// Tree is a mutation tree with cells attached to nodes.
+type Tree struct {
+	Events        []Event   // Events[node] is the event at each node. the last node is the root
+	Parent        []int     // Parent[node] is the parent of each node, or -1 for the root
+	Attachment    []int     // Attachment[cellId] is the most probable node of each cell
+	Support       []float64 // Support[node] is the fraction of replicate trees with the edge from Parent[node] to node. NaN if not computed
+	LogLikelihood float64   // log likelihood of the genotypes marginalized over cell attachments
+}
+
+// Param defines the parameters for tree inference.
+type Param struct {
+	FalsePositive float64 // rate of calling a mutation that is not present // Default 0.01
+	FalseNegative float64 // rate of missing a heterozygous mutation due to allelic dropout // Default 0.2
+	Iterations    int     // number of MCMC proposals per chain // Default 20000
+	Chains        int     // number of independent chains. the best tree across all chains is kept // Default 4
+	Seed          int64   // seed for random number generation
+	Workers       int     // number of goroutines. 0 uses all available cores
+}
+
+var DefaultParam = Param{FalsePositive: 0.01, FalseNegative: 0.2, Iterations: 20000, Chains: 4, Seed: 1}
+
+// missing marks a genotype that is not observed in an observation matrix.
+const missing int8 = -1
+
+// observations returns the observed number of copies (0, 1, or 2) of each variant in each cell
+// such that answer[cellId][idx] is the genotype of variantIds[idx]. Genotypes that did not pass
+// cell filters are missing.
+func observations(d *cells.Data, variantIds []int) [][]int8 {
+	mask := impute.GenotypedMask(d)
+	answer := make([][]int8, len(d.Cells))
+	for i := range answer {
+		answer[i] = make([]int8, len(variantIds))
+		for j, vid := range variantIds {
+			answer[i][j] = missing
+			if !mask[i][vid] {
+				continue
+			}
+			switch d.Genotype(i, vid) {
+			case variants.WildType:
+				answer[i][j] = 0
+			case variants.Heterozygous:
+				answer[i][j] = 1
+			case variants.Homozygous, variants.Hemizygous:
+				answer[i][j] = 2
+			}
+		}
+	}
+	return answer
+}
+
+// logObsProb returns a table such that answer[observed][expected] is the log probability of
+// observing a genotype given the expected genotype. A heterozygous genotype drops out to either
+// homozygous state with total probability FalseNegative. False positives call a single copy
+// with probability FalsePositive and two copies with probability FalsePositive^2.
+func logObsProb(p Param) [3][3]float64 {
+	a, b := p.FalsePositive, p.FalseNegative
+	prob := [3][3]float64{
+		{1 - a - a*a, b / 2, a * a},
+		{a, 1 - b, a},
+		{a * a, b / 2, 1 - a - a*a},
+	}
+	var answer [3][3]float64
+	for i := range prob {
+		for j := range prob[i] {
+			answer[i][j] = math.Log(prob[i][j])
+		}
+	}
+	return answer
+}
+
+// change is the change in expected genotype of a single variant at a node.
+type change struct {
+	idx      int // index of the variant in the observation matrix
+	from, to int8
+}
+
+// problem stores the data shared by all chains.
+type problem struct {
+	obs    [][]int8 // obs[cell][idx]
+	events []Event  // all events except the root
+	index  map[int]int
+	lp     [3][3]float64
+}
+
+// Infer finds the maximum likelihood mutation tree for the input variants and LOH events. If
+// variantIds is nil, all variants in d are used. LOH events may be generated with LohEvents and
+// only affect variants in their haplotype that are in variantIds.
+func Infer(d *cells.Data, variantIds []int, lohEvents []loh.Haplotype, p Param) Tree {
+	prob := newProblem(d, variantIds, lohEvents, p)
+	return prob.infer(p, p.Seed)
+}
+
+func newProblem(d *cells.Data, variantIds []int, lohEvents []loh.Haplotype, p Param) *problem {
+	if variantIds == nil {
+		variantIds = make([]int, len(d.Variants))
+		for i := range variantIds {
+			variantIds[i] = i
+		}
+	}
+	prob := &problem{obs: observations(d, variantIds), index: make(map[int]int), lp: logObsProb(p)}
+	for idx, vid := range variantIds {
+		prob.index[vid] = idx
+		prob.events = append(prob.events, Event{Type: Mutation, Variant: vid})
+	}
+	for _, h := range lohEvents {
+		if len(h.VariantIds) != len(h.Genotypes) {
+			log.Panicf("LOH haplotype has %d variants and %d genotypes", len(h.VariantIds), len(h.Genotypes))
+		}
+		prob.events = append(prob.events, Event{Type: Loh, Haplotype: h})
+	}
+	return prob
+}
+
+// infer runs p.Chains independent chains and returns the best tree.
+func (prob *problem) infer(p Param, seed int64) Tree {
+	chains := p.Chains
+	if chains < 1 {
+		chains = 1
+	}
+	results := make([]chainState, chains)
+	parallel.For(chains, p.Workers, func(i int) {
+		results[i] = prob.runChain(p.Iterations, seed+int64(i))
+	})
+	best := 0
+	for i := range results {
+		if results[i].lik > results[best].lik {
+			best = i
+		}
+	}
+	return prob.tree(results[best])
+}
+
+// chainState is a tree during MCMC. Node positions are fixed and label[pos] is the event at
+// each position so that events can be swapped without changing the topology. The root is
+// the last position and has label -1.
+type chainState struct {
+	parent []int
+	label  []int
+	lik    float64
+}
+
+func (s chainState) copy() chainState {
+	return chainState{parent: append([]int{}, s.parent...), label: append([]int{}, s.label...), lik: s.lik}
+}
+
+// runChain samples trees by Metropolis-Hastings starting from a random tree and returns the
+// tree with the greatest likelihood.
+func (prob *problem) runChain(iterations int, seed int64) chainState {
+	r := rand.New(rand.NewSource(seed))
+	n := len(prob.events)
+	curr := chainState{parent: make([]int, n+1), label: make([]int, n+1)}
+	order := r.Perm(n)
+	for i, pos := range order {
+		curr.label[pos] = pos
+		if i == 0 {
+			curr.parent[pos] = n
+		} else {
+			curr.parent[pos] = []int{n, order[r.Intn(i)]}[r.Intn(2)]
+		}
+	}
+	curr.parent[n], curr.label[n] = -1, -1
+	curr.lik = prob.likelihood(curr, nil)
+	best := curr.copy()
+	if n < 2 {
+		return best
+	}
+
+	next := curr.copy()
+	var a, b int
+	for iter := 0; iter < iterations; iter++ {
+		copy(next.parent, curr.parent)
+		copy(next.label, curr.label)
+		if r.Intn(2) == 0 {
+			a = r.Intn(n)
+			next.parent[a] = randomNonDescendant(next.parent, a, r)
+		} else {
+			a, b = r.Intn(n), r.Intn(n-1)
+			if b >= a {
+				b++
+			}
+			next.label[a], next.label[b] = next.label[b], next.label[a]
+		}
+		next.lik = prob.likelihood(next, nil)
+		if next.lik >= curr.lik || r.Float64() < math.Exp(next.lik-curr.lik) {
+			curr, next = next, curr
+			if curr.lik > best.lik {
+				best = curr.copy()
+			}
+		}
+	}
+	return best
+}
+
+// randomNonDescendant returns a random position that is not node or a descendant of node.
+func randomNonDescendant(parent []int, node int, r *rand.Rand) int {
+	var candidates []int
+	var curr int
+	for i := range parent {
+		for curr = i; curr != -1 && curr != node; curr = parent[curr] {
+		}
+		if curr == -1 {
+			candidates = append(candidates, i)
+		}
+	}
+	return candidates[r.Intn(len(candidates))]
+}
+
+// preorder returns the positions of the tree in depth first order from the root.
+func preorder(parent []int) []int {
+	children := make([][]int, len(parent))
+	root := -1
+	for i, p := range parent {
+		if p == -1 {
+			root = i
+		} else {
+			children[p] = append(children[p], i)
+		}
+	}
+	answer := make([]int, 0, len(parent))
+	stack := []int{root}
+	var curr int
+	for len(stack) > 0 {
+		curr, stack = stack[len(stack)-1], stack[:len(stack)-1]
+		answer = append(answer, curr)
+		for i := len(children[curr]) - 1; i >= 0; i-- {
+			stack = append(stack, children[curr][i])
+		}
+	}
+	return answer
+}
+
+// changes returns the changes in expected genotype at each position relative to its parent.
+func (prob *problem) changes(s chainState) [][]change {
+	children := make([][]int, len(s.parent))
+	root := -1
+	for i, p := range s.parent {
+		if p == -1 {
+			root = i
+		} else {
+			children[p] = append(children[p], i)
+		}
+	}
+	answer := make([][]change, len(s.parent))
+	state := make([]int8, len(prob.index))
+	var visit func(pos int)
+	visit = func(pos int) {
+		if s.label[pos] != -1 {
+			answer[pos] = prob.apply(prob.events[s.label[pos]], state)
+		}
+		for _, child := range children[pos] {
+			visit(child)
+		}
+		for _, c := range answer[pos] {
+			state[c.idx] = c.from
+		}
+	}
+	visit(root)
+	return answer
+}
+
+// apply updates the expected genotypes in state with an event and returns the changes made.
+func (prob *problem) apply(e Event, state []int8) []change {
+	var answer []change
+	var idx int
+	var ok bool
+	switch e.Type {
+	case Mutation:
+		idx = prob.index[e.Variant]
+		if state[idx] == 0 {
+			answer = append(answer, change{idx: idx, from: 0, to: 1})
+		}
+	case Loh:
+		for j, vid := range e.Haplotype.VariantIds {
+			if idx, ok = prob.index[vid]; !ok || state[idx] != 1 {
+				continue
+			}
+			if e.Haplotype.Genotypes[j] == variants.Homozygous {
+				answer = append(answer, change{idx: idx, from: 1, to: 2})
+			} else {
+				answer = append(answer, change{idx: idx, from: 1, to: 0})
+			}
+		}
+	}
+	for _, c := range answer {
+		state[c.idx] = c.to
+	}
+	return answer
+}
+
+// likelihood returns the log likelihood of the observations given the tree, marginalized over
+// a uniform prior on the attachment of each cell. If attachment is not nil, the most probable
+// position of each cell is stored in attachment.
+func (prob *problem) likelihood(s chainState, attachment []int) float64 {
+	order := preorder(s.parent)
+	ch := prob.changes(s)
+	score := make([]float64, len(s.parent))
+	logNodes := math.Log(float64(len(s.parent)))
+	var answer, max, sum float64
+	var best int
+	for cell, obs := range prob.obs {
+		for _, pos := range order {
+			if s.parent[pos] == -1 {
+				score[pos] = prob.rootScore(obs)
+				continue
+			}
+			score[pos] = score[s.parent[pos]]
+			for _, c := range ch[pos] {
+				if obs[c.idx] != missing {
+					score[pos] += prob.lp[obs[c.idx]][c.to] - prob.lp[obs[c.idx]][c.from]
+				}
+			}
+		}
+		max, best = math.Inf(-1), -1
+		for pos := range score {
+			if score[pos] > max {
+				max, best = score[pos], pos
+			}
+		}
+		sum = 0
+		for pos := range score {
+			sum += math.Exp(score[pos] - max)
+		}
+		answer += max + math.Log(sum) - logNodes
+		if attachment != nil {
+			attachment[cell] = best
+		}
+	}
+	return answer
+}
+
+// rootScore returns the log likelihood of the observations of a cell with no mutations.
+func (prob *problem) rootScore(obs []int8) float64 {
+	var answer float64
+	for _, o := range obs {
+		if o != missing {
+			answer += prob.lp[o][0]
+		}
+	}
+	return answer
+}
+
+// tree converts a chain state to a Tree. Positions in the chain become nodes in the tree
+// with events reordered such that node i has event i and the root is the last node.
+func (prob *problem) tree(s chainState) Tree {
+	n := len(prob.events)
+	node := make([]int, len(s.label)) // node[pos] is the node index of each position
+	for pos, label := range s.label {
+		if label == -1 {
+			node[pos] = n
+		} else {
+			node[pos] = label
+		}
+	}
+	answer := Tree{
+		Events:     make([]Event, n+1),
+		Parent:     make([]int, n+1),
+		Attachment: make([]int, len(prob.obs)),
+		Support:    make([]float64, n+1),
+	}
+	copy(answer.Events, prob.events)
+	answer.Events[n] = Event{Type: Root, Variant: -1}
+	for pos := range s.parent {
+		if s.parent[pos] == -1 {
+			answer.Parent[node[pos]] = -1
+		} else {
+			answer.Parent[node[pos]] = node[s.parent[pos]]
+		}
+		answer.Support[node[pos]] = math.NaN()
+	}
+	answer.LogLikelihood = prob.likelihood(s, answer.Attachment)
+	for i := range answer.Attachment {
+		answer.Attachment[i] = node[answer.Attachment[i]]
+	}
+	return answer
+}
+
+// Bootstrap infers a tree from each of replicates resamplings of the cells with replacement.
+// The attachments of the returned trees refer to the resampled cells and should not be used.
+func Bootstrap(d *cells.Data, variantIds []int, lohEvents []loh.Haplotype, p Param, replicates int) []Tree {
+	prob := newProblem(d, variantIds, lohEvents, p)
+	answer := make([]Tree, replicates)
+	chain := p
+	chain.Workers = 1
+	parallel.For(replicates, p.Workers, func(rep int) {
+		r := rand.New(rand.NewSource(p.Seed + int64(rep)*int64(p.Chains+1)))
+		resampled := &problem{obs: make([][]int8, len(prob.obs)), events: prob.events, index: prob.index, lp: prob.lp}
+		for i := range resampled.obs {
+			resampled.obs[i] = prob.obs[r.Intn(len(prob.obs))]
+		}
+		answer[rep] = resampled.infer(chain, r.Int63())
+	})
+	return answer
+}
+
+// edge identifies an edge by the events at the parent and child.
+type edge struct {
+	parent, child int
+}
+
+// edges returns the set of edges in t.
+func (t Tree) edges() map[edge]bool {
+	answer := make(map[edge]bool, len(t.Parent))
+	for node, parent := range t.Parent {
+		if parent != -1 {
+			answer[edge{parent: t.eventKey(parent), child: t.eventKey(node)}] = true
+		}
+	}
+	return answer
+}
+
+// eventKey returns -1 for the root and the node index otherwise. Trees inferred from the same
+// variants and LOH events store events in the same order, so node indices are comparable.
+func (t Tree) eventKey(node int) int {
+	if t.Events[node].Type == Root {
+		return -1
+	}
+	return node
+}
+
+// SetSupport sets the support of each edge in t to the fraction of replicate trees
+// containing an edge between the same events.
+func (t *Tree) SetSupport(replicates []Tree) {
+	counts := make(map[edge]int)
+	for _, rep := range replicates {
+		if len(rep.Events) != len(t.Events) {
+			log.Panicf("replicate tree has %d nodes, expected %d", len(rep.Events), len(t.Events))
+		}
+		for e := range rep.edges() {
+			counts[e]++
+		}
+	}
+	for node, parent := range t.Parent {
+		if parent == -1 || len(replicates) == 0 {
+			t.Support[node] = math.NaN()
+			continue
+		}
+		t.Support[node] = float64(counts[edge{parent: t.eventKey(parent), child: t.eventKey(node)}]) / float64(len(replicates))
+	}
+}
+
+// LohEvents converts runs of homozygosity found with the loh package into candidate LOH events.
+// Haplotypes present in at least minCells cells are returned sorted by region, with contigs in
+// the order of c (see variants.Contigs), and haplotype.
+// Genotypes in each haplotype that are not WildType or Homozygous are removed.
+func LohEvents(counts map[variants.Region]*loh.RohHaplotypes, c *variants.Contigs, minCells int) []loh.Haplotype {
+	var regions []variants.Region
+	for region := range counts {
+		regions = append(regions, region)
+	}
+	interval.Sort(regions, c)
+
+	var answer []loh.Haplotype
+	var start int
+	for _, region := range regions {
+		start = len(answer)
+		for i, h := range counts[region].Haplotypes {
+			if counts[region].HaplotypeCounts[i] < minCells {
+				continue
+			}
+			var event loh.Haplotype
+			for j := range h.VariantIds {
+				if h.Genotypes[j] == variants.WildType || h.Genotypes[j] == variants.Homozygous {
+					event.VariantIds = append(event.VariantIds, h.VariantIds[j])
+					event.Genotypes = append(event.Genotypes, h.Genotypes[j])
+				}
+			}
+			if len(event.VariantIds) > 0 {
+				answer = append(answer, event)
+			}
+		}
+		sort.Slice(answer[start:], func(i, j int) bool {
+			return answer[start+i].String() < answer[start+j].String()
+		})
+	}
+	return answer
+}
+
+// Attach sets the attachment of each cell in t to its most probable node and sets the
+// log likelihood of the tree. Used for trees that were not inferred with Infer, such as
+// trees read from the output of other tools.
+func Attach(d *cells.Data, t *Tree, p Param) {
+	var variantIds []int
+	var lohEvents []loh.Haplotype
+	for _, e := range t.Events {
+		switch e.Type {
+		case Mutation:
+			variantIds = append(variantIds, e.Variant)
+		case Loh:
+			lohEvents = append(lohEvents, e.Haplotype)
+		}
+	}
+	prob := newProblem(d, variantIds, lohEvents, p)
+	s := chainState{parent: t.Parent, label: make([]int, len(t.Events))}
+	var mutations, lohs int
+	for node, e := range t.Events {
+		switch e.Type {
+		case Mutation:
+			s.label[node] = mutations
+			mutations++
+		case Loh:
+			s.label[node] = len(variantIds) + lohs
+			lohs++
+		default:
+			s.label[node] = -1
+		}
+	}
+	t.Attachment = make([]int, len(d.Cells))
+	t.LogLikelihood = prob.likelihood(s, t.Attachment)
+}
@@ -0,0 +1,108 @@
+package phylogeny
+
+import (
+	"fmt"
+	"github.com/ddsnellings/weaver/cells"
+	"github.com/ddsnellings/weaver/cells/cellstest"
+	"github.com/ddsnellings/weaver/loh"
+	"github.com/ddsnellings/weaver/variants"
+	"math/rand"
+	"testing"
+)
+
+// trueParent is a tree of 4 mutations and an LOH event (node 4) that reverts the
+// first mutation to wild-type. Node 5 is the root.
+var trueParent = []int{5, 0, 0, 2, 3, -1}
+
+var trueLoh = loh.Haplotype{VariantIds: []int{0}, Genotypes: []variants.Zygosity{variants.WildType}}
+
+// trueGenotypes are the expected number of copies of each variant in cells attached to each node.
+var trueGenotypes = [][]int{
+	{1, 0, 0, 0},
+	{1, 1, 0, 0},
+	{1, 0, 1, 0},
+	{1, 0, 1, 1},
+	{0, 0, 1, 1},
+	{0, 0, 0, 0},
+}
+
+// simulateTree returns cellsPerNode cells attached to each node of the true tree with allelic
+// dropout, false positives, and missing genotypes.
+func simulateTree(cellsPerNode int) *cells.Data {
+	r := rand.New(rand.NewSource(7))
+	var genotypes [][]int
+	var g int
+	for node := range trueGenotypes {
+		for i := 0; i < cellsPerNode; i++ {
+			cell := make([]int, len(trueGenotypes[node]))
+			for j := range cell {
+				if r.Float64() < 0.1 {
+					cell[j] = -1
+					continue
+				}
+				g = trueGenotypes[node][j]
+				switch {
+				case g == 1 && r.Float64() < 0.15:
+					g = 2 * r.Intn(2)
+				case g == 0 && r.Float64() < 0.01:
+					g = 1
+				}
+				cell[j] = g
+			}
+			genotypes = append(genotypes, cell)
+		}
+	}
+	d := cellstest.FromGenotypes(genotypes)
+	for i := range d.Cells {
+		d.Cells[i].Name = fmt.Sprintf("cell%d", i)
+	}
+	for j := range d.Variants {
+		d.Variants[j].Chr = "chr1"
+		d.Variants[j].Pos = 100 * j
+	}
+	return d
+}
+
+func TestInfer(t *testing.T) {
+	d := simulateTree(15)
+	p := DefaultParam
+	p.Iterations = 2000
+	tree := Infer(d, nil, []loh.Haplotype{trueLoh}, p)
+	for node := range trueParent {
+		if tree.Parent[node] != trueParent[node] {
+			t.Errorf("inferred tree %v does not match %v", tree.Parent, trueParent)
+			break
+		}
+	}
+	var correct int
+	for cellId, node := range tree.Attachment {
+		if node == cellId/15 {
+			correct++
+		}
+	}
+	if correct < 75 {
+		t.Errorf("only %d of 90 cells attached to the correct node", correct)
+	}
+
+	replicates := Bootstrap(d, nil, []loh.Haplotype{trueLoh}, p, 10)
+	tree.SetSupport(replicates)
+	for node, parent := range tree.Parent {
+		if parent != -1 && tree.Support[node] < 0.8 {
+			t.Errorf("expected high support for edge %d -> %d, found %f", parent, node, tree.Support[node])
+		}
+	}
+}
+
+func TestNewick(t *testing.T) {
+	d := simulateTree(1)
+	tree := Tree{
+		Events:     []Event{{Type: Mutation, Variant: 0}, {Type: Mutation, Variant: 1}, {Type: Loh, Haplotype: trueLoh}, {Type: Root}},
+		Parent:     []int{3, 0, 0, -1},
+		Attachment: []int{0, 1, 1, 2, 3, 3},
+		Support:    []float64{1, 0.5, 0.25, 0},
+	}
+	expected := "(('chr1:100::'[&cells=2,support=0.500],'LOH:chr1:0-1'[&cells=1,support=0.250])'chr1:0::'[&cells=1,support=1.000])'root'[&cells=2];"
+	if newick := tree.Newick(d); newick != expected {
+		t.Errorf("expected newick\n%s\nfound\n%s", expected, newick)
+	}
+}
@@ -0,0 +1,134 @@
+// Package reference provides random access to reference genome sequences in an
+// uncompressed fasta file indexed with samtools faidx.
+package reference
+
+import (
+	"github.com/ddsnellings/weaver/variants"
+	"github.com/vertgenlab/gonomics/dna"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Fasta reads sequences from an indexed fasta file. It is safe for concurrent use.
+type Fasta struct {
+	file  *os.File
+	index map[string]faiEntry // keyed by variants.CanonicalChr of the contig name
+}
+
+// faiEntry is a line of a fasta index.
+type faiEntry struct {
+	length    int
+	offset    int64
+	lineBases int
+	lineWidth int
+}
+
+// Open a fasta file with an index at file + ".fai". Contigs may be queried by any alias
+// of their name (see variants.CanonicalChr).
+func Open(file string) *Fasta {
+	if strings.HasSuffix(file, ".gz") {
+		log.Panicf("compressed fasta files are not supported, found '%s'", file)
+	}
+	answer := &Fasta{index: make(map[string]faiEntry)}
+	var err error
+	answer.file, err = os.Open(file)
+	exception.PanicOnErr(err)
+
+	var fields []string
+	var entry faiEntry
+	for _, line := range fileio.Read(file + ".fai") {
+		fields = strings.Split(line, "\t")
+		if len(fields) < 5 {
+			log.Panicf("expected 5 columns in fai file '%s.fai', found line: %s", file, line)
+		}
+		entry.length, err = strconv.Atoi(fields[1])
+		exception.PanicOnErr(err)
+		entry.offset, err = strconv.ParseInt(fields[2], 10, 64)
+		exception.PanicOnErr(err)
+		entry.lineBases, err = strconv.Atoi(fields[3])
+		exception.PanicOnErr(err)
+		entry.lineWidth, err = strconv.Atoi(fields[4])
+		exception.PanicOnErr(err)
+		answer.index[variants.CanonicalChr(fields[0])] = entry
+	}
+	return answer
+}
+
+// Seq returns the bases from start (base 0) to end (base 1) on chr. The returned slice is
+// truncated at the end of the contig. Panics if chr is not in the index.
+func (f *Fasta) Seq(chr string, start, end int) []dna.Base {
+	entry, found := f.index[variants.CanonicalChr(chr)]
+	if !found {
+		log.Panicf("contig '%s' was not found in the fasta index", chr)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end > entry.length {
+		end = entry.length
+	}
+	if start >= end {
+		return nil
+	}
+	first := entry.offset + int64(start/entry.lineBases*entry.lineWidth+start%entry.lineBases)
+	last := entry.offset + int64((end-1)/entry.lineBases*entry.lineWidth+(end-1)%entry.lineBases)
+	buf := make([]byte, last-first+1)
+	n, err := f.file.ReadAt(buf, first)
+	if err != nil && err != io.EOF {
+		log.Panic(err)
+	}
+	buf = buf[:n]
+	answer := make([]dna.Base, 0, end-start)
+	for _, b := range buf {
+		if b == '\n' || b == '\r' {
+			continue
+		}
+		answer = append(answer, dna.ByteToBase(b))
+	}
+	return answer
+}
+
+// Name returns the path of the fasta file.
+func (f *Fasta) Name() string {
+	return f.file.Name()
+}
+
+// Close the fasta file.
+func (f *Fasta) Close() {
+	exception.PanicOnErr(f.file.Close())
+}
+
+// Map is a Reference of sequences stored in memory, keyed by contig name.
+type Map map[string][]dna.Base
+
+// Seq returns the bases from start (base 0) to end (base 1) on chr. The returned slice is
+// truncated at the end of the contig.
+func (m Map) Seq(chr string, start, end int) []dna.Base {
+	seq, found := m[chr]
+	if !found {
+		for name := range m {
+			if variants.CanonicalChr(name) == variants.CanonicalChr(chr) {
+				seq, found = m[name], true
+				break
+			}
+		}
+	}
+	if !found {
+		log.Panicf("contig '%s' was not found in the reference", chr)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end > len(seq) {
+		end = len(seq)
+	}
+	if start >= end {
+		return nil
+	}
+	return seq[start:end]
+}
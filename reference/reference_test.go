@@ -0,0 +1,43 @@
+package reference
+
+import (
+	"github.com/vertgenlab/gonomics/dna"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFasta(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "weaver.ref.fa")
+	content := ">chr1 description\nACGTA\nCGTAC\nGG\n>2\nTTTT\n"
+	index := "chr1\t12\t18\t5\t6\n2\t4\t36\t5\t6\n"
+	if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file+".fai", []byte(index), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f := Open(file)
+	m := Map{"chr1": dna.StringToBases("ACGTACGTACGG"), "2": dna.StringToBases("TTTT")}
+	tests := []struct {
+		chr        string
+		start, end int
+		expected   string
+	}{
+		{"chr1", 0, 12, "ACGTACGTACGG"},
+		{"chr1", 3, 7, "TACG"},
+		{"chr1", 4, 5, "A"},
+		{"chr1", 10, 20, "GG"},
+		{"1", 9, 11, "CG"},
+		{"chr2", 1, 3, "TT"},
+		{"chr1", 12, 13, ""},
+	}
+	for _, test := range tests {
+		for _, found := range [][]dna.Base{f.Seq(test.chr, test.start, test.end), m.Seq(test.chr, test.start, test.end)} {
+			if dna.BasesToString(found) != test.expected {
+				t.Errorf("expected %s for %s:%d-%d, found %s", test.expected, test.chr, test.start, test.end, dna.BasesToString(found))
+			}
+		}
+	}
+	f.Close()
+}
@@ -0,0 +1,215 @@
+package tabix
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"github.com/ddsnellings/weaver/parallel"
+	"github.com/vertgenlab/gonomics/exception"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+// bgzfReader reads lines from a BGZF file starting at a virtual offset. A virtual offset is the
+// file offset of a BGZF block shifted left 16 bits plus the offset in the uncompressed block.
+type bgzfReader struct {
+	file      *os.File
+	name      string
+	blockAddr int64  // file offset of the current block
+	nextAddr  int64  // file offset of the next block
+	data      []byte // uncompressed data of the current block
+	pos       int    // offset of the next byte in data
+	line      bytes.Buffer
+}
+
+func newBgzfReader(file *os.File, name string) *bgzfReader {
+	return &bgzfReader{file: file, name: name}
+}
+
+// seek moves the reader to the virtual offset voff.
+func (r *bgzfReader) seek(voff uint64) {
+	addr := int64(voff >> 16)
+	if addr != r.blockAddr || r.data == nil {
+		r.nextAddr = addr
+		if !r.readBlock() {
+			log.Panicf("virtual offset %d is past the end of '%s'", voff, r.name)
+		}
+	}
+	r.pos = int(voff & 0xffff)
+	if r.pos > len(r.data) {
+		log.Panicf("virtual offset %d is outside block in '%s'", voff, r.name)
+	}
+}
+
+// virtualOffset returns the virtual offset of the next byte.
+func (r *bgzfReader) virtualOffset() uint64 {
+	if r.pos == len(r.data) && r.data != nil {
+		return uint64(r.nextAddr) << 16 // the next byte is at the start of the next block
+	}
+	return uint64(r.blockAddr)<<16 | uint64(r.pos)
+}
+
+// readBlock reads and decompresses the block at nextAddr. Returns false at the end of the file.
+func (r *bgzfReader) readBlock() bool {
+	block := readRawBlock(r.file, r.nextAddr, r.name)
+	if block == nil {
+		return false
+	}
+	r.data = inflateBlock(block, r.name)
+	r.blockAddr = r.nextAddr
+	r.nextAddr += int64(len(block))
+	r.pos = 0
+	return true
+}
+
+// readRawBlock returns the compressed BGZF block at file offset addr, or nil at the end of the file.
+func readRawBlock(file io.ReaderAt, addr int64, name string) []byte {
+	header := make([]byte, 18)
+	_, err := file.ReadAt(header, addr)
+	if err == io.EOF {
+		return nil
+	}
+	exception.PanicOnErr(err)
+	if header[0] != 31 || header[1] != 139 || header[3]&4 == 0 {
+		log.Panicf("'%s' is not a BGZF file", name)
+	}
+	xlen := int(binary.LittleEndian.Uint16(header[10:]))
+	extra := make([]byte, xlen)
+	_, err = file.ReadAt(extra, addr+12)
+	exception.PanicOnErr(err)
+	blockSize := -1
+	for i := 0; i+4 <= len(extra); i += 4 + int(binary.LittleEndian.Uint16(extra[i+2:])) {
+		if extra[i] == 'B' && extra[i+1] == 'C' {
+			blockSize = int(binary.LittleEndian.Uint16(extra[i+4:])) + 1
+		}
+	}
+	if blockSize == -1 {
+		log.Panicf("missing BGZF block size in '%s'", name)
+	}
+	block := make([]byte, blockSize)
+	_, err = file.ReadAt(block, addr)
+	exception.PanicOnErr(err)
+	return block
+}
+
+// inflateBlock returns the uncompressed data of a BGZF block.
+func inflateBlock(block []byte, name string) []byte {
+	xlen := int(binary.LittleEndian.Uint16(block[10:]))
+	fr := flate.NewReader(bytes.NewReader(block[12+xlen : len(block)-8]))
+	answer, err := ioutil.ReadAll(fr)
+	exception.PanicOnErr(err)
+	exception.PanicOnErr(fr.Close())
+	if len(answer) != int(binary.LittleEndian.Uint32(block[len(block)-4:])) {
+		log.Panicf("BGZF block in '%s' has the wrong uncompressed size", name)
+	}
+	return answer
+}
+
+// readLine returns the next line without the trailing newline. Returns false at the end of the file.
+func (r *bgzfReader) readLine() (string, bool) {
+	r.line.Reset()
+	for {
+		if r.pos == len(r.data) {
+			if !r.readBlock() {
+				if r.line.Len() > 0 {
+					return r.line.String(), true
+				}
+				return "", false
+			}
+			continue
+		}
+		if idx := bytes.IndexByte(r.data[r.pos:], '\n'); idx != -1 {
+			r.line.Write(r.data[r.pos : r.pos+idx])
+			r.pos += idx + 1
+			return r.line.String(), true
+		}
+		r.line.Write(r.data[r.pos:])
+		r.pos = len(r.data)
+	}
+}
+
+// IsBgzf returns true if file is a BGZF file, such as a vcf compressed with bgzip.
+func IsBgzf(file string) bool {
+	f, err := os.Open(file)
+	exception.PanicOnErr(err)
+	defer f.Close()
+	header := make([]byte, 16)
+	if _, err = io.ReadFull(f, header); err != nil {
+		return false
+	}
+	return header[0] == 31 && header[1] == 139 && header[3]&4 != 0 && header[12] == 'B' && header[13] == 'C'
+}
+
+// BlockReader reads the uncompressed data of a BGZF file in order. Blocks are decompressed
+// ahead of the reader by a pool of goroutines.
+type BlockReader struct {
+	file    *os.File
+	name    string
+	pending chan *pendingBlock // blocks in file order
+	done    chan struct{}
+	data    []byte
+}
+
+// pendingBlock is a block waiting to be decompressed.
+type pendingBlock struct {
+	raw  []byte
+	data chan []byte
+}
+
+// OpenBgzf returns a BlockReader for a BGZF file that decompresses blocks with the input number
+// of workers. 0 uses all available cores.
+func OpenBgzf(file string, workers int) *BlockReader {
+	f, err := os.Open(file)
+	exception.PanicOnErr(err)
+	workers = parallel.NumWorkers(workers)
+	r := &BlockReader{file: f, name: file, pending: make(chan *pendingBlock, 4*workers), done: make(chan struct{})}
+	jobs := make(chan *pendingBlock, workers)
+	go func() {
+		defer close(r.pending)
+		defer close(jobs)
+		var addr int64
+		for raw := readRawBlock(f, addr, file); raw != nil; raw = readRawBlock(f, addr, file) {
+			addr += int64(len(raw))
+			b := &pendingBlock{raw: raw, data: make(chan []byte, 1)}
+			select {
+			case r.pending <- b:
+				jobs <- b
+			case <-r.done:
+				return
+			}
+		}
+	}()
+	for w := 0; w < workers; w++ {
+		go func() {
+			for b := range jobs {
+				b.data <- inflateBlock(b.raw, file)
+			}
+		}()
+	}
+	return r
+}
+
+// Read reads the uncompressed data into p.
+func (r *BlockReader) Read(p []byte) (int, error) {
+	for len(r.data) == 0 {
+		b, ok := <-r.pending
+		if !ok {
+			return 0, io.EOF
+		}
+		r.data = <-b.data
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// Close stops decompressing blocks and closes the file.
+func (r *BlockReader) Close() error {
+	close(r.done)
+	for b := range r.pending { // wait for the blocks in progress so the file is no longer read
+		<-b.data
+	}
+	return r.file.Close()
+}
@@ -0,0 +1,286 @@
+// Package tabix reads the records of a bgzip-compressed vcf file that overlap a region using a
+// tabix (.tbi) or coordinate-sorted (.csi) index, without reading the rest of the file.
+package tabix
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"github.com/ddsnellings/weaver/variants"
+	"github.com/vertgenlab/gonomics/exception"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Index is a tabix or csi index of a bgzip-compressed file.
+type Index struct {
+	Names    []string // contig names in index order
+	MinShift int      // size of the smallest bin is 1 << MinShift
+	Depth    int      // number of levels of bins below the root
+	refs     []refIndex
+}
+
+// refIndex stores the bins of a single contig.
+type refIndex struct {
+	bins   map[uint32][]chunk
+	linear []uint64 // smallest virtual offset of a record in each 1 << MinShift window. tbi only
+}
+
+// chunk is a range of virtual offsets in the compressed file.
+type chunk struct {
+	beg, end uint64
+}
+
+// ReadIndex reads a .tbi or .csi index file.
+func ReadIndex(file string) *Index {
+	f, err := os.Open(file)
+	exception.PanicOnErr(err)
+	gz, err := gzip.NewReader(f)
+	exception.PanicOnErr(err)
+	b, err := ioutil.ReadAll(gz)
+	exception.PanicOnErr(err)
+	exception.PanicOnErr(gz.Close())
+	exception.PanicOnErr(f.Close())
+
+	r := bytes.NewReader(b)
+	magic := make([]byte, 4)
+	_, err = io.ReadFull(r, magic)
+	exception.PanicOnErr(err)
+	answer := new(Index)
+	switch string(magic) {
+	case "TBI\x01":
+		answer.MinShift, answer.Depth = 14, 5
+		numRefs := readInt32(r)
+		answer.Names = readTabixHeader(r)
+		if len(answer.Names) != numRefs {
+			log.Panicf("found %d names for %d contigs in '%s'", len(answer.Names), numRefs, file)
+		}
+		answer.refs = make([]refIndex, numRefs)
+		for i := range answer.refs {
+			answer.refs[i] = readRefIndex(r, false)
+			numIntervals := readInt32(r)
+			answer.refs[i].linear = make([]uint64, numIntervals)
+			exception.PanicOnErr(binary.Read(r, binary.LittleEndian, answer.refs[i].linear))
+		}
+	case "CSI\x01":
+		answer.MinShift = readInt32(r)
+		answer.Depth = readInt32(r)
+		aux := make([]byte, readInt32(r))
+		_, err = io.ReadFull(r, aux)
+		exception.PanicOnErr(err)
+		if len(aux) >= 28 {
+			answer.Names = readTabixHeader(bytes.NewReader(aux))
+		}
+		answer.refs = make([]refIndex, readInt32(r))
+		for i := range answer.refs {
+			answer.refs[i] = readRefIndex(r, true)
+		}
+		if len(answer.Names) != len(answer.refs) {
+			log.Panicf("csi index '%s' does not store contig names", file)
+		}
+	default:
+		log.Panicf("'%s' is not a tbi or csi index", file)
+	}
+	return answer
+}
+
+// readTabixHeader reads the tabix column definitions and returns the contig names.
+func readTabixHeader(r io.Reader) []string {
+	var cols [6]int32 // format, col_seq, col_beg, col_end, meta, skip
+	exception.PanicOnErr(binary.Read(r, binary.LittleEndian, &cols))
+	names := make([]byte, readInt32(r))
+	_, err := io.ReadFull(r, names)
+	exception.PanicOnErr(err)
+	return strings.Split(strings.TrimRight(string(names), "\x00"), "\x00")
+}
+
+// readRefIndex reads the bins of a contig. csi bins store a linear offset before the chunks.
+func readRefIndex(r io.Reader, csi bool) refIndex {
+	answer := refIndex{bins: make(map[uint32][]chunk)}
+	numBins := readInt32(r)
+	var bin uint32
+	var loffset uint64
+	for i := 0; i < numBins; i++ {
+		exception.PanicOnErr(binary.Read(r, binary.LittleEndian, &bin))
+		if csi {
+			exception.PanicOnErr(binary.Read(r, binary.LittleEndian, &loffset))
+		}
+		offsets := make([]uint64, 2*readInt32(r))
+		exception.PanicOnErr(binary.Read(r, binary.LittleEndian, offsets))
+		chunks := make([]chunk, len(offsets)/2)
+		for j := range chunks {
+			chunks[j] = chunk{beg: offsets[2*j], end: offsets[2*j+1]}
+		}
+		answer.bins[bin] = chunks
+	}
+	return answer
+}
+
+func readInt32(r io.Reader) int {
+	var answer int32
+	exception.PanicOnErr(binary.Read(r, binary.LittleEndian, &answer))
+	return int(answer)
+}
+
+// refId returns the index of chr in the index, matching contig name aliases (see
+// variants.CanonicalChr). Returns -1 if chr is not in the index.
+func (idx *Index) refId(chr string) int {
+	for i := range idx.Names {
+		if idx.Names[i] == chr {
+			return i
+		}
+	}
+	for i := range idx.Names {
+		if variants.CanonicalChr(idx.Names[i]) == variants.CanonicalChr(chr) {
+			return i
+		}
+	}
+	return -1
+}
+
+// chunks returns the sorted and merged chunks that may contain records overlapping region.
+func (idx *Index) chunks(region variants.Region) []chunk {
+	id := idx.refId(region.Chr)
+	if id == -1 {
+		return nil
+	}
+	ref := idx.refs[id]
+	var minOffset uint64
+	if len(ref.linear) > 0 {
+		window := region.Start >> idx.MinShift
+		if window >= len(ref.linear) {
+			window = len(ref.linear) - 1
+		}
+		minOffset = ref.linear[window]
+	}
+	var answer []chunk
+	for _, bin := range regionBins(region.Start, region.End, idx.MinShift, idx.Depth) {
+		for _, c := range ref.bins[bin] {
+			if c.end > minOffset {
+				answer = append(answer, c)
+			}
+		}
+	}
+	sort.Slice(answer, func(i, j int) bool { return answer[i].beg < answer[j].beg })
+	var j int
+	for i := range answer {
+		if j > 0 && answer[i].beg <= answer[j-1].end {
+			if answer[i].end > answer[j-1].end {
+				answer[j-1].end = answer[i].end
+			}
+			continue
+		}
+		answer[j] = answer[i]
+		j++
+	}
+	return answer[:j]
+}
+
+// regionBins returns the bins that may contain records overlapping [start, end) as in the
+// reg2bins function of the SAM specification.
+func regionBins(start, end int, minShift, depth int) []uint32 {
+	if start < 0 {
+		start = 0
+	}
+	if maxEnd := 1 << (minShift + depth*3); end > maxEnd {
+		end = maxEnd
+	}
+	if end <= start {
+		end = start + 1
+	}
+	end--
+	var answer []uint32
+	shift := minShift + depth*3
+	var first int
+	for level := 0; level <= depth; level++ {
+		for b := first + start>>shift; b <= first+end>>shift; b++ {
+			answer = append(answer, uint32(b))
+		}
+		shift -= 3
+		first += 1 << (level * 3)
+	}
+	return answer
+}
+
+// Reader reads the records of a bgzip-compressed vcf file that overlap regions.
+type Reader struct {
+	Index  *Index
+	file   *os.File
+	name   string
+	bgzf   *bgzfReader
+	header []string
+}
+
+// Open opens a bgzip-compressed vcf file with the index file.tbi or file.csi.
+func Open(file string) *Reader {
+	indexFile := file + ".tbi"
+	if _, err := os.Stat(indexFile); os.IsNotExist(err) {
+		indexFile = file + ".csi"
+	}
+	if _, err := os.Stat(indexFile); os.IsNotExist(err) {
+		log.Panicf("no .tbi or .csi index found for '%s'", file)
+	}
+	f, err := os.Open(file)
+	exception.PanicOnErr(err)
+	return &Reader{Index: ReadIndex(indexFile), file: f, name: file, bgzf: newBgzfReader(f, file)}
+}
+
+// Close closes the underlying file.
+func (r *Reader) Close() {
+	exception.PanicOnErr(r.file.Close())
+}
+
+// Header returns the header lines at the start of the file, which begin with '#'.
+func (r *Reader) Header() []string {
+	if r.header != nil {
+		return r.header
+	}
+	r.bgzf.seek(0)
+	for line, ok := r.bgzf.readLine(); ok && strings.HasPrefix(line, "#"); line, ok = r.bgzf.readLine() {
+		r.header = append(r.header, line)
+	}
+	return r.header
+}
+
+// Query calls f with the line of each record overlapping region in file order, reading the
+// records one at a time. A record covers the bases of its REF allele. The Reader must not be
+// used by f.
+func (r *Reader) Query(region variants.Region, f func(line string)) {
+	var fields []string
+	var start, end int
+	var err error
+	for _, c := range r.Index.chunks(region) {
+		r.bgzf.seek(c.beg)
+		for r.bgzf.virtualOffset() < c.end {
+			line, ok := r.bgzf.readLine()
+			if !ok {
+				break
+			}
+			if strings.HasPrefix(line, "#") {
+				continue
+			}
+			fields = strings.SplitN(line, "\t", 5)
+			if len(fields) < 4 {
+				log.Panicf("expected at least 4 columns in '%s', found line: %s", r.name, line)
+			}
+			start, err = strconv.Atoi(fields[1])
+			exception.PanicOnErr(err)
+			start--
+			end = start + len(fields[3])
+			if variants.CanonicalChr(fields[0]) != variants.CanonicalChr(region.Chr) {
+				continue
+			}
+			if start >= region.End {
+				return // records are sorted by position
+			}
+			if end > region.Start {
+				f(line)
+			}
+		}
+	}
+}
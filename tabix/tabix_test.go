@@ -0,0 +1,196 @@
+package tabix
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/ddsnellings/weaver/variants"
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var testHeader = []string{"##fileformat=VCFv4.2", "#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\tcell1"}
+
+// writeTestVcf writes a sorted, bgzip-compressed vcf with records every 50 bases on chr1 and chr7
+// and builds its tabix index. Returns the record lines.
+func writeTestVcf(t *testing.T, file string) []string {
+	var records []string
+	for _, chr := range []string{"chr1", "chr7"} {
+		for pos := 1; pos <= 200000; pos += 50 {
+			ref := "A"
+			if pos%1000 == 1 {
+				ref = "ACGTACGTAC" // deletion spanning 10 bases
+			}
+			records = append(records, fmt.Sprintf("%s\t%d\t.\t%s\tG\t50\tPASS\t.\tGT:AD:DP:GQ:PL\t0/1:5,5:10:99:100,0,100", chr, pos, ref))
+		}
+	}
+	w := NewWriter(file)
+	for _, line := range append(append([]string{}, testHeader...), records...) {
+		_, err := w.Write([]byte(line + "\n"))
+		exception.PanicOnErr(err)
+	}
+	exception.PanicOnErr(w.Close())
+	BuildIndex(file)
+	return records
+}
+
+// expectedRecords returns the records overlapping [start, end) on chr by scanning all records.
+func expectedRecords(records []string, chr string, start, end int) []string {
+	var answer []string
+	var recordChr, id, ref string
+	var pos int
+	for _, line := range records {
+		_, err := fmt.Sscanf(line, "%s\t%d\t%s\t%s", &recordChr, &pos, &id, &ref)
+		exception.PanicOnErr(err)
+		if recordChr == chr && pos-1 < end && pos-1+len(ref) > start {
+			answer = append(answer, line)
+		}
+	}
+	return answer
+}
+
+// query returns the lines of the records overlapping region.
+func query(r *Reader, region variants.Region) []string {
+	var answer []string
+	r.Query(region, func(line string) {
+		answer = append(answer, line)
+	})
+	return answer
+}
+
+func TestQuery(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "weaver.tabix.vcf.gz")
+	records := writeTestVcf(t, file)
+
+	r := Open(file)
+	defer r.Close()
+	if len(r.Index.Names) != 2 || r.Index.Names[0] != "chr1" || r.Index.Names[1] != "chr7" {
+		t.Errorf("expected contigs [chr1 chr7], found %v", r.Index.Names)
+	}
+	header := r.Header()
+	if len(header) != len(testHeader) || header[1] != testHeader[1] {
+		t.Errorf("expected header %v, found %v", testHeader, header)
+	}
+
+	tests := []variants.Region{
+		{Chr: "chr1", Start: 0, End: 100},
+		{Chr: "chr1", Start: 1005, End: 1010},    // inside the deletion at 1001
+		{Chr: "chr1", Start: 16300, End: 16500},  // crosses a linear index window
+		{Chr: "chr1", Start: 60000, End: 140000}, // crosses block boundaries
+		{Chr: "7", Start: 199900, End: 300000},   // contig alias and end past the last record
+		{Chr: "chr7", Start: 51, End: 99},        // between records
+		{Chr: "chr2", Start: 0, End: 1000},       // contig not in the file
+	}
+	for _, region := range tests {
+		expected := expectedRecords(records, variants.CanonicalChr(region.Chr), region.Start, region.End)
+		if region.Chr == "7" {
+			expected = expectedRecords(records, "chr7", region.Start, region.End)
+		}
+		found := query(r, region)
+		if len(found) != len(expected) {
+			t.Errorf("%v: expected %d records, found %d", region, len(expected), len(found))
+			continue
+		}
+		for i := range found {
+			if found[i] != expected[i] {
+				t.Errorf("%v: expected record %s, found %s", region, expected[i], found[i])
+			}
+		}
+	}
+}
+
+func TestCsiIndex(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "weaver.tabix.csi.vcf.gz")
+	records := writeTestVcf(t, file)
+	writeCsi(ReadIndex(file+".tbi"), file+".csi")
+	exception.PanicOnErr(os.Remove(file + ".tbi"))
+
+	r := Open(file)
+	defer r.Close()
+	if r.Index.MinShift != 14 || r.Index.Depth != 5 || len(r.Index.Names) != 2 {
+		t.Errorf("csi index not read correctly. found min shift %d, depth %d, contigs %v", r.Index.MinShift, r.Index.Depth, r.Index.Names)
+	}
+	region := variants.Region{Chr: "chr7", Start: 10000, End: 90000}
+	expected := expectedRecords(records, "chr7", region.Start, region.End)
+	if found := query(r, region); len(found) != len(expected) || found[0] != expected[0] {
+		t.Errorf("%v: expected %d records, found %d", region, len(expected), len(found))
+	}
+}
+
+// TestHtslibIndex queries files compressed and indexed by htslib's bgzip and tabix, which are
+// generated from testdata/htslib.vcf by testdata/htslib.sh.
+func TestHtslibIndex(t *testing.T) {
+	var records []string
+	for _, line := range fileio.Read("testdata/htslib.vcf") {
+		if !strings.HasPrefix(line, "#") {
+			records = append(records, line)
+		}
+	}
+	tests := []variants.Region{
+		{Chr: "chr1", Start: 0, End: 100},
+		{Chr: "chr1", Start: 16300, End: 16500},  // crosses a linear index window
+		{Chr: "chr1", Start: 60000, End: 340000}, // crosses block boundaries
+		{Chr: "chr7", Start: 399000, End: 500000},
+		{Chr: "chr2", Start: 0, End: 1000},
+	}
+	for _, file := range []string{"testdata/htslib.vcf.gz", "testdata/htslib.csi.vcf.gz"} {
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			t.Skipf("%s not found. run testdata/htslib.sh with htslib installed to generate it", file)
+		}
+		r := Open(file)
+		if len(r.Index.Names) != 2 || r.Index.Names[0] != "chr1" || r.Index.Names[1] != "chr7" {
+			t.Errorf("%s: expected contigs [chr1 chr7], found %v", file, r.Index.Names)
+		}
+		for _, region := range tests {
+			expected := expectedRecords(records, region.Chr, region.Start, region.End)
+			if found := query(r, region); strings.Join(found, "\n") != strings.Join(expected, "\n") {
+				t.Errorf("%s %v: expected %d records, found %d", file, region, len(expected), len(found))
+			}
+		}
+		r.Close()
+	}
+}
+
+// writeCsi writes idx as a csi index with the same bins as idx and the tabix header in the
+// auxiliary data.
+func writeCsi(idx *Index, file string) {
+	var aux, b bytes.Buffer
+	write := func(buf *bytes.Buffer, data interface{}) {
+		exception.PanicOnErr(binary.Write(buf, binary.LittleEndian, data))
+	}
+	write(&aux, [6]int32{2, 1, 2, 0, '#', 0})
+	var names []byte
+	for _, name := range idx.Names {
+		names = append(append(names, name...), 0)
+	}
+	write(&aux, int32(len(names)))
+	aux.Write(names)
+
+	b.WriteString("CSI\x01")
+	write(&b, [3]int32{int32(idx.MinShift), int32(idx.Depth), int32(aux.Len())})
+	b.Write(aux.Bytes())
+	write(&b, int32(len(idx.refs)))
+	for _, ref := range idx.refs {
+		var bins []uint32
+		for bin := range ref.bins {
+			bins = append(bins, bin)
+		}
+		sort.Slice(bins, func(i, j int) bool { return bins[i] < bins[j] })
+		write(&b, int32(len(bins)))
+		for _, bin := range bins {
+			write(&b, bin)
+			write(&b, ref.bins[bin][0].beg)
+			write(&b, int32(len(ref.bins[bin])))
+			write(&b, ref.bins[bin])
+		}
+	}
+	w := NewWriter(file)
+	_, err := w.Write(b.Bytes())
+	exception.PanicOnErr(err)
+	exception.PanicOnErr(w.Close())
+}
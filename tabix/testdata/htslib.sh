@@ -0,0 +1,9 @@
+#!/bin/sh
+# Compresses and indexes htslib.vcf with htslib's bgzip and tabix to produce the fixtures read by
+# TestHtslibIndex: htslib.vcf.gz with a .tbi index and htslib.csi.vcf.gz with a .csi index.
+set -e
+cd "$(dirname "$0")"
+bgzip -c htslib.vcf > htslib.vcf.gz
+tabix -f -p vcf htslib.vcf.gz
+bgzip -c htslib.vcf > htslib.csi.vcf.gz
+tabix -f -C -p vcf htslib.csi.vcf.gz
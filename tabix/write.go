@@ -0,0 +1,205 @@
+package tabix
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"github.com/vertgenlab/gonomics/exception"
+	"hash/crc32"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxBlockData is the most uncompressed bytes stored in a BGZF block, as in htslib.
+const maxBlockData = 0xff00
+
+// bgzfEOF is the empty block that marks the end of a BGZF file.
+var bgzfEOF = []byte{31, 139, 8, 4, 0, 0, 0, 0, 0, 255, 6, 0, 66, 67, 2, 0, 27, 0, 3, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+
+// Writer writes a bgzip-compressed (BGZF) file that can be indexed with BuildIndex.
+type Writer struct {
+	file *os.File
+	buf  bytes.Buffer
+	out  bytes.Buffer
+}
+
+// NewWriter creates file and returns a Writer for it.
+func NewWriter(file string) *Writer {
+	f, err := os.Create(file)
+	exception.PanicOnErr(err)
+	return &Writer{file: f}
+}
+
+// Write buffers p and writes each full block to the file.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for w.buf.Len() >= maxBlockData {
+		if err := w.writeBlock(w.buf.Next(maxBlockData)); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Close writes the remaining data and the end of file marker and closes the file.
+func (w *Writer) Close() error {
+	if w.buf.Len() > 0 {
+		if err := w.writeBlock(w.buf.Next(w.buf.Len())); err != nil {
+			return err
+		}
+	}
+	if _, err := w.file.Write(bgzfEOF); err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+// writeBlock compresses data into a single BGZF block.
+func (w *Writer) writeBlock(data []byte) error {
+	w.out.Reset()
+	w.out.Write([]byte{31, 139, 8, 4, 0, 0, 0, 0, 0, 255, 6, 0, 66, 67, 2, 0, 0, 0}) // block size is set below
+	fw, err := flate.NewWriter(&w.out, flate.DefaultCompression)
+	if err != nil {
+		return err
+	}
+	if _, err = fw.Write(data); err != nil {
+		return err
+	}
+	if err = fw.Close(); err != nil {
+		return err
+	}
+	var tail [8]byte
+	binary.LittleEndian.PutUint32(tail[:4], crc32.ChecksumIEEE(data))
+	binary.LittleEndian.PutUint32(tail[4:], uint32(len(data)))
+	w.out.Write(tail[:])
+	block := w.out.Bytes()
+	binary.LittleEndian.PutUint16(block[16:], uint16(len(block)-1))
+	_, err = w.file.Write(block)
+	return err
+}
+
+// tbiMinShift and tbiDepth are the bin sizes of a tabix index.
+const (
+	tbiMinShift = 14
+	tbiDepth    = 5
+)
+
+// BuildIndex writes the tabix index file.tbi of a bgzip-compressed vcf file sorted by position.
+func BuildIndex(file string) {
+	f, err := os.Open(file)
+	exception.PanicOnErr(err)
+	r := newBgzfReader(f, file)
+	var names []string
+	var refs []refIndex
+	var fields []string
+	var start, end, window int
+	var beg, endOffset uint64
+	var bin uint32
+	var ref *refIndex
+	r.seek(0)
+	for beg = r.virtualOffset(); ; beg = r.virtualOffset() {
+		line, ok := r.readLine()
+		if !ok {
+			break
+		}
+		endOffset = r.virtualOffset()
+		if strings.HasPrefix(line, "#") || line == "" {
+			continue
+		}
+		fields = strings.SplitN(line, "\t", 5)
+		if len(fields) < 4 {
+			log.Panicf("expected at least 4 columns in '%s', found line: %s", file, line)
+		}
+		if len(names) == 0 || names[len(names)-1] != fields[0] {
+			for i := range names {
+				if names[i] == fields[0] {
+					log.Panicf("'%s' is not sorted. %s is not contiguous", file, fields[0])
+				}
+			}
+			names = append(names, fields[0])
+			refs = append(refs, refIndex{bins: make(map[uint32][]chunk)})
+		}
+		ref = &refs[len(refs)-1]
+		start, err = strconv.Atoi(fields[1])
+		exception.PanicOnErr(err)
+		start--
+		end = start + len(fields[3])
+		if end <= start {
+			end = start + 1
+		}
+
+		bin = regionBin(start, end)
+		if chunks := ref.bins[bin]; len(chunks) > 0 && chunks[len(chunks)-1].end == beg {
+			chunks[len(chunks)-1].end = endOffset
+		} else {
+			ref.bins[bin] = append(chunks, chunk{beg: beg, end: endOffset})
+		}
+		for window = start >> tbiMinShift; window <= (end-1)>>tbiMinShift; window++ {
+			for len(ref.linear) <= window {
+				ref.linear = append(ref.linear, 0)
+			}
+			if ref.linear[window] == 0 {
+				ref.linear[window] = beg
+			}
+		}
+	}
+	exception.PanicOnErr(f.Close())
+	writeTbi(file+".tbi", names, refs)
+}
+
+// regionBin returns the smallest tabix bin containing [start, end) as in the reg2bin function
+// of the SAM specification.
+func regionBin(start, end int) uint32 {
+	end--
+	shift := tbiMinShift
+	first := ((1 << (tbiDepth * 3)) - 1) / 7
+	for level := tbiDepth; level > 0; level-- {
+		if start>>shift == end>>shift {
+			return uint32(first + start>>shift)
+		}
+		shift += 3
+		first -= 1 << ((level - 1) * 3)
+	}
+	return 0
+}
+
+// writeTbi writes a tabix index for a vcf file.
+func writeTbi(file string, names []string, refs []refIndex) {
+	var b bytes.Buffer
+	write := func(data interface{}) {
+		exception.PanicOnErr(binary.Write(&b, binary.LittleEndian, data))
+	}
+	b.WriteString("TBI\x01")
+	write(int32(len(names)))
+	write([6]int32{2, 1, 2, 0, '#', 0}) // vcf format, columns, meta character, and lines to skip
+	nameBytes := strings.Join(names, "\x00") + "\x00"
+	write(int32(len(nameBytes)))
+	b.WriteString(nameBytes)
+	for _, ref := range refs {
+		bins := make([]uint32, 0, len(ref.bins))
+		for bin := range ref.bins {
+			bins = append(bins, bin)
+		}
+		sort.Slice(bins, func(i, j int) bool { return bins[i] < bins[j] })
+		write(int32(len(bins)))
+		for _, bin := range bins {
+			write(bin)
+			write(int32(len(ref.bins[bin])))
+			write(ref.bins[bin])
+		}
+		for i := 1; i < len(ref.linear); i++ { // empty windows start at the previous record
+			if ref.linear[i] == 0 {
+				ref.linear[i] = ref.linear[i-1]
+			}
+		}
+		write(int32(len(ref.linear)))
+		write(ref.linear)
+	}
+	w := NewWriter(file)
+	_, err := w.Write(b.Bytes())
+	exception.PanicOnErr(err)
+	exception.PanicOnErr(w.Close())
+}
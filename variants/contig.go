@@ -0,0 +1,274 @@
+package variants
+
+import (
+	"github.com/vertgenlab/gonomics/exception"
+	"github.com/vertgenlab/gonomics/fileio"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Contigs stores the order and length of the contigs in a reference genome. Contig names
+// are matched through CanonicalChr so that UCSC (chr1, chrM) and Ensembl (1, MT) names
+// refer to the same contig. A nil *Contigs is valid and orders contigs with CompareChr.
+type Contigs struct {
+	Names   []string
+	Lengths []int          // 0 if unknown
+	index   map[string]int // canonical name -> position in Names
+}
+
+// NewContigs returns a registry with contigs in the input order. lengths may be nil.
+func NewContigs(names []string, lengths []int) *Contigs {
+	answer := &Contigs{Names: names, Lengths: lengths, index: make(map[string]int, len(names))}
+	if answer.Lengths == nil {
+		answer.Lengths = make([]int, len(names))
+	}
+	if len(answer.Lengths) != len(names) {
+		log.Panicf("found %d contig names but %d lengths", len(names), len(answer.Lengths))
+	}
+	for i := range names {
+		answer.index[CanonicalChr(names[i])] = i
+	}
+	return answer
+}
+
+// ContigsFromHeader returns the contigs in the ##contig lines of a vcf header in the order
+// they appear, or nil if there are no ##contig lines.
+func ContigsFromHeader(header []string) *Contigs {
+	var names []string
+	var lengths []int
+	var id string
+	var length int
+	for _, line := range header {
+		if !strings.HasPrefix(line, "##contig=<") {
+			continue
+		}
+		id, length = "", 0
+		for _, field := range strings.Split(strings.TrimSuffix(strings.TrimPrefix(line, "##contig=<"), ">"), ",") {
+			switch {
+			case strings.HasPrefix(field, "ID="):
+				id = strings.TrimPrefix(field, "ID=")
+			case strings.HasPrefix(field, "length="):
+				length, _ = strconv.Atoi(strings.TrimPrefix(field, "length="))
+			}
+		}
+		if id == "" {
+			log.Panicf("could not find contig ID in vcf header line: %s", line)
+		}
+		names = append(names, id)
+		lengths = append(lengths, length)
+	}
+	if names == nil {
+		return nil
+	}
+	return NewContigs(names, lengths)
+}
+
+// ReadFai reads the contigs from a fasta index (.fai) file.
+func ReadFai(file string) *Contigs {
+	var names []string
+	var lengths []int
+	var fields []string
+	var length int
+	var err error
+	for _, line := range fileio.Read(file) {
+		fields = strings.Split(line, "\t")
+		if len(fields) < 2 {
+			log.Panicf("expected at least 2 columns in fai file '%s', found line: %s", file, line)
+		}
+		length, err = strconv.Atoi(fields[1])
+		exception.PanicOnErr(err)
+		names = append(names, fields[0])
+		lengths = append(lengths, length)
+	}
+	return NewContigs(names, lengths)
+}
+
+// ReadDict reads the contigs from the @SQ lines of a sequence dictionary (.dict) file.
+func ReadDict(file string) *Contigs {
+	var names []string
+	var lengths []int
+	var name string
+	var length int
+	var err error
+	for _, line := range fileio.Read(file) {
+		if !strings.HasPrefix(line, "@SQ") {
+			continue
+		}
+		name, length = "", 0
+		for _, field := range strings.Split(line, "\t")[1:] {
+			switch {
+			case strings.HasPrefix(field, "SN:"):
+				name = strings.TrimPrefix(field, "SN:")
+			case strings.HasPrefix(field, "LN:"):
+				length, err = strconv.Atoi(strings.TrimPrefix(field, "LN:"))
+				exception.PanicOnErr(err)
+			}
+		}
+		if name == "" {
+			log.Panicf("could not find SN field in dict file '%s', line: %s", file, line)
+		}
+		names = append(names, name)
+		lengths = append(lengths, length)
+	}
+	return NewContigs(names, lengths)
+}
+
+// Index returns the position of chr in the registry, or -1 and false if chr is not present.
+func (c *Contigs) Index(chr string) (int, bool) {
+	if c == nil {
+		return -1, false
+	}
+	idx, found := c.index[CanonicalChr(chr)]
+	if !found {
+		return -1, false
+	}
+	return idx, true
+}
+
+// Name returns the name used in the registry for chr (e.g. 1 for chr1 in an Ensembl reference),
+// or chr if it is not present.
+func (c *Contigs) Name(chr string) string {
+	if idx, found := c.Index(chr); found {
+		return c.Names[idx]
+	}
+	return chr
+}
+
+// Compare returns a negative number if contig a is before b, a positive number if b is
+// before a, and 0 if they are the same contig. Contigs in the registry are in registry
+// order and are before all other contigs, which are ordered with CompareChr.
+func (c *Contigs) Compare(a, b string) int {
+	idxA, foundA := c.Index(a)
+	idxB, foundB := c.Index(b)
+	switch {
+	case foundA && foundB:
+		return idxA - idxB
+	case foundA:
+		return -1
+	case foundB:
+		return 1
+	default:
+		return CompareChr(a, b)
+	}
+}
+
+// SortByCoord sorts a slice of variants by genomic coordinate with contigs in registry order.
+// Ties by position are broken by alt allele length, then lexicographically by alt sequence.
+func (c *Contigs) SortByCoord(v []Variant) {
+	sort.Slice(v, func(i, j int) bool {
+		return c.lessVariants(v[i], v[j])
+	})
+}
+
+// SortIdsByCoord sorts an input []VariantIds (ints) by genomic coordinate with contigs in
+// registry order. Does not alter the input []Variant ordering.
+func (c *Contigs) SortIdsByCoord(ids []int, v []Variant) {
+	sort.Slice(ids, func(i, j int) bool {
+		return c.lessVariants(v[ids[i]], v[ids[j]])
+	})
+}
+
+// SortRegions sorts regions by genomic coordinate with contigs in registry order, then by start and end position.
+func (c *Contigs) SortRegions(r []Region) {
+	sort.Slice(r, func(i, j int) bool {
+		if cmp := c.Compare(r[i].Chr, r[j].Chr); cmp != 0 {
+			return cmp < 0
+		}
+		if r[i].Start != r[j].Start {
+			return r[i].Start < r[j].Start
+		}
+		return r[i].End < r[j].End
+	})
+}
+
+// CanonicalChr returns the UCSC-style name of the primary chromosomes so that names from
+// different references can be compared (e.g. 1 -> chr1, MT -> chrM). Other contig names are
+// returned unchanged.
+func CanonicalChr(chr string) string {
+	name := chr
+	if len(name) > 3 && strings.EqualFold(name[:3], "chr") {
+		name = name[3:]
+	}
+	switch strings.ToUpper(name) {
+	case "M", "MT":
+		return "chrM"
+	case "X", "Y":
+		return "chr" + strings.ToUpper(name)
+	}
+	if n, err := strconv.Atoi(name); err == nil && n > 0 && strconv.Itoa(n) == name {
+		return "chr" + name
+	}
+	return chr
+}
+
+// CompareChr compares contig names in natural order: numbered chromosomes in numeric order,
+// then X, Y, and M, then all other contigs with embedded numbers compared numerically
+// (e.g. chr2 is before chr10). Names that are aliases (see CanonicalChr) compare as equal.
+func CompareChr(a, b string) int {
+	a, b = CanonicalChr(a), CanonicalChr(b)
+	if a == b {
+		return 0
+	}
+	rankA, rankB := chrRank(a), chrRank(b)
+	if rankA != rankB {
+		return rankA - rankB
+	}
+	return compareNatural(a, b)
+}
+
+// chrRank returns the rank of canonical contig names: numbered chromosomes first in numeric
+// order, then X, Y, M, and all others.
+func chrRank(chr string) int {
+	if !strings.HasPrefix(chr, "chr") {
+		return 1 << 20
+	}
+	switch chr {
+	case "chrX":
+		return 1<<20 - 3
+	case "chrY":
+		return 1<<20 - 2
+	case "chrM":
+		return 1<<20 - 1
+	}
+	if n, err := strconv.Atoi(chr[3:]); err == nil && n < 1<<20-3 {
+		return n
+	}
+	return 1 << 20
+}
+
+// compareNatural compares strings with runs of digits compared by numeric value.
+func compareNatural(a, b string) int {
+	var i, j int
+	for i < len(a) && j < len(b) {
+		if isDigit(a[i]) && isDigit(b[j]) {
+			startA, startB := i, j
+			for i < len(a) && isDigit(a[i]) {
+				i++
+			}
+			for j < len(b) && isDigit(b[j]) {
+				j++
+			}
+			numA := strings.TrimLeft(a[startA:i], "0")
+			numB := strings.TrimLeft(b[startB:j], "0")
+			if len(numA) != len(numB) {
+				return len(numA) - len(numB)
+			}
+			if numA != numB {
+				return strings.Compare(numA, numB)
+			}
+			continue
+		}
+		if a[i] != b[j] {
+			return int(a[i]) - int(b[j])
+		}
+		i++
+		j++
+	}
+	return (len(a) - i) - (len(b) - j)
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
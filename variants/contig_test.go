@@ -0,0 +1,77 @@
+package variants
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCompareChr(t *testing.T) {
+	sorted := []string{"chr1", "2", "chr10", "chr22", "X", "chrY", "MT", "GL000192.1", "GL000193.1", "chrUn_gl000220"}
+	for i := range sorted {
+		for j := range sorted {
+			cmp := CompareChr(sorted[i], sorted[j])
+			if (i < j && cmp >= 0) || (i > j && cmp <= 0) || (i == j && cmp != 0) {
+				t.Errorf("unexpected comparison %d between %s and %s", cmp, sorted[i], sorted[j])
+			}
+		}
+	}
+	if CompareChr("chr1", "1") != 0 || CompareChr("chrM", "MT") != 0 {
+		t.Errorf("expected aliases to compare equal")
+	}
+}
+
+func TestContigs(t *testing.T) {
+	header := []string{
+		"##fileformat=VCFv4.2",
+		"##contig=<ID=2,length=243199373>",
+		"##contig=<ID=1,length=249250621>",
+		"##contig=<ID=MT,length=16569>",
+		"#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO",
+	}
+	c := ContigsFromHeader(header)
+	if len(c.Names) != 3 || c.Lengths[1] != 249250621 {
+		t.Fatalf("unexpected contigs %v %v", c.Names, c.Lengths)
+	}
+	if c.Name("chr1") != "1" || c.Name("chrM") != "MT" || c.Name("chr5") != "chr5" {
+		t.Errorf("unexpected alias mapping")
+	}
+	v := []Variant{{Chr: "chr5", Pos: 1}, {Chr: "chr1", Pos: 10}, {Chr: "1", Pos: 5}, {Chr: "chr2", Pos: 50}, {Chr: "chrM", Pos: 0}}
+	c.SortByCoord(v)
+	expected := []string{"chr2", "1", "chr1", "chrM", "chr5"}
+	for i := range v {
+		if v[i].Chr != expected[i] {
+			t.Errorf("expected contig order %v, found %v", expected, v)
+			break
+		}
+	}
+
+	ids := []int{0, 1, 2}
+	SortIdsByCoord(ids, []Variant{{Chr: "chr10"}, {Chr: "chr2"}, {Chr: "chr1"}})
+	if ids[0] != 2 || ids[1] != 1 || ids[2] != 0 {
+		t.Errorf("expected natural order, found %v", ids)
+	}
+	if ContigsFromHeader(header[:1]) != nil {
+		t.Errorf("expected nil contigs for header without contig lines")
+	}
+}
+
+func TestReadFaiAndDict(t *testing.T) {
+	dir := t.TempDir()
+	fai := filepath.Join(dir, "weaver.ref.fa.fai")
+	dict := filepath.Join(dir, "weaver.ref.dict")
+	if err := os.WriteFile(fai, []byte("chr1\t1000\t6\t60\t61\nchr2\t500\t1030\t60\t61\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dict, []byte("@HD\tVN:1.5\n@SQ\tSN:chr1\tLN:1000\tM5:abc\n@SQ\tSN:chr2\tLN:500\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*Contigs{ReadFai(fai), ReadDict(dict)} {
+		if len(c.Names) != 2 || c.Names[1] != "chr2" || c.Lengths[0] != 1000 {
+			t.Errorf("unexpected contigs %v %v", c.Names, c.Lengths)
+		}
+		if idx, found := c.Index("2"); !found || idx != 1 {
+			t.Errorf("expected alias 2 at index 1")
+		}
+	}
+}
@@ -2,7 +2,6 @@ package variants
 
 import (
 	"github.com/vertgenlab/gonomics/dna"
-	"sort"
 )
 
 // FindHeterozygous finds all variants in the input that are likely to be
@@ -24,32 +23,27 @@ func FindVariantsInAfRange(v []Variant, minAf float64, maxAf float64) []int {
 	return answer
 }
 
-// SortByCoord sorts a slice of variants by genomic coordinate
-// Ties by position are broken by alt allele length, then
-// lexicographically by alt sequence.
+// SortByCoord sorts a slice of variants by genomic coordinate with contigs in
+// natural order (see CompareChr). Ties by position are broken by alt allele length,
+// then lexicographically by alt sequence.
 func SortByCoord(v []Variant) {
-	sort.Slice(v, func(i, j int) bool {
-		return lessVariants(v[i], v[j])
-	})
+	var c *Contigs
+	c.SortByCoord(v)
 }
 
-// SortIdsByCoord sorts an input []VariantIds (ints) by genomic coordinate.
-// Does not alter the input []Variant ordering.
+// SortIdsByCoord sorts an input []VariantIds (ints) by genomic coordinate with contigs
+// in natural order (see CompareChr). Does not alter the input []Variant ordering.
 func SortIdsByCoord(ids []int, v []Variant) {
-	vCopy := make([]Variant, len(v))
-	copy(vCopy, v)
-	sort.Slice(ids, func(i, j int) bool {
-		return lessVariants(v[ids[i]], v[ids[j]])
-	})
+	var c *Contigs
+	c.SortIdsByCoord(ids, v)
 }
 
 // lessVariants returns whether a should be before b in a sorted slice.
-func lessVariants(a, b Variant) bool {
+func (c *Contigs) lessVariants(a, b Variant) bool {
+	if cmp := c.Compare(a.Chr, b.Chr); cmp != 0 {
+		return cmp < 0
+	}
 	switch {
-	case a.Chr < b.Chr:
-		return true
-	case a.Chr > b.Chr:
-		return false
 	case a.Pos < b.Pos:
 		return true
 	case a.Pos > b.Pos:
@@ -62,3 +56,40 @@ func lessVariants(a, b Variant) bool {
 		return dna.CompareSeqsIgnoreCase(a.Alt, b.Alt) < 0
 	}
 }
+
+// PhaseBlocks groups phased variants by phased block (see Variant.PhaseSet). Returns the
+// indexes in v of each block with at least 2 variants, ordered by the index of the first
+// variant in the block. Unphased variants are not returned. Runs of homozygosity treat each
+// block as a unit (see loh.FindRunsOfHomozygosity), while clone features use phased variants
+// as independent columns.
+func PhaseBlocks(v []Variant) [][]int {
+	type block struct {
+		chr      string
+		phaseSet int
+	}
+	blockIdx := make(map[block]int)
+	var answer [][]int
+	var b block
+	var idx int
+	var found bool
+	for i := range v {
+		if v[i].PhaseSet == 0 {
+			continue
+		}
+		b = block{chr: CanonicalChr(v[i].Chr), phaseSet: v[i].PhaseSet}
+		if idx, found = blockIdx[b]; !found {
+			idx = len(answer)
+			blockIdx[b] = idx
+			answer = append(answer, nil)
+		}
+		answer[idx] = append(answer[idx], i)
+	}
+	var j int
+	for i := range answer {
+		if len(answer[i]) > 1 {
+			answer[j] = answer[i]
+			j++
+		}
+	}
+	return answer[:j]
+}
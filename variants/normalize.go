@@ -0,0 +1,86 @@
+package variants
+
+import (
+	"github.com/vertgenlab/gonomics/dna"
+	"log"
+)
+
+// Reference provides random access to reference sequences.
+type Reference interface {
+	// Seq returns the bases from start (base 0) to end (base 1) on chr. The returned
+	// slice may be shorter than requested at the end of a contig.
+	Seq(chr string, start, end int) []dna.Base
+}
+
+// normWindow is the number of reference bases fetched at a time while left-aligning.
+const normWindow = 64
+
+// Normalize left-aligns an indel in repeated sequence against ref, as in bcftools norm
+// (Tan et al. 2015). v must have matching bases trimmed from Ref and Alt as done when reading
+// a vcf, so that either Ref or Alt is empty for an indel. Complex variants and substitutions are
+// returned unchanged. If the variant is moved, Original is set to the String of the input variant.
+// Panics if the Ref bases of an indel do not match ref. Use MatchesReference to skip such variants.
+func Normalize(v Variant, ref Reference) Variant {
+	if (len(v.Ref) == 0) == (len(v.Alt) == 0) { // not a simple indel
+		return v
+	}
+	if !MatchesReference(v, ref) {
+		seq := ref.Seq(v.Chr, v.Pos, v.Pos+len(v.Ref))
+		if v.Record.Pos > 0 {
+			log.Panicf("reference bases %s do not match variant %s from vcf record %s:%d %s>%s. was the vcf called against a different reference?",
+				dna.BasesToString(seq), v, v.Chr, v.Record.Pos, v.Record.Ref, v.Record.Alt)
+		}
+		log.Panicf("reference bases %s do not match variant %s. was the variant called against a different reference?", dna.BasesToString(seq), v)
+	}
+	orig := v.String()
+	var allele []dna.Base
+	if len(v.Ref) > 0 {
+		allele = append(allele, v.Ref...)
+	} else {
+		allele = append(allele, v.Alt...)
+	}
+
+	var window []dna.Base
+	var windowStart int
+	for v.Pos > 0 {
+		if len(window) == 0 || v.Pos-1 < windowStart {
+			windowStart = maxInt(0, v.Pos-normWindow)
+			window = ref.Seq(v.Chr, windowStart, v.Pos)
+			if len(window) != v.Pos-windowStart {
+				log.Panicf("could not retrieve reference sequence before variant %s", v)
+			}
+		}
+		prev := window[v.Pos-1-windowStart]
+		if dna.ToUpper(prev) != dna.ToUpper(allele[len(allele)-1]) {
+			break
+		}
+		copy(allele[1:], allele[:len(allele)-1]) // rotate the allele one base to the left
+		allele[0] = prev
+		v.Pos--
+	}
+
+	if len(v.Ref) > 0 {
+		v.Ref = allele
+	} else {
+		v.Alt = allele
+	}
+	if v.String() != orig {
+		v.Original = orig
+	}
+	return v
+}
+
+// MatchesReference returns true if the Ref bases of v match ref, ignoring case.
+func MatchesReference(v Variant, ref Reference) bool {
+	if len(v.Ref) == 0 {
+		return true
+	}
+	return dna.CompareSeqsIgnoreCase(ref.Seq(v.Chr, v.Pos, v.Pos+len(v.Ref)), v.Ref) == 0
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,61 @@
+package variants
+
+import (
+	"github.com/vertgenlab/gonomics/dna"
+	"testing"
+)
+
+// testRef is a Reference with a single sequence for each contig.
+type testRef map[string]string
+
+func (r testRef) Seq(chr string, start, end int) []dna.Base {
+	seq := r[chr]
+	if end > len(seq) {
+		end = len(seq)
+	}
+	return dna.StringToBases(seq[start:end])
+}
+
+func TestNormalize(t *testing.T) {
+	ref := testRef{"chr1": "GCAAAATCACACAGT"}
+	tests := []struct {
+		in       Variant
+		expected string
+		moved    bool
+	}{
+		{Variant{Chr: "chr1", Pos: 5, Ref: dna.StringToBases("A")}, "chr1:2:A:", true},
+		{Variant{Chr: "chr1", Pos: 6, Alt: dna.StringToBases("A")}, "chr1:2::A", true},
+		{Variant{Chr: "chr1", Pos: 11, Ref: dna.StringToBases("CA")}, "chr1:7:CA:", true},
+		{Variant{Chr: "chr1", Pos: 13, Alt: dna.StringToBases("CA")}, "chr1:7::CA", true},
+		{Variant{Chr: "chr1", Pos: 7, Ref: dna.StringToBases("CA")}, "chr1:7:CA:", false},
+		{Variant{Chr: "chr1", Pos: 0, Ref: dna.StringToBases("G")}, "chr1:0:G:", false},
+		{Variant{Chr: "chr1", Pos: 3, Ref: dna.StringToBases("A"), Alt: dna.StringToBases("T")}, "chr1:3:A:T", false},
+	}
+	var found Variant
+	for _, test := range tests {
+		found = Normalize(test.in, ref)
+		if found.String() != test.expected {
+			t.Errorf("expected %s for %s, found %s", test.expected, test.in, found)
+		}
+		if test.moved && found.Original != test.in.String() {
+			t.Errorf("expected original %s, found %s", test.in, found.Original)
+		}
+		if !test.moved && found.Original != "" {
+			t.Errorf("expected no original for %s, found %s", test.in, found.Original)
+		}
+	}
+	if test := tests[0].in; dna.BasesToString(test.Ref) != "A" || test.Pos != 5 {
+		t.Errorf("Normalize modified the input variant")
+	}
+
+	if !MatchesReference(tests[0].in, ref) || MatchesReference(Variant{Chr: "chr1", Pos: 0, Ref: dna.StringToBases("A")}, ref) {
+		t.Errorf("unexpected result of MatchesReference")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic for reference mismatch")
+		}
+	}()
+	Normalize(Variant{Chr: "chr1", Pos: 0, Ref: dna.StringToBases("A")}, ref)
+}
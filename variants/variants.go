@@ -18,20 +18,58 @@ type Variant struct {
 	GenotypedFrac    float64 // % of post-filter cells with passing genotype
 	CellsMutatedFrac float64 // fraction of genotyped cells mutated
 	CellAf           float64 // allele frequency in cells. genotype aware
+	ErrorRate        float64 // background rate of alt reads in wild-type cells. only set by error model genotyping
+	Original         string  // String of the variant as read from the vcf. only set if the variant was moved by Normalize
+	PhaseSet         int     // 1-based position of the first variant in the phased block as in the vcf PS field. 0 if unphased
+	PhaseHap         int     // haplotype (0 or 1) of the alt allele in the phased block. only set if PhaseSet is set
+	Record           Record  // vcf record the variant was read from. zero if the variant was not read from a vcf
+}
+
+// Record is the position and alleles of the vcf record a Variant was read from, before matching
+// bases are trimmed and before normalization.
+type Record struct {
+	Pos int    // 1-based POS
+	Ref string // REF
+	Alt string // the ALT allele of the variant
 }
 
 func (v Variant) String() string {
 	return fmt.Sprintf("%s:%d:%s:%s", v.Chr, v.Pos, dna.BasesToString(v.Ref), dna.BasesToString(v.Alt))
 }
 
+// Key returns a normalized identifier for the variant in the same format as String, but with
+// upper case Ref and Alt bases and the contig name normalized with CanonicalChr. Unlike Id, the
+// Key does not change when cells or variants are filtered, so it can be used to join results
+// across runs and filter settings.
+func (v Variant) Key() string {
+	k := Variant{Chr: CanonicalChr(v.Chr), Pos: v.Pos, Ref: make([]dna.Base, len(v.Ref)), Alt: make([]dna.Base, len(v.Alt))}
+	copy(k.Ref, v.Ref)
+	copy(k.Alt, v.Alt)
+	dna.AllToUpper(k.Ref)
+	dna.AllToUpper(k.Alt)
+	return k.String()
+}
+
+// Region returns the reference bases covered by the variant. Insertions cover the base at Pos.
+func (v Variant) Region() Region {
+	if len(v.Ref) == 0 {
+		return Region{Chr: v.Chr, Start: v.Pos, End: v.Pos + 1}
+	}
+	return Region{Chr: v.Chr, Start: v.Pos, End: v.Pos + len(v.Ref)}
+}
+
 // CellVar stores information about a paritcular variant inside a cell
 type CellVar struct {
 	Vid             int // variant ID, equivalent to Variant.Id
 	Genotype        Zygosity
-	GenotypeQuality int     // GQ
-	ReadDepth       int     // DP
-	AltReads        int     // AD[alleleIdx]
-	Af              float64 // allele frequency by read count
+	GenotypeQuality int        // GQ
+	ReadDepth       int        // DP
+	AltReads        int        // AD[alleleIdx]
+	Af              float64    // allele frequency by read count
+	Posterior       [3]float64 // posterior probability of WildType, Heterozygous, Homozygous. only set when genotyped from likelihoods
+	PValue          float64    // probability of AltReads under the site error rate. only set by error model genotyping
+	Imputed         bool       // Genotype was missing and has been imputed from similar cells
+	Confidence      float64    // confidence in an imputed Genotype (0-1). only set when Imputed
 }
 
 // Zygosity of a given variant
@@ -57,9 +95,9 @@ func (z Zygosity) String() string {
 
 // Region defines a genomic span. left-closed, right-open.
 type Region struct {
-	Chr 	string
-	Start 	int // base 0
-	End 	int // base 1
+	Chr   string
+	Start int // base 0
+	End   int // base 1
 }
 
 const (
@@ -69,3 +107,26 @@ const (
 	Homozygous
 	Hemizygous
 )
+
+// HasPosterior returns true if the CellVar was genotyped from likelihoods
+// and stores a posterior probability for each genotype.
+func (cv CellVar) HasPosterior() bool {
+	return cv.Posterior[0]+cv.Posterior[1]+cv.Posterior[2] > 0
+}
+
+// Dosage returns the expected number of mutant alleles in the cell. If the CellVar
+// has posterior probabilities the dosage is soft (P(Het) + 2*P(Hom)), otherwise it is
+// determined from the Genotype. Returns 0 for NoGenotype.
+func (cv CellVar) Dosage() float64 {
+	if cv.HasPosterior() {
+		return cv.Posterior[Heterozygous-1] + 2*cv.Posterior[Homozygous-1]
+	}
+	switch cv.Genotype {
+	case Heterozygous, Hemizygous:
+		return 1
+	case Homozygous:
+		return 2
+	default:
+		return 0
+	}
+}